@@ -0,0 +1,3 @@
+module nvshare-admission-webhook
+
+go 1.15
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2023, Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/*
+ * nvshare-admission-webhook is an optional mutating admission webhook for
+ * Pods that request nvshare.com/gpu devices.
+ *
+ * Such Pods typically also need a specific runtime class (and sometimes some
+ * annotations) for the NVIDIA container runtime to expose the GPU to them.
+ * Without them, the Pods start but don't see a GPU. The webhook adds whatever
+ * is missing, and rejects Pods that explicitly ask for something else with a
+ * clear message.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	ListenAddrEnvVar   = "NVSHARE_WEBHOOK_ADDR"
+	CertFileEnvVar     = "NVSHARE_WEBHOOK_CERT_FILE"
+	KeyFileEnvVar      = "NVSHARE_WEBHOOK_KEY_FILE"
+	RuntimeClassEnvVar = "NVSHARE_WEBHOOK_RUNTIME_CLASS"
+	AnnotationsEnvVar  = "NVSHARE_WEBHOOK_ANNOTATIONS"
+	DefaultListenAddr  = ":8443"
+	DefaultCertFile    = "/etc/nvshare-webhook/tls.crt"
+	DefaultKeyFile     = "/etc/nvshare-webhook/tls.key"
+	/* Matches nvshare.com/gpu and nvshare.com/gpu-<id> */
+	ResourcePrefix = "nvshare.com/gpu"
+)
+
+/* Workload type that Pods may declare, see workloadTypePatch() */
+const (
+	WorkloadTypeAnnotation = "nvshare.com/workload-type"
+	WorkloadTypeEnvVar     = "NVSHARE_WORKLOAD_TYPE"
+	WorkloadTypeMaxLen     = 16 /* NVSHARE_WORKLOAD_TYPE_MAX in comm.h */
+)
+
+/* Where libnvshare goes in LD_PRELOAD, see preloadPatch() */
+const (
+	PreloadOrderAnnotation = "nvshare.com/preload-order"
+	PreloadOrderPrepend    = "prepend"
+	PreloadOrderAppend     = "append"
+	/* Must match LibNvshareContainerPath of the device plugin */
+	LibNvshareContainerPath = "/usr/lib/nvshare/libnvshare.so"
+)
+
+/* Runtime class that Pods requesting nvshare GPUs must use, if not empty */
+var RuntimeClass string
+
+/* Annotations that Pods requesting nvshare GPUs must have */
+var Annotations map[string]string
+
+func lookupEnvDefault(key string, def string) string {
+	value, exists := os.LookupEnv(key)
+	if exists == false || value == "" {
+		return def
+	}
+	return value
+}
+
+/* Parse "key1=value1,key2=value2" */
+func parseAnnotations(s string) (map[string]string, error) {
+	annotations := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid annotation %q, expected <key>=<value>", kv)
+		}
+		annotations[parts[0]] = parts[1]
+	}
+	return annotations, nil
+}
+
+func main() {
+	var err error
+
+	log.SetOutput(os.Stderr)
+
+	addr := lookupEnvDefault(ListenAddrEnvVar, DefaultListenAddr)
+	certFile := lookupEnvDefault(CertFileEnvVar, DefaultCertFile)
+	keyFile := lookupEnvDefault(KeyFileEnvVar, DefaultKeyFile)
+	RuntimeClass = lookupEnvDefault(RuntimeClassEnvVar, "")
+	Annotations, err = parseAnnotations(lookupEnvDefault(AnnotationsEnvVar, ""))
+	if err != nil {
+		log.Printf("Invalid %s", AnnotationsEnvVar)
+		log.Fatal(err)
+	}
+
+	if RuntimeClass != "" {
+		log.Printf("Required runtime class = %s", RuntimeClass)
+	} else {
+		log.Printf("No runtime class required")
+	}
+	for k, v := range Annotations {
+		log.Printf("Required annotation %s = %s", k, v)
+	}
+
+	http.HandleFunc("/mutate", serveMutate)
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	log.Printf("Listening on %s", addr)
+	log.Fatal(http.ListenAndServeTLS(addr, certFile, keyFile, nil))
+}
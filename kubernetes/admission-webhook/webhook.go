@@ -0,0 +1,371 @@
+/*
+ * Copyright (c) 2023, Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+ * Minimal subset of the admission.k8s.io/v1 and core/v1 types that we need.
+ * We define them here to keep the webhook free of Kubernetes dependencies.
+ */
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string          `json:"uid"`
+	Operation string          `json:"operation"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Object    json.RawMessage `json:"object"`
+}
+
+type admissionStatus struct {
+	Code    int32  `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type admissionResponse struct {
+	UID       string           `json:"uid"`
+	Allowed   bool             `json:"allowed"`
+	Result    *admissionStatus `json:"status,omitempty"`
+	Patch     []byte           `json:"patch,omitempty"`
+	PatchType string           `json:"patchType,omitempty"`
+}
+
+type resourceRequirements struct {
+	Limits   map[string]interface{} `json:"limits"`
+	Requests map[string]interface{} `json:"requests"`
+}
+
+type envVar struct {
+	Name      string          `json:"name"`
+	Value     string          `json:"value,omitempty"`
+	ValueFrom json.RawMessage `json:"valueFrom,omitempty"`
+}
+
+type container struct {
+	Name      string               `json:"name"`
+	Env       []envVar             `json:"env"`
+	Resources resourceRequirements `json:"resources"`
+}
+
+type pod struct {
+	Metadata struct {
+		Name         string            `json:"name"`
+		GenerateName string            `json:"generateName"`
+		Annotations  map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		RuntimeClassName *string     `json:"runtimeClassName"`
+		InitContainers   []container `json:"initContainers"`
+		Containers       []container `json:"containers"`
+	} `json:"spec"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func isNvshareResource(name string) bool {
+	return name == ResourcePrefix || strings.HasPrefix(name, ResourcePrefix+"-")
+}
+
+func containerRequestsNvshareGPU(c *container) bool {
+	for name := range c.Resources.Limits {
+		if isNvshareResource(name) {
+			return true
+		}
+	}
+	for name := range c.Resources.Requests {
+		if isNvshareResource(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestsNvshareGPU(p *pod) bool {
+	var containers []container
+	containers = append(containers, p.Spec.InitContainers...)
+	containers = append(containers, p.Spec.Containers...)
+	for i := range containers {
+		if containerRequestsNvshareGPU(&containers[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+/* See RFC 6901 */
+func escapeJSONPointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+/*
+ * Compute the JSON patch that adds the required runtime class and
+ * annotations to a Pod, or return an error explaining why the Pod cannot use
+ * nvshare GPUs as it is.
+ */
+func mutatePod(p *pod) ([]patchOperation, error) {
+	var patch []patchOperation
+
+	if RuntimeClass != "" {
+		if p.Spec.RuntimeClassName == nil || *p.Spec.RuntimeClassName == "" {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/spec/runtimeClassName",
+				Value: RuntimeClass,
+			})
+		} else if *p.Spec.RuntimeClassName != RuntimeClass {
+			return nil, fmt.Errorf("Pods that request %s devices must use runtime class %q, not %q. Otherwise, the GPU is not exposed to the Pod", ResourcePrefix, RuntimeClass, *p.Spec.RuntimeClassName)
+		}
+	}
+
+	/* Iterate in a stable order, to produce deterministic patches */
+	keys := make([]string, 0, len(Annotations))
+	for k := range Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) > 0 && p.Metadata.Annotations == nil {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{},
+		})
+	}
+	for _, k := range keys {
+		v, exists := p.Metadata.Annotations[k]
+		if exists == false {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/metadata/annotations/" + escapeJSONPointer(k),
+				Value: Annotations[k],
+			})
+		} else if v != Annotations[k] {
+			return nil, fmt.Errorf("Pods that request %s devices must have annotation %s=%q, not %q", ResourcePrefix, k, Annotations[k], v)
+		}
+	}
+
+	workloadPatch, err := workloadTypePatch(p)
+	if err != nil {
+		return nil, err
+	}
+	patch = append(patch, workloadPatch...)
+
+	preloadPatch, err := preloadPatch(p)
+	if err != nil {
+		return nil, err
+	}
+	patch = append(patch, preloadPatch...)
+
+	return patch, nil
+}
+
+/*
+ * The LD_PRELOAD that a container sets in its spec overrides the one that
+ * the device plugin returns from Allocate(), which only has libnvshare.
+ * Combine the two instead, putting libnvshare before (prepend) or after
+ * (append) the libraries of the container, as the Pod asks for through its
+ * annotation. We leave containers that already list libnvshare alone, as
+ * they've picked its position themselves.
+ */
+func preloadPatch(p *pod) ([]patchOperation, error) {
+	var patch []patchOperation
+	var err error
+
+	order, exists := p.Metadata.Annotations[PreloadOrderAnnotation]
+	if exists == false || order == "" {
+		order = PreloadOrderPrepend
+	}
+	if order != PreloadOrderPrepend && order != PreloadOrderAppend {
+		return nil, fmt.Errorf("invalid %s annotation %q, must be %q or %q", PreloadOrderAnnotation, order, PreloadOrderPrepend, PreloadOrderAppend)
+	}
+
+	combine := func(path string, c *container) {
+		if err != nil || containerRequestsNvshareGPU(c) == false {
+			return
+		}
+		for i, e := range c.Env {
+			if e.Name != "LD_PRELOAD" {
+				continue
+			}
+			if len(e.ValueFrom) > 0 {
+				err = fmt.Errorf("container %q sets LD_PRELOAD from a source, so %s cannot be added to it. Set it to a value instead", c.Name, LibNvshareContainerPath)
+				return
+			}
+			libs := strings.FieldsFunc(e.Value, func(r rune) bool {
+				return r == ':' || r == ' '
+			})
+			for _, lib := range libs {
+				if lib == LibNvshareContainerPath {
+					return
+				}
+			}
+			if order == PreloadOrderPrepend {
+				libs = append([]string{LibNvshareContainerPath}, libs...)
+			} else {
+				libs = append(libs, LibNvshareContainerPath)
+			}
+			/* Unlike "replace", "add" also works if the value is unset */
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("%s/env/%d/value", path, i),
+				Value: strings.Join(libs, ":"),
+			})
+		}
+	}
+	for i := range p.Spec.InitContainers {
+		combine(fmt.Sprintf("/spec/initContainers/%d", i), &p.Spec.InitContainers[i])
+	}
+	for i := range p.Spec.Containers {
+		combine(fmt.Sprintf("/spec/containers/%d", i), &p.Spec.Containers[i])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+/*
+ * Pass the workload type that the Pod declares through its annotation on to
+ * libnvshare in the containers that use nvshare GPUs, unless they set it
+ * themselves. The scheduler applies the defaults of the type to them.
+ */
+func workloadTypePatch(p *pod) ([]patchOperation, error) {
+	var patch []patchOperation
+
+	workloadType := p.Metadata.Annotations[WorkloadTypeAnnotation]
+	if workloadType == "" {
+		return nil, nil
+	}
+	if len(workloadType) > WorkloadTypeMaxLen || strings.ContainsAny(workloadType, " \t=") {
+		return nil, fmt.Errorf("invalid %s annotation %q, must be at most %d characters without spaces or '='", WorkloadTypeAnnotation, workloadType, WorkloadTypeMaxLen)
+	}
+
+	addEnv := func(path string, c *container) {
+		if containerRequestsNvshareGPU(c) == false {
+			return
+		}
+		for _, e := range c.Env {
+			if e.Name == WorkloadTypeEnvVar {
+				return
+			}
+		}
+		env := envVar{Name: WorkloadTypeEnvVar, Value: workloadType}
+		if c.Env == nil {
+			patch = append(patch, patchOperation{Op: "add", Path: path + "/env", Value: []envVar{env}})
+		} else {
+			patch = append(patch, patchOperation{Op: "add", Path: path + "/env/-", Value: env})
+		}
+	}
+	for i := range p.Spec.InitContainers {
+		addEnv(fmt.Sprintf("/spec/initContainers/%d", i), &p.Spec.InitContainers[i])
+	}
+	for i := range p.Spec.Containers {
+		addEnv(fmt.Sprintf("/spec/containers/%d", i), &p.Spec.Containers[i])
+	}
+	return patch, nil
+}
+
+func review(req *admissionRequest) *admissionResponse {
+	var p pod
+
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	if req.Operation != "CREATE" {
+		return resp
+	}
+
+	err := json.Unmarshal(req.Object, &p)
+	if err != nil {
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Code: http.StatusBadRequest, Message: fmt.Sprintf("nvshare: failed to decode Pod: %v", err)}
+		return resp
+	}
+	name := p.Metadata.Name
+	if name == "" {
+		name = p.Metadata.GenerateName
+	}
+	if !requestsNvshareGPU(&p) {
+		return resp
+	}
+
+	patch, err := mutatePod(&p)
+	if err != nil {
+		log.Printf("Rejecting Pod %s/%s: %v", req.Namespace, name, err)
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Code: http.StatusForbidden, Message: "nvshare: " + err.Error()}
+		return resp
+	}
+	if len(patch) == 0 {
+		return resp
+	}
+
+	resp.Patch, err = json.Marshal(patch)
+	if err != nil {
+		resp.Allowed = false
+		resp.Result = &admissionStatus{Code: http.StatusInternalServerError, Message: fmt.Sprintf("nvshare: failed to encode patch: %v", err)}
+		return resp
+	}
+	resp.PatchType = "JSONPatch"
+	log.Printf("Patching Pod %s/%s: %s", req.Namespace, name, resp.Patch)
+	return resp
+}
+
+func serveMutate(w http.ResponseWriter, r *http.Request) {
+	var ar admissionReview
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(body, &ar)
+	if err != nil || ar.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	ar.Response = review(ar.Request)
+	ar.Request = nil
+	out, err := json.Marshal(ar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Annotate the Pods we allocate devices to with what they actually got, so
+ * that users can see how nvshare placed them with kubectl get pod -o yaml.
+ * Allocate() doesn't tell us the Pod, so we learn it from the kubelet
+ * PodResources API, like /pods does, and patch the Pod through the API
+ * server, which takes RBAC permission to patch Pods.
+ */
+const (
+	GPUUUIDAnnotation     = "nvshare.com/gpu-uuid"
+	DeviceSlotsAnnotation = "nvshare.com/device-slots"
+	MillisharesAnnotation = "nvshare.com/millishares"
+)
+
+/* How often to look for Pods to annotate, besides after every Allocate() */
+const podAnnotationInterval = 30 * time.Second
+
+const apiServerTimeout = 10 * time.Second
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+/* Kicks the annotator after an allocation, never blocks */
+var annotateKick = make(chan struct{}, 1)
+
+/* The annotations we last set on each Pod ("namespace/name") */
+var podAnnotations = map[string]map[string]string{}
+
+type apiServerClient struct {
+	host   string
+	client *http.Client
+}
+
+/* Talk to the API server with the credentials of our service account */
+func newAPIServerClient() (*apiServerClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read the service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM(ca) == false {
+		return nil, fmt.Errorf("no certificates in the service account CA")
+	}
+	return &apiServerClient{
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout: apiServerTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+/* Merge the annotations into those of the Pod */
+func (c *apiServerClient) annotatePod(namespace, pod string, annotations map[string]string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	/* Bound service account tokens get rotated, so read it every time */
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return fmt.Errorf("could not read the service account token: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPatch,
+		c.host+"/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(pod),
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &apiServerError{code: resp.StatusCode, msg: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+type apiServerError struct {
+	code int
+	msg  string
+}
+
+func (e *apiServerError) Error() string {
+	return fmt.Sprintf("API server returned %d: %s", e.code, e.msg)
+}
+
+/* Format per-container values as "<container>=<value>,..." */
+func containerValues(values map[string]string) string {
+	containers := make([]string, 0, len(values))
+	for container := range values {
+		containers = append(containers, container)
+	}
+	sort.Strings(containers)
+	pairs := make([]string, 0, len(containers))
+	for _, container := range containers {
+		pairs = append(pairs, container+"="+values[container])
+	}
+	return strings.Join(pairs, ",")
+}
+
+/*
+ * The annotations for each Pod that holds our devices. A container's slot is
+ * the ordinal of its first device, like libnvshare gets it. Outside of
+ * millishares mode, every container gets the whole GPU in its turns.
+ */
+func desiredPodAnnotations(allocs *PodAllocations) map[string]map[string]string {
+	slots := map[string]map[string]string{}
+	shares := map[string]map[string]string{}
+	for _, alloc := range allocs.Allocations {
+		key := alloc.Namespace + "/" + alloc.Pod
+		if slots[key] == nil {
+			slots[key] = map[string]string{}
+			shares[key] = map[string]string{}
+		}
+		_, ordinal, err := parseDeviceID(alloc.DeviceIDs[0])
+		if err != nil {
+			continue
+		}
+		slots[key][alloc.Container] = strconv.Itoa(ordinal)
+		share := MillisharesPerGPU
+		if Millishares == true {
+			share = alloc.Millishares
+		}
+		shares[key][alloc.Container] = strconv.Itoa(share)
+	}
+	desired := map[string]map[string]string{}
+	for key := range slots {
+		desired[key] = map[string]string{
+			GPUUUIDAnnotation:     gpuUUID(),
+			DeviceSlotsAnnotation: containerValues(slots[key]),
+			MillisharesAnnotation: containerValues(shares[key]),
+		}
+	}
+	return desired
+}
+
+func sameAnnotations(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func annotatePods(c *apiServerClient) {
+	allocs, err := listPodAllocations()
+	if err != nil {
+		log.Printf("Could not annotate Pods: %v", err)
+		return
+	}
+	desired := desiredPodAnnotations(allocs)
+	for key, annotations := range desired {
+		if sameAnnotations(podAnnotations[key], annotations) == true {
+			continue
+		}
+		parts := strings.SplitN(key, "/", 2)
+		err = c.annotatePod(parts[0], parts[1], annotations)
+		if apiErr, ok := err.(*apiServerError); ok && apiErr.code == http.StatusNotFound {
+			/* The Pod is gone, the kubelet will soon forget it too */
+			podAnnotations[key] = annotations
+			continue
+		}
+		if err != nil {
+			log.Printf("Could not annotate Pod %s: %v", key, err)
+			continue
+		}
+		log.Printf("Annotated Pod %s with its allocation", key)
+		podAnnotations[key] = annotations
+	}
+	/* Forget the Pods that no longer hold our devices */
+	for key := range podAnnotations {
+		if _, exists := desired[key]; exists == false {
+			delete(podAnnotations, key)
+		}
+	}
+}
+
+/* Kick the annotator, e.g., after an allocation */
+func kickPodAnnotator() {
+	select {
+	case annotateKick <- struct{}{}:
+	default:
+	}
+}
+
+func startPodAnnotator() error {
+	c, err := newAPIServerClient()
+	if err != nil {
+		return err
+	}
+	log.Printf("Annotating the Pods that hold devices of %s with their allocation", resourceName)
+	go func() {
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-timer.C:
+			case <-annotateKick:
+				if timer.Stop() == false {
+					<-timer.C
+				}
+				/*
+				 * The kubelet only reports the allocation once it
+				 * has created the container, so give it a moment.
+				 */
+				time.Sleep(time.Second)
+			}
+			annotatePods(c)
+			timer.Reset(podAnnotationInterval)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * Attributes of the GPU we manage, for scheduler extenders and other
+ * node-local tooling that wants to make GPU-aware placement decisions.
+ */
+type GPUAttributes struct {
+	ResourceName   string `json:"resourceName"`
+	UUID           string `json:"uuid"`
+	ProductName    string `json:"productName,omitempty"`
+	MemoryTotalMiB int64  `json:"memoryTotalMiB,omitempty"`
+	/* How many devices of ResourceName we advertise for the GPU */
+	Devices int `json:"devices"`
+	/*
+	 * How many of them are allocated and to how many containers. Omitted
+	 * if the kubelet PodResources API is unavailable.
+	 */
+	AllocatedDevices *int      `json:"allocatedDevices,omitempty"`
+	Containers       *int      `json:"containers,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+func collectGPUAttributes() GPUAttributes {
+	attrs := GPUAttributes{
+		ResourceName: resourceName,
+		UUID:         gpuUUID(),
+		Devices:      NvshareVirtualDevices,
+		UpdatedAt:    time.Now(),
+	}
+
+	gpuInfoMutex.Lock()
+	for _, gpu := range gpuInfo.GPUs {
+		if gpu.UUID == attrs.UUID || len(gpuInfo.GPUs) == 1 {
+			attrs.ProductName = gpu.ProductName
+			attrs.MemoryTotalMiB = gpu.MemoryTotalMiB
+			break
+		}
+	}
+	gpuInfoMutex.Unlock()
+
+	allocs, err := listPodAllocations()
+	if err != nil {
+		attrs.Error = err.Error()
+		return attrs
+	}
+	allocated := 0
+	for _, alloc := range allocs.Allocations {
+		allocated += len(alloc.DeviceIDs)
+	}
+	containers := len(allocs.Allocations)
+	attrs.AllocatedDevices = &allocated
+	attrs.Containers = &containers
+	return attrs
+}
+
+func writeGPUAttributes(path string) error {
+	out, err := json.MarshalIndent(collectGPUAttributes(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(out, '\n'))
+}
+
+/*
+ * Replace the file atomically, so that readers never see a partial write.
+ */
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+/* Keep the attributes file fresh. Call after startGPUInfoRefresher(). */
+func startAttributesPublisher(path string, interval time.Duration) {
+	log.Printf("Publishing GPU attributes to %s every %s", path, interval)
+	go func() {
+		for {
+			err := writeGPUAttributes(path)
+			if err != nil {
+				log.Printf("Failed to publish GPU attributes to %s: %v", path, err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
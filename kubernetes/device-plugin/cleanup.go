@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * What to do about compute processes that are left on the managed GPU when
+ * the device plugin starts, e.g., from clients that crashed before a reboot
+ * or a restart of the plugin.
+ */
+const (
+	GPUCleanupOff    = ""
+	GPUCleanupReport = "report" /* Only log them */
+	GPUCleanupKill   = "kill"   /* Kill them */
+	GPUCleanupReset  = "reset"  /* Kill them and reset the GPU */
+)
+
+/* How long processes have to exit on SIGTERM before we SIGKILL them */
+const GPUCleanupKillTimeout = 10 * time.Second
+
+type computeProcess struct {
+	PID           int
+	Name          string
+	UsedMemoryMiB int64
+}
+
+func validateGPUCleanupMode(mode string) error {
+	switch mode {
+	case GPUCleanupOff, GPUCleanupReport, GPUCleanupKill, GPUCleanupReset:
+		return nil
+	}
+	return fmt.Errorf("unknown GPU cleanup mode %q, must be one of %q, %q or %q",
+		mode, GPUCleanupReport, GPUCleanupKill, GPUCleanupReset)
+}
+
+func queryComputeProcesses(uuid string) ([]computeProcess, error) {
+	out, err := runCommand(exec.Command("nvidia-smi", "--id="+uuid,
+		"--query-compute-apps=pid,process_name,used_memory",
+		"--format=csv,noheader,nounits").Output)
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi: %v", err)
+	}
+	procs := []computeProcess{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("nvidia-smi: unexpected output %q", line)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("nvidia-smi: unexpected PID in %q", line)
+		}
+		used, _ := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		procs = append(procs, computeProcess{
+			PID:           pid,
+			Name:          strings.TrimSpace(fields[1]),
+			UsedMemoryMiB: used,
+		})
+	}
+	return procs, nil
+}
+
+/* Wait until none of the processes exists anymore, up to timeout */
+func waitForExit(procs []computeProcess, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		alive := false
+		for _, p := range procs {
+			if syscall.Kill(p.PID, 0) != syscall.ESRCH {
+				alive = true
+			}
+		}
+		if !alive {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+/*
+ * nvidia-smi reports host PIDs, so killing the processes only works if the
+ * device plugin runs in the host PID namespace (hostPID: true).
+ */
+func killComputeProcesses(procs []computeProcess) {
+	for _, p := range procs {
+		log.Printf("Sending SIGTERM to stale GPU process %d (%s)", p.PID, p.Name)
+		if err := syscall.Kill(p.PID, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			log.Printf("Failed to signal process %d: %v", p.PID, err)
+		}
+	}
+	if waitForExit(procs, GPUCleanupKillTimeout) {
+		return
+	}
+	for _, p := range procs {
+		if err := syscall.Kill(p.PID, syscall.SIGKILL); err == nil {
+			log.Printf("Process %d did not exit within %s, sent SIGKILL", p.PID, GPUCleanupKillTimeout)
+		}
+	}
+	waitForExit(procs, GPUCleanupKillTimeout)
+}
+
+/*
+ * Give the managed GPU a clean slate before we advertise any devices, so that
+ * new clients don't inherit the leftovers of crashed ones. This is
+ * disruptive, so it only happens if explicitly enabled. We carry on even if
+ * it fails, as the GPU may still be usable.
+ */
+func cleanupGPU(uuid string, mode string) {
+	if mode == GPUCleanupOff {
+		return
+	}
+	procs, err := queryComputeProcesses(uuid)
+	if err != nil {
+		log.Printf("GPU cleanup: could not list the compute processes on %s: %v", uuid, err)
+		return
+	}
+	if len(procs) == 0 {
+		log.Printf("GPU cleanup: no compute processes on %s", uuid)
+	}
+	for _, p := range procs {
+		log.Printf("GPU cleanup: found compute process %d (%s) using %d MiB on %s", p.PID, p.Name, p.UsedMemoryMiB, uuid)
+	}
+	if mode == GPUCleanupReport {
+		return
+	}
+
+	if len(procs) > 0 {
+		killComputeProcesses(procs)
+		procs, err = queryComputeProcesses(uuid)
+		if err != nil || len(procs) > 0 {
+			log.Printf("GPU cleanup: compute processes remain on %s, giving up", uuid)
+			return
+		}
+	}
+	if mode != GPUCleanupReset {
+		return
+	}
+
+	log.Printf("GPU cleanup: resetting %s", uuid)
+	out, err := runCommand(exec.Command("nvidia-smi", "--id="+uuid, "--gpu-reset").CombinedOutput)
+	if err != nil {
+		log.Printf("GPU cleanup: failed to reset %s: %v: %s", uuid, err, strings.TrimSpace(string(out)))
+		return
+	}
+	log.Printf("GPU cleanup: reset %s", uuid)
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+/*
+ * Every time the container of a crash-looping Pod restarts, the kubelet
+ * allocates its devices again, and libnvshare registers with the scheduler
+ * again. If set, we hold back repeat allocations of the same devices to the
+ * same Pod, for the cooldown after the first repeat, doubling with every
+ * repeat that follows up to reallocCooldownMaxFactor times the cooldown.
+ * A Pod that stays up for that long starts over.
+ */
+var reallocCooldown time.Duration
+
+const reallocCooldownMaxFactor = 8
+
+type reallocation struct {
+	pod     string /* "namespace/name" */
+	last    time.Time
+	repeats int
+}
+
+var reallocMutex sync.Mutex
+
+/* The last allocation of each set of devices, by its sorted device IDs */
+var reallocations = map[string]*reallocation{}
+
+func reallocationKey(ids []string) string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+/*
+ * The Pod ("namespace/name") whose container holds the devices, "" if none
+ * does. A container that restarts keeps its devices, while a new Pod only
+ * shows up once the kubelet has created its container, i.e., after
+ * Allocate().
+ */
+func podOfDevices(ids []string) string {
+	allocs, err := listPodAllocations()
+	if err != nil {
+		log.Printf("Could not tell which Pod holds devices %v: %v", ids, err)
+		return ""
+	}
+	key := reallocationKey(ids)
+	for _, alloc := range allocs.Allocations {
+		if reallocationKey(alloc.DeviceIDs) == key {
+			return alloc.Namespace + "/" + alloc.Pod
+		}
+	}
+	return ""
+}
+
+/*
+ * How long to hold back an allocation of the devices. repeat tells whether
+ * we have allocated them before.
+ */
+func reallocationDelay(ids []string, repeat bool) time.Duration {
+	key := reallocationKey(ids)
+	now := time.Now()
+	maxDelay := reallocCooldown * reallocCooldownMaxFactor
+
+	reallocMutex.Lock()
+	r := reallocations[key]
+	if repeat == false || r == nil || now.Sub(r.last) >= 2*maxDelay {
+		reallocations[key] = &reallocation{last: now}
+		reallocMutex.Unlock()
+		return 0
+	}
+	reallocMutex.Unlock()
+
+	/* Ask the kubelet outside of reallocMutex, it may take a while */
+	pod := podOfDevices(ids)
+
+	reallocMutex.Lock()
+	defer reallocMutex.Unlock()
+	if pod == "" || (r.pod != "" && r.pod != pod) {
+		/* Another Pod got the devices, it hasn't crashed yet */
+		reallocations[key] = &reallocation{pod: pod, last: now}
+		return 0
+	}
+	r.pod = pod
+	r.repeats++
+	delay := reallocCooldown
+	for i := 1; i < r.repeats && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	delay -= now.Sub(r.last)
+	if delay < 0 {
+		delay = 0
+	}
+	r.last = now.Add(delay)
+	if delay > 0 {
+		log.Printf("Throttling the allocation of devices %v to Pod %s by %s, its container has restarted %d time(s) in a row",
+			ids, pod, delay.Round(time.Millisecond), r.repeats)
+	}
+	return delay
+}
+
+/* Forget the devices that nobody has allocated for long */
+func pruneReallocations() {
+	maxDelay := reallocCooldown * reallocCooldownMaxFactor
+
+	reallocMutex.Lock()
+	defer reallocMutex.Unlock()
+	for key, r := range reallocations {
+		if time.Since(r.last) >= 2*maxDelay {
+			delete(reallocations, key)
+		}
+	}
+}
+
+/* Hold back a repeat allocation of the devices, until ctx is done */
+func waitReallocationCooldown(ctx context.Context, ids []string, repeat bool) error {
+	if reallocCooldown == 0 {
+		return nil
+	}
+	pruneReallocations()
+	delay := reallocationDelay(ids, repeat)
+	if delay == 0 {
+		return nil
+	}
+	recordAllocationThrottled(delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -5,28 +5,76 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+const DefaultDeviceIDSeparator = "__"
+
+/*
+ * Device IDs have the form <UUID><separator><ordinal>. Always go through
+ * generateDeviceID() and parseDeviceID() to build and take them apart.
+ */
+var DeviceIDSeparator = DefaultDeviceIDSeparator
+
+/*
+ * The separator must not consist only of digits, otherwise we couldn't tell
+ * where the ordinal starts.
+ */
+func validateDeviceIDSeparator(sep string) error {
+	if sep == "" {
+		return fmt.Errorf("device ID separator must not be empty")
+	}
+	if strings.Trim(sep, "0123456789") == "" {
+		return fmt.Errorf("device ID separator %q must contain a non-digit character", sep)
+	}
+	return nil
+}
+
 func generateDeviceID(uuid string, ordinal int) string {
 	var ordinalStr string
 	var devID string
 	ordinalStr = strconv.FormatInt(int64(ordinal), 10)
-	devID = uuid + "__" + ordinalStr
+	devID = uuid + DeviceIDSeparator + ordinalStr
 	return devID
 }
 
-func getDevices() []*pluginapi.Device {
+/*
+ * Split a device ID into the GPU UUID and the ordinal of the virtual device.
+ *
+ * The ordinal always comes after the last separator, so this works even if
+ * the UUID itself contains the separator.
+ */
+func parseDeviceID(id string) (uuid string, ordinal int, err error) {
+	idx := strings.LastIndex(id, DeviceIDSeparator)
+	if idx < 0 {
+		return "", 0, fmt.Errorf("device ID %q has no separator %q", id, DeviceIDSeparator)
+	}
+	uuid = id[:idx]
+	if uuid == "" {
+		return "", 0, fmt.Errorf("device ID %q has an empty UUID", id)
+	}
+	ordinalStr := id[idx+len(DeviceIDSeparator):]
+	n, err := strconv.ParseInt(ordinalStr, 10, 32)
+	if err != nil || n < 1 || strconv.FormatInt(n, 10) != ordinalStr {
+		return "", 0, fmt.Errorf("device ID %q has an invalid ordinal %q", id, ordinalStr)
+	}
+	return uuid, int(n), nil
+}
+
+/* The devices with ordinals first to first+count-1 */
+func getDevices(first int, count int) []*pluginapi.Device {
 	var devID string
 	var devs []*pluginapi.Device
 	log.Printf("Reporting the following DeviceIDs to kubelet:\n")
 
-	for j := int(0); j < NvshareVirtualDevices; j++ {
-		devID = generateDeviceID(UUID, j+1)
-		log.Printf("[%d] Device ID:%s\n", j+1, devID)
+	for j := first; j < first+count; j++ {
+		devID = generateDeviceID(gpuUUID(), j)
+		log.Printf("[%d] Device ID:%s\n", j, devID)
 		devs = append(devs, &pluginapi.Device{
 			ID:     devID,
 			Health: pluginapi.Healthy,
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+const testUUID = "GPU-8f3e6b2a-1c4d-4e5f-9a0b-7c6d5e4f3a2b"
+
+func withDeviceIDSeparator(t *testing.T, sep string) {
+	old := DeviceIDSeparator
+	DeviceIDSeparator = sep
+	t.Cleanup(func() { DeviceIDSeparator = old })
+}
+
+func TestDeviceIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		sep     string
+		uuid    string
+		ordinal int
+	}{
+		{"default separator", DefaultDeviceIDSeparator, testUUID, 1},
+		{"large ordinal", DefaultDeviceIDSeparator, testUUID, 2147483647},
+		{"custom separator", ":", testUUID, 7},
+		{"multi-character separator", "-vdev-", testUUID, 12},
+		{"separator with digits", "x1", testUUID, 3},
+		{"UUID contains default separator", DefaultDeviceIDSeparator, "GPU__a__b", 2},
+		{"UUID ends with separator", DefaultDeviceIDSeparator, "GPU-abc__", 4},
+		{"UUID contains custom separator", "-", testUUID, 9},
+		{"UUID is digits", ":", "1234", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDeviceIDSeparator(t, tt.sep)
+			id := generateDeviceID(tt.uuid, tt.ordinal)
+			uuid, ordinal, err := parseDeviceID(id)
+			if err != nil {
+				t.Fatalf("parseDeviceID(%q) failed: %v", id, err)
+			}
+			if uuid != tt.uuid || ordinal != tt.ordinal {
+				t.Fatalf("parseDeviceID(%q) = (%q, %d), want (%q, %d)", id, uuid, ordinal, tt.uuid, tt.ordinal)
+			}
+		})
+	}
+}
+
+/* Ordinals start at 1, so generated IDs for 0 and below must not parse */
+func TestDeviceIDNonPositiveOrdinal(t *testing.T) {
+	for _, ordinal := range []int{0, -1, -42} {
+		id := generateDeviceID(testUUID, ordinal)
+		if uuid, n, err := parseDeviceID(id); err == nil {
+			t.Errorf("parseDeviceID(%q) = (%q, %d), want error", id, uuid, n)
+		}
+	}
+}
+
+func TestParseDeviceIDInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		sep  string
+		id   string
+	}{
+		{"empty", DefaultDeviceIDSeparator, ""},
+		{"no separator", DefaultDeviceIDSeparator, testUUID},
+		{"wrong separator", ":", testUUID + "__1"},
+		{"empty UUID", DefaultDeviceIDSeparator, "__1"},
+		{"empty ordinal", DefaultDeviceIDSeparator, testUUID + "__"},
+		{"non-numeric ordinal", DefaultDeviceIDSeparator, testUUID + "__one"},
+		{"leading zero", DefaultDeviceIDSeparator, testUUID + "__01"},
+		{"plus sign", DefaultDeviceIDSeparator, testUUID + "__+1"},
+		{"trailing garbage", DefaultDeviceIDSeparator, testUUID + "__1x"},
+		{"zero", DefaultDeviceIDSeparator, testUUID + "__0"},
+		{"negative", DefaultDeviceIDSeparator, testUUID + "__-3"},
+		{"overflow", DefaultDeviceIDSeparator, testUUID + "__2147483648"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDeviceIDSeparator(t, tt.sep)
+			if uuid, n, err := parseDeviceID(tt.id); err == nil {
+				t.Fatalf("parseDeviceID(%q) = (%q, %d), want error", tt.id, uuid, n)
+			}
+		})
+	}
+}
+
+func TestValidateDeviceIDSeparator(t *testing.T) {
+	tests := []struct {
+		sep     string
+		wantErr bool
+	}{
+		{"__", false},
+		{":", false},
+		{"-", false},
+		{"x1", false},
+		{"", true},
+		{"0", true},
+		{"123", true},
+	}
+	for _, tt := range tests {
+		err := validateDeviceIDSeparator(tt.sep)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateDeviceIDSeparator(%q) = %v, want error %v", tt.sep, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+/*
+ * Like libnvshare and the scheduler, log a diagnostics block once at startup,
+ * to copy into bug reports: versions, GPUs, paths and settings. With
+ * DebugEnvVar set, it also lists the environment variables that change what
+ * we and the containers we set up do.
+ */
+func logDiagnostics() {
+	info := queryGPUInfo()
+
+	log.Printf("----- nvshare diagnostics (nvshare-device-plugin) -----")
+	log.Printf("nvshare: nvshare-device-plugin %s, protocol version %s, %s", Version, ProtocolVersion, runtime.Version())
+	hostname, _ := os.Hostname()
+	kernel, _ := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	log.Printf("host: %s, %s %s %s", hostname, runtime.GOOS, strings.TrimSpace(string(kernel)), runtime.GOARCH)
+	switch {
+	case info.Source == "":
+		log.Printf("driver: unknown, %s", info.Error)
+	case info.CUDAVersion == "":
+		log.Printf("driver: NVIDIA %s (from %s)", info.DriverVersion, info.Source)
+	default:
+		log.Printf("driver: NVIDIA %s, CUDA %s (from %s)", info.DriverVersion, info.CUDAVersion, info.Source)
+	}
+	for i, gpu := range info.GPUs {
+		log.Printf("GPU %d: %s, %d MiB, %s", i, gpu.ProductName, gpu.MemoryTotalMiB, gpu.UUID)
+	}
+	mode := "time-slicing"
+	if Passthrough == true {
+		mode = "pass-through"
+	}
+	log.Printf("sharing: GPU %s as %d device(s) of %s, %s", UUID, NvshareVirtualDevices, resourceName, mode)
+	scheduler := SchedulerAddress
+	if scheduler == "" {
+		scheduler = SocketHostPath
+	}
+	log.Printf("paths: scheduler %s, libnvshare %s, device plugins %s, kubelet %s, PodResources %s",
+		scheduler, LibNvshareHostPath, DevicePluginPath, KubeletSocket, PodResourcesSocket)
+
+	if os.Getenv(DebugEnvVar) != "" {
+		env := os.Environ()
+		sort.Strings(env)
+		for _, kv := range env {
+			if strings.HasPrefix(kv, "NVSHARE_") || strings.HasPrefix(kv, "NVIDIA_") {
+				log.Printf("env: %s", kv)
+			}
+		}
+	}
+	log.Printf("----- end of nvshare diagnostics -----")
+}
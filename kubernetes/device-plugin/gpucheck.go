@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * We read the UUID of the GPU once at startup, but on some platforms the
+ * NVIDIA device plugin may reassign the GPU of our container later on. Our
+ * own environment never changes, so watch what the container runtime
+ * actually exposes to us, i.e., the volume mount or the GPUs that NVML or
+ * /proc/driver/nvidia show, and tell the main loop when it changes, so that
+ * it advertises devices of the new GPU.
+ */
+
+var uuidMutex sync.RWMutex
+
+/* The UUID of the GPU we currently advertise devices of */
+func gpuUUID() string {
+	uuidMutex.RLock()
+	defer uuidMutex.RUnlock()
+	return UUID
+}
+
+func setGPUUUID(uuid string) {
+	uuidMutex.Lock()
+	UUID = uuid
+	uuidMutex.Unlock()
+}
+
+/* How long to wait at startup for the volume mounts, see waitExposeMountUUIDs() */
+const DefaultExposeMountTimeout = 30 * time.Second
+
+const (
+	exposeMountBackoffMin = 100 * time.Millisecond
+	exposeMountBackoffMax = 2 * time.Second
+)
+
+/* The UUIDs that the NVIDIA device plugin passes to us through volume mounts, sorted */
+func readExposeMountUUIDs() ([]string, error) {
+	f, err := os.Open(NvidiaExposeMountDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	nvFiles, err := f.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(nvFiles)
+	return nvFiles, nil
+}
+
+/*
+ * The UUID of the GPU we share, out of the entries of the volume mounts.
+ * Every instance of the device plugin advertises the devices of a single GPU,
+ * and sharing one of several GPUs would leave the others idle while the
+ * NVIDIA device plugin counts them as taken, so we refuse to.
+ */
+func singleExposeMountUUID(uuids []string) (string, error) {
+	if len(uuids) == 0 {
+		return "", fmt.Errorf("no entries in %s", NvidiaExposeMountDir)
+	}
+	if len(uuids) > 1 {
+		return "", fmt.Errorf("got %d GPUs (%s) in %s, but every instance of the device plugin shares a single GPU. Request a single nvidia.com/gpu for every instance",
+			len(uuids), strings.Join(uuids, ", "), NvidiaExposeMountDir)
+	}
+	return uuids[0], nil
+}
+
+/* The UUID of the GPU that the NVIDIA device plugin passes to us through volume mounts */
+func readExposeMountUUID() (string, error) {
+	uuids, err := readExposeMountUUIDs()
+	if err != nil {
+		return "", err
+	}
+	return singleExposeMountUUID(uuids)
+}
+
+/*
+ * The NVIDIA container runtime may still be populating the volume mounts when
+ * we start. Read them until two reads in a row find the same entries, backing
+ * off in between, for up to timeout.
+ */
+func waitExposeMountUUIDs(timeout time.Duration) ([]string, error) {
+	var last []string
+
+	deadline := time.Now().Add(timeout)
+	backoff := exposeMountBackoffMin
+	for attempt := 1; ; attempt++ {
+		uuids, err := readExposeMountUUIDs()
+		if err == nil && len(uuids) == 0 {
+			uuids = nil
+			err = fmt.Errorf("no entries in %s yet", NvidiaExposeMountDir)
+		}
+		if err == nil && last != nil {
+			if strings.Join(uuids, ",") == strings.Join(last, ",") {
+				return uuids, nil
+			}
+			err = fmt.Errorf("the entries of %s changed from %v to %v", NvidiaExposeMountDir, last, uuids)
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			if err == nil {
+				/* No time left to read them again */
+				return uuids, nil
+			}
+			return nil, fmt.Errorf("the volume mounts did not settle within %s: %v", timeout, err)
+		}
+		/* The first read that finds entries only needs confirming */
+		if err != nil {
+			log.Printf("Reading the volume mounts, attempt %d: %v. Retrying in %s", attempt, err, backoff)
+		}
+		last = uuids
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > exposeMountBackoffMax {
+			backoff = exposeMountBackoffMax
+		}
+	}
+}
+
+/* The UUID of the single GPU that our container sees */
+func observeGPUUUID() (string, error) {
+	if nvidiaRuntimeUseMounts == true {
+		return readExposeMountUUID()
+	}
+	info := PluginInfo{}
+	err := queryNvidiaSmi(&info)
+	if err != nil {
+		info.GPUs = nil
+		err = queryProcfs(&info)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(info.GPUs) != 1 {
+		return "", fmt.Errorf("expected a single visible GPU, found %d", len(info.GPUs))
+	}
+	return info.GPUs[0].UUID, nil
+}
+
+/*
+ * Check what our container sees every interval and send the UUID of the new
+ * GPU on the returned channel when it changes. Send "" if we can't tell which
+ * GPU we got, e.g., because NVIDIA_VISIBLE_DEVICES doesn't name the GPU by
+ * its UUID, in which case the device plugin should give up.
+ *
+ * Compare with what we saw at startup, not with UUID, which may name the GPU
+ * differently from what NVML reports.
+ */
+func startGPUChangeChecker(interval time.Duration) <-chan string {
+	changed := make(chan string, 1)
+	baseline, err := observeGPUUUID()
+	if err != nil {
+		log.Printf("Cannot check whether the GPU changes: %v", err)
+		return changed
+	}
+	log.Printf("Checking every %s whether the GPU of the device plugin changes", interval)
+	go func() {
+		for range time.Tick(interval) {
+			current, err := observeGPUUUID()
+			if err != nil {
+				log.Printf("Could not check whether the GPU changed: %v", err)
+				continue
+			}
+			if current == baseline {
+				continue
+			}
+			log.Printf("GPU CHANGED: the device plugin now sees GPU %s instead of %s", current, baseline)
+			if baseline != gpuUUID() {
+				/* We can't derive a new UUID from what NVML reports */
+				current = ""
+			}
+			baseline = current
+			changed <- current
+			if current == "" {
+				return
+			}
+		}
+	}()
+	return changed
+}
@@ -0,0 +1,33 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSingleExposeMountUUID(t *testing.T) {
+	tests := []struct {
+		name    string
+		uuids   []string
+		want    string
+		wantErr bool
+	}{
+		{"single GPU", []string{testUUID}, testUUID, false},
+		{"no GPU", nil, "", true},
+		{"several GPUs", []string{testUUID, "GPU-9a0b7c6d-5e4f-3a2b-8f3e-6b2a1c4d4e5f"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := singleExposeMountUUID(tt.uuids)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("singleExposeMountUUID(%v) = %q, %v, want error %v", tt.uuids, got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("singleExposeMountUUID(%v) = %q, want %q", tt.uuids, got, tt.want)
+			}
+		})
+	}
+}
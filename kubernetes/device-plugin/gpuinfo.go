@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultGPUInfoRefreshInterval = 30 * time.Second
+
+/* Information about a physical GPU that this device plugin manages */
+type GPUInfo struct {
+	UUID           string `json:"uuid"`
+	ProductName    string `json:"productName"`
+	PCIBusID       string `json:"pciBusID,omitempty"`
+	MemoryTotalMiB int64  `json:"memoryTotalMiB"`
+	MemoryUsedMiB  int64  `json:"memoryUsedMiB"`
+}
+
+type PluginInfo struct {
+	ResourceName  string    `json:"resourceName"`
+	UUID          string    `json:"uuid"`
+	DriverVersion string    `json:"driverVersion,omitempty"`
+	CUDAVersion   string    `json:"cudaVersion,omitempty"`
+	GPUs          []GPUInfo `json:"gpus"`
+	/* Where the information came from: "nvml" or "procfs" */
+	Source    string    `json:"source"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var gpuInfoMutex sync.Mutex
+var gpuInfo PluginInfo
+
+/*
+ * Query NVML through nvidia-smi, which the NVIDIA container runtime makes
+ * available in our container. We don't link against NVML directly, as the
+ * device plugin is a static (CGO_ENABLED=0) binary.
+ */
+func queryNvidiaSmi(info *PluginInfo) error {
+	out, err := runCommand(exec.Command("nvidia-smi",
+		"--query-gpu=uuid,name,pci.bus_id,memory.total,memory.used,driver_version",
+		"--format=csv,noheader,nounits").Output)
+	if err != nil {
+		return fmt.Errorf("nvidia-smi: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 6 {
+			return fmt.Errorf("nvidia-smi: unexpected output %q", line)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		total, _ := strconv.ParseInt(fields[3], 10, 64)
+		used, _ := strconv.ParseInt(fields[4], 10, 64)
+		info.GPUs = append(info.GPUs, GPUInfo{
+			UUID:           fields[0],
+			ProductName:    fields[1],
+			PCIBusID:       fields[2],
+			MemoryTotalMiB: total,
+			MemoryUsedMiB:  used,
+		})
+		info.DriverVersion = fields[5]
+	}
+
+	/* The CUDA version is not available as a query field */
+	out, err = runCommand(exec.Command("nvidia-smi", "-q").Output)
+	if err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(out)))
+		for scanner.Scan() {
+			kv := strings.SplitN(scanner.Text(), ":", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "CUDA Version" {
+				info.CUDAVersion = strings.TrimSpace(kv[1])
+				break
+			}
+		}
+	}
+	info.Source = "nvml"
+	return nil
+}
+
+/*
+ * Fall back to what the NVIDIA kernel module exposes under /proc, which lacks
+ * memory usage and the CUDA version.
+ */
+func queryProcfs(info *PluginInfo) error {
+	version, err := ioutil.ReadFile("/proc/driver/nvidia/version")
+	if err != nil {
+		return err
+	}
+	/* NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.104.05  Sat Aug 19 ... */
+	fields := strings.Fields(strings.SplitN(string(version), "\n", 2)[0])
+	for i, f := range fields {
+		if f == "Module" && i+1 < len(fields) {
+			info.DriverVersion = fields[i+1]
+		}
+	}
+
+	gpuDirs, _ := filepath.Glob("/proc/driver/nvidia/gpus/*")
+	for _, dir := range gpuDirs {
+		f, err := os.Open(filepath.Join(dir, "information"))
+		if err != nil {
+			continue
+		}
+		gpu := GPUInfo{PCIBusID: filepath.Base(dir)}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			kv := strings.SplitN(scanner.Text(), ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.TrimSpace(kv[0]) {
+			case "Model":
+				gpu.ProductName = strings.TrimSpace(kv[1])
+			case "GPU UUID":
+				gpu.UUID = strings.TrimSpace(kv[1])
+			}
+		}
+		f.Close()
+		info.GPUs = append(info.GPUs, gpu)
+	}
+	info.Source = "procfs"
+	return nil
+}
+
+/* Query the GPUs, through NVML if we can, through /proc otherwise */
+func queryGPUInfo() PluginInfo {
+	info := PluginInfo{
+		ResourceName: resourceName,
+		UUID:         gpuUUID(),
+		GPUs:         []GPUInfo{},
+		UpdatedAt:    time.Now(),
+	}
+	err := queryNvidiaSmi(&info)
+	if err != nil {
+		log.Printf("Could not query NVML, falling back to /proc/driver/nvidia: %v", err)
+		info.GPUs = []GPUInfo{}
+		err = queryProcfs(&info)
+		if err != nil {
+			info.Source = ""
+			info.Error = err.Error()
+		}
+	}
+	return info
+}
+
+func refreshGPUInfo() {
+	info := queryGPUInfo()
+	gpuInfoMutex.Lock()
+	gpuInfo = info
+	gpuInfoMutex.Unlock()
+}
+
+/* Keep the cached GPU information fresh */
+func startGPUInfoRefresher(interval time.Duration) {
+	refreshGPUInfo()
+	go func() {
+		for range time.Tick(interval) {
+			refreshGPUInfo()
+		}
+	}()
+}
+
+func serveGPUInfo(w http.ResponseWriter, r *http.Request) {
+	gpuInfoMutex.Lock()
+	out, err := json.MarshalIndent(gpuInfo, "", "  ")
+	gpuInfoMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(out, '\n'))
+}
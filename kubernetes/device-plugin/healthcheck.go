@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * Besides the checks of the NVIDIA device plugin, sites may have GPU health
+ * checks of their own, e.g., a tiny CUDA self-test. If set, we run the
+ * command with /bin/sh every interval and mark all of our devices unhealthy
+ * in ListAndWatch() while it fails, i.e., exits with a non-zero code or runs
+ * past the timeout, so that the kubelet stops placing Pods on them.
+ */
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultHealthCheckTimeout  = 10 * time.Second
+)
+
+/* How much of the output of a failed check we log */
+const healthCheckOutputMax = 1024
+
+/* Run the check once */
+func runHealthCheck(command string, timeout time.Duration) error {
+	return runCheck(exec.Command("/bin/sh", "-c", command), timeout)
+}
+
+/*
+ * Run a check command. It runs in a process group of its own, so that we can
+ * kill whatever it has spawned on timeout, which would otherwise hold on to
+ * its output and keep us waiting.
+ */
+func runCheck(cmd *exec.Cmd, timeout time.Duration) error {
+	var out bytes.Buffer
+
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	_, err := runCommand(func() ([]byte, error) {
+		err := cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+		timer := time.AfterFunc(timeout, func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		err = cmd.Wait()
+		if timer.Stop() == false {
+			return nil, fmt.Errorf("timed out after %s", timeout)
+		}
+		return nil, err
+	})
+	if err != nil && out.Len() > 0 {
+		output := strings.TrimSpace(out.String())
+		if len(output) > healthCheckOutputMax {
+			output = "..." + output[len(output)-healthCheckOutputMax:]
+		}
+		err = fmt.Errorf("%v: %s", err, output)
+	}
+	return err
+}
+
+/*
+ * Run the check every interval and send whether our devices are healthy on
+ * the returned channel whenever it changes. They start out healthy.
+ */
+func startHealthChecker(command string, interval, timeout time.Duration) <-chan bool {
+	changed := make(chan bool, 1)
+	log.Printf("Running health check %q every %s, with a timeout of %s", command, interval, timeout)
+	go func() {
+		healthy := true
+		for {
+			err := runHealthCheck(command, timeout)
+			if err != nil {
+				log.Printf("Health check failed: %v", err)
+			}
+			if (err == nil) != healthy {
+				healthy = (err == nil)
+				if healthy == true {
+					log.Printf("Health check passed, marking the devices of %s healthy again", resourceName)
+				} else {
+					log.Printf("Marking the devices of %s unhealthy", resourceName)
+				}
+				changed <- healthy
+			}
+			time.Sleep(interval)
+		}
+	}()
+	return changed
+}
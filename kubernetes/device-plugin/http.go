@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+)
+
+/*
+ * Serve read-only information about the device plugin over HTTP. This is
+ * disabled unless HTTPAddrEnvVar is set.
+ */
+func startHTTPServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", serveGPUInfo)
+	mux.HandleFunc("/pods", servePodAllocations)
+	mux.HandleFunc("/unused", serveUnusedAllocations)
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	go func() {
+		log.Printf("Serving HTTP on %s", addr)
+		err := http.ListenAndServe(addr, mux)
+		log.Fatal("HTTP server failed: ", err)
+	}()
+}
+
+func validatePprofPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("pprof port %q is not a valid port number", port)
+	}
+	return nil
+}
+
+/*
+ * Serve the Go profiler for debugging stuck or misbehaving instances. This
+ * is disabled unless PprofPortEnvVar is set. Profiles expose the internals
+ * of the process, so we only ever listen on the loopback interface.
+ */
+func startPprofServer(port string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	addr := net.JoinHostPort("127.0.0.1", port)
+	go func() {
+		log.Printf("Serving pprof on %s", addr)
+		err := http.ListenAndServe(addr, mux)
+		log.Fatal("pprof server failed: ", err)
+	}()
+}
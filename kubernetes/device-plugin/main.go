@@ -18,10 +18,14 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 	"syscall"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -36,20 +40,142 @@ const (
 	NvidiaDevicesEnvVar              = "NVIDIA_VISIBLE_DEVICES"
 	NvidiaExposeMountDir             = "/var/run/nvidia-container-devices"
 	NvidiaExposeMountHostPath        = "/dev/null"
+	DevicePluginPathEnvVar           = "NVSHARE_DEVICE_PLUGIN_PATH"
+	KubeletSocketEnvVar              = "NVSHARE_KUBELET_SOCKET"
+	SockIDEnvVar                     = "NVSHARE_SOCK_ID"
+	ProtocolVersionEnvVar            = "NVSHARE_PROTOCOL_VERSION"
+	DeviceIDSeparatorEnvVar          = "NVSHARE_DEVICE_ID_SEPARATOR"
+	HTTPAddrEnvVar                   = "NVSHARE_PLUGIN_HTTP_ADDR"
+	GPUInfoRefreshIntervalEnvVar     = "NVSHARE_GPU_INFO_REFRESH_INTERVAL"
+	FallbackTimeoutEnvVar            = "NVSHARE_FALLBACK_TIMEOUT_MS"
+	DeviceSlotEnvVar                 = "NVSHARE_DEVICE_SLOT"
+	GPUCleanupEnvVar                 = "NVSHARE_STARTUP_GPU_CLEANUP"
+	MillisharesModeEnvVar            = "NVSHARE_MILLISHARES_MODE"
+	PprofPortEnvVar                  = "NVSHARE_PLUGIN_PPROF_PORT"
+	PodResourcesSocketEnvVar         = "NVSHARE_POD_RESOURCES_SOCKET"
+	AllocateRateEnvVar               = "NVSHARE_ALLOCATE_RATE"
+	AllocateBurstEnvVar              = "NVSHARE_ALLOCATE_BURST"
+	AttributesFileEnvVar             = "NVSHARE_ATTRIBUTES_FILE"
+	MillisharesEnvVar                = "NVSHARE_MILLISHARES"
+	StopGracePeriodEnvVar            = "NVSHARE_STOP_GRACE_PERIOD"
+	UnusedAllocationTimeoutEnvVar    = "NVSHARE_UNUSED_ALLOCATION_TIMEOUT"
+	SchedulerSocketEnvVar            = "NVSHARE_SCHEDULER_SOCKET"
+	AnnotatePodsEnvVar               = "NVSHARE_ANNOTATE_PODS"
+	PassthroughEnvVar                = "NVSHARE_SINGLE_DEVICE_PASSTHROUGH"
+	StandaloneEnvVar                 = "NVSHARE_STANDALONE"
+	MaxNodeDevicesEnvVar             = "NVSHARE_MAX_NODE_DEVICES"
+	NodeDevicesDirEnvVar             = "NVSHARE_NODE_DEVICES_DIR"
+	SchedulerAddressEnvVar           = "NVSHARE_SCHEDULER_ADDRESS"
+	LogAllocationsEnvVar             = "NVSHARE_LOG_ALLOCATIONS"
+	GPUCheckIntervalEnvVar           = "NVSHARE_GPU_CHECK_INTERVAL"
+	StartTimeoutEnvVar               = "NVSHARE_START_TIMEOUT"
+	TeamsEnvVar                      = "NVSHARE_TEAMS"
+	GuaranteedDevicesEnvVar          = "NVSHARE_GUARANTEED_DEVICES"
+	GuaranteedMemoryEnvVar           = "NVSHARE_GUARANTEED_MEMORY_MIB"
+	ReserveMemoryEnvVar              = "NVSHARE_RESERVE_MEMORY_MIB"
+	WorkloadTypeEnvVar               = "NVSHARE_WORKLOAD_TYPE"
+	ReallocationCooldownEnvVar       = "NVSHARE_REALLOCATION_COOLDOWN"
+	TestGRPCPortEnvVar               = "NVSHARE_TEST_GRPC_PORT"
+	ExposeMountTimeoutEnvVar         = "NVSHARE_EXPOSE_MOUNT_TIMEOUT"
+	HealthCheckCommandEnvVar         = "NVSHARE_HEALTH_CHECK_COMMAND"
+	HealthCheckIntervalEnvVar        = "NVSHARE_HEALTH_CHECK_INTERVAL"
+	HealthCheckTimeoutEnvVar         = "NVSHARE_HEALTH_CHECK_TIMEOUT"
+	SelfCheckEnvVar                  = "NVSHARE_SELF_CHECK"
+	SelfCheckIntervalEnvVar          = "NVSHARE_SELF_CHECK_INTERVAL"
+	SelfCheckTimeoutEnvVar           = "NVSHARE_SELF_CHECK_TIMEOUT"
+	DeviceSnapshotFileEnvVar         = "NVSHARE_DEVICE_SNAPSHOT_FILE"
+	DeviceSnapshotIntervalEnvVar     = "NVSHARE_DEVICE_SNAPSHOT_INTERVAL"
+	MaxListAndWatchStreamsEnvVar     = "NVSHARE_MAX_LIST_AND_WATCH_STREAMS"
+	DebugEnvVar                      = "NVSHARE_DEBUG"
+	MillisharesPerGPU                = 1000
+	/*
+	 * Version of the protocol between libnvshare and nvshare-scheduler that
+	 * this device plugin was released with. Must be kept in sync with
+	 * NVSHARE_PROTOCOL_VERSION in src/comm.h.
+	 */
+	ProtocolVersion                  = "18"
 )
 
+/* The commit we were built from, set with -ldflags "-X main.Version=..." */
+var Version = "unknown"
+
+/* Use gpuUUID() once other goroutines run, see gpucheck.go */
 var UUID string
 var NvshareVirtualDevices int
 var nvidiaRuntimeUseMounts bool
+var DevicePluginPath string
+var KubeletSocket string
+/*
+ * Advertise the GPU as MillisharesPerGPU devices of the millishares resource,
+ * instead of NvshareVirtualDevices devices of the plain one.
+ */
+var Millishares bool
+/*
+ * With a single virtual device per GPU, every GPU has at most one client, so
+ * there's nothing to time-slice. If set, containers run libnvshare in
+ * standalone mode, i.e., without the scheduler.
+ */
+var Passthrough bool
+/*
+ * If set, passed on to containers so that libnvshare falls back to
+ * standalone mode when it can't reach the scheduler in time.
+ */
+var FallbackTimeoutMs string
+/*
+ * If set, containers reach the scheduler at this address instead of through
+ * the scheduler socket, which we then don't mount, see
+ * validateSchedulerAddress().
+ */
+var SchedulerAddress string
+/*
+ * Log every Allocate request and the response we build for it in full, to
+ * debug what containers get from us.
+ */
+var LogAllocations bool
+/*
+ * How long to let in-flight requests complete when stopping the gRPC server,
+ * before aborting them. 0 aborts them right away.
+ */
+var StopGracePeriod time.Duration
+
+/*
+ * The kubelet socket may be created several times in quick succession while
+ * the kubelet restarts, so wait for it to settle before registering again.
+ */
+const kubeletSocketDebounce = time.Second
+
+/*
+ * If set, give up once the device plugin has failed to start for this long
+ * in a row, e.g., because the kubelet is broken, and exit with
+ * startTimeoutExitCode, so that monitoring can tell this case apart.
+ */
+var startTimeout time.Duration
+
+const startTimeoutExitCode = 3
 
 func main() {
 	var exists bool
 	var NumVirtualDevicesEnv string
 	var err error
-	var devicePlugin *NvshareDevicePlugin
+	var devicePlugins []*NvshareDevicePlugin
+	var reregister <-chan time.Time
+	var gpuChanged <-chan string
+	var healthChanged <-chan bool
+	var selfCheckChanged <-chan bool
+	var healthFailed, selfCheckFailed bool
+	var unhealthy bool
+	var failingSince time.Time
+	var failedStarts int
+
 
+	if len(os.Args) > 1 && os.Args[1] == "--version" {
+		fmt.Printf("nvshare-device-plugin %s (protocol version %s)\n", Version, ProtocolVersion)
+		os.Exit(0)
+	}
 
 	log.SetOutput(os.Stderr)
+	log.Printf("nvshare-device-plugin version %s, protocol version %s", Version, ProtocolVersion)
+	startReaper()
 
 	/*
 	 * Read the underlying GPU UUID from the NVIDIA_VISIBLE_DEVICES environment
@@ -73,22 +199,40 @@ func main() {
 		os.Exit(1)
 	}
 
+	millisharesMode, _ := os.LookupEnv(MillisharesModeEnvVar)
+	Millishares = (millisharesMode == "1" || strings.EqualFold(millisharesMode, "true"))
+
 	/*
 	 * Find out how many virtual GPUs we must advertize
 	 */
-	NumVirtualDevicesEnv, exists = os.LookupEnv(NvshareVirtualDevicesEnvVar)
-	if exists == false {
-		log.Printf("%s is not set, exiting", NvshareVirtualDevicesEnvVar)
-		os.Exit(1)
-	}
-	NvshareVirtualDevices, err = strconv.Atoi(NumVirtualDevicesEnv)
-	if err != nil {
-		log.Printf("Failed to parse nvshare devices per GPU")
-		log.Fatal(err)
+	if Millishares == true {
+		NvshareVirtualDevices = MillisharesPerGPU
+		log.Printf("Millishares mode, advertising %d millishares per GPU", MillisharesPerGPU)
+	} else {
+		NumVirtualDevicesEnv, exists = os.LookupEnv(NvshareVirtualDevicesEnvVar)
+		if exists == false {
+			log.Printf("%s is not set, exiting", NvshareVirtualDevicesEnvVar)
+			os.Exit(1)
+		}
+		NvshareVirtualDevices, err = strconv.Atoi(NumVirtualDevicesEnv)
+		if err != nil {
+			log.Printf("Failed to parse nvshare devices per GPU")
+			log.Fatal(err)
+		}
+		if NvshareVirtualDevices <= 0 {
+			log.Printf("Parsed nvshare virtual devices per GPU is not a positive integer, exiting")
+			os.Exit(1)
+		}
 	}
-	if NvshareVirtualDevices <= 0 {
-		log.Printf("Parsed nvshare virtual devices per GPU is not a positive integer, exiting")
-		os.Exit(1)
+
+	passthrough, _ := os.LookupEnv(PassthroughEnvVar)
+	Passthrough = (passthrough == "1" || strings.EqualFold(passthrough, "true"))
+	if Passthrough == true {
+		if NvshareVirtualDevices != 1 {
+			log.Fatalf("%s requires %s=1 and no millishares mode, as clients would share the GPU without time-slicing",
+				PassthroughEnvVar, NvshareVirtualDevicesEnvVar)
+		}
+		log.Printf("Pass-through mode, containers use the GPU exclusively without the scheduler")
 	}
 
 	/*
@@ -98,29 +242,365 @@ func main() {
 	 */
 	if UUID == NvidiaExposeMountDir {
 		log.Printf("Device Exposure method of NVIDIA device plugin is Volume Mounts, following the same strategy for Nvshare device plugin")
-		f, err := os.Open(NvidiaExposeMountDir)
+		timeout := DefaultExposeMountTimeout
+		timeoutStr, exists := os.LookupEnv(ExposeMountTimeoutEnvVar)
+		if exists == true && timeoutStr != "" {
+			timeout, err = time.ParseDuration(timeoutStr)
+			if err != nil || timeout < 0 {
+				log.Fatalf("Invalid %s: %q", ExposeMountTimeoutEnvVar, timeoutStr)
+			}
+		}
+		uuids, err := waitExposeMountUUIDs(timeout)
 		if err != nil {
-			log.Printf("Failed to open %s", NvidiaExposeMountDir)
+			log.Printf("Error when reading UUID from %s directory", NvidiaExposeMountDir)
 			log.Fatal(err)
 		}
-		// Read all filenames in the directory
-		nvFiles, err := f.Readdirnames(0)
-		if (len(nvFiles) != 1) || (err != nil) {
-			log.Printf("Error when reading UUID from %s directory:%s", NvidiaExposeMountDir, err)
-			if err != nil {
-				log.Fatal(err)
-			} else {
-				os.Exit(1)
-			}
+		log.Printf("Found GPU(s) %s in %s", strings.Join(uuids, ", "), NvidiaExposeMountDir)
+		UUID, err = singleExposeMountUUID(uuids)
+		if err != nil {
+			log.Fatal(err)
 		}
-		UUID = nvFiles[0]
 		nvidiaRuntimeUseMounts = true
 	}
 
 	log.Printf("Read UUID = %s", UUID)
 
+	/*
+	 * Some Kubernetes distributions (e.g., k3s, microk8s) keep the kubelet
+	 * and device plugin sockets under non-standard paths. Allow overriding
+	 * them, defaulting to the upstream Kubernetes locations.
+	 */
+	DevicePluginPath, exists = os.LookupEnv(DevicePluginPathEnvVar)
+	if exists == false || DevicePluginPath == "" {
+		DevicePluginPath = pluginapi.DevicePluginPath
+	}
+	KubeletSocket, exists = os.LookupEnv(KubeletSocketEnvVar)
+	if exists == false || KubeletSocket == "" {
+		KubeletSocket = pluginapi.KubeletSocket
+	}
+	/*
+	 * Validate the socket ID early, so that a misconfiguration fails fast
+	 * instead of producing a plugin that the kubelet ignores.
+	 */
+	sockID, _ := os.LookupEnv(SockIDEnvVar)
+	err = setResourceName(sockID, Millishares)
+	if err != nil {
+		log.Printf("Invalid %s", SockIDEnvVar)
+		log.Fatal(err)
+	}
+	log.Printf("Resource name = %s", resourceName)
+
+	teamSplit, _ := os.LookupEnv(TeamsEnvVar)
+	err = setTeams(strings.TrimSpace(teamSplit))
+	if err != nil {
+		log.Printf("Invalid %s", TeamsEnvVar)
+		log.Fatal(err)
+	}
+	guaranteedStr, exists := os.LookupEnv(GuaranteedDevicesEnvVar)
+	if exists == true && guaranteedStr != "" {
+		guaranteed, err := strconv.Atoi(guaranteedStr)
+		if err != nil {
+			log.Fatalf("Invalid %s: %q", GuaranteedDevicesEnvVar, guaranteedStr)
+		}
+		if teamSplit != "" {
+			log.Fatalf("Cannot split the devices into tiers with %s and among teams with %s at once", GuaranteedDevicesEnvVar, TeamsEnvVar)
+		}
+		err = setTiers(guaranteed)
+		if err != nil {
+			log.Printf("Invalid %s", GuaranteedDevicesEnvVar)
+			log.Fatal(err)
+		}
+		memoryStr, exists := os.LookupEnv(GuaranteedMemoryEnvVar)
+		if exists == true && memoryStr != "" {
+			guaranteedMemoryMiB, err = strconv.Atoi(memoryStr)
+			if err != nil || guaranteedMemoryMiB < 0 {
+				log.Fatalf("Invalid %s: %q", GuaranteedMemoryEnvVar, memoryStr)
+			}
+		}
+	}
+	for _, t := range teams {
+		if t.name != "" {
+			log.Printf("Team %s gets %d device(s) as %s", t.name, t.devices, t.resourceName)
+		}
+		if t.tier != "" {
+			log.Printf("%d device(s) are %s, as %s", t.devices, t.tier, t.resourceName)
+		}
+	}
+	if guaranteedMemoryMiB > 0 {
+		log.Printf("Reserving %d MiB of GPU memory per %s device", guaranteedMemoryMiB, TierGuaranteed)
+	}
+
+	maxNodeDevices := 0
+	maxNodeDevicesStr, exists := os.LookupEnv(MaxNodeDevicesEnvVar)
+	if exists == true && maxNodeDevicesStr != "" {
+		maxNodeDevices, err = strconv.Atoi(maxNodeDevicesStr)
+		if err != nil || maxNodeDevices < 0 {
+			log.Fatalf("Invalid %s: %q", MaxNodeDevicesEnvVar, maxNodeDevicesStr)
+		}
+	}
+	if maxNodeDevices > 0 {
+		dir, exists := os.LookupEnv(NodeDevicesDirEnvVar)
+		if exists == true && dir != "" {
+			nodeDevicesDir = dir
+		}
+		err = registerNodeDevices(maxNodeDevices)
+		if err != nil {
+			log.Printf("Refusing to advertise the devices of %s", resourceName)
+			log.Fatal(err)
+		}
+	}
+
+	sep, exists := os.LookupEnv(DeviceIDSeparatorEnvVar)
+	if exists == true {
+		err = validateDeviceIDSeparator(sep)
+		if err != nil {
+			log.Printf("Invalid %s", DeviceIDSeparatorEnvVar)
+			log.Fatal(err)
+		}
+		DeviceIDSeparator = sep
+	}
+	log.Printf("Device ID separator = %q", DeviceIDSeparator)
+
+	FallbackTimeoutMs, exists = os.LookupEnv(FallbackTimeoutEnvVar)
+	if exists == true && FallbackTimeoutMs != "" {
+		ms, err := strconv.Atoi(FallbackTimeoutMs)
+		if err != nil || ms < 0 {
+			log.Fatalf("Invalid %s: %q", FallbackTimeoutEnvVar, FallbackTimeoutMs)
+		}
+		log.Printf("libnvshare falls back to standalone mode if it can't reach the scheduler within %d ms", ms)
+	}
+
+	SchedulerAddress, _ = os.LookupEnv(SchedulerAddressEnvVar)
+	if SchedulerAddress != "" {
+		err = validateSchedulerAddress(SchedulerAddress)
+		if err != nil {
+			log.Printf("Invalid %s", SchedulerAddressEnvVar)
+			log.Fatal(err)
+		}
+		log.Printf("Containers reach the scheduler at %s, not mounting the scheduler socket", SchedulerAddress)
+	}
+
+	gracePeriod, exists := os.LookupEnv(StopGracePeriodEnvVar)
+	if exists == true && gracePeriod != "" {
+		StopGracePeriod, err = time.ParseDuration(gracePeriod)
+		if err != nil || StopGracePeriod < 0 {
+			log.Fatalf("Invalid %s: %q", StopGracePeriodEnvVar, gracePeriod)
+		}
+		log.Printf("Letting in-flight requests complete for up to %s when stopping", StopGracePeriod)
+	}
+
+	sock, exists := os.LookupEnv(PodResourcesSocketEnvVar)
+	if exists == true && sock != "" {
+		PodResourcesSocket = sock
+	}
+
+	unusedTimeoutStr, exists := os.LookupEnv(UnusedAllocationTimeoutEnvVar)
+	if exists == true && unusedTimeoutStr != "" {
+		timeout, err := time.ParseDuration(unusedTimeoutStr)
+		if err != nil || timeout < 0 {
+			log.Fatalf("Invalid %s: %q", UnusedAllocationTimeoutEnvVar, unusedTimeoutStr)
+		}
+		if timeout > 0 && Passthrough == true {
+			log.Printf("Ignoring %s in pass-through mode, where clients never register with the scheduler", UnusedAllocationTimeoutEnvVar)
+		} else if timeout > 0 {
+			schedulerSocket, exists := os.LookupEnv(SchedulerSocketEnvVar)
+			if exists == false || schedulerSocket == "" {
+				schedulerSocket = SocketHostPath
+			}
+			startUnusedAllocationsChecker(schedulerSocket, timeout)
+		}
+	}
+
+	logAllocations, _ := os.LookupEnv(LogAllocationsEnvVar)
+	if logAllocations == "1" || strings.EqualFold(logAllocations, "true") {
+		LogAllocations = true
+		log.Printf("Logging every Allocate request and response in full")
+	}
+
+	annotatePods, _ := os.LookupEnv(AnnotatePodsEnvVar)
+	if annotatePods == "1" || strings.EqualFold(annotatePods, "true") {
+		err = startPodAnnotator()
+		if err != nil {
+			log.Printf("Cannot annotate Pods, unset %s", AnnotatePodsEnvVar)
+			log.Fatal(err)
+		}
+	}
+
+	httpAddr, _ := os.LookupEnv(HTTPAddrEnvVar)
+	attributesFile, _ := os.LookupEnv(AttributesFileEnvVar)
+	if httpAddr != "" || attributesFile != "" {
+		refreshInterval := DefaultGPUInfoRefreshInterval
+		intervalStr, exists := os.LookupEnv(GPUInfoRefreshIntervalEnvVar)
+		if exists == true {
+			refreshInterval, err = time.ParseDuration(intervalStr)
+			if err != nil || refreshInterval <= 0 {
+				log.Fatalf("Invalid %s: %q", GPUInfoRefreshIntervalEnvVar, intervalStr)
+			}
+		}
+		startGPUInfoRefresher(refreshInterval)
+		if attributesFile != "" {
+			startAttributesPublisher(attributesFile, refreshInterval)
+		}
+		if httpAddr != "" {
+			startHTTPServer(httpAddr)
+		}
+	}
+
+	allocateRate, exists := os.LookupEnv(AllocateRateEnvVar)
+	if exists == true && allocateRate != "" {
+		allocateBurst, _ := os.LookupEnv(AllocateBurstEnvVar)
+		allocateLimiter, err = parseAllocateRateLimit(allocateRate, allocateBurst)
+		if err != nil {
+			log.Printf("Invalid %s or %s", AllocateRateEnvVar, AllocateBurstEnvVar)
+			log.Fatal(err)
+		}
+		if allocateLimiter != nil {
+			log.Printf("Admitting up to %s Allocate requests per second, in bursts of up to %.0f", allocateRate, allocateLimiter.burst)
+		}
+	}
+
+	cooldown, exists := os.LookupEnv(ReallocationCooldownEnvVar)
+	if exists == true && cooldown != "" {
+		reallocCooldown, err = time.ParseDuration(cooldown)
+		if err != nil || reallocCooldown < 0 {
+			log.Fatalf("Invalid %s: %q", ReallocationCooldownEnvVar, cooldown)
+		}
+		if reallocCooldown > 0 {
+			log.Printf("Holding back repeat allocations to crash-looping Pods for %s, up to %s",
+				reallocCooldown, reallocCooldown*reallocCooldownMaxFactor)
+		}
+	}
+
+	pprofPort, exists := os.LookupEnv(PprofPortEnvVar)
+	if exists == true && pprofPort != "" {
+		err = validatePprofPort(pprofPort)
+		if err != nil {
+			log.Printf("Invalid %s", PprofPortEnvVar)
+			log.Fatal(err)
+		}
+		startPprofServer(pprofPort)
+	}
+
+	maxStreams, exists := os.LookupEnv(MaxListAndWatchStreamsEnvVar)
+	if exists == true && maxStreams != "" {
+		maxListAndWatchStreams, err = strconv.Atoi(maxStreams)
+		if err != nil || maxListAndWatchStreams < 0 {
+			log.Fatalf("Invalid %s: %q", MaxListAndWatchStreamsEnvVar, maxStreams)
+		}
+	}
+
+	testPort, exists := os.LookupEnv(TestGRPCPortEnvVar)
+	if exists == true && testPort != "" {
+		testGRPCPort, err = strconv.Atoi(testPort)
+		if err != nil || testGRPCPort < 1 || testGRPCPort+len(teams)-1 > 65535 {
+			log.Fatalf("Invalid %s: %q", TestGRPCPortEnvVar, testPort)
+		}
+		/* Keep it out of production, see testGRPCPort */
+		if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			log.Fatalf("%s is only for testing outside of a cluster, refusing to start in a Pod", TestGRPCPortEnvVar)
+		}
+		log.Printf("WARNING: %s is set, serving the device plugin API on 127.0.0.1 for testing", TestGRPCPortEnvVar)
+	}
+
+	startTimeoutStr, exists := os.LookupEnv(StartTimeoutEnvVar)
+	if exists == true && startTimeoutStr != "" {
+		startTimeout, err = time.ParseDuration(startTimeoutStr)
+		if err != nil || startTimeout < 0 {
+			log.Fatalf("Invalid %s: %q", StartTimeoutEnvVar, startTimeoutStr)
+		}
+		if startTimeout > 0 {
+			log.Printf("Exiting with code %d if the device plugin fails to start for %s", startTimeoutExitCode, startTimeout)
+		}
+	}
+
+	gpuCheckInterval, exists := os.LookupEnv(GPUCheckIntervalEnvVar)
+	if exists == true && gpuCheckInterval != "" {
+		interval, err := time.ParseDuration(gpuCheckInterval)
+		if err != nil || interval < 0 {
+			log.Fatalf("Invalid %s: %q", GPUCheckIntervalEnvVar, gpuCheckInterval)
+		}
+		if interval > 0 {
+			gpuChanged = startGPUChangeChecker(interval)
+		}
+	}
+
+	healthCheckCommand, _ := os.LookupEnv(HealthCheckCommandEnvVar)
+	if healthCheckCommand != "" {
+		interval := DefaultHealthCheckInterval
+		intervalStr, exists := os.LookupEnv(HealthCheckIntervalEnvVar)
+		if exists == true && intervalStr != "" {
+			interval, err = time.ParseDuration(intervalStr)
+			if err != nil || interval <= 0 {
+				log.Fatalf("Invalid %s: %q", HealthCheckIntervalEnvVar, intervalStr)
+			}
+		}
+		timeout := DefaultHealthCheckTimeout
+		timeoutStr, exists := os.LookupEnv(HealthCheckTimeoutEnvVar)
+		if exists == true && timeoutStr != "" {
+			timeout, err = time.ParseDuration(timeoutStr)
+			if err != nil || timeout <= 0 {
+				log.Fatalf("Invalid %s: %q", HealthCheckTimeoutEnvVar, timeoutStr)
+			}
+		}
+		healthChanged = startHealthChecker(healthCheckCommand, interval, timeout)
+	}
+
+	selfCheck, _ := os.LookupEnv(SelfCheckEnvVar)
+	if selfCheck == "1" || strings.EqualFold(selfCheck, "true") {
+		interval := DefaultSelfCheckInterval
+		intervalStr, exists := os.LookupEnv(SelfCheckIntervalEnvVar)
+		if exists == true && intervalStr != "" {
+			interval, err = time.ParseDuration(intervalStr)
+			if err != nil || interval <= 0 {
+				log.Fatalf("Invalid %s: %q", SelfCheckIntervalEnvVar, intervalStr)
+			}
+		}
+		timeout := DefaultSelfCheckTimeout
+		timeoutStr, exists := os.LookupEnv(SelfCheckTimeoutEnvVar)
+		if exists == true && timeoutStr != "" {
+			timeout, err = time.ParseDuration(timeoutStr)
+			if err != nil || timeout <= 0 {
+				log.Fatalf("Invalid %s: %q", SelfCheckTimeoutEnvVar, timeoutStr)
+			}
+		}
+		selfCheckChanged = startSelfCheck(interval, timeout)
+	}
+
+	snapshotFile, _ := os.LookupEnv(DeviceSnapshotFileEnvVar)
+	if snapshotFile != "" {
+		interval := DefaultDeviceSnapshotInterval
+		intervalStr, exists := os.LookupEnv(DeviceSnapshotIntervalEnvVar)
+		if exists == true && intervalStr != "" {
+			interval, err = time.ParseDuration(intervalStr)
+			if err != nil || interval <= 0 {
+				log.Fatalf("Invalid %s: %q", DeviceSnapshotIntervalEnvVar, intervalStr)
+			}
+		}
+		startDeviceSnapshotWriter(snapshotFile, interval)
+	}
+
+	gpuCleanup, _ := os.LookupEnv(GPUCleanupEnvVar)
+	err = validateGPUCleanupMode(gpuCleanup)
+	if err != nil {
+		log.Printf("Invalid %s", GPUCleanupEnvVar)
+		log.Fatal(err)
+	}
+	cleanupGPU(UUID, gpuCleanup)
+	logDiagnostics()
+
+	log.Printf("Device plugin directory = %s", DevicePluginPath)
+	log.Printf("Kubelet socket = %s", KubeletSocket)
+	err = checkSocketDir(DevicePluginPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Println("Starting FS watcher.")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+	watchDirs := []string{DevicePluginPath}
+	if filepath.Clean(filepath.Dir(KubeletSocket)) != filepath.Clean(DevicePluginPath) {
+		watchDirs = append(watchDirs, filepath.Dir(KubeletSocket))
+	}
+	watcher, err := newFSWatcher(watchDirs...)
 	if err != nil {
 		log.Fatal("Failed to create FS watcher:", err)
 	}
@@ -130,10 +610,22 @@ func main() {
 	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 restart:
-	/* If we are restarting, stop any running plugin before recreating it */
-	devicePlugin.Stop()
+	/* If we are restarting, stop any running plugins before recreating them */
+	stopDevicePlugins(devicePlugins)
+	reregister = nil
 
-	devicePlugin = NewNvshareDevicePlugin()
+	devicePlugins = nil
+	for i, t := range teams {
+		p := NewNvshareDevicePlugin(t)
+		if testGRPCPort != 0 {
+			p.testPort = testGRPCPort + i
+		}
+		/* New devices start out healthy */
+		if unhealthy == true {
+			p.setHealth(pluginapi.Unhealthy)
+		}
+		devicePlugins = append(devicePlugins, p)
+	}
 
 	pluginStartError := make(chan struct{})
 
@@ -141,12 +633,27 @@ restart:
 	 * Start the gRPC server for the device plugin and connect it with
 	 * the kubelet.
 	 */
-	err = devicePlugin.Start()
+	attempt := time.Now()
+	err = startDevicePlugins(devicePlugins)
 	if err != nil {
 		log.Println("devicePlugin.Start() FAILED. Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
+		if failedStarts == 0 {
+			failingSince = attempt
+		}
+		failedStarts++
+		failing := time.Since(failingSince)
+		log.Printf("The device plugin has failed to start %d time(s) in a row, for %s", failedStarts, failing.Round(time.Second))
+		if startTimeout > 0 && failing >= startTimeout {
+			log.Printf("Could not start the device plugin within %s, exiting", startTimeout)
+			os.Exit(startTimeoutExitCode)
+		}
 		close(pluginStartError)
 		goto events
 	}
+	if failedStarts > 0 {
+		log.Printf("Started the device plugin after %d failed attempt(s) over %s", failedStarts, time.Since(failingSince).Round(time.Second))
+		failedStarts = 0
+	}
 
 events:
 	for {
@@ -155,10 +662,56 @@ events:
 			goto restart
 
 		case event := <-watcher.Events:
-			if (event.Name == pluginapi.KubeletSocket) && (event.Op&fsnotify.Create == fsnotify.Create) {
-				log.Printf("inotify: %s created, restarting", pluginapi.KubeletSocket)
-				goto restart
+			if (filepath.Clean(event.Name) == filepath.Clean(KubeletSocket)) && (event.Op&fsnotify.Create == fsnotify.Create) {
+				log.Printf("inotify: %s created, registering again in %s", KubeletSocket, kubeletSocketDebounce)
+				reregister = time.After(kubeletSocketDebounce)
+			}
+
+		case <-reregister:
+			reregister = nil
+			/* Try to keep serving, restart only if we must */
+			for _, p := range devicePlugins {
+				err = p.Reregister()
+				if err != nil {
+					log.Printf("Could not register device plugin again: %v. Restarting", err)
+					goto restart
+				}
+				log.Printf("Registered device plugin for '%s' with Kubelet again", p.resourceName)
+			}
+
+		case uuid := <-gpuChanged:
+			stopDevicePlugins(devicePlugins)
+			if uuid == "" {
+				log.Fatalf("Cannot tell which GPU the device plugin got, exiting. Name the GPU by its UUID in %s to have the device plugin follow it", NvidiaDevicesEnvVar)
+			}
+			log.Printf("Advertising the devices of GPU %s instead of %s", uuid, gpuUUID())
+			setGPUUUID(uuid)
+			kickDeviceSnapshot()
+			goto restart
+
+		case healthy := <-healthChanged:
+			healthFailed = !healthy
+			unhealthy = healthFailed || selfCheckFailed
+			health := pluginapi.Healthy
+			if unhealthy == true {
+				health = pluginapi.Unhealthy
+			}
+			for _, p := range devicePlugins {
+				p.setHealth(health)
+			}
+			setSnapshotHealth(health)
+
+		case healthy := <-selfCheckChanged:
+			selfCheckFailed = !healthy
+			unhealthy = healthFailed || selfCheckFailed
+			health := pluginapi.Healthy
+			if unhealthy == true {
+				health = pluginapi.Unhealthy
+			}
+			for _, p := range devicePlugins {
+				p.setHealth(health)
 			}
+			setSnapshotHealth(health)
 
 		case err := <-watcher.Errors:
 			log.Printf("inotify: %s", err)
@@ -170,7 +723,7 @@ events:
 				goto restart
 			default:
 				log.Printf("Received signal \"%v\", shutting down.", s)
-				devicePlugin.Stop()
+				stopDevicePlugins(devicePlugins)
 				break events
 			}
 		}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* Window over which we report the current allocation rate */
+const allocationRateWindow = time.Minute
+
+/* Why Allocate() failed, kept to a few values to keep the labels bounded */
+const (
+	AllocationFailureRateLimiter   = "rate_limiter"   /* Gave up waiting */
+	AllocationFailureUnknownDevice = "unknown_device" /* Not one of ours */
+	AllocationFailureCooldown      = "cooldown"       /* Gave up waiting */
+)
+
+/* Results of Allocate() calls, for the duration histogram */
+const (
+	AllocationResultSuccess = "success"
+	AllocationResultFailure = "failure"
+)
+
+/*
+ * Upper bounds of the buckets of the Allocate() duration histogram, in
+ * seconds. Allocations normally take a few milliseconds, but the rate limiter
+ * and the re-allocation cooldown may hold them back for much longer.
+ */
+var allocationDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	counts []uint64 /* Per bucket, not cumulative */
+	sum    float64
+	count  uint64
+}
+
+var metricsMutex sync.Mutex
+
+var allocationsTotal uint64
+var allocationsDelayedTotal uint64
+var allocationDelaySecondsTotal float64
+var allocationsThrottledTotal uint64
+var allocationThrottleSecondsTotal float64
+var listAndWatchRejectedTotal uint64
+
+/* Start at zero, so that alerts see every series from the start */
+var allocationFailuresTotal = map[string]uint64{
+	AllocationFailureRateLimiter:   0,
+	AllocationFailureUnknownDevice: 0,
+	AllocationFailureCooldown:      0,
+}
+
+/* How long Allocate() calls took, by result */
+var allocationDurations = map[string]*histogram{
+	AllocationResultSuccess: {counts: make([]uint64, len(allocationDurationBuckets))},
+	AllocationResultFailure: {counts: make([]uint64, len(allocationDurationBuckets))},
+}
+
+/* When recent Allocate() calls were admitted, oldest first */
+var recentAllocations []time.Time
+
+/* Drop the allocations that have fallen out of the window */
+func pruneRecentAllocations(now time.Time) {
+	i := 0
+	for i < len(recentAllocations) && now.Sub(recentAllocations[i]) > allocationRateWindow {
+		i++
+	}
+	recentAllocations = recentAllocations[i:]
+}
+
+/* Account for an admitted Allocate() call that waited for delay */
+func recordAllocation(delay time.Duration) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	now := time.Now()
+	allocationsTotal++
+	if delay > 0 {
+		allocationsDelayedTotal++
+		allocationDelaySecondsTotal += delay.Seconds()
+	}
+	pruneRecentAllocations(now)
+	recentAllocations = append(recentAllocations, now)
+}
+
+/* Account for a repeat allocation that the cooldown held back for delay */
+func recordAllocationThrottled(delay time.Duration) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	allocationsThrottledTotal++
+	allocationThrottleSecondsTotal += delay.Seconds()
+}
+
+/* Account for an Allocate() call that returned an error */
+func recordAllocationFailure(reason string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	allocationFailuresTotal[reason]++
+}
+
+/* Account for a ListAndWatch() stream we rejected at the cap */
+func recordListAndWatchRejected() {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	listAndWatchRejectedTotal++
+}
+
+/* Account for an Allocate() call that took d, successful or not */
+func recordAllocationDuration(d time.Duration, success bool) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	h := allocationDurations[AllocationResultFailure]
+	if success == true {
+		h = allocationDurations[AllocationResultSuccess]
+	}
+	for i, bound := range allocationDurationBuckets {
+		if d.Seconds() <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += d.Seconds()
+	h.count++
+}
+
+/* Serve metrics in the Prometheus text format */
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	pruneRecentAllocations(time.Now())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP nvshare_plugin_build_info The version the device plugin was built from, always 1.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_build_info gauge\n")
+	fmt.Fprintf(w, "nvshare_plugin_build_info{version=\"%s\",protocol_version=\"%s\"} 1\n", Version, ProtocolVersion)
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocations_total Number of Allocate() calls the device plugin admitted.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocations_total counter\n")
+	fmt.Fprintf(w, "nvshare_plugin_allocations_total %d\n", allocationsTotal)
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocations_delayed_total Number of Allocate() calls the rate limiter delayed.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocations_delayed_total counter\n")
+	fmt.Fprintf(w, "nvshare_plugin_allocations_delayed_total %d\n", allocationsDelayedTotal)
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocation_delay_seconds_total Time Allocate() calls spent waiting for the rate limiter.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocation_delay_seconds_total counter\n")
+	fmt.Fprintf(w, "nvshare_plugin_allocation_delay_seconds_total %.3f\n", allocationDelaySecondsTotal)
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocations_throttled_total Number of repeat allocations the re-allocation cooldown held back.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocations_throttled_total counter\n")
+	fmt.Fprintf(w, "nvshare_plugin_allocations_throttled_total %d\n", allocationsThrottledTotal)
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocation_throttle_seconds_total Time repeat allocations spent held back by the re-allocation cooldown.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocation_throttle_seconds_total counter\n")
+	fmt.Fprintf(w, "nvshare_plugin_allocation_throttle_seconds_total %.3f\n", allocationThrottleSecondsTotal)
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocation_failures_total Number of Allocate() calls that failed, by reason.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocation_failures_total counter\n")
+	reasons := make([]string, 0, len(allocationFailuresTotal))
+	for reason := range allocationFailuresTotal {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "nvshare_plugin_allocation_failures_total{reason=\"%s\"} %d\n", reason, allocationFailuresTotal[reason])
+	}
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocation_duration_seconds Time Allocate() calls took, including any waits, by result.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocation_duration_seconds histogram\n")
+	for _, result := range []string{AllocationResultFailure, AllocationResultSuccess} {
+		h := allocationDurations[result]
+		cumulative := uint64(0)
+		for i, bound := range allocationDurationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "nvshare_plugin_allocation_duration_seconds_bucket{result=\"%s\",le=\"%g\"} %d\n", result, bound, cumulative)
+		}
+		fmt.Fprintf(w, "nvshare_plugin_allocation_duration_seconds_bucket{result=\"%s\",le=\"+Inf\"} %d\n", result, h.count)
+		fmt.Fprintf(w, "nvshare_plugin_allocation_duration_seconds_sum{result=\"%s\"} %.6f\n", result, h.sum)
+		fmt.Fprintf(w, "nvshare_plugin_allocation_duration_seconds_count{result=\"%s\"} %d\n", result, h.count)
+	}
+	fmt.Fprintf(w, "# HELP nvshare_plugin_allocation_rate Allocate() calls per second over the last minute.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_allocation_rate gauge\n")
+	fmt.Fprintf(w, "nvshare_plugin_allocation_rate %.3f\n", float64(len(recentAllocations))/allocationRateWindow.Seconds())
+	fmt.Fprintf(w, "# HELP nvshare_plugin_list_and_watch_rejected_total Number of ListAndWatch() streams rejected at the cap.\n")
+	fmt.Fprintf(w, "# TYPE nvshare_plugin_list_and_watch_rejected_total counter\n")
+	fmt.Fprintf(w, "nvshare_plugin_list_and_watch_rejected_total %d\n", listAndWatchRejectedTotal)
+	if unusedTimeout > 0 {
+		fmt.Fprintf(w, "# HELP nvshare_plugin_unused_devices Devices held by containers without a registered nvshare client.\n")
+		fmt.Fprintf(w, "# TYPE nvshare_plugin_unused_devices gauge\n")
+		fmt.Fprintf(w, "nvshare_plugin_unused_devices %d\n", unusedDevices())
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * Several instances of the device plugin may run on the same node (see
+ * NVSHARE_SOCK_ID), and each one advertises its own devices, so the node may
+ * end up with many more of them than intended. With a node-wide cap, every
+ * instance records how many devices it advertises in nodeDevicesDir, as
+ * "<socket>.devices", so that the instances can add them up and refuse to go
+ * over the cap. The kubelet wipes its device plugin directory when it
+ * restarts, so we keep the records out of it.
+ */
+const nodeDevicesSuffix = ".devices"
+
+const DefaultNodeDevicesDir = "/var/run/nvshare/device-plugin"
+
+/* Shared by all instances on the node, see NodeDevicesDirEnvVar */
+var nodeDevicesDir = DefaultNodeDevicesDir
+
+/* Serializes the instances that start at the same time */
+const nodeDevicesLockName = serverSockBaseName + nodeDevicesSuffix + ".lock"
+
+/*
+ * An instance counts while its socket exists, i.e., while it serves its
+ * devices. An instance that is starting has no socket yet, so it counts
+ * while its record is recent too.
+ */
+const nodeDevicesStartupGrace = time.Minute
+
+/* How many devices the other live instances advertise, by socket */
+func otherNodeDevices(self map[string]bool) (map[string]int, error) {
+	paths, err := filepath.Glob(filepath.Join(nodeDevicesDir, "*.sock"+nodeDevicesSuffix))
+	if err != nil {
+		return nil, err
+	}
+	devices := map[string]int{}
+	for _, path := range paths {
+		socket := filepath.Join(DevicePluginPath, strings.TrimSuffix(filepath.Base(path), nodeDevicesSuffix))
+		if self[socket] == true {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		_, err = os.Stat(socket)
+		if err != nil && time.Since(fi.ModTime()) > nodeDevicesStartupGrace {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("malformed device count in %s: %q", path, data)
+		}
+		devices[filepath.Base(socket)] = n
+	}
+	return devices, nil
+}
+
+/*
+ * Record the devices we advertise and log the total for the node, or fail if
+ * we would bring the node over maxDevices. With teams, every team has a
+ * socket and a record of its own.
+ */
+func registerNodeDevices(maxDevices int) error {
+	self := map[string]bool{}
+	for _, t := range teams {
+		self[filepath.Join(DevicePluginPath, t.socketName)] = true
+	}
+	err := os.MkdirAll(nodeDevicesDir, 0755)
+	if err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(nodeDevicesDir, nodeDevicesLockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	others, err := otherNodeDevices(self)
+	if err != nil {
+		return err
+	}
+	total := NvshareVirtualDevices
+	for _, n := range others {
+		total += n
+	}
+	log.Printf("This node advertises %d nvshare devices across %d device plugin instance(s), %d of them ours",
+		total, len(others)+1, NvshareVirtualDevices)
+	if total > maxDevices {
+		return fmt.Errorf("advertising %d devices would bring this node to %d nvshare devices, over the cap of %d (other instances: %v)",
+			NvshareVirtualDevices, total, maxDevices, others)
+	}
+	for _, t := range teams {
+		path := filepath.Join(nodeDevicesDir, t.socketName) + nodeDevicesSuffix
+		err = ioutil.WriteFile(path, []byte(strconv.Itoa(t.devices)+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/* Run as an instance with devices devices, in a node of our own */
+func withNodeDevices(t *testing.T, devices int) {
+	oldDir, oldPath := nodeDevicesDir, DevicePluginPath
+	oldTeams, oldDevices := teams, NvshareVirtualDevices
+	nodeDevicesDir = filepath.Join(t.TempDir(), "records")
+	DevicePluginPath = t.TempDir()
+	teams = []team{{resourceName: resourceBaseName, socketName: "nvshare-device-plugin.sock", devices: devices}}
+	NvshareVirtualDevices = devices
+	t.Cleanup(func() {
+		nodeDevicesDir, DevicePluginPath = oldDir, oldPath
+		teams, NvshareVirtualDevices = oldTeams, oldDevices
+	})
+}
+
+/* Another instance, which advertises devices devices through socket */
+func otherInstance(t *testing.T, socket string, devices int, live bool, age time.Duration) {
+	record := filepath.Join(nodeDevicesDir, socket+nodeDevicesSuffix)
+	err := os.MkdirAll(nodeDevicesDir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(record, []byte(strconv.Itoa(devices)+"\n"), 0644)
+	}
+	if err == nil {
+		mtime := time.Now().Add(-age)
+		err = os.Chtimes(record, mtime, mtime)
+	}
+	if err == nil && live {
+		err = ioutil.WriteFile(filepath.Join(DevicePluginPath, socket), nil, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterNodeDevices(t *testing.T) {
+	withNodeDevices(t, 4)
+	otherInstance(t, "nvshare-device-plugin-a.sock", 3, true, time.Hour)
+
+	err := registerNodeDevices(7)
+	if err != nil {
+		t.Fatalf("registerNodeDevices(7) failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(nodeDevicesDir, "nvshare-device-plugin.sock"+nodeDevicesSuffix))
+	if err != nil || string(data) != "4\n" {
+		t.Errorf("record = %q (%v), want \"4\\n\"", data, err)
+	}
+	/* The kubelet owns its directory */
+	entries, err := ioutil.ReadDir(DevicePluginPath)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("device plugin directory has %d entries (%v), want only the socket of the other instance", len(entries), err)
+	}
+}
+
+func TestRegisterNodeDevicesOverCap(t *testing.T) {
+	withNodeDevices(t, 4)
+	otherInstance(t, "nvshare-device-plugin-a.sock", 3, true, time.Hour)
+
+	if err := registerNodeDevices(6); err == nil {
+		t.Fatalf("registerNodeDevices(6) succeeded, want error")
+	}
+	if _, err := os.Stat(filepath.Join(nodeDevicesDir, "nvshare-device-plugin.sock"+nodeDevicesSuffix)); err == nil {
+		t.Errorf("an instance over the cap recorded its devices")
+	}
+}
+
+/* Instances count while they serve, or while they start */
+func TestRegisterNodeDevicesLiveness(t *testing.T) {
+	withNodeDevices(t, 4)
+	otherInstance(t, "nvshare-device-plugin-gone.sock", 9, false, time.Hour)
+	otherInstance(t, "nvshare-device-plugin-starting.sock", 3, false, 0)
+
+	if err := registerNodeDevices(7); err != nil {
+		t.Fatalf("registerNodeDevices(7) failed: %v", err)
+	}
+	withNodeDevices(t, 4)
+	otherInstance(t, "nvshare-device-plugin-starting.sock", 3, false, 0)
+	if err := registerNodeDevices(6); err == nil {
+		t.Fatalf("registerNodeDevices(6) succeeded with an instance that is starting, want error")
+	}
+}
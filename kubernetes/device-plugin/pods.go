@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const DefaultPodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+/* How long to wait for the kubelet to list the Pod resources */
+const podResourcesTimeout = 10 * time.Second
+
+var PodResourcesSocket = DefaultPodResourcesSocket
+
+/* A container that holds devices of our resource */
+type PodAllocation struct {
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container"`
+	DeviceIDs []string `json:"deviceIDs"`
+	/* Only in millishares mode */
+	Millishares int `json:"millishares,omitempty"`
+	/* Only with teams or tiers, see teams.go */
+	Team string `json:"team,omitempty"`
+	Tier string `json:"tier,omitempty"`
+}
+
+type PodAllocations struct {
+	ResourceName string          `json:"resourceName"`
+	UUID         string          `json:"uuid"`
+	Allocations  []PodAllocation `json:"allocations"`
+}
+
+/*
+ * Only the kubelet knows which Pod each allocation belongs to, as Allocate()
+ * doesn't tell us. Ask it through its PodResources API.
+ */
+func listPodAllocations() (*PodAllocations, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, PodResourcesSocket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the kubelet PodResources API at %s: %v", PodResourcesSocket, err)
+	}
+	defer conn.Close()
+
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list Pod resources: %v", err)
+	}
+
+	allocs := &PodAllocations{
+		ResourceName: resourceName,
+		UUID:         gpuUUID(),
+		Allocations:  []PodAllocation{},
+	}
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			var ids []string
+			for _, dev := range container.GetDevices() {
+				if isOurResource(dev.GetResourceName()) == true {
+					ids = append(ids, dev.GetDeviceIds()...)
+				}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			sort.Strings(ids)
+			alloc := PodAllocation{
+				Namespace: pod.GetNamespace(),
+				Pod:       pod.GetName(),
+				Container: container.GetName(),
+				DeviceIDs: ids,
+			}
+			if Millishares == true {
+				alloc.Millishares = len(ids)
+			}
+			if _, ordinal, err := parseDeviceID(ids[0]); err == nil {
+				alloc.Team = teamOfOrdinal(ordinal)
+				alloc.Tier = tierOfOrdinal(ordinal)
+			}
+			allocs.Allocations = append(allocs.Allocations, alloc)
+		}
+	}
+	return allocs, nil
+}
+
+func servePodAllocations(w http.ResponseWriter, r *http.Request) {
+	allocs, err := listPodAllocations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	out, err := json.MarshalIndent(allocs, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(out, '\n'))
+}
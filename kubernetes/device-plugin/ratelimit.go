@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+/*
+ * A token bucket that admits Allocate() calls at a controlled pace, so that
+ * a burst of Pods landing on the node doesn't hit the device plugin and the
+ * scheduler all at once. Excess calls wait for their turn instead of failing.
+ */
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 /* Tokens per second */
+	burst  float64
+	tokens float64 /* Negative when callers are waiting */
+	last   time.Time
+}
+
+/* A nil *rateLimiter admits everything */
+var allocateLimiter *rateLimiter
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func parseAllocateRateLimit(rateStr string, burstStr string) (*rateLimiter, error) {
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate < 0 {
+		return nil, fmt.Errorf("allocation rate %q is not a non-negative number", rateStr)
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	burst := 1
+	if burstStr != "" {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("allocation burst %q is not a positive integer", burstStr)
+		}
+	}
+	return newRateLimiter(rate, burst), nil
+}
+
+/*
+ * Wait until the caller may go ahead, or until ctx is done. Return how long
+ * the caller had to wait.
+ */
+func (l *rateLimiter) Wait(ctx context.Context) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	/* Take our token now, even if it's not there yet, to keep our turn */
+	l.tokens--
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if wait == 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return wait, nil
+	case <-ctx.Done():
+		/* Give back our token, we won't use it */
+		l.mutex.Lock()
+		l.tokens++
+		l.mutex.Unlock()
+		return 0, ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+/*
+ * As PID 1 of a minimal container, we inherit every orphaned process in the
+ * container, e.g., whatever nvidia-smi leaves behind, and they pile up as
+ * zombies unless we reap them. Reaping any child would also steal the exit
+ * status of the commands we run ourselves, so commands run under a read
+ * lock, see runCommand(), and the reaper only reaps while none is running.
+ */
+var commandLock sync.RWMutex
+
+/* Run a command, e.g., runCommand(exec.Command(...).Output) */
+func runCommand(run func() ([]byte, error)) ([]byte, error) {
+	commandLock.RLock()
+	defer commandLock.RUnlock()
+	return run()
+}
+
+func reapOrphans() {
+	commandLock.Lock()
+	defer commandLock.Unlock()
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+		log.Printf("Reaped orphaned process %d (status %d)", pid, status)
+	}
+}
+
+/* Reap orphaned processes on every SIGCHLD, if we run as PID 1 */
+func startReaper() {
+	if os.Getpid() != 1 {
+		return
+	}
+	log.Printf("Running as PID 1, reaping orphaned processes")
+	sigs := newOSWatcher(syscall.SIGCHLD)
+	go func() {
+		for range sigs {
+			reapOrphans()
+		}
+	}()
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+/*
+ * Unlike the health checks of the NVIDIA device plugin, which only look at
+ * the GPU, the self-check runs a tiny CUDA program under libnvshare
+ * (nvshare-selfcheck) and checks that libnvshare intercepts it, that it
+ * registers with the scheduler and gets the GPU lock, and that it can
+ * allocate GPU memory and run a kernel. This catches a broken libnvshare or
+ * scheduler before Pods do. If set, we run it at startup and mark all of our
+ * devices unhealthy while it fails, retrying every interval until it passes.
+ * It takes the GPU lock like any other client, so it is off by default.
+ */
+const (
+	DefaultSelfCheckInterval = time.Minute
+	/* It may have to wait for the GPU lock, for up to a time quantum */
+	DefaultSelfCheckTimeout = 5 * time.Minute
+)
+
+const SelfCheckCommand = "nvshare-selfcheck"
+
+/* Run the self-check once, against the scheduler that our containers use */
+func runSelfCheck(timeout time.Duration) error {
+	address := SchedulerAddress
+	if address == "" {
+		address = os.Getenv(SchedulerSocketEnvVar)
+	}
+	if address == "" {
+		address = SocketHostPath
+	}
+	cmd := exec.Command(SelfCheckCommand)
+	cmd.Env = append(os.Environ(),
+		"LD_PRELOAD="+LibNvshareContainerPath,
+		SchedulerAddressEnvVar+"="+address)
+	return runCheck(cmd, timeout)
+}
+
+/*
+ * Run the self-check until it passes and send whether our devices are
+ * healthy on the returned channel whenever it changes. They start out
+ * healthy.
+ */
+func startSelfCheck(interval, timeout time.Duration) <-chan bool {
+	changed := make(chan bool, 1)
+	log.Printf("Running %s at startup, with a timeout of %s", SelfCheckCommand, timeout)
+	go func() {
+		healthy := true
+		for {
+			err := runSelfCheck(timeout)
+			if err == nil {
+				log.Printf("Self-check passed")
+				if healthy == false {
+					log.Printf("Marking the devices of %s healthy again", resourceName)
+					changed <- true
+				}
+				return
+			}
+			log.Printf("Self-check failed: %v. Retrying in %s", err, interval)
+			if healthy == true {
+				healthy = false
+				log.Printf("Marking the devices of %s unhealthy", resourceName)
+				changed <- false
+			}
+			time.Sleep(interval)
+		}
+	}()
+	return changed
+}
@@ -20,8 +20,14 @@ package main
 import (
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -32,38 +38,196 @@ import (
 )
 
 const (
-	resourceName = "nvshare.com/gpu"
-	serverSock   = pluginapi.DevicePluginPath + "nvshare-device-plugin.sock"
+	resourceDomain     = "nvshare.com"
+	resourceBaseName   = "gpu"
+	serverSockBaseName = "nvshare-device-plugin"
+	/* Maximum length of the name part of an extended resource name */
+	resourceNameMaxLen = 63
 )
 
-type NvshareDevicePlugin struct {
-	devs   []*pluginapi.Device
-	socket string
+/*
+ * In millishares mode, we advertise every physical GPU as MillisharesPerGPU
+ * devices of this resource instead.
+ */
+const millisharesResourceBaseName = "gpu-millishares"
+
+/*
+ * Deadline for a whole registration attempt with the kubelet, and how much
+ * longer we wait for the attempt to return before we give up on it.
+ */
+const (
+	registerTimeout     = 10 * time.Second
+	registerGracePeriod = 2 * time.Second
+)
+
+/*
+ * The resource name and socket file name depend on the (optional) socket ID,
+ * see setResourceName().
+ */
+var resourceName = resourceDomain + "/" + resourceBaseName
+var serverSockName = serverSockBaseName + ".sock"
+
+/*
+ * A socket ID must be usable as part of the name of an extended resource,
+ * which is a Kubernetes qualified name.
+ */
+var sockIDRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9_.]*[a-z0-9])?$`)
+
+/*
+ * Normalize and validate a socket ID.
+ *
+ * We ignore surrounding whitespace and case, as the kubelet would otherwise
+ * silently ignore a plugin that advertises an invalid resource name.
+ */
+func normalizeSockID(sockID string, baseName string) (string, error) {
+	id := strings.ToLower(strings.TrimSpace(sockID))
+	if id == "" {
+		return "", fmt.Errorf("socket ID %q is empty", sockID)
+	}
+	if !sockIDRegexp.MatchString(id) {
+		return "", fmt.Errorf("socket ID %q is invalid: it must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character", sockID)
+	}
+	name := baseName + "-" + id
+	if len(name) > resourceNameMaxLen {
+		return "", fmt.Errorf("socket ID %q is too long: resource name %q exceeds %d characters", sockID, name, resourceNameMaxLen)
+	}
+	return id, nil
+}
+
+/*
+ * Derive the resource name and socket file name from the socket ID and the
+ * mode, which allows running multiple instances of the device plugin on the
+ * same node.
+ *
+ * An empty socket ID keeps the defaults of the mode.
+ */
+func setResourceName(sockID string, millishares bool) error {
+	baseName := resourceBaseName
+	sockBaseName := serverSockBaseName
+	if millishares {
+		baseName = millisharesResourceBaseName
+		sockBaseName = serverSockBaseName + "-millishares"
+	}
+	resourceName = resourceDomain + "/" + baseName
+	serverSockName = sockBaseName + ".sock"
+	if sockID == "" {
+		return nil
+	}
+	id, err := normalizeSockID(sockID, baseName)
+	if err != nil {
+		return err
+	}
+	resourceName = resourceDomain + "/" + baseName + "-" + id
+	serverSockName = sockBaseName + "-" + id + ".sock"
+	return nil
+}
+
+/*
+ * libnvshare reaches the scheduler at the path of a UNIX socket, at
+ * "@<name>" for a socket in the abstract namespace, or at "tcp:<host>:<port>".
+ * The address must fit in the path of a UNIX socket.
+ */
+const schedulerAddressMaxLen = 107
+
+func validateSchedulerAddress(addr string) error {
+	if len(addr) > schedulerAddressMaxLen {
+		return fmt.Errorf("scheduler address %q is longer than %d characters", addr, schedulerAddressMaxLen)
+	}
+	switch {
+	case strings.HasPrefix(addr, "tcp:"):
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(addr, "tcp:"))
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("scheduler address %q must be of the form tcp:<host>:<port>", addr)
+		}
+	case strings.HasPrefix(addr, "@"):
+		if len(addr) == 1 {
+			return fmt.Errorf("scheduler address %q lacks the name of the abstract socket", addr)
+		}
+	case filepath.IsAbs(addr) == false:
+		return fmt.Errorf("scheduler address %q must be an absolute path, @<name> or tcp:<host>:<port>", addr)
+	}
+	return nil
+}
+
+/*
+ * For testing Allocate() and ListAndWatch() outside of a cluster, without a
+ * kubelet, the gRPC server can also listen on TCP, on the loopback interface
+ * only. The device plugin of the i-th team listens on testGRPCPort + i. 0,
+ * the default, means off. Never set it in production, the TCP port takes no
+ * credentials, so any process on the host could allocate devices through it.
+ */
+var testGRPCPort int
 
-	stop   chan interface{}
+/*
+ * The kubelet keeps a single ListAndWatch() stream per device plugin open,
+ * and opens a new one when it restarts. A client that opens streams without
+ * ever closing them would pile up goroutines, so we reject streams beyond
+ * maxListAndWatchStreams per device plugin. 0 means no cap.
+ */
+const DefaultMaxListAndWatchStreams = 4
+
+var maxListAndWatchStreams = DefaultMaxListAndWatchStreams
+
+type NvshareDevicePlugin struct {
+	resourceName string
+	tier         string /* See setTiers() */
+	first        int    /* Ordinal of devs[0] */
+	devs         []*pluginapi.Device
+	socket       string
+	testPort     int /* See testGRPCPort */
+
+	stop chan interface{}
+	/*
+	 * Kicks ListAndWatch() with a device whose health has changed, see
+	 * setHealth(). It sends the whole list anyway, so one pending kick
+	 * is enough.
+	 */
 	health chan *pluginapi.Device
+	/* Guards the health of devs */
+	healthMutex sync.Mutex
 
 	server *grpc.Server
+
+	/*
+	 * Device IDs we've allocated and that, as far as we know, a
+	 * container still holds. The kubelet may allocate the same device
+	 * again when a container restarts. See recordAllocation().
+	 */
+	allocatedMutex sync.Mutex
+	allocated      map[string]bool
+
+	/* Open ListAndWatch() streams, and those we rejected at the cap */
+	streamsMutex    sync.Mutex
+	streams         int
+	streamsRejected int
 }
 
-func NewNvshareDevicePlugin() *NvshareDevicePlugin {
+/* A device plugin for the resource of a team, see teams.go */
+func NewNvshareDevicePlugin(t team) *NvshareDevicePlugin {
 	return &NvshareDevicePlugin{
-		devs:   getDevices(),
-		socket: serverSock,
+		resourceName: t.resourceName,
+		tier:         t.tier,
+		first:        t.first,
+		devs:         getDevices(t.first, t.devices),
+		socket:       filepath.Join(DevicePluginPath, t.socketName),
 
 		stop:   make(chan interface{}),
-		health: make(chan *pluginapi.Device),
+		health: make(chan *pluginapi.Device, 1),
+
+		allocated: make(map[string]bool),
 	}
 }
 
 func (m *NvshareDevicePlugin) initialize() {
 	m.server = grpc.NewServer([]grpc.ServerOption{}...)
-	m.health = make(chan *pluginapi.Device)
+	m.health = make(chan *pluginapi.Device, 1)
 	m.stop = make(chan interface{})
 }
 
 func (m *NvshareDevicePlugin) cleanup() {
-	close(m.stop)
+	if m.stop != nil {
+		close(m.stop)
+	}
 	m.server = nil
 	m.health = nil
 	m.stop = nil
@@ -77,19 +241,23 @@ func (m *NvshareDevicePlugin) Start() error {
 
 	err := m.Serve()
 	if err != nil {
-		log.Printf("Could not start device plugin for '%s': %s", resourceName, err)
+		log.Printf("Could not start device plugin for '%s': %s", m.resourceName, err)
 		m.cleanup()
 		return err
 	}
-	log.Printf("Starting to serve '%s' on %s", resourceName, m.socket)
+	log.Printf("Starting to serve '%s' on %s", m.resourceName, m.socket)
 
 	err = m.Register()
+	if err != nil && m.testPort != 0 {
+		log.Printf("Could not register device plugin: %s. Serving '%s' on port %d for testing anyway", err, m.resourceName, m.testPort)
+		return nil
+	}
 	if err != nil {
 		log.Printf("Could not register device plugin: %s", err)
 		m.Stop()
 		return err
 	}
-	log.Printf("Registered device plugin for '%s' with Kubelet", resourceName)
+	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
 
 	return nil
 }
@@ -99,8 +267,11 @@ func (m *NvshareDevicePlugin) Stop() error {
 	if (m == nil) || (m.server == nil) {
 		return nil
 	}
-	log.Printf("Stopping to serve '%s' on %s\n", resourceName, m.socket)
-	m.server.Stop()
+	log.Printf("Stopping to serve '%s' on %s\n", m.resourceName, m.socket)
+	/* ListAndWatch() streams until we tell it to stop */
+	close(m.stop)
+	m.stopServer()
+	m.stop = nil
 	err := os.Remove(m.socket)
 	if (err != nil) && (!os.IsNotExist(err)) {
 		return err
@@ -109,6 +280,54 @@ func (m *NvshareDevicePlugin) Stop() error {
 	return nil
 }
 
+/*
+ * Stopping the server aborts in-flight RPCs, failing, e.g., the Allocate()
+ * call of a Pod that is starting. With a grace period, let them finish first,
+ * but stop the server anyway once the grace period is over.
+ */
+func (m *NvshareDevicePlugin) stopServer() {
+	if StopGracePeriod <= 0 {
+		m.server.Stop()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		m.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(StopGracePeriod):
+		log.Printf("In-flight requests did not complete within %s, stopping the server", StopGracePeriod)
+		m.server.Stop()
+		<-done
+	}
+}
+
+/*
+ * Make sure that we can create our socket in the device plugin directory.
+ *
+ * On hardened nodes, the directory may be missing or mounted read-only, and
+ * net.Listen() would fail with an obscure error, so check it upfront and
+ * tell the user what to fix.
+ */
+func checkSocketDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("device plugin directory %s is not accessible: %v. Make sure that it exists on the node and is mounted into the device plugin container, or set %s to the right path", dir, err, DevicePluginPathEnvVar)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("device plugin directory %s is not a directory. Set %s to the directory in which the kubelet expects device plugin sockets", dir, DevicePluginPathEnvVar)
+	}
+	f, err := ioutil.TempFile(dir, ".nvshare-write-check-")
+	if err != nil {
+		return fmt.Errorf("device plugin directory %s is not writable: %v. Make sure that it is mounted read-write into the device plugin container", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
 /* Starts the gRPC server which serves incoming requests from kubelet */
 func (m *NvshareDevicePlugin) Serve() error {
 	os.Remove(m.socket)
@@ -116,24 +335,43 @@ func (m *NvshareDevicePlugin) Serve() error {
 	if err != nil {
 		return err
 	}
+	var testSock net.Listener
+	if m.testPort != 0 {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(m.testPort))
+		testSock, err = net.Listen("tcp", addr)
+		if err != nil {
+			sock.Close()
+			return fmt.Errorf("could not listen on %s for testing: %v", addr, err)
+		}
+		log.Printf("WARNING: Also serving '%s' on %s, for testing only", m.resourceName, addr)
+	}
 
 	pluginapi.RegisterDevicePluginServer(m.server, m)
 
+	if testSock != nil {
+		go func() {
+			err := m.server.Serve(testSock)
+			if err != nil {
+				log.Printf("Test gRPC server for '%s' failed: %v", m.resourceName, err)
+			}
+		}()
+	}
+
 	go func() {
 		lastCrashTime := time.Now()
 		restartCount := 0
 		for {
-			log.Printf("Starting gRPC server for '%s'", resourceName)
+			log.Printf("Starting gRPC server for '%s'", m.resourceName)
 			err := m.server.Serve(sock)
 			if err == nil {
 				break
 			}
 
 			log.Printf("GRPC server for '%s' crashed with error: %v",
-				resourceName, err)
+				m.resourceName, err)
 
 			if restartCount > 5 {
-				log.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", resourceName)
+				log.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", m.resourceName)
 			}
 			timeSinceLastCrash := time.Since(lastCrashTime).Seconds()
 			lastCrashTime = time.Now()
@@ -154,9 +392,38 @@ func (m *NvshareDevicePlugin) Serve() error {
 	return nil
 }
 
-/* Registers the device plugin for resourceName with kubelet */
+/*
+ * Registers the device plugin for its resource with kubelet.
+ *
+ * The restart loop in main() waits on us, so bound the whole attempt, dial
+ * included, with a deadline. A kubelet that accepts connections but never
+ * answers must not stall it, so don't rely on gRPC honoring the deadline
+ * either: give up on the attempt shortly after it expires.
+ */
 func (m *NvshareDevicePlugin) Register() error {
-	conn, err := m.dial(pluginapi.KubeletSocket, 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), registerTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- m.register(ctx)
+	}()
+	select {
+	case err := <-done:
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Registration with the kubelet exceeded its deadline of %s", registerTimeout)
+		}
+		return err
+	case <-time.After(registerTimeout + registerGracePeriod):
+		log.Printf("Registration with the kubelet exceeded its deadline of %s and hasn't returned after %s, giving up on it",
+			registerTimeout, time.Since(start).Round(time.Millisecond))
+		return fmt.Errorf("registration with the kubelet timed out after %s", registerTimeout)
+	}
+}
+
+func (m *NvshareDevicePlugin) register(ctx context.Context) error {
+	conn, err := m.dialContext(ctx, KubeletSocket)
 	if err != nil {
 		return err
 	}
@@ -166,19 +433,35 @@ func (m *NvshareDevicePlugin) Register() error {
 	reqt := &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(m.socket),
-		ResourceName: resourceName,
+		ResourceName: m.resourceName,
 		Options: &pluginapi.DevicePluginOptions{
 			GetPreferredAllocationAvailable: false,
 		},
 	}
 
-	_, err = client.Register(context.Background(), reqt)
+	_, err = client.Register(ctx, reqt)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+/*
+ * Register again with a restarted kubelet, keeping the gRPC server up so that
+ * we don't stop advertising our devices. This only works if the kubelet has
+ * left our socket in place.
+ */
+func (m *NvshareDevicePlugin) Reregister() error {
+	if (m == nil) || (m.server == nil) {
+		return fmt.Errorf("the gRPC server is not running")
+	}
+	_, err := os.Stat(m.socket)
+	if err != nil {
+		return fmt.Errorf("socket %s is gone: %v", m.socket, err)
+	}
+	return m.Register()
+}
+
 
 func (m *NvshareDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	options := &pluginapi.DevicePluginOptions{
@@ -188,12 +471,33 @@ func (m *NvshareDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi
 	return options, nil
 }
 
+/* Mark all devices healthy or unhealthy and tell ListAndWatch() */
+func (m *NvshareDevicePlugin) setHealth(health string) {
+	var changed *pluginapi.Device
+
+	m.healthMutex.Lock()
+	defer m.healthMutex.Unlock()
+	for _, dev := range m.devs {
+		if dev.Health != health {
+			dev.Health = health
+			changed = dev
+		}
+	}
+	if changed == nil {
+		return
+	}
+	select {
+	case m.health <- changed:
+	default:
+	}
+}
+
 /*
- * Reports available devices to kubelet and (theoretically) updates that list
- * according to their health status.
+ * Reports available devices to kubelet and updates that list according to
+ * their health status.
  *
- * We don't monitor health for Nvshare devices at the moment, we consider them
- * all to be healthy.
+ * All devices share the GPU, so they are all healthy, unless the health
+ * check of NVSHARE_HEALTH_CHECK_COMMAND fails, see healthcheck.go.
  *
  * If the underlying GPU goes unhealthy, NVIDIA's device
  * plugin will detect it and fail the (Nvshare device plugin) Pod.
@@ -202,12 +506,112 @@ func (m *NvshareDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi
  * https://github.com/kubernetes/community/blob/c4466d9fbfa6645410083e37560810a9aa000267/contributors/design-proposals/resource-management/device-plugin.md#healthcheck-and-failure-recovery
  */
 func (m *NvshareDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	err := m.openStream()
+	if err != nil {
+		return err
+	}
+	defer m.closeStream()
+
+	m.healthMutex.Lock()
 	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+	m.healthMutex.Unlock()
 	log.Printf("Sent ListAndWatchResponse with DeviceIDs")
 	for {
 		select {
+		case dev := <-m.health:
+			m.healthMutex.Lock()
+			log.Printf("Devices of '%s' are now %s, sending ListAndWatchResponse", m.resourceName, dev.Health)
+			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+			m.healthMutex.Unlock()
 		case <-m.stop:
 			return nil
+		/* The kubelet went away, e.g., it restarted */
+		case <-s.Context().Done():
+			return nil
+		}
+	}
+}
+
+/* Account for a new ListAndWatch() stream, unless we're at the cap */
+func (m *NvshareDevicePlugin) openStream() error {
+	m.streamsMutex.Lock()
+	defer m.streamsMutex.Unlock()
+	if maxListAndWatchStreams > 0 && m.streams >= maxListAndWatchStreams {
+		if m.streamsRejected == 0 {
+			log.Printf("'%s' has reached the cap of %d ListAndWatch streams, rejecting new ones", m.resourceName, maxListAndWatchStreams)
+		}
+		m.streamsRejected++
+		recordListAndWatchRejected()
+		return fmt.Errorf("too many ListAndWatch streams for '%s', at most %d may be open", m.resourceName, maxListAndWatchStreams)
+	}
+	m.streams++
+	return nil
+}
+
+func (m *NvshareDevicePlugin) closeStream() {
+	m.streamsMutex.Lock()
+	defer m.streamsMutex.Unlock()
+	m.streams--
+	if m.streamsRejected > 0 {
+		log.Printf("'%s' is below the cap of %d ListAndWatch streams again, after rejecting %d", m.resourceName, maxListAndWatchStreams, m.streamsRejected)
+		m.streamsRejected = 0
+	}
+}
+
+/*
+ * Record an allocation of devices ids and tell whether it repeats one of
+ * ours, i.e., whether its container has restarted. A container that
+ * restarts keeps its devices, so the kubelet still reports them allocated.
+ * Devices it no longer reports have been freed, e.g., because their Pod went
+ * away, and may go to another Pod, so we forget them. We only ask the
+ * kubelet if we have allocated one of the devices before.
+ */
+func (m *NvshareDevicePlugin) recordAllocation(ids []string) bool {
+	m.allocatedMutex.Lock()
+	seen := false
+	for _, id := range ids {
+		seen = seen || m.allocated[id]
+	}
+	m.allocatedMutex.Unlock()
+
+	/* Ask the kubelet outside of allocatedMutex, it may take a while */
+	var held *PodAllocations
+	if seen == true {
+		allocs, err := listPodAllocations()
+		if err != nil {
+			log.Printf("Could not tell whether devices %v are still allocated, assuming they are: %v", ids, err)
+		} else {
+			held = allocs
+		}
+	}
+
+	m.allocatedMutex.Lock()
+	defer m.allocatedMutex.Unlock()
+	if held != nil {
+		forgetFreedDevices(m.allocated, held)
+	}
+	repeat := false
+	for _, id := range ids {
+		if m.allocated[id] {
+			log.Printf("Device %s allocated again, its container has probably restarted", id)
+			repeat = true
+		}
+		m.allocated[id] = true
+	}
+	return repeat
+}
+
+/* Forget the devices in allocated that no container in held holds */
+func forgetFreedDevices(allocated map[string]bool, held *PodAllocations) {
+	holds := map[string]bool{}
+	for _, alloc := range held.Allocations {
+		for _, id := range alloc.DeviceIDs {
+			holds[id] = true
+		}
+	}
+	for id := range allocated {
+		if holds[id] == false {
+			delete(allocated, id)
 		}
 	}
 }
@@ -216,24 +620,115 @@ func (m *NvshareDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.Devic
  * Kubelet calls this method when it wants to run containers in a Pod that
  * has requested an Nvshare GPU.
  */
-func (m *NvshareDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+func (m *NvshareDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (_ *pluginapi.AllocateResponse, err error) {
+	start := time.Now()
+	defer func() {
+		recordAllocationDuration(time.Since(start), err == nil)
+	}()
 	log.SetOutput(os.Stderr)
+	if LogAllocations == true {
+		logAllocation("request", reqs)
+	}
+	delay, err := allocateLimiter.Wait(ctx)
+	if err != nil {
+		recordAllocationFailure(AllocationFailureRateLimiter)
+		return nil, fmt.Errorf("allocation request for '%s' gave up waiting for the rate limiter: %v", m.resourceName, err)
+	}
+	if delay > 0 {
+		log.Printf("Rate limiter delayed Allocate request by %s", delay.Round(time.Millisecond))
+	}
+	recordAllocation(delay)
 	responses := pluginapi.AllocateResponse{}
 	for _, req := range reqs.ContainerRequests {
+		/*
+		 * Only containers that were granted a device get libnvshare and
+		 * the scheduler socket, so that sidecars in the same Pod don't
+		 * become spurious clients.
+		 */
+		if len(req.DevicesIDs) == 0 {
+			responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{})
+			continue
+		}
 		for _, id := range req.DevicesIDs {
 			log.Printf("Received Allocate request for %s", id)
 			if !m.deviceExists(id) {
-				return nil, fmt.Errorf("invalid allocation request for '%s' - unknown device: %s", resourceName, id)
+				recordAllocationFailure(AllocationFailureUnknownDevice)
+				return nil, fmt.Errorf("invalid allocation request for '%s' - unknown device: %s", m.resourceName, id)
 			}
 		}
+		/*
+		 * The response only depends on the requested devices, so a
+		 * repeat allocation (e.g., after a container restart) gets the
+		 * same response as the original one.
+		 */
+		repeat := m.recordAllocation(req.DevicesIDs)
+		err = waitReallocationCooldown(ctx, req.DevicesIDs, repeat)
+		if err != nil {
+			recordAllocationFailure(AllocationFailureCooldown)
+			return nil, fmt.Errorf("allocation request for '%s' gave up waiting for the re-allocation cooldown: %v", m.resourceName, err)
+		}
 
 		response := pluginapi.ContainerAllocateResponse{}
 
 		var envsMap map[string]string
 		envsMap = make(map[string]string)
+		/*
+		 * An LD_PRELOAD in the container spec overrides ours. We can't
+		 * combine the two here, as the kubelet doesn't tell us which
+		 * container we allocate for, so we see neither its LD_PRELOAD
+		 * nor the annotations of its Pod. The admission webhook adds
+		 * libnvshare to it instead, at the position the
+		 * nvshare.com/preload-order annotation of the Pod asks for.
+		 */
 		envsMap["LD_PRELOAD"] = LibNvshareContainerPath
+		/*
+		 * Let libnvshare detect version skew between itself and the
+		 * nvshare components on the node, e.g., during a rolling upgrade.
+		 */
+		envsMap[ProtocolVersionEnvVar] = ProtocolVersion
+		if FallbackTimeoutMs != "" {
+			envsMap[FallbackTimeoutEnvVar] = FallbackTimeoutMs
+		}
+		/*
+		 * Tell libnvshare which device slot its container uses, so that
+		 * the scheduler can recognize a restarted container and evict
+		 * the client of its previous instance. libnvshare also stays
+		 * inert in containers without a slot.
+		 */
+		_, ordinal, _ := parseDeviceID(req.DevicesIDs[0])
+		envsMap[DeviceSlotEnvVar] = strconv.Itoa(ordinal)
+		/*
+		 * In millishares mode, every device is a thousandth of the GPU.
+		 * The scheduler scales the slices of the container by its
+		 * share.
+		 */
+		if Millishares == true {
+			envsMap[MillisharesEnvVar] = strconv.Itoa(len(req.DevicesIDs))
+		}
+		/*
+		 * The container has the GPU to itself, so skip the handshake
+		 * with the scheduler and never give up the GPU.
+		 */
+		if Passthrough == true {
+			envsMap[StandaloneEnvVar] = "1"
+		}
+		if SchedulerAddress != "" {
+			envsMap[SchedulerAddressEnvVar] = SchedulerAddress
+		}
+		/*
+		 * Guaranteed devices come with their GPU memory reserved and
+		 * a workload type the scheduler doesn't preempt. The container
+		 * spec may still override both.
+		 */
+		if m.tier == TierGuaranteed {
+			envsMap[WorkloadTypeEnvVar] = TierGuaranteed
+			if guaranteedMemoryMiB > 0 {
+				envsMap[ReserveMemoryEnvVar] = strconv.Itoa(guaranteedMemoryMiB * len(req.DevicesIDs))
+			}
+		}
+		uuid := gpuUUID()
 		if nvidiaRuntimeUseMounts == false {
-			envsMap[NvidiaDevicesEnvVar] = UUID
+			envsMap[NvidiaDevicesEnvVar] = uuid
 		} else {
 			envsMap[NvidiaDevicesEnvVar] = NvidiaExposeMountDir
 		}
@@ -249,13 +744,15 @@ func (m *NvshareDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 			ReadOnly:      true,
 		}
 		mounts = append(mounts, mount)
-		/* Mount scheduler socket */
-		mount = &pluginapi.Mount{
-			HostPath:      SocketHostPath,
-			ContainerPath: SocketContainerPath,
-			ReadOnly:      true,
+		/* Mount scheduler socket, unless containers reach it elsewhere */
+		if SchedulerAddress == "" {
+			mount = &pluginapi.Mount{
+				HostPath:      SocketHostPath,
+				ContainerPath: SocketContainerPath,
+				ReadOnly:      true,
+			}
+			mounts = append(mounts, mount)
 		}
-		mounts = append(mounts, mount)
 		/*
 		 * If the method for requesting GPUs from the underlying NVIDIA
 		 * container runtime is through Volume Mounts, set symbolic /dev/null
@@ -264,7 +761,7 @@ func (m *NvshareDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 		if nvidiaRuntimeUseMounts == true {
 			mount = &pluginapi.Mount{
 				HostPath:      NvidiaExposeMountHostPath,
-				ContainerPath: filepath.Join(NvidiaExposeMountDir, UUID),
+				ContainerPath: filepath.Join(NvidiaExposeMountDir, uuid),
 			}
 			mounts = append(mounts, mount)
 		}
@@ -273,9 +770,27 @@ func (m *NvshareDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Allo
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
 
+	if LogAllocations == true {
+		logAllocation("response", &responses)
+	}
+	kickPodAnnotator()
+	kickDeviceSnapshot()
 	return &responses, nil
 }
 
+/*
+ * Log an Allocate request or response, e.g., the devices the kubelet asks for
+ * and the envs and mounts we tell it to set up for each container.
+ */
+func logAllocation(what string, msg interface{}) {
+	out, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Could not log Allocate %s: %v", what, err)
+		return
+	}
+	log.Printf("Allocate %s: %s", what, out)
+}
+
 /* GetPreferredAllocation is unimplemented for Nvshare device plugin */
 func (m *NvshareDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
 	response := &pluginapi.PreferredAllocationResponse{}
@@ -304,12 +819,22 @@ func (m *NvshareDevicePlugin) dial(unixSocketPath string, timeout time.Duration)
 	return c, nil
 }
 
+/* Like dial(), but until ctx is done */
+func (m *NvshareDevicePlugin) dialContext(ctx context.Context, unixSocketPath string) (*grpc.ClientConn, error) {
+	return grpc.DialContext(ctx, unixSocketPath, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+}
+
 func (m *NvshareDevicePlugin) deviceExists(id string) bool {
-	for _, d := range m.devs {
-		if d.ID == id {
-			return true
-		}
+	uuid, ordinal, err := parseDeviceID(id)
+	if err != nil {
+		log.Printf("%v", err)
+		return false
 	}
-	return false
+	return uuid == gpuUUID() && ordinal >= m.first && ordinal < m.first+len(m.devs)
 }
 
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+func TestNormalizeSockID(t *testing.T) {
+	tests := []struct {
+		name    string
+		sockID  string
+		want    string
+		wantErr bool
+	}{
+		{"lowercase", "a100", "a100", false},
+		{"uppercase", "A100", "a100", false},
+		{"surrounding whitespace", "  team-1 \n", "team-1", false},
+		{"inner punctuation", "a.b_c-d", "a.b_c-d", false},
+		{"single character", "x", "x", false},
+		{"empty", "", "", true},
+		{"only whitespace", "   ", "", true},
+		{"leading dash", "-a", "", true},
+		{"trailing dash", "a-", "", true},
+		{"leading dot", ".a", "", true},
+		{"trailing underscore", "a_", "", true},
+		{"slash", "a/b", "", true},
+		{"inner space", "a b", "", true},
+		{"colon", "a:b", "", true},
+		{"non-ASCII", "gpü", "", true},
+		{"too long", strings.Repeat("a", resourceNameMaxLen-len(resourceBaseName)), "", true},
+		{"longest", strings.Repeat("a", resourceNameMaxLen-len(resourceBaseName)-1), strings.Repeat("a", resourceNameMaxLen-len(resourceBaseName)-1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeSockID(tt.sockID, resourceBaseName)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("normalizeSockID(%q) = %q, want error", tt.sockID, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizeSockID(%q) failed: %v", tt.sockID, err)
+			}
+			if got != tt.want {
+				t.Fatalf("normalizeSockID(%q) = %q, want %q", tt.sockID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetResourceName(t *testing.T) {
+	defer setResourceName("", false)
+
+	tests := []struct {
+		name         string
+		sockID       string
+		millishares  bool
+		wantResource string
+		wantSock     string
+		wantErr      bool
+	}{
+		{"default", "", false, "nvshare.com/gpu", "nvshare-device-plugin.sock", false},
+		{"default millishares", "", true, "nvshare.com/gpu-millishares", "nvshare-device-plugin-millishares.sock", false},
+		{"socket ID", "A100", false, "nvshare.com/gpu-a100", "nvshare-device-plugin-a100.sock", false},
+		{"socket ID millishares", "a100", true, "nvshare.com/gpu-millishares-a100", "nvshare-device-plugin-millishares-a100.sock", false},
+		{"invalid socket ID", "a/b", false, "", "", true},
+		{"invalid socket ID millishares", "-x", true, "", "", true},
+		/* The millishares base name leaves less room for the socket ID */
+		{"too long with millishares", strings.Repeat("a", resourceNameMaxLen-len(resourceBaseName)-1), true, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := setResourceName(tt.sockID, tt.millishares)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("setResourceName(%q, %v) succeeded with resource name %q, want error", tt.sockID, tt.millishares, resourceName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setResourceName(%q, %v) failed: %v", tt.sockID, tt.millishares, err)
+			}
+			if resourceName != tt.wantResource {
+				t.Errorf("resource name = %q, want %q", resourceName, tt.wantResource)
+			}
+			if serverSockName != tt.wantSock {
+				t.Errorf("socket name = %q, want %q", serverSockName, tt.wantSock)
+			}
+		})
+	}
+}
+
+/* A kubelet whose PodResources API reports containers that hold devices */
+type fakeKubelet struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	held map[string][]string /* Device IDs, by Pod */
+}
+
+func (k *fakeKubelet) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	resp := &podresourcesapi.ListPodResourcesResponse{}
+	for pod, ids := range k.held {
+		resp.PodResources = append(resp.PodResources, &podresourcesapi.PodResources{
+			Name:      pod,
+			Namespace: "default",
+			Containers: []*podresourcesapi.ContainerResources{{
+				Name:    "app",
+				Devices: []*podresourcesapi.ContainerDevices{{ResourceName: resourceName, DeviceIds: ids}},
+			}},
+		})
+	}
+	return resp, nil
+}
+
+func withFakeKubelet(t *testing.T, k *fakeKubelet) {
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("could not listen on %s: %v", socket, err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, k)
+	go server.Serve(l)
+
+	oldSocket, oldTeams := PodResourcesSocket, teams
+	PodResourcesSocket = socket
+	teams = []team{{resourceName: resourceName}}
+	t.Cleanup(func() {
+		server.Stop()
+		PodResourcesSocket, teams = oldSocket, oldTeams
+	})
+}
+
+func TestRecordAllocation(t *testing.T) {
+	k := &fakeKubelet{held: map[string][]string{}}
+	withFakeKubelet(t, k)
+	m := NewNvshareDevicePlugin(team{resourceName: resourceName, first: 1, devices: 4})
+	a, b := generateDeviceID("GPU-a", 1), generateDeviceID("GPU-a", 2)
+
+	if m.recordAllocation([]string{a}) == true {
+		t.Errorf("first allocation of %s is a repeat", a)
+	}
+	k.held["web-0"] = []string{a}
+
+	/* The container of web-0 restarts and keeps its device */
+	if m.recordAllocation([]string{a}) == false {
+		t.Errorf("allocation of %s to a restarted container is not a repeat", a)
+	}
+
+	/* web-0 goes away, and another Pod gets its device */
+	delete(k.held, "web-0")
+	if m.recordAllocation([]string{a}) == true {
+		t.Errorf("allocation of freed device %s to another Pod is a repeat", a)
+	}
+
+	/* Asking the kubelet forgets every freed device */
+	if m.recordAllocation([]string{b}) == true {
+		t.Errorf("first allocation of %s is a repeat", b)
+	}
+	k.held["web-1"] = []string{b}
+	m.recordAllocation([]string{a})
+	if len(m.allocated) != 2 {
+		t.Errorf("allocated = %v, want %s and %s", m.allocated, a, b)
+	}
+	m.recordAllocation([]string{b})
+	if len(m.allocated) != 1 || m.allocated[b] == false {
+		t.Errorf("allocated = %v, want only %s", m.allocated, b)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+/*
+ * For node-local agents that speak neither gRPC nor HTTP, the device plugin
+ * can keep a JSON snapshot of the devices it advertises and of the
+ * containers they are allocated to in a file. We rewrite it every interval,
+ * as well as soon as the allocations or the health of the devices change.
+ */
+const DefaultDeviceSnapshotInterval = 30 * time.Second
+
+type DeviceStatus struct {
+	ID      string `json:"id"`
+	Ordinal int    `json:"ordinal"`
+	/* Only with teams or tiers, see teams.go */
+	Team   string `json:"team,omitempty"`
+	Tier   string `json:"tier,omitempty"`
+	Health string `json:"health"`
+	/*
+	 * Whether a container holds the device, and which one. Omitted if the
+	 * kubelet PodResources API is unavailable.
+	 */
+	Allocated *bool  `json:"allocated,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+type DeviceSnapshot struct {
+	ResourceName string         `json:"resourceName"`
+	UUID         string         `json:"uuid"`
+	Devices      []DeviceStatus `json:"devices"`
+	/* Omitted if the kubelet PodResources API is unavailable */
+	AllocatedDevices *int      `json:"allocatedDevices,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+var snapshotKick = make(chan struct{}, 1)
+
+var snapshotHealthMutex sync.Mutex
+
+/* All of our devices share the health of the GPU, see setHealth() */
+var snapshotHealth = pluginapi.Healthy
+
+func collectDeviceSnapshot() DeviceSnapshot {
+	uuid := gpuUUID()
+	snapshot := DeviceSnapshot{
+		ResourceName: resourceName,
+		UUID:         uuid,
+		Devices:      []DeviceStatus{},
+		UpdatedAt:    time.Now(),
+	}
+	snapshotHealthMutex.Lock()
+	health := snapshotHealth
+	snapshotHealthMutex.Unlock()
+
+	byID := map[string]*PodAllocation{}
+	allocs, err := listPodAllocations()
+	if err != nil {
+		snapshot.Error = err.Error()
+	} else {
+		for i := range allocs.Allocations {
+			for _, id := range allocs.Allocations[i].DeviceIDs {
+				byID[id] = &allocs.Allocations[i]
+			}
+		}
+	}
+	allocated := 0
+	for _, t := range teams {
+		for ordinal := t.first; ordinal < t.first+t.devices; ordinal++ {
+			dev := DeviceStatus{
+				ID:      generateDeviceID(uuid, ordinal),
+				Ordinal: ordinal,
+				Team:    t.name,
+				Tier:    t.tier,
+				Health:  health,
+			}
+			if err == nil {
+				alloc, exists := byID[dev.ID]
+				dev.Allocated = &exists
+				if exists == true {
+					dev.Namespace = alloc.Namespace
+					dev.Pod = alloc.Pod
+					dev.Container = alloc.Container
+					allocated++
+				}
+			}
+			snapshot.Devices = append(snapshot.Devices, dev)
+		}
+	}
+	if err == nil {
+		snapshot.AllocatedDevices = &allocated
+	}
+	return snapshot
+}
+
+func writeDeviceSnapshot(path string) error {
+	out, err := json.MarshalIndent(collectDeviceSnapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(out, '\n'))
+}
+
+/* Record the health of the devices and rewrite the snapshot */
+func setSnapshotHealth(health string) {
+	snapshotHealthMutex.Lock()
+	snapshotHealth = health
+	snapshotHealthMutex.Unlock()
+	kickDeviceSnapshot()
+}
+
+/* Rewrite the snapshot, e.g., after an allocation */
+func kickDeviceSnapshot() {
+	select {
+	case snapshotKick <- struct{}{}:
+	default:
+	}
+}
+
+func startDeviceSnapshotWriter(path string, interval time.Duration) {
+	log.Printf("Writing a snapshot of the devices of %s to %s every %s", resourceName, path, interval)
+	go func() {
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-timer.C:
+			case <-snapshotKick:
+				if timer.Stop() == false {
+					<-timer.C
+				}
+				/*
+				 * The kubelet only reports the allocation once it
+				 * has created the container, so give it a moment.
+				 */
+				time.Sleep(time.Second)
+			}
+			err := writeDeviceSnapshot(path)
+			if err != nil {
+				log.Printf("Failed to write the snapshot of the devices to %s: %v", path, err)
+			}
+			timer.Reset(interval)
+		}
+	}()
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+ * For chargeback and quotas, the device plugin can split the devices of the
+ * GPU among teams and advertise the share of every team under a resource of
+ * its own, e.g., nvshare.com/gpu-team-a, so that a ResourceQuota on
+ * requests.nvshare.com/gpu-team-a caps what the team gets. Every resource
+ * has a device plugin server of its own. The ordinals of the devices run
+ * across all teams, so that every device keeps its own slot.
+ */
+type team struct {
+	name         string
+	tier         string /* See setTiers(), "" without tiers */
+	resourceName string
+	socketName   string
+	first        int /* Ordinal of the first device of the team */
+	devices      int
+}
+
+/*
+ * The resources we advertise, one per team, or just resourceName without
+ * teams. Set once at startup by setTeams().
+ */
+var teams []team
+
+/*
+ * Parse the split, "<team>=<devices>,...", e.g., "team-a=4,team-b=6". The
+ * teams must add up to all of our devices. An empty split advertises all of
+ * the devices under resourceName.
+ */
+func setTeams(split string) error {
+	if split == "" {
+		teams = []team{{
+			resourceName: resourceName,
+			socketName:   serverSockName,
+			first:        1,
+			devices:      NvshareVirtualDevices,
+		}}
+		return nil
+	}
+	var parsed []team
+	seen := map[string]bool{}
+	first := 1
+	for _, entry := range strings.Split(split, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("team %q must be of the form <team>=<devices>", entry)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		devices, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || devices <= 0 {
+			return fmt.Errorf("team %q must get a positive number of devices", name)
+		}
+		if !sockIDRegexp.MatchString(name) {
+			return fmt.Errorf("team name %q is invalid: it must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character", parts[0])
+		}
+		if seen[name] == true {
+			return fmt.Errorf("team %q appears more than once", name)
+		}
+		seen[name] = true
+		t := team{
+			name:         name,
+			resourceName: resourceName + "-" + name,
+			socketName:   strings.TrimSuffix(serverSockName, ".sock") + "-" + name + ".sock",
+			first:        first,
+			devices:      devices,
+		}
+		if len(strings.TrimPrefix(t.resourceName, resourceDomain+"/")) > resourceNameMaxLen {
+			return fmt.Errorf("team name %q is too long: resource name %q exceeds %d characters", name, t.resourceName, resourceNameMaxLen)
+		}
+		parsed = append(parsed, t)
+		first += devices
+	}
+	if first-1 != NvshareVirtualDevices {
+		return fmt.Errorf("the teams get %d devices in total, but the device plugin advertises %d", first-1, NvshareVirtualDevices)
+	}
+	teams = parsed
+	return nil
+}
+
+/*
+ * Tiers, analogous to the guaranteed and burstable QoS classes of Pods: The
+ * device plugin can split the devices of the GPU into shared devices, which
+ * it keeps advertising under resourceName, and guaranteed devices, which it
+ * advertises under resourceName-guaranteed. Containers with shared devices
+ * are time-sliced and best-effort, as usual. Containers with guaranteed
+ * devices get guaranteedMemoryMiB of GPU memory per device reserved upfront
+ * and the guaranteed workload type, whose clients the scheduler doesn't
+ * preempt and never evicts to reclaim memory.
+ */
+const (
+	TierShared     = "shared"
+	TierGuaranteed = "guaranteed"
+)
+
+/* GPU memory to reserve per guaranteed device */
+var guaranteedMemoryMiB int
+
+/*
+ * Split our devices into shared ones, first, and the last guaranteed ones.
+ * There must be devices of both tiers. Tiers replace teams.
+ */
+func setTiers(guaranteed int) error {
+	if guaranteed <= 0 || guaranteed >= NvshareVirtualDevices {
+		return fmt.Errorf("the guaranteed devices must be more than 0 and fewer than the %d devices the device plugin advertises", NvshareVirtualDevices)
+	}
+	t := team{
+		tier:         TierGuaranteed,
+		resourceName: resourceName + "-" + TierGuaranteed,
+		socketName:   strings.TrimSuffix(serverSockName, ".sock") + "-" + TierGuaranteed + ".sock",
+		first:        NvshareVirtualDevices - guaranteed + 1,
+		devices:      guaranteed,
+	}
+	if len(strings.TrimPrefix(t.resourceName, resourceDomain+"/")) > resourceNameMaxLen {
+		return fmt.Errorf("resource name %q exceeds %d characters", t.resourceName, resourceNameMaxLen)
+	}
+	teams = []team{{
+		tier:         TierShared,
+		resourceName: resourceName,
+		socketName:   serverSockName,
+		first:        1,
+		devices:      NvshareVirtualDevices - guaranteed,
+	}, t}
+	return nil
+}
+
+/* Whether the kubelet resource is one of the resources we advertise */
+func isOurResource(name string) bool {
+	for _, t := range teams {
+		if t.resourceName == name {
+			return true
+		}
+	}
+	return false
+}
+
+/* The team a device ordinal belongs to, "" without teams */
+func teamOfOrdinal(ordinal int) string {
+	for _, t := range teams {
+		if ordinal >= t.first && ordinal < t.first+t.devices {
+			return t.name
+		}
+	}
+	return ""
+}
+
+/* The tier a device ordinal belongs to, "" without tiers */
+func tierOfOrdinal(ordinal int) string {
+	for _, t := range teams {
+		if ordinal >= t.first && ordinal < t.first+t.devices {
+			return t.tier
+		}
+	}
+	return ""
+}
+
+/* Start a device plugin for every team, or none if any of them fails */
+func startDevicePlugins(plugins []*NvshareDevicePlugin) error {
+	for _, p := range plugins {
+		err := p.Start()
+		if err != nil {
+			stopDevicePlugins(plugins)
+			return err
+		}
+	}
+	return nil
+}
+
+func stopDevicePlugins(plugins []*NvshareDevicePlugin) {
+	for _, p := range plugins {
+		p.Stop()
+	}
+}
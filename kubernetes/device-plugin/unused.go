@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Some Pods request nvshare devices but never initialize CUDA, so they hold
+ * device slots without ever registering with the scheduler. Spot them by
+ * comparing the allocations the kubelet reports with the clients the
+ * scheduler knows of, so that operators can right-size
+ * NVSHARE_VIRTUAL_DEVICES. We only report them, the kubelet owns the slots.
+ */
+
+/* How long the scheduler has to answer a status query */
+const schedulerStatusTimeout = 10 * time.Second
+
+/*
+ * Layout of struct message in src/comm.h, which is packed, with a one-byte
+ * type. TestMessageLayout checks it against comm.h.
+ */
+const (
+	messageTypeLen         = 1
+	messagePodNameLen      = 254 /* POD_NAME_LEN_MAX */
+	messagePodNamespaceLen = 254 /* POD_NAMESPACE_LEN_MAX */
+	messageDataLen         = 20  /* MSG_DATA_LEN */
+	messageIDOffset        = messageTypeLen + messagePodNameLen + messagePodNamespaceLen
+	messageDataOffset      = messageIDOffset + 8
+	messageSize            = messageDataOffset + messageDataLen
+	messageTypeStatus      = 9 /* STATUS */
+	nvsharectlID           = 0xBEEF
+)
+
+/* Ask for the registered clients only, as JSON */
+const statusClientsJSONFields = "j=1 c=1"
+
+/* What we need of a client in the JSON status of the scheduler */
+type schedulerClient struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+}
+
+/* An allocation without a registered client */
+type UnusedAllocation struct {
+	PodAllocation
+	Since time.Time `json:"since"`
+}
+
+type UnusedAllocations struct {
+	ResourceName string             `json:"resourceName"`
+	UUID         string             `json:"uuid"`
+	Timeout      string             `json:"timeout"`
+	Allocations  []UnusedAllocation `json:"allocations"`
+	Error        string             `json:"error,omitempty"`
+	UpdatedAt    time.Time          `json:"updatedAt"`
+}
+
+var unusedMutex sync.Mutex
+
+/* 0 means the check is off */
+var unusedTimeout time.Duration
+
+/* When we first saw each allocation without a client, by container */
+var unusedSince = map[string]time.Time{}
+
+/* The result of the last check */
+var unusedAllocations = UnusedAllocations{Allocations: []UnusedAllocation{}}
+
+func allocationKey(alloc PodAllocation) string {
+	return alloc.Namespace + "/" + alloc.Pod + "/" + alloc.Container
+}
+
+/*
+ * Ask the scheduler for its status, like nvsharectl --status does, and return
+ * the Pods ("namespace/name") of the registered clients.
+ */
+func listSchedulerPods(socket string) (map[string]bool, error) {
+	conn, err := net.DialTimeout("unix", socket, schedulerStatusTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the scheduler at %s: %v", socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(schedulerStatusTimeout))
+
+	msg := make([]byte, messageSize)
+	msg[0] = messageTypeStatus
+	binary.LittleEndian.PutUint64(msg[messageIDOffset:], nvsharectlID)
+	copy(msg[messageDataOffset:messageSize-1], statusClientsJSONFields)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, fmt.Errorf("could not query the scheduler status: %v", err)
+	}
+
+	/* The scheduler closes the connection after sending the status */
+	var clients []schedulerClient
+	err = json.NewDecoder(conn).Decode(&clients)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the scheduler status: %v", err)
+	}
+	pods := map[string]bool{}
+	for _, c := range clients {
+		pods[c.Namespace+"/"+c.Pod] = true
+	}
+	return pods, nil
+}
+
+func checkUnusedAllocations(socket string) {
+	now := time.Now()
+	result := UnusedAllocations{
+		ResourceName: resourceName,
+		UUID:         gpuUUID(),
+		Timeout:      unusedTimeout.String(),
+		Allocations:  []UnusedAllocation{},
+		UpdatedAt:    now,
+	}
+
+	allocs, err := listPodAllocations()
+	var pods map[string]bool
+	if err == nil {
+		pods, err = listSchedulerPods(socket)
+	}
+
+	unusedMutex.Lock()
+	defer unusedMutex.Unlock()
+
+	if err != nil {
+		/* Keep what we know, we can't tell clients apart right now */
+		log.Printf("Could not check for unused allocations: %v", err)
+		result.Allocations = unusedAllocations.Allocations
+		result.Error = err.Error()
+		unusedAllocations = result
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, alloc := range allocs.Allocations {
+		key := allocationKey(alloc)
+		if pods[alloc.Namespace+"/"+alloc.Pod] == true {
+			if _, exists := unusedSince[key]; exists == true && now.Sub(unusedSince[key]) >= unusedTimeout {
+				log.Printf("Container %s now has a registered nvshare client", key)
+			}
+			continue
+		}
+		seen[key] = true
+		since, exists := unusedSince[key]
+		if exists == false {
+			unusedSince[key] = now
+			continue
+		}
+		if now.Sub(since) < unusedTimeout {
+			continue
+		}
+		if unusedReported(key) == false {
+			log.Printf("Container %s holds %d device(s) of %s but has had no registered nvshare client for %s",
+				key, len(alloc.DeviceIDs), resourceName, now.Sub(since).Round(time.Second))
+		}
+		result.Allocations = append(result.Allocations, UnusedAllocation{
+			PodAllocation: alloc,
+			Since:         since,
+		})
+	}
+	/* Forget the containers that are gone or have registered */
+	for key := range unusedSince {
+		if seen[key] == false {
+			delete(unusedSince, key)
+		}
+	}
+	sort.Slice(result.Allocations, func(i, j int) bool {
+		return allocationKey(result.Allocations[i].PodAllocation) < allocationKey(result.Allocations[j].PodAllocation)
+	})
+	unusedAllocations = result
+}
+
+/* Whether the last check already reported the container. Hold unusedMutex. */
+func unusedReported(key string) bool {
+	for _, alloc := range unusedAllocations.Allocations {
+		if allocationKey(alloc.PodAllocation) == key {
+			return true
+		}
+	}
+	return false
+}
+
+/* How many devices the unused allocations hold */
+func unusedDevices() int {
+	unusedMutex.Lock()
+	defer unusedMutex.Unlock()
+
+	n := 0
+	for _, alloc := range unusedAllocations.Allocations {
+		n += len(alloc.DeviceIDs)
+	}
+	return n
+}
+
+/* Check every interval, which is a fraction of the timeout, up to a minute */
+func startUnusedAllocationsChecker(socket string, timeout time.Duration) {
+	unusedTimeout = timeout
+	interval := timeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	log.Printf("Reporting allocations without a registered nvshare client for %s", timeout)
+	go func() {
+		for {
+			checkUnusedAllocations(socket)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func serveUnusedAllocations(w http.ResponseWriter, r *http.Request) {
+	if unusedTimeout == 0 {
+		http.Error(w, "unused allocation check is off, set "+UnusedAllocationTimeoutEnvVar, http.StatusNotFound)
+		return
+	}
+	unusedMutex.Lock()
+	out, err := json.MarshalIndent(unusedAllocations, "", "  ")
+	unusedMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(out, '\n'))
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+const commHeader = "../../src/comm.h"
+
+func readSource(t *testing.T, path string) string {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read %s: %v", path, err)
+	}
+	return string(src)
+}
+
+/* The value of a #define in src */
+func define(t *testing.T, src, name string) string {
+	m := regexp.MustCompile(`(?m)^#define\s+` + name + `\s+(\S+)`).FindStringSubmatch(src)
+	if m == nil {
+		t.Fatalf("%s does not define %s", commHeader, name)
+	}
+	return m[1]
+}
+
+func defineInt(t *testing.T, src, name string) int {
+	n, err := strconv.Atoi(define(t, src, name))
+	if err != nil {
+		t.Fatalf("%s in %s is not a number: %v", name, commHeader, err)
+	}
+	return n
+}
+
+func defineString(t *testing.T, src, name string) string {
+	s, err := strconv.Unquote(define(t, src, name))
+	if err != nil {
+		t.Fatalf("%s in %s is not a string: %v", name, commHeader, err)
+	}
+	return s
+}
+
+/* Fail if the layout of struct message drifts from the one we hardcode */
+func TestMessageLayout(t *testing.T) {
+	src := readSource(t, commHeader)
+
+	m := regexp.MustCompile(`(?s)struct message \{(.*?)\} __attribute__\(\(__packed__\)\);`).FindStringSubmatch(src)
+	if m == nil {
+		t.Fatalf("%s does not declare a packed struct message", commHeader)
+	}
+	members := regexp.MustCompile(`(?m)^\s*([a-z_ 0-9]+?)\s+(\w+)(?:\[(\w+)\])?;`).FindAllStringSubmatch(m[1], -1)
+	want := []struct{ typ, name, len string }{
+		{"enum message_type", "type", ""},
+		{"char", "pod_name", "POD_NAME_LEN_MAX"},
+		{"char", "pod_namespace", "POD_NAMESPACE_LEN_MAX"},
+		{"uint64_t", "id", ""},
+		{"char", "data", "MSG_DATA_LEN"},
+	}
+	if len(members) != len(want) {
+		t.Fatalf("struct message has %d fields, want %d", len(members), len(want))
+	}
+	for i, w := range want {
+		if members[i][1] != w.typ || members[i][2] != w.name || members[i][3] != w.len {
+			t.Errorf("field %d of struct message is %q, want %s %s[%s]", i, members[i][0], w.typ, w.name, w.len)
+		}
+	}
+
+	if n := defineInt(t, src, "POD_NAME_LEN_MAX"); n != messagePodNameLen {
+		t.Errorf("POD_NAME_LEN_MAX = %d, want %d", n, messagePodNameLen)
+	}
+	if n := defineInt(t, src, "POD_NAMESPACE_LEN_MAX"); n != messagePodNamespaceLen {
+		t.Errorf("POD_NAMESPACE_LEN_MAX = %d, want %d", n, messagePodNamespaceLen)
+	}
+	if n := defineInt(t, src, "MSG_DATA_LEN"); n != messageDataLen {
+		t.Errorf("MSG_DATA_LEN = %d, want %d", n, messageDataLen)
+	}
+
+	m = regexp.MustCompile(`\bSTATUS\s*=\s*(\d+),`).FindStringSubmatch(src)
+	if m == nil {
+		t.Fatalf("%s does not define the STATUS message type", commHeader)
+	}
+	if m[1] != strconv.Itoa(messageTypeStatus) {
+		t.Errorf("STATUS = %s, want %d", m[1], messageTypeStatus)
+	}
+
+	statusFields := defineString(t, src, "NVSHARE_STATUS_JSON_FIELD") + "=1 " +
+		defineString(t, src, "NVSHARE_STATUS_CLIENTS_FIELD") + "=1"
+	if statusFields != statusClientsJSONFields {
+		t.Errorf("status fields are %q in comm.h, want %q", statusFields, statusClientsJSONFields)
+	}
+}
+
+/* We pose as nvsharectl, so use its ID */
+func TestNvsharectlID(t *testing.T) {
+	src := readSource(t, "../../src/cli.c")
+	ids := regexp.MustCompile(`msg\.id = 0x([0-9A-Fa-f]+);`).FindAllStringSubmatch(src, -1)
+	if len(ids) == 0 {
+		t.Fatalf("nvsharectl sets no message ID")
+	}
+	for _, id := range ids {
+		if n, err := strconv.ParseUint(id[1], 16, 64); err != nil || n != nvsharectlID {
+			t.Errorf("nvsharectl uses ID 0x%s, want 0x%X", id[1], nvsharectlID)
+		}
+	}
+}
+
+/*
+ * Serve a single status query on a fake scheduler socket: hand the message
+ * we got to check, then answer with status.
+ */
+func fakeScheduler(t *testing.T, status string, check func(msg []byte)) string {
+	socket := filepath.Join(t.TempDir(), "scheduler.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("could not listen on %s: %v", socket, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg := make([]byte, messageSize)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		check(msg)
+		conn.Write([]byte(status))
+	}()
+	return socket
+}
+
+func TestListSchedulerPods(t *testing.T) {
+	var got []byte
+	done := make(chan struct{})
+	socket := fakeScheduler(t, `[
+  {"id": "00000000000000ab", "name": "a", "namespace": "ns1", "pod": "train-0", "pod_uid": null},
+  {"id": "00000000000000cd", "name": "b", "namespace": "ns2", "pod": "infer-1", "pod_uid": null}
+]
+`, func(msg []byte) {
+		got = msg
+		close(done)
+	})
+
+	pods, err := listSchedulerPods(socket)
+	if err != nil {
+		t.Fatalf("listSchedulerPods() failed: %v", err)
+	}
+	<-done
+	if got[0] != messageTypeStatus {
+		t.Errorf("message type = %d, want %d", got[0], messageTypeStatus)
+	}
+	if id := binary.LittleEndian.Uint64(got[messageIDOffset:]); id != nvsharectlID {
+		t.Errorf("message ID = %#x, want %#x", id, nvsharectlID)
+	}
+	data := got[messageDataOffset:]
+	if i := bytes.IndexByte(data, 0); i < 0 || string(data[:i]) != statusClientsJSONFields {
+		t.Errorf("message data = %q, want %q", data, statusClientsJSONFields)
+	}
+	if len(pods) != 2 || pods["ns1/train-0"] == false || pods["ns2/infer-1"] == false {
+		t.Errorf("listSchedulerPods() = %v, want ns1/train-0 and ns2/infer-1", pods)
+	}
+}
+
+func TestListSchedulerPodsNoClients(t *testing.T) {
+	socket := fakeScheduler(t, "[]\n", func([]byte) {})
+	pods, err := listSchedulerPods(socket)
+	if err != nil {
+		t.Fatalf("listSchedulerPods() failed: %v", err)
+	}
+	if len(pods) != 0 {
+		t.Errorf("listSchedulerPods() = %v, want none", pods)
+	}
+}
+
+/* E.g., a scheduler that predates JSON status answers with text */
+func TestListSchedulerPodsMalformed(t *testing.T) {
+	for _, status := range []string{"", "Scheduler: on\nClients:\n", `[{"namespace": "ns"`} {
+		socket := fakeScheduler(t, status, func([]byte) {})
+		if pods, err := listSchedulerPods(socket); err == nil {
+			t.Errorf("listSchedulerPods() = %v for status %q, want error", pods, status)
+		}
+	}
+}
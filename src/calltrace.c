@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Sampled trace of the CUDA calls that libnvshare intercepts.
+ *
+ * Logging every intercepted call would drown out what we're after, so we
+ * time one in every call_trace_sample calls and append a JSON line for it
+ * to the trace file:
+ *
+ *   {"time":1700000000.123456,"pid":42,"client_id":"6cbe29a349f195e6",
+ *    "call":"cuLaunchKernel","duration_us":12.345,"waited_for_lock":false,
+ *    "result":0}
+ *
+ * The duration includes the time we spent in libnvshare, e.g., waiting for
+ * the GPU lock, which is the point.
+ */
+
+#include <errno.h>
+#include <fcntl.h>
+#include <inttypes.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "calltrace.h"
+#include "client.h"
+#include "common.h"
+
+__thread int waited_for_lock = 0;
+
+/* 0 means tracing is off */
+static unsigned long call_trace_sample = 0;
+static unsigned long calls = 0;
+static int trace_fd = -1;
+static int write_failed = 0;
+
+void nvshare_call_trace_init(void)
+{
+	char *path, *value, *endptr;
+
+	path = getenv(ENV_NVSHARE_CALL_TRACE_FILE);
+	if (path == NULL || *path == '\0') return;
+
+	call_trace_sample = NVSHARE_DEFAULT_CALL_TRACE_SAMPLE;
+	value = getenv(ENV_NVSHARE_CALL_TRACE_SAMPLE);
+	if (value != NULL) {
+		errno = 0;
+		call_trace_sample = strtoul(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    call_trace_sample == 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_CALL_TRACE_SAMPLE, value);
+	}
+
+	/* Every process of the container may append to the same file */
+	trace_fd = open(path, O_WRONLY | O_APPEND | O_CREAT | O_CLOEXEC, 0644);
+	if (trace_fd < 0) {
+		log_warn("Failed to open the call trace file %s: %s", path,
+			 strerror(errno));
+		call_trace_sample = 0;
+		return;
+	}
+	log_info("Tracing 1 in %lu intercepted CUDA calls to %s",
+		 call_trace_sample, path);
+}
+
+
+void nvshare_call_trace_begin(struct call_sample *s)
+{
+	s->sampled = 0;
+	if (call_trace_sample == 0) return;
+	if (__atomic_fetch_add(&calls, 1, __ATOMIC_RELAXED) %
+	    call_trace_sample != 0)
+		return;
+
+	s->sampled = 1;
+	waited_for_lock = 0;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &s->start) == 0);
+}
+
+
+void nvshare_call_trace_end(struct call_sample *s, const char *call,
+	CUresult result)
+{
+	struct timespec end, now;
+	char line[256];
+	int len;
+
+	if (!s->sampled) return;
+
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &end) == 0);
+	true_or_exit(clock_gettime(CLOCK_REALTIME, &now) == 0);
+	len = snprintf(line, sizeof(line), "{\"time\":%lld.%06ld,\"pid\":%d,"
+		       "\"client_id\":\"%016" PRIx64 "\",\"call\":\"%s\","
+		       "\"duration_us\":%.3f,\"waited_for_lock\":%s,"
+		       "\"result\":%d}\n", (long long)now.tv_sec,
+		       now.tv_nsec / 1000, (int)getpid(), nvshare_client_id,
+		       call, (end.tv_sec - s->start.tv_sec) * 1e6 +
+		       (end.tv_nsec - s->start.tv_nsec) / 1e3,
+		       waited_for_lock ? "true" : "false", (int)result);
+	/* A single write, so that lines of concurrent writers don't mix */
+	if (len > 0 && (size_t)len < sizeof(line) &&
+	    write(trace_fd, line, len) == len)
+		return;
+	if (!__atomic_exchange_n(&write_failed, 1, __ATOMIC_RELAXED))
+		log_warn("Failed to write to the call trace file");
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Sampled trace of the CUDA calls that libnvshare intercepts.
+ */
+
+#ifndef _NVSHARE_CALLTRACE_H_
+#define _NVSHARE_CALLTRACE_H_
+
+#include <time.h>
+
+#include "cuda_defs.h"
+
+#define ENV_NVSHARE_CALL_TRACE_FILE   "NVSHARE_CALL_TRACE_FILE"
+#define ENV_NVSHARE_CALL_TRACE_SAMPLE "NVSHARE_CALL_TRACE_SAMPLE"
+
+#define NVSHARE_DEFAULT_CALL_TRACE_SAMPLE 1000
+
+/* A call in flight. Only sampled calls get timed. */
+struct call_sample {
+	int sampled;
+	struct timespec start;
+};
+
+/*
+ * Set by continue_with_lock() when the calling thread had to wait for the
+ * GPU lock, i.e., when the call involved the scheduler.
+ */
+extern __thread int waited_for_lock;
+
+extern void nvshare_call_trace_init(void);
+extern void nvshare_call_trace_begin(struct call_sample *s);
+extern void nvshare_call_trace_end(struct call_sample *s, const char *call,
+	CUresult result);
+
+#endif /* _NVSHARE_CALLTRACE_H_ */
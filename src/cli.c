@@ -22,6 +22,8 @@
 #include <unistd.h>
 #include <stddef.h>
 #include <stdlib.h>
+#include <errno.h>
+#include <inttypes.h>
 
 #include "xopt.h"
 #include "comm.h"
@@ -33,6 +35,17 @@ static char nvscheduler_socket_path[NVSHARE_SOCK_PATH_MAX];
 typedef struct {
 	int cmdline_scheduler_tq;
 	const char *cmdline_anti_thrash;
+	bool status;
+	bool clients;
+	bool json;
+	const char *cmdline_evict;
+	const char *cmdline_boost;
+	const char *cmdline_duration;
+	const char *cmdline_drain;
+	bool wait_drained;
+	const char *cmdline_quiesce;
+	bool wait_quiesced;
+	bool version;
 	bool help;
 } SimpleConfig;
 
@@ -58,6 +71,112 @@ xoptOption options[] = {
 		"Set the desired status of the scheduler. Only accepts values"
 		" \"on\" or \"off\"."
 	},
+	{
+		"status",
+		's',
+		offsetof(SimpleConfig, status),
+		0,
+		XOPT_TYPE_BOOL,
+		0,
+		"Show the current status of the scheduler and its clients."
+	},
+	{
+		"clients",
+		'c',
+		offsetof(SimpleConfig, clients),
+		0,
+		XOPT_TYPE_BOOL,
+		0,
+		"Show the registered clients of the scheduler."
+	},
+	{
+		"json",
+		'j',
+		offsetof(SimpleConfig, json),
+		0,
+		XOPT_TYPE_BOOL,
+		0,
+		"Show --status or --clients as JSON."
+	},
+	{
+		"evict",
+		'E',
+		offsetof(SimpleConfig, cmdline_evict),
+		0,
+		XOPT_TYPE_STRING,
+		"id",
+		"Evict the client with the given ID (as --status shows it)."
+		" Its application exits."
+	},
+	{
+		"boost",
+		'B',
+		offsetof(SimpleConfig, cmdline_boost),
+		0,
+		XOPT_TYPE_STRING,
+		"id",
+		"Temporarily raise the share of the client with the given ID"
+		" (as --status shows it), for --duration."
+	},
+	{
+		"duration",
+		'd',
+		offsetof(SimpleConfig, cmdline_duration),
+		0,
+		XOPT_TYPE_STRING,
+		"d",
+		"How long --boost lasts, in seconds or with an s, m or h"
+		" suffix, e.g., 10m. At most a day. 0 ends the boost early."
+	},
+	{
+		"drain",
+		'D',
+		offsetof(SimpleConfig, cmdline_drain),
+		0,
+		XOPT_TYPE_STRING,
+		"s",
+		"Start (\"on\") or cancel (\"off\") draining the scheduler."
+		" While draining, the scheduler rejects new clients."
+	},
+	{
+		"wait-drained",
+		'w',
+		offsetof(SimpleConfig, wait_drained),
+		0,
+		XOPT_TYPE_BOOL,
+		0,
+		"Start draining the scheduler and block until no registered"
+		" clients remain."
+	},
+	{
+		"quiesce",
+		'Q',
+		offsetof(SimpleConfig, cmdline_quiesce),
+		0,
+		XOPT_TYPE_STRING,
+		"s",
+		"Start (\"on\") or cancel (\"off\") quiescing the GPU."
+		" While quiescing, the scheduler grants no new slices."
+	},
+	{
+		"wait-quiesced",
+		'q',
+		offsetof(SimpleConfig, wait_quiesced),
+		0,
+		XOPT_TYPE_BOOL,
+		0,
+		"Start quiescing the GPU and block until the lock holder has"
+		" released the lock and the GPU is idle."
+	},
+	{
+		"version",
+		'V',
+		offsetof(SimpleConfig, version),
+		0,
+		XOPT_TYPE_BOOL,
+		0,
+		"Show the version of nvsharectl and exit."
+	},
 	{
 		"help",
 		'h',
@@ -114,6 +233,206 @@ static int change_status(int status)
 }
 
 
+/* Show the status, or only the clients, as text or as JSON */
+static int show_status(int only_clients, int json)
+{
+	int rsock;
+	int ret;
+	ssize_t n;
+	char buf[4096];
+	struct message msg = {0};
+
+	msg.id = 0xBEEF;
+	msg.type = STATUS;
+	snprintf(msg.data, MSG_DATA_LEN, "%s=%d %s=%d",
+		 NVSHARE_STATUS_CLIENTS_FIELD, only_clients,
+		 NVSHARE_STATUS_JSON_FIELD, json);
+
+	ret = 0;
+	if (nvshare_connect(&rsock, nvscheduler_socket_path) != 0)
+		log_fatal("nvshare_connect() failed");
+	if (write_whole(rsock, &msg, sizeof(msg)) != sizeof(msg))
+		ret = -1;
+	/* The scheduler closes the connection after sending the status */
+	while (ret == 0 && (n = RETRY_INTR(read(rsock, buf, sizeof(buf)))) != 0) {
+		if (n < 0) ret = -1;
+		else fwrite(buf, 1, n, stdout);
+	}
+	true_or_exit(close(rsock) == 0);
+
+	return ret;
+}
+
+
+/*
+ * Ask the scheduler to evict a client.
+ *
+ * Return 1 if it has evicted the client, 0 if it has no such client and -1
+ * on error.
+ */
+static int evict_client(uint64_t id)
+{
+	int rsock;
+	int ret;
+	char value[MSG_DATA_LEN + 1];
+	struct message msg = {0};
+
+	msg.id = 0xBEEF;
+	msg.type = EVICT;
+	snprintf(msg.data, MSG_DATA_LEN, "%s=%016" PRIx64,
+		 NVSHARE_EVICT_ID_FIELD, id);
+
+	ret = 0;
+	if (nvshare_connect(&rsock, nvscheduler_socket_path) != 0)
+		log_fatal("nvshare_connect() failed");
+	if (write_whole(rsock, &msg, sizeof(msg)) != sizeof(msg))
+		ret = -1;
+	if (ret == 0) {
+		if (nvshare_receive_block(rsock, &msg, sizeof(msg)) != sizeof(msg)
+		    || msg.type != EVICT ||
+		    nvshare_msg_get_field(msg.data, NVSHARE_EVICTED_FIELD,
+					  value, sizeof(value)) != 0)
+			ret = -1;
+		else ret = (atoi(value) > 0);
+	}
+	true_or_exit(close(rsock) == 0);
+
+	return ret;
+}
+
+
+/*
+ * Parse a duration, in seconds or with an s, m or h suffix, into seconds.
+ *
+ * Return -1 if it is invalid.
+ */
+static long long parse_duration_s(const char *s)
+{
+	long long n;
+	char *endptr;
+
+	errno = 0;
+	n = strtoll(s, &endptr, 10);
+	if (s == endptr || errno != 0 || n < 0) return -1;
+	switch (*endptr) {
+	case 'h':
+		n *= 60;
+		/* fall through */
+	case 'm':
+		n *= 60;
+		/* fall through */
+	case 's':
+		endptr++;
+		break;
+	}
+	if (*endptr != '\0' || n > NVSHARE_BOOST_MAX_S) return -1;
+	return n;
+}
+
+
+/*
+ * Ask the scheduler to boost a client for duration_s, or to end its boost
+ * if duration_s is 0.
+ *
+ * Return 1 if it has boosted the client, 0 if it has no such client and -1
+ * on error.
+ */
+static int boost_client(uint64_t id, long long duration_s)
+{
+	int rsock;
+	int ret;
+	char value[MSG_DATA_LEN + 1];
+	struct message msg = {0};
+
+	msg.id = 0xBEEF;
+	msg.type = BOOST;
+	snprintf(msg.data, MSG_DATA_LEN, "%s=%016" PRIx64,
+		 NVSHARE_BOOST_ID_FIELD, id);
+	snprintf(msg.pod_name, sizeof(msg.pod_name), "%s=%lld",
+		 NVSHARE_BOOST_DURATION_FIELD, duration_s);
+
+	ret = 0;
+	if (nvshare_connect(&rsock, nvscheduler_socket_path) != 0)
+		log_fatal("nvshare_connect() failed");
+	if (write_whole(rsock, &msg, sizeof(msg)) != sizeof(msg))
+		ret = -1;
+	if (ret == 0) {
+		if (nvshare_receive_block(rsock, &msg, sizeof(msg)) != sizeof(msg)
+		    || msg.type != BOOST ||
+		    nvshare_msg_get_field(msg.data, NVSHARE_BOOSTED_FIELD,
+					  value, sizeof(value)) != 0)
+			ret = -1;
+		else ret = (atoi(value) > 0);
+	}
+	true_or_exit(close(rsock) == 0);
+
+	return ret;
+}
+
+
+/*
+ * Ask the scheduler to start/stop draining.
+ *
+ * If wait is set, block until the scheduler tells us that the drain is
+ * complete.
+ */
+static int change_drain(const char *drain, int wait)
+{
+	int rsock;
+	int ret;
+	struct message msg = {0};
+
+	msg.id = 0xBEEF;
+	msg.type = DRAIN;
+	strlcpy(msg.data, wait ? "wait" : drain, MSG_DATA_LEN);
+
+	ret = 0;
+	if (nvshare_connect(&rsock, nvscheduler_socket_path) != 0)
+		log_fatal("nvshare_connect() failed");
+	if (write_whole(rsock, &msg, sizeof(msg)) != sizeof(msg))
+		ret = -1;
+	if (ret == 0 && wait) {
+		if (nvshare_receive_block(rsock, &msg, sizeof(msg)) != sizeof(msg)
+		    || msg.type != DRAIN)
+			ret = -1;
+	}
+	true_or_exit(close(rsock) == 0);
+
+	return ret;
+}
+
+
+/*
+ * Ask the scheduler to start/stop quiescing the GPU.
+ *
+ * If wait is set, block until the scheduler tells us that the GPU is idle.
+ */
+static int change_quiesce(const char *quiesce, int wait)
+{
+	int rsock;
+	int ret;
+	struct message msg = {0};
+
+	msg.id = 0xBEEF;
+	msg.type = QUIESCE;
+	strlcpy(msg.data, wait ? "wait" : quiesce, MSG_DATA_LEN);
+
+	ret = 0;
+	if (nvshare_connect(&rsock, nvscheduler_socket_path) != 0)
+		log_fatal("nvshare_connect() failed");
+	if (write_whole(rsock, &msg, sizeof(msg)) != sizeof(msg))
+		ret = -1;
+	if (ret == 0 && wait) {
+		if (nvshare_receive_block(rsock, &msg, sizeof(msg)) != sizeof(msg)
+		    || msg.type != QUIESCE)
+			ret = -1;
+	}
+	true_or_exit(close(rsock) == 0);
+
+	return ret;
+}
+
+
 int main(int argc, const char *argv[])
 {
 	int status;
@@ -125,6 +444,18 @@ int main(int argc, const char *argv[])
 
 	config.cmdline_scheduler_tq = 0;
 	config.cmdline_anti_thrash = NULL;
+	config.status = false;
+	config.clients = false;
+	config.json = false;
+	config.cmdline_evict = NULL;
+	config.cmdline_boost = NULL;
+	config.cmdline_duration = NULL;
+	config.cmdline_drain = NULL;
+	config.wait_drained = false;
+	config.cmdline_quiesce = NULL;
+	config.wait_quiesced = false;
+	config.version = false;
+	config.help = false;
 
 	ctx = xopt_context("nvsharectl", options,
 			XOPT_CTX_POSIXMEHARDER | XOPT_CTX_STRICT, &opt_err);
@@ -138,6 +469,12 @@ int main(int argc, const char *argv[])
 		log_fatal("Error: %s", opt_err);
 	}
 
+	if (config.version) {
+		printf("nvsharectl %s (protocol version %d)\n",
+		       NVSHARE_VERSION, NVSHARE_PROTOCOL_VERSION);
+		exit(0);
+	}
+
 	if (nvshare_get_scheduler_path(nvscheduler_socket_path) != 0)
 		log_fatal("Failed to obtain nvshare-scheduler socket path.");
 
@@ -171,6 +508,131 @@ int main(int argc, const char *argv[])
 		actions_done++;
 	}
 
+	if (config.cmdline_drain != NULL) {
+		if (strcmp(config.cmdline_drain, "on") != 0 &&
+		    strcmp(config.cmdline_drain, "off") != 0)
+			log_fatal("Invalid option for --drain (-D). Must be one"
+				  " of 'on' or 'off'.");
+		if (change_drain(config.cmdline_drain, 0) != 0)
+			log_info("Failed to turn draining %s.",
+				 config.cmdline_drain);
+		else log_info("Successfully turned draining %s.",
+			      config.cmdline_drain);
+		actions_done++;
+	}
+
+	if (config.wait_drained) {
+		log_info("Waiting for the nvshare-scheduler to drain...");
+		if (change_drain("on", 1) != 0)
+			log_fatal("Failed to wait for the nvshare-scheduler to"
+				  " drain.");
+		log_info("The nvshare-scheduler has drained.");
+		actions_done++;
+	}
+
+	if (config.cmdline_quiesce != NULL) {
+		if (strcmp(config.cmdline_quiesce, "on") != 0 &&
+		    strcmp(config.cmdline_quiesce, "off") != 0)
+			log_fatal("Invalid option for --quiesce (-Q). Must be"
+				  " one of 'on' or 'off'.");
+		if (change_quiesce(config.cmdline_quiesce, 0) != 0)
+			log_info("Failed to turn quiescing %s.",
+				 config.cmdline_quiesce);
+		else log_info("Successfully turned quiescing %s.",
+			      config.cmdline_quiesce);
+		actions_done++;
+	}
+
+	if (config.wait_quiesced) {
+		log_info("Waiting for the GPU to quiesce...");
+		if (change_quiesce("on", 1) != 0)
+			log_fatal("Failed to wait for the GPU to quiesce.");
+		log_info("The GPU has quiesced.");
+		actions_done++;
+	}
+
+	if (config.cmdline_evict != NULL) {
+		uint64_t id;
+		char *endptr;
+
+		errno = 0;
+		id = strtoull(config.cmdline_evict, &endptr, 16);
+		if (config.cmdline_evict == endptr || *endptr != '\0' ||
+		    errno != 0)
+			log_fatal("Invalid option for --evict (-E). Must be the"
+				  " ID of a client, as --status shows it.");
+		switch (evict_client(id)) {
+		case 1:
+			log_info("Successfully evicted client %016" PRIx64 ".",
+				 id);
+			break;
+		case 0:
+			log_info("No registered client has ID %016" PRIx64 ".",
+				 id);
+			break;
+		default:
+			log_info("Failed to evict client %016" PRIx64 ".", id);
+			break;
+		}
+		actions_done++;
+	}
+
+	if (config.cmdline_duration != NULL && config.cmdline_boost == NULL)
+		log_fatal("--duration (-d) only goes with --boost (-B).");
+
+	if (config.cmdline_boost != NULL) {
+		uint64_t id;
+		long long duration_s;
+		char *endptr;
+
+		errno = 0;
+		id = strtoull(config.cmdline_boost, &endptr, 16);
+		if (config.cmdline_boost == endptr || *endptr != '\0' ||
+		    errno != 0)
+			log_fatal("Invalid option for --boost (-B). Must be the"
+				  " ID of a client, as --status shows it.");
+		if (config.cmdline_duration == NULL)
+			log_fatal("--boost (-B) needs a --duration (-d).");
+		duration_s = parse_duration_s(config.cmdline_duration);
+		if (duration_s < 0)
+			log_fatal("Invalid option for --duration (-d). Must be"
+				  " a number of seconds, or of minutes or hours"
+				  " with an m or h suffix, up to a day.");
+		switch (boost_client(id, duration_s)) {
+		case 1:
+			if (duration_s > 0)
+				log_info("Successfully boosted client %016"
+					 PRIx64 " for %lld s.", id, duration_s);
+			else log_info("Successfully ended the boost of client"
+				      " %016" PRIx64 ".", id);
+			break;
+		case 0:
+			log_info("No registered client has ID %016" PRIx64 ".",
+				 id);
+			break;
+		default:
+			log_info("Failed to boost client %016" PRIx64 ".", id);
+			break;
+		}
+		actions_done++;
+	}
+
+	if (config.json && !config.status && !config.clients)
+		log_fatal("--json (-j) only goes with --status (-s) or"
+			  " --clients (-c).");
+
+	if (config.status) {
+		if (show_status(0, config.json) != 0)
+			log_info("Failed to get the nvshare-scheduler status.");
+		actions_done++;
+	}
+
+	if (config.clients) {
+		if (show_status(1, config.json) != 0)
+			log_info("Failed to get the nvshare-scheduler clients.");
+		actions_done++;
+	}
+
 	/* help? */
 	if (config.help || (actions_done == 0)) {
 		xoptAutohelpOptions opts;
@@ -29,12 +29,35 @@
 #include <sys/stat.h>
 #include <semaphore.h>
 #include <errno.h>
+#include <stdarg.h>
+#include <limits.h>
+#include <poll.h>
+#include <sys/socket.h>
 
 #include "comm.h"
 #include "common.h"
+#include "calltrace.h"
 #include "client.h"
 #include "cuda_defs.h"
 
+#define ENV_NVSHARE_KERNEL_COALESCE_WINDOW "NVSHARE_KERNEL_COALESCE_WINDOW"
+#define ENV_NVSHARE_FALLBACK_TIMEOUT_MS "NVSHARE_FALLBACK_TIMEOUT_MS"
+#define ENV_NVSHARE_RECONNECT_TIMEOUT_MS "NVSHARE_RECONNECT_TIMEOUT_MS"
+#define ENV_NVSHARE_STREAM_SYNC "NVSHARE_STREAM_SYNC"
+#define ENV_NVSHARE_CLIENT_NAME "NVSHARE_CLIENT_NAME"
+#define ENV_NVSHARE_CONNECT_RETRIES "NVSHARE_CONNECT_RETRIES"
+#define ENV_NVSHARE_CONNECT_BACKOFF_MS "NVSHARE_CONNECT_BACKOFF_MS"
+#define ENV_NVSHARE_VERSION_MISMATCH "NVSHARE_VERSION_MISMATCH"
+
+#define DEFAULT_RECONNECT_TIMEOUT_MS 30000
+
+/* Exponential backoff between attempts to (re)connect to the scheduler */
+#define CONNECT_RETRY_MIN_MS 100
+#define CONNECT_RETRY_MAX_MS 5000
+
+/* How many streams we track per slice before we give up on stream sync */
+#define SLICE_STREAMS_MAX 16
+
 void *client_fn(void *arg __attribute__((unused)));
 void *release_early_fn(void *arg __attribute__((unused)));
 
@@ -52,10 +75,127 @@ int release_early_check_interval = 5;
 int own_lock;
 int need_lock;
 int did_work;
+int standalone;
+/*
+ * With NVSHARE_TIMESLICE=off, we don't time-slice the GPU with other
+ * applications, i.e., we run in standalone mode. hook.c reads it.
+ */
+int timeslice = 1;
+/*
+ * Number of consecutive kernel launches that may skip synchronizing with the
+ * client thread while we hold the GPU lock. 0 disables coalescing.
+ */
+unsigned int kernel_coalesce_window = 0;
+unsigned int kernels_since_check = 0;
+unsigned long long kernels_coalesced = 0;
+/*
+ * If we can't register with the scheduler within this many ms, fall back to
+ * standalone mode instead of failing. -1 means never fall back.
+ */
+long fallback_timeout_ms = -1;
+/*
+ * With NVSHARE_VERSION_MISMATCH=standalone, fall back to standalone mode
+ * instead of failing if we and the scheduler don't speak compatible protocol
+ * versions, e.g., because a long-lived container still has the libnvshare
+ * of an older release mounted during a rolling upgrade of the node.
+ */
+int mismatch_standalone = 0;
+/*
+ * How long to keep trying to reattach to the scheduler after losing the
+ * connection to it.
+ */
+long reconnect_timeout_ms = DEFAULT_RECONNECT_TIMEOUT_MS;
+/*
+ * How many times to retry connecting to the scheduler at startup, and how
+ * long to wait before the first retry. The wait doubles with every retry,
+ * up to CONNECT_RETRY_MAX_MS.
+ */
+long connect_retries = 0;
+long connect_backoff_ms = CONNECT_RETRY_MIN_MS;
+/*
+ * Number of clients registered with the scheduler, including us, as last
+ * reported by it. Older schedulers don't report it, so assume we're alone.
+ */
+int registered_clients = 1;
+/*
+ * While the scheduler is under load, it asks us to wait for
+ * backpressure_pause_ms after we release the lock before we request it
+ * again. 0 means no backpressure. lock_released_ts is when we last released
+ * the lock.
+ */
+long backpressure_pause_ms = 0;
+struct timespec lock_released_ts;
+/*
+ * When stream sync is enabled, we track the streams the application submits
+ * work to during its slice and only synchronize those when we hand the GPU
+ * over, instead of the whole context.
+ *
+ * If we can't be sure that we've seen every stream (too many of them, the
+ * per-thread default stream, or a stream destroyed mid-slice), we fall back
+ * to synchronizing the whole context.
+ */
+int stream_sync = 0;
+pthread_mutex_t slice_streams_mutex = PTHREAD_MUTEX_INITIALIZER;
+CUstream slice_streams[SLICE_STREAMS_MAX];
+int slice_streams_cnt = 0;
+int slice_streams_incomplete = 0;
+/*
+ * The GPU memory the application has committed and the physical GPU memory,
+ * in MiB, for the node-wide oversubscription check of the scheduler.
+ */
+size_t mem_committed_mib = 0;
+size_t mem_total_mib = 0;
+long long mem_reported_mib = -1; /* What we last told the scheduler */
+char gpu_uuid[NVSHARE_GPU_UUID_LEN] = ""; /* Empty until we know it */
+/* The CUDA contexts the application has created, see cuCtxCreate() */
+long live_contexts_cnt = 0;
+long contexts_reported = -1; /* What we last told the scheduler */
+/* Our REGISTER message. We reuse the Pod information when reattaching. */
+struct message register_msg = {0};
+/*
+ * Our IDENTITY message, if we know our Pod UID or our device slot, see
+ * read_identity()
+ */
+struct message identity_msg = {0};
 uint64_t nvshare_client_id;
 char nvscheduler_socket_path[NVSHARE_SOCK_PATH_MAX];
 
 
+/*
+ * Send a whole message to the scheduler.
+ *
+ * Unlike write(), don't raise SIGPIPE if the scheduler has gone away, as
+ * that would kill the application. The client thread notices the dropped
+ * connection and reattaches.
+ *
+ * Return 0 on success, -1 on error.
+ */
+static int send_to_scheduler(int sock, const struct message *msg)
+{
+	size_t sent = 0;
+	ssize_t ret;
+
+	while (sent < sizeof(*msg)) {
+		ret = RETRY_INTR(send(sock, (const char *)msg + sent,
+				      sizeof(*msg) - sent, MSG_NOSIGNAL));
+		if (ret < 0) return -1;
+		sent += ret;
+	}
+	log_debug("Sent %s", message_type_string[msg->type]);
+	return 0;
+}
+
+
+static long elapsed_ms_since(const struct timespec *start)
+{
+	struct timespec now, elapsed;
+
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &now) == 0);
+	timespecsub(&now, start, &elapsed);
+	return elapsed.tv_sec * 1000 + elapsed.tv_nsec / 1000000;
+}
+
+
 static void cuda_sync_context(void) {
 	CUresult cu_err = CUDA_SUCCESS;
 
@@ -67,6 +207,97 @@ static void cuda_sync_context(void) {
 }
 
 
+/* Remember that the application submitted work to a stream in this slice. */
+void track_stream(CUstream stream)
+{
+	int i;
+
+	if (!stream_sync) return;
+
+	true_or_exit(pthread_mutex_lock(&slice_streams_mutex) == 0);
+	if (slice_streams_incomplete) goto out;
+	/*
+	 * The per-thread default stream of the client thread isn't the one
+	 * of the application thread, so we can't synchronize it for them.
+	 */
+	if (stream == CU_STREAM_PER_THREAD) {
+		slice_streams_incomplete = 1;
+		goto out;
+	}
+	for (i = 0; i < slice_streams_cnt; i++)
+		if (slice_streams[i] == stream) goto out;
+	if (slice_streams_cnt == SLICE_STREAMS_MAX) {
+		slice_streams_incomplete = 1;
+		goto out;
+	}
+	slice_streams[slice_streams_cnt++] = stream;
+out:
+	true_or_exit(pthread_mutex_unlock(&slice_streams_mutex) == 0);
+}
+
+
+/*
+ * The application is about to destroy a stream. Any work it submitted to
+ * the stream still completes, but we can no longer synchronize it.
+ */
+void forget_stream(CUstream stream)
+{
+	int i;
+
+	if (!stream_sync) return;
+
+	true_or_exit(pthread_mutex_lock(&slice_streams_mutex) == 0);
+	for (i = 0; i < slice_streams_cnt; i++)
+		if (slice_streams[i] == stream) slice_streams_incomplete = 1;
+	true_or_exit(pthread_mutex_unlock(&slice_streams_mutex) == 0);
+}
+
+
+/*
+ * Wait for the work the application submitted during its slice to finish,
+ * before we hand the GPU over.
+ *
+ * With stream sync, only synchronize the streams we've seen in this slice.
+ * Otherwise, or if stream tracking is incomplete, synchronize the whole
+ * context.
+ */
+static void cuda_sync_slice(void)
+{
+	CUresult cu_err = CUDA_SUCCESS;
+	struct timespec start;
+	int i, cnt;
+
+	if (!stream_sync) {
+		cuda_sync_context();
+		return;
+	}
+
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &start) == 0);
+	true_or_exit(pthread_mutex_lock(&slice_streams_mutex) == 0);
+	cnt = slice_streams_cnt;
+	if (!slice_streams_incomplete) {
+		pending_kernel_window = 1;
+		cu_err = real_cuCtxSetCurrent(cuda_ctx);
+		cuda_driver_check_error(cu_err,
+					CUDA_SYMBOL_STRING(cuCtxSetCurrent));
+		for (i = 0; i < cnt && cu_err == CUDA_SUCCESS; i++) {
+			cu_err = real_cuStreamSynchronize(slice_streams[i]);
+			cuda_driver_check_error(cu_err,
+				CUDA_SYMBOL_STRING(cuStreamSynchronize));
+		}
+	}
+	if (slice_streams_incomplete || cu_err != CUDA_SUCCESS) {
+		cuda_sync_context();
+		log_debug("Synchronized the whole context in %ld ms",
+			  elapsed_ms_since(&start));
+	} else log_debug("Synchronized %d stream(s) in %ld ms", cnt,
+			 elapsed_ms_since(&start));
+	slice_streams_cnt = 0;
+	slice_streams_incomplete = 0;
+	true_or_exit(pthread_mutex_unlock(&slice_streams_mutex) == 0);
+}
+
+
 /*
  * Only returns if the client has the GPU lock or if the scheduler is off.
  */
@@ -74,6 +305,9 @@ void continue_with_lock(void)
 {
 	CUresult cu_err = CUDA_SUCCESS;
 	static int cuda_ctx_ok = 0;
+	struct timespec deadline;
+	long pause_ms;
+	int ret;
 
 	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
 	if (cuda_ctx_ok == 0) {
@@ -85,14 +319,42 @@ void continue_with_lock(void)
 		}
 		cuda_ctx_ok = 1;
 	}
+	if (own_lock == 0) waited_for_lock = 1;
 	while (own_lock == 0) {
 		/*
 		 * The application may comprise multiple threads. We must
 		 * request the lock only once on behalf of the whole app.
 		 */
+		pause_ms = need_lock == 0 && backpressure_pause_ms > 0 ?
+			   backpressure_pause_ms -
+			   elapsed_ms_since(&lock_released_ts) : 0;
+		if (pause_ms > 0) {
+			/* The scheduler is under load, back off for a bit */
+			true_or_exit(clock_gettime(CLOCK_REALTIME,
+				     &deadline) == 0);
+			deadline.tv_sec += pause_ms / 1000;
+			deadline.tv_nsec += (pause_ms % 1000) * 1000000;
+			if (deadline.tv_nsec >= 1000000000) {
+				deadline.tv_sec++;
+				deadline.tv_nsec -= 1000000000;
+			}
+			ret = pthread_cond_timedwait(&own_lock_cv,
+						     &global_mutex, &deadline);
+			if (ret != 0 && ret != ETIMEDOUT) {
+				errno = ret;
+				log_fatal_errno("pthread_cond_timedwait()"
+						" failed");
+			}
+			continue;
+		}
 		if (need_lock == 0) {
 			need_lock = 1;
-			true_or_exit(write_whole(rsock, &req_lock_msg, sizeof(req_lock_msg)) == sizeof(req_lock_msg));
+			/*
+			 * If this fails, the client thread will reattach and
+			 * wake us up to request the lock again.
+			 */
+			if (send_to_scheduler(rsock, &req_lock_msg) != 0)
+				log_debug("Failed to request the GPU lock");
 		}
 
 		true_or_exit(pthread_cond_wait(&own_lock_cv, &global_mutex) == 0);
@@ -106,6 +368,32 @@ void continue_with_lock(void)
 }
 
 
+/*
+ * Kernel launches are by far the most frequent calls we intercept. When
+ * coalescing is enabled and we hold the GPU lock, let up to
+ * kernel_coalesce_window consecutive launches skip the global mutex and the
+ * early release bookkeeping in continue_with_lock().
+ *
+ * We still check own_lock on every launch, so we stop coalescing as soon as
+ * the scheduler takes the lock away from us. However, a launch that races
+ * with a DROP_LOCK may reach the GPU right after we've synchronized the
+ * context. This is the price we pay for less per-call overhead.
+ */
+void continue_with_lock_kernel(void)
+{
+	if (kernel_coalesce_window > 0 &&
+	    __atomic_load_n(&own_lock, __ATOMIC_ACQUIRE) &&
+	    __atomic_fetch_add(&kernels_since_check, 1, __ATOMIC_RELAXED) <
+	    kernel_coalesce_window) {
+		__atomic_fetch_add(&kernels_coalesced, 1, __ATOMIC_RELAXED);
+		return;
+	}
+
+	continue_with_lock();
+	__atomic_store_n(&kernels_since_check, 0, __ATOMIC_RELAXED);
+}
+
+
 /* We use the HOSTNAME environment variable to read the Kubernetes pod name,
  * when we are running on Kubernetes.
  *
@@ -165,6 +453,679 @@ out_ns_none:
 }
 
 
+/*
+ * Identify the instance of the container we run in, using the start time of
+ * PID 1 of our PID namespace. All processes of a container see the same
+ * value, which changes every time the container restarts.
+ *
+ * Return 0 on success, -1 on error.
+ */
+static int read_container_generation(unsigned long long *generation)
+{
+	char buf[1024];
+	char *p;
+	FILE *fp;
+	int field;
+
+	fp = fopen("/proc/1/stat", "r");
+	if (fp == NULL) return -1;
+	p = fgets(buf, sizeof(buf), fp);
+	true_or_exit(fclose(fp) == 0);
+	if (p == NULL) return -1;
+
+	/* The command name may contain spaces, so skip past it */
+	p = strrchr(buf, ')');
+	if (p == NULL) return -1;
+
+	/* The start time is the 22nd field. The state is the 3rd. */
+	for (field = 3; field <= 22; field++) {
+		p = strchr(p, ' ');
+		if (p == NULL) return -1;
+		p++;
+	}
+	if (sscanf(p, "%llu", generation) != 1) return -1;
+	return 0;
+}
+
+
+/*
+ * Tell the scheduler in the data segment of the REGISTER message that we run
+ * without an nvshare device, if the device plugin told us so.
+ */
+static void add_overflow_field(char *data, size_t size)
+{
+	size_t len = strlen(data);
+
+	if (getenv(ENV_NVSHARE_DEVICE_SLOT) == NULL &&
+	    getenv(ENV_NVSHARE_OVERFLOW) != NULL)
+		snprintf(data + len, size - len, " %s=1",
+			 NVSHARE_OVERFLOW_FIELD);
+}
+
+
+/*
+ * Put the fields that identify our container in the data segment of the
+ * IDENTITY message, if the device plugin told us our device slot. They don't
+ * fit in REGISTER along with our protocol version.
+ *
+ * Return 0 if we did, -1 otherwise.
+ */
+static int set_container_fields(char *data, size_t size)
+{
+	char *slot;
+	unsigned long long generation;
+	int ret;
+
+	slot = getenv(ENV_NVSHARE_DEVICE_SLOT);
+	if (slot == NULL) return -1;
+	if (read_container_generation(&generation) != 0) {
+		log_debug("Could not identify the instance of our container");
+		return -1;
+	}
+	/* Keep the low 32 bits, a collision is harmless and very unlikely */
+	ret = snprintf(data, size, "%s=%s %s=%llx", NVSHARE_SLOT_FIELD, slot,
+		       NVSHARE_GENERATION_FIELD, generation & 0xffffffffULL);
+	if (ret < 0 || (size_t)ret >= size) {
+		log_warn("Device slot %s is too long, the scheduler won't"
+			 " recognize a restart of our container", slot);
+		data[0] = '\0';
+		return -1;
+	}
+	return 0;
+}
+
+
+/*
+ * On Kubernetes, the device plugin tells us which protocol version the
+ * nvshare components on the node speak. A mismatch means that this
+ * libnvshare and the node are from different releases, which can happen in
+ * the middle of a rolling upgrade. Warn loudly, as things may break in
+ * obscure ways.
+ */
+static void check_protocol_version(void)
+{
+	char *value, *endptr;
+	long version;
+
+	value = getenv(ENV_NVSHARE_PROTOCOL_VERSION);
+	if (value == NULL) return;
+
+	errno = 0;
+	version = strtol(value, &endptr, 10);
+	if (value == endptr || *endptr != '\0' || errno != 0) {
+		log_warn("Could not parse %s = %s",
+			 ENV_NVSHARE_PROTOCOL_VERSION, value);
+		return;
+	}
+	if (version != NVSHARE_PROTOCOL_VERSION)
+		log_warn("Version skew: libnvshare speaks protocol version %d,"
+			 " but the nvshare device plugin expects version %ld."
+			 " Are you in the middle of an upgrade?",
+			 NVSHARE_PROTOCOL_VERSION, version);
+	else log_debug("Protocol version = %d", NVSHARE_PROTOCOL_VERSION);
+}
+
+
+/*
+ * Log the error the scheduler sent us along with turning us away and return
+ * its code.
+ */
+static int log_scheduler_error(const struct message *in_msg)
+{
+	char code[MSG_DATA_LEN + 1];
+	int ret = -1;
+
+	if (nvshare_msg_get_field(in_msg->data, NVSHARE_ERROR_FIELD, code,
+				  sizeof(code)) == 0)
+		ret = atoi(code);
+	log_warn("nvshare-scheduler turned us away: %.*s (error %d)",
+		 (int)sizeof(in_msg->pod_name), in_msg->pod_name, ret);
+	return ret;
+}
+
+
+/*
+ * Build our IDENTITY message from the UID of our Pod and the name of our
+ * container, which the user passes to us, e.g., through the Downward API,
+ * and from our device slot and the instance of our container. Without the
+ * Pod UID, the scheduler knows us by our ID only.
+ */
+static void read_identity(void)
+{
+	char *uid, *container;
+
+	if (set_container_fields(identity_msg.data,
+				 sizeof(identity_msg.data)) == 0)
+		identity_msg.type = IDENTITY;
+
+	uid = getenv(ENV_NVSHARE_POD_UID);
+	if (uid == NULL || *uid == '\0') return;
+	container = getenv(ENV_NVSHARE_CONTAINER_NAME);
+	if (container == NULL) container = "";
+	if (strlen(uid) > NVSHARE_POD_UID_LEN_MAX || strchr(uid, '/') != NULL ||
+	    strlen(container) > NVSHARE_CONTAINER_LEN_MAX) {
+		log_warn("Ignoring %s and %s, they are not a valid Pod UID and"
+			 " container name", ENV_NVSHARE_POD_UID,
+			 ENV_NVSHARE_CONTAINER_NAME);
+		return;
+	}
+	identity_msg.type = IDENTITY;
+	snprintf(identity_msg.pod_name, sizeof(identity_msg.pod_name),
+		 "%s/%s", uid, container);
+	log_debug("Pod UID = %s, container = %s", uid, container);
+}
+
+
+/* Send our IDENTITY message, if we have one, ahead of REGISTER or REATTACH */
+static int send_identity(int sock)
+{
+	if (identity_msg.type != IDENTITY) return 0;
+	return send_to_scheduler(sock, &identity_msg);
+}
+
+
+/*
+ * Connect to the scheduler once, send out_msg (REGISTER or REATTACH) and
+ * wait up to timeout_ms for the initial scheduler status.
+ *
+ * On success, store the connected socket in *sock and return 0. Return -1
+ * on timeout or error.
+ */
+static int try_register(int *sock, const struct message *out_msg,
+	struct message *in_msg, long timeout_ms)
+{
+	struct pollfd pfd;
+	int ret;
+
+	if (nvshare_connect(sock, nvscheduler_socket_path) != 0) return -1;
+	if (send_identity(*sock) != 0 ||
+	    send_to_scheduler(*sock, out_msg) != 0)
+		goto out_with_sock;
+
+	pfd.fd = *sock;
+	pfd.events = POLLIN;
+	ret = RETRY_INTR(poll(&pfd, 1, (int)max(timeout_ms, 0L)));
+	if (ret <= 0) goto out_with_sock;
+	if (nvshare_receive_block(*sock, in_msg, sizeof(*in_msg)) !=
+	    sizeof(*in_msg))
+		goto out_with_sock;
+	/* Whatever the error, it may go away, so let the caller retry */
+	if (in_msg->type == SCHED_ERROR) {
+		(void)log_scheduler_error(in_msg);
+		goto out_with_sock;
+	}
+	return 0;
+
+out_with_sock:
+	close(*sock);
+	return -1;
+}
+
+
+/*
+ * Connect to the scheduler, retrying up to connect_retries times if it isn't
+ * there yet, e.g., because our container started before the scheduler
+ * socket was ready.
+ *
+ * Return 0 on success, -1 when out of retries.
+ */
+static int connect_with_retries(int *sock)
+{
+	long retry, backoff_ms = connect_backoff_ms;
+
+	for (retry = 1; ; retry++) {
+		if (nvshare_connect(sock, nvscheduler_socket_path) == 0)
+			return 0;
+		if (retry > connect_retries) return -1;
+		log_warn("Could not connect to nvshare-scheduler at %s: %s."
+			 " Retrying in %ld ms (%ld of %ld).",
+			 nvscheduler_socket_path, strerror(errno), backoff_ms,
+			 retry, connect_retries);
+		usleep(backoff_ms * 1000);
+		backoff_ms = min(backoff_ms * 2, (long)CONNECT_RETRY_MAX_MS);
+	}
+}
+
+
+/*
+ * Keep trying to register with the scheduler, backing off exponentially
+ * between attempts, giving up after timeout_ms.
+ *
+ * Return 0 on success, -1 on timeout.
+ */
+static int register_with_retries(int *sock, const struct message *out_msg,
+	struct message *in_msg, long timeout_ms)
+{
+	struct timespec start;
+	long remaining, backoff_ms = CONNECT_RETRY_MIN_MS;
+
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &start) == 0);
+	while (1) {
+		remaining = timeout_ms - elapsed_ms_since(&start);
+		if (try_register(sock, out_msg, in_msg, remaining) == 0)
+			return 0;
+		remaining = timeout_ms - elapsed_ms_since(&start);
+		if (remaining <= 0) return -1;
+		usleep(min(remaining, backoff_ms) * 1000);
+		backoff_ms = min(backoff_ms * 2, (long)CONNECT_RETRY_MAX_MS);
+	}
+}
+
+
+/*
+ * Tell the scheduler our human-friendly name, if the user gave us one.
+ * Otherwise, the scheduler names us after our Pod.
+ */
+static void send_client_name(int sock)
+{
+	struct message msg = {0};
+	char *name;
+
+	name = getenv(ENV_NVSHARE_CLIENT_NAME);
+	if (name == NULL || *name == '\0') return;
+
+	msg.type = CLIENT_NAME;
+	msg.id = nvshare_client_id;
+	if (strlcpy(msg.pod_name, name, sizeof(msg.pod_name)) >=
+	    sizeof(msg.pod_name))
+		log_warn("Client name is longer than %zu characters."
+			 " Truncating it.", sizeof(msg.pod_name) - 1);
+	if (send_to_scheduler(sock, &msg) != 0)
+		log_warn("Failed to send our name to nvshare-scheduler");
+}
+
+
+/*
+ * Tell the scheduler our share of the GPU, if the device plugin gave us one
+ * (i.e., our container requested millishares). Otherwise, the scheduler
+ * treats us as having a full share.
+ */
+static void send_share(int sock)
+{
+	struct message msg = {0};
+	char *value, *endptr;
+	long long millishares;
+
+	value = getenv(ENV_NVSHARE_MILLISHARES);
+	if (value == NULL) return;
+
+	errno = 0;
+	millishares = strtoll(value, &endptr, 10);
+	if (value == endptr || *endptr != '\0' || errno != 0 ||
+	    millishares < 1 || millishares > NVSHARE_FULL_SHARE) {
+		log_warn("Ignoring invalid %s = %s, must be in [1, %d]",
+			 ENV_NVSHARE_MILLISHARES, value, NVSHARE_FULL_SHARE);
+		return;
+	}
+
+	msg.type = SHARE;
+	msg.id = nvshare_client_id;
+	snprintf(msg.data, sizeof(msg.data), "%s=%lld", NVSHARE_SHARE_FIELD,
+		 millishares);
+	if (send_to_scheduler(sock, &msg) != 0)
+		log_warn("Failed to send our share to nvshare-scheduler");
+}
+
+
+/*
+ * Tell the scheduler how much GPU memory we reserve upfront, if any, so that
+ * it accounts it before we allocate it. libnvshare has already checked the
+ * value at startup.
+ */
+static void send_reservation(int sock)
+{
+	struct message msg = {0};
+	char *value;
+	long reserve_mib;
+
+	value = getenv(ENV_NVSHARE_RESERVE_MEMORY_MIB);
+	if (value == NULL) return;
+	reserve_mib = strtol(value, NULL, 10);
+	if (reserve_mib <= 0 || reserve_mib > INT_MAX) return;
+
+	msg.type = RESERVE;
+	msg.id = nvshare_client_id;
+	snprintf(msg.data, sizeof(msg.data), "%s=%d",
+		 NVSHARE_RESERVED_FIELD, (int)reserve_mib);
+	if (send_to_scheduler(sock, &msg) != 0)
+		log_warn("Failed to send our memory reservation to"
+			 " nvshare-scheduler");
+}
+
+
+/*
+ * Tell the scheduler our workload type, if the user declared one, so that it
+ * applies its defaults for the type. The admission webhook sets it from the
+ * nvshare.com/workload-type annotation of the Pod.
+ */
+static void send_workload_type(int sock)
+{
+	struct message msg = {0};
+	char *type;
+
+	type = getenv(ENV_NVSHARE_WORKLOAD_TYPE);
+	if (type == NULL || *type == '\0') return;
+
+	if (strlen(type) > NVSHARE_WORKLOAD_TYPE_MAX ||
+	    strpbrk(type, " \t=") != NULL) {
+		log_warn("Ignoring invalid %s = %s, must be at most %d"
+			 " characters without spaces or '='",
+			 ENV_NVSHARE_WORKLOAD_TYPE, type,
+			 NVSHARE_WORKLOAD_TYPE_MAX);
+		return;
+	}
+
+	msg.type = WORKLOAD;
+	msg.id = nvshare_client_id;
+	snprintf(msg.data, sizeof(msg.data), "%s=%s", NVSHARE_WORKLOAD_FIELD,
+		 type);
+	if (send_to_scheduler(sock, &msg) != 0)
+		log_warn("Failed to send our workload type to"
+			 " nvshare-scheduler");
+}
+
+
+/*
+ * Tell the scheduler how much GPU memory we have committed.
+ *
+ * Called with global_mutex held.
+ */
+static void send_memory_usage(int sock)
+{
+	struct message msg = {0};
+
+	if (standalone || sock < 0) return;
+
+	msg.type = MEM_USAGE;
+	msg.id = nvshare_client_id;
+	snprintf(msg.data, sizeof(msg.data), "%s=%zu %s=%zu",
+		 NVSHARE_COMMITTED_FIELD, mem_committed_mib,
+		 NVSHARE_TOTAL_FIELD, mem_total_mib);
+	snprintf(msg.pod_name, sizeof(msg.pod_name), "%s", gpu_uuid);
+	if (send_to_scheduler(sock, &msg) != 0) {
+		log_debug("Failed to report our memory usage");
+		return;
+	}
+	mem_reported_mib = (long long)mem_committed_mib;
+}
+
+
+/*
+ * Tell the scheduler how many CUDA contexts we have created.
+ *
+ * Called with global_mutex held.
+ */
+static void send_context_count(int sock)
+{
+	struct message msg = {0};
+
+	if (standalone || sock < 0) return;
+
+	msg.type = CONTEXTS;
+	msg.id = nvshare_client_id;
+	snprintf(msg.data, sizeof(msg.data), "%s=%ld", NVSHARE_CONTEXTS_FIELD,
+		 live_contexts_cnt);
+	if (send_to_scheduler(sock, &msg) != 0) {
+		log_debug("Failed to report our context count");
+		return;
+	}
+	contexts_reported = live_contexts_cnt;
+}
+
+
+/* Called by the context hooks whenever the application's contexts change */
+void report_context_count(long contexts)
+{
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	live_contexts_cnt = contexts;
+	if (live_contexts_cnt != contexts_reported) send_context_count(rsock);
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+}
+
+
+/*
+ * Called by the memory hooks, which must not wait for global_mutex, as the
+ * client thread may hold it for long while synchronizing.
+ */
+int scheduler_client_count(void)
+{
+	return __atomic_load_n(&registered_clients, __ATOMIC_RELAXED);
+}
+
+
+/*
+ * Called by the memory hooks whenever our allocations change. We only talk
+ * to the scheduler when the committed memory changes by at least a MiB, to
+ * keep the chatter down for applications that make many small allocations.
+ */
+void report_memory_usage(size_t committed, size_t total)
+{
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	mem_committed_mib = committed / (1 MiB);
+	mem_total_mib = total / (1 MiB);
+	if ((long long)mem_committed_mib != mem_reported_mib)
+		send_memory_usage(rsock);
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+}
+
+
+/*
+ * Called by the memory hooks when an allocation fails for lack of GPU memory,
+ * so that the scheduler learns about the memory pressure on the GPU.
+ */
+void report_oom(size_t bytesize)
+{
+	struct message msg = {0};
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	if (!standalone && rsock >= 0) {
+		msg.type = OOM;
+		msg.id = nvshare_client_id;
+		snprintf(msg.data, sizeof(msg.data), "%s=%zu",
+			 NVSHARE_OOM_FIELD, (bytesize + (1 MiB) - 1) / (1 MiB));
+		if (send_to_scheduler(rsock, &msg) != 0)
+			log_debug("Failed to report running out of GPU"
+				  " memory");
+	}
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+}
+
+
+/* Called by the memory hooks once they know which GPU we use */
+void report_gpu_uuid(const char *uuid)
+{
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	snprintf(gpu_uuid, sizeof(gpu_uuid), "%s", uuid);
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+}
+
+
+/*
+ * We and the scheduler don't speak compatible protocol versions. Fail, or
+ * return -1 to have the caller fall back to standalone mode, depending on
+ * mismatch_standalone.
+ */
+static int version_mismatch(const char *fmt, ...)
+{
+	char why[512];
+	va_list ap;
+
+	va_start(ap, fmt);
+	vsnprintf(why, sizeof(why), fmt, ap);
+	va_end(ap);
+	if (!mismatch_standalone)
+		log_fatal("%s. Make sure libnvshare and nvshare-scheduler come"
+			  " from compatible releases, or set %s=standalone to"
+			  " run without the scheduler meanwhile.", why,
+			  ENV_NVSHARE_VERSION_MISMATCH);
+	log_warn("%s. Falling back to standalone mode. This application will"
+		 " NOT share the GPU fairly with others.", why);
+	return -1;
+}
+
+
+/*
+ * The scheduler has accepted us, so it says it speaks our protocol version.
+ * Schedulers older than NVSHARE_SCHED_VERSION_MIN_VERSION don't tell us
+ * their version, and the oldest ones accept every client without checking.
+ */
+static int check_scheduler_version(const struct message *in_msg)
+{
+	int version = nvshare_msg_get_version(in_msg->pod_name);
+
+	if (version < 0)
+		return version_mismatch("nvshare-scheduler reported a"
+					" malformed protocol version");
+	if (version < NVSHARE_PROTOCOL_VERSION)
+		return version_mismatch("nvshare-scheduler speaks protocol"
+			" version %d (or doesn't tell, being older than version"
+			" %d), which is older than version %d of this"
+			" libnvshare", version,
+			NVSHARE_SCHED_VERSION_MIN_VERSION,
+			NVSHARE_PROTOCOL_VERSION);
+	if (version > NVSHARE_PROTOCOL_VERSION)
+		log_info("nvshare-scheduler speaks protocol version %d and"
+			 " supports version %d of this libnvshare", version,
+			 NVSHARE_PROTOCOL_VERSION);
+	else log_debug("nvshare-scheduler speaks protocol version %d",
+		       version);
+	return 0;
+}
+
+
+/*
+ * Handle the scheduler status we receive when we (re)register. Return -1 if
+ * we must fall back to standalone mode, see version_mismatch().
+ *
+ * Called with global_mutex held.
+ */
+static int handle_initial_sched_status(const struct message *in_msg)
+{
+	char versions[MSG_DATA_LEN + 1];
+
+	switch (in_msg->type) {
+	case SCHED_ON:
+		log_debug("Received %s", message_type_string[in_msg->type]);
+		if (check_scheduler_version(in_msg) != 0) return -1;
+
+		true_or_exit(sscanf(in_msg->data, "%" SCNx64, &nvshare_client_id) == 1);
+		scheduler_on = 1;
+		own_lock = 0;
+		need_lock = 0;
+		break;
+
+	case SCHED_OFF:
+		log_debug("Received %s", message_type_string[in_msg->type]);
+		if (check_scheduler_version(in_msg) != 0) return -1;
+
+		true_or_exit(sscanf(in_msg->data, "%" SCNx64, &nvshare_client_id) == 1);
+		scheduler_on = 0;
+		own_lock = 1;
+		need_lock = 0;
+		break;
+
+	case UNSUPPORTED_VERSION:
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_VERSION_FIELD,
+					  versions, sizeof(versions)) != 0)
+			strlcpy(versions, "unknown", sizeof(versions));
+		return version_mismatch("nvshare-scheduler does not support"
+			" protocol version %d of this libnvshare (it supports"
+			" versions %s)", NVSHARE_PROTOCOL_VERSION, versions);
+
+	default:
+		log_fatal("Got message with type (%d) instead of initial"
+			  " nvshare-scheduler status", (int)in_msg->type);
+		break;
+	}
+	return 0;
+}
+
+
+/*
+ * Fall back to standalone mode after losing the scheduler. From now on, the
+ * application always holds the GPU lock.
+ *
+ * Called with global_mutex held.
+ */
+static void go_standalone(void)
+{
+	standalone = 1;
+	scheduler_on = 0;
+	own_lock = 1;
+	need_lock = 0;
+	true_or_exit(pthread_cond_broadcast(&own_lock_cv) == 0);
+}
+
+
+/*
+ * The connection to the scheduler dropped, most likely because the
+ * scheduler restarted. Reconnect and ask it to take us back under the same
+ * client ID, so that the rest of libnvshare doesn't have to care.
+ *
+ * The restarted scheduler doesn't know that we may hold the GPU lock, so we
+ * drop it before reconnecting and request it anew afterwards.
+ *
+ * Called from the client thread, without global_mutex held.
+ */
+static void reattach(void)
+{
+	struct message out_msg = register_msg;
+	struct message in_msg;
+	int sock;
+
+	log_warn("Lost connection to nvshare-scheduler, trying to reattach"
+		 " for up to %ld ms", reconnect_timeout_ms);
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	if (scheduler_on && own_lock) {
+		own_lock = 0;
+		cuda_sync_context();
+	}
+	close(rsock);
+	rsock = -1; /* Make app threads fail fast instead of using a stale fd */
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+
+	out_msg.type = REATTACH;
+	out_msg.id = nvshare_client_id;
+	if (register_with_retries(&sock, &out_msg, &in_msg,
+				  reconnect_timeout_ms) != 0) {
+		if (fallback_timeout_ms < 0)
+			log_fatal("Could not reattach to nvshare-scheduler"
+				  " within %ld ms. Is it running?",
+				  reconnect_timeout_ms);
+		log_warn("Could not reattach to nvshare-scheduler within %ld"
+			 " ms, falling back to standalone mode. This"
+			 " application will NOT share the GPU fairly with"
+			 " others.", reconnect_timeout_ms);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		go_standalone();
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		pthread_exit(NULL);
+	}
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	rsock = sock;
+	if (handle_initial_sched_status(&in_msg) != 0) {
+		close(rsock);
+		rsock = -1;
+		go_standalone();
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		pthread_exit(NULL);
+	}
+	send_client_name(rsock);
+	send_share(rsock);
+	send_workload_type(rsock);
+	send_reservation(rsock);
+	/* The scheduler has forgotten our memory usage, if it restarted */
+	if (mem_reported_mib >= 0) send_memory_usage(rsock);
+	if (contexts_reported >= 0) send_context_count(rsock);
+	/* Wake up app threads waiting for the lock, so that they request it */
+	true_or_exit(pthread_cond_broadcast(&own_lock_cv) == 0);
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+	log_info("Reattached to nvshare-scheduler");
+}
+
+
 /*
  * Spawn all nvshare-related threads, bootstrap the client.
  *
@@ -175,9 +1136,16 @@ out_ns_none:
  * 4. Fill in the globally visible req_lock_msg, that the
  *    app threads will send to the nvshare-scheduler to request
  *    the GPU lock.
+ *
+ * In standalone mode, we don't talk to the nvshare-scheduler at all. The
+ * application always holds the GPU lock and only the memory-related logic
+ * of libnvshare is in effect.
  */
 void initialize_client(void)
 {
+	char *value, *endptr;
+	long window;
+
 	scheduler_on = 0;
 	cuda_ctx = NULL;
 	own_lock = 0;
@@ -188,12 +1156,95 @@ void initialize_client(void)
 	true_or_exit(pthread_mutex_init(&global_mutex, NULL) == 0);
 	true_or_exit(sem_init(&got_initial_sched_status, 0, 0) == 0);
 
+	check_protocol_version();
+
+	value = getenv(ENV_NVSHARE_KERNEL_COALESCE_WINDOW);
+	if (value != NULL) {
+		errno = 0;
+		window = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    window < 0 || window > UINT_MAX)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_KERNEL_COALESCE_WINDOW, value);
+		kernel_coalesce_window = (unsigned int)window;
+		if (kernel_coalesce_window > 0)
+			log_info("Coalescing up to %u consecutive kernel"
+				 " launches", kernel_coalesce_window);
+	}
+
+	if (getenv(ENV_NVSHARE_STREAM_SYNC) != NULL) {
+		stream_sync = 1;
+		log_info("Synchronizing only the streams used in each slice"
+			 " when releasing the GPU");
+	}
+
+	value = getenv(ENV_NVSHARE_RECONNECT_TIMEOUT_MS);
+	if (value != NULL) {
+		errno = 0;
+		reconnect_timeout_ms = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    reconnect_timeout_ms < 0 || reconnect_timeout_ms > INT_MAX)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_RECONNECT_TIMEOUT_MS, value);
+	}
+
+	value = getenv(ENV_NVSHARE_CONNECT_RETRIES);
+	if (value != NULL) {
+		errno = 0;
+		connect_retries = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    connect_retries < 0 || connect_retries > INT_MAX)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_CONNECT_RETRIES, value);
+	}
+
+	value = getenv(ENV_NVSHARE_CONNECT_BACKOFF_MS);
+	if (value != NULL) {
+		errno = 0;
+		connect_backoff_ms = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    connect_backoff_ms < 1 ||
+		    connect_backoff_ms > CONNECT_RETRY_MAX_MS)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_CONNECT_BACKOFF_MS, value);
+	}
+
+	value = getenv(ENV_NVSHARE_FALLBACK_TIMEOUT_MS);
+	if (value != NULL) {
+		errno = 0;
+		fallback_timeout_ms = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    fallback_timeout_ms < 0 || fallback_timeout_ms > INT_MAX)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_FALLBACK_TIMEOUT_MS, value);
+	}
+
+	value = getenv(ENV_NVSHARE_VERSION_MISMATCH);
+	if (value != NULL) {
+		if (strcmp(value, "standalone") == 0) mismatch_standalone = 1;
+		else if (strcmp(value, "fail") != 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_VERSION_MISMATCH, value);
+	}
+
+	if (getenv(ENV_NVSHARE_STANDALONE) != NULL || !timeslice) {
+		standalone = 1;
+		own_lock = 1;
+		nvshare_client_id = NVSHARE_UNREGISTERED_ID;
+		log_info("Running in standalone mode, without the"
+			 " nvshare-scheduler. Time-slicing is off.");
+		return;
+	}
+
 	/* Client thread. */
 	true_or_exit(pthread_create(&client_tid, NULL, client_fn, NULL) == 0);
 
 	/* Ensure the client thread has received the initial scheduler status */
 	true_or_exit(RETRY_INTR(sem_wait(&got_initial_sched_status)) == 0);
 
+	/* The client thread gave up on the scheduler */
+	if (standalone) return;
+
 	true_or_exit(pthread_create(&release_early_thread_tid, NULL,
 		     release_early_fn, NULL) == 0);
 
@@ -203,6 +1254,31 @@ void initialize_client(void)
 }
 
 
+/*
+ * Our part of the diagnostics block of libnvshare, see log_diagnostics() in
+ * hook.c: How we reach the scheduler, if at all, and under which name.
+ */
+void log_client_diagnostics(void)
+{
+	if (standalone)
+		log_info("mode: standalone, without nvshare-scheduler");
+	else log_info("mode: time-slicing, client ID %016" PRIx64,
+		      nvshare_client_id);
+	if (nvscheduler_socket_path[0] != '\0')
+		log_info("scheduler: %s", nvscheduler_socket_path);
+	if (register_msg.type == REGISTER)
+		log_info("pod: %s/%s", register_msg.pod_namespace,
+			 register_msg.pod_name);
+	log_debug("config: kernel coalesce window = %u, stream sync = %d,"
+		  " fallback timeout = %ld ms, reconnect timeout = %ld ms,"
+		  " connect retries = %ld, connect backoff = %ld ms,"
+		  " standalone on version mismatch = %d",
+		  kernel_coalesce_window, stream_sync, fallback_timeout_ms,
+		  reconnect_timeout_ms, connect_retries, connect_backoff_ms,
+		  mismatch_standalone);
+}
+
+
 /* The nvshare client main thread.
  *
  * Does the following:
@@ -213,6 +1289,8 @@ void *client_fn(void *arg __attribute__((unused)))
 {
 	struct message in_msg;
 	struct message out_msg;
+	char count[MSG_DATA_LEN + 1];
+	char *value;
 	CUresult cu_err = CUDA_SUCCESS;
 
 	memset(&out_msg, 0, sizeof(out_msg));
@@ -239,49 +1317,74 @@ void *client_fn(void *arg __attribute__((unused)))
 		strlcpy(out_msg.pod_name, "none", sizeof(out_msg.pod_name));
 	}
 
+	log_debug("libnvshare version %s", NVSHARE_VERSION);
 	log_debug("NVSHARE_POD_NAME = %s", out_msg.pod_name);
 	log_debug("NVSHARE_POD_NAMESPACE = %s", out_msg.pod_namespace);
 
 	true_or_exit(nvshare_get_scheduler_path(nvscheduler_socket_path) == 0);
+	value = getenv(ENV_NVSHARE_SCHEDULER_ADDRESS);
+	if (value != NULL && *value != '\0') {
+		if (strlcpy(nvscheduler_socket_path, value,
+			    sizeof(nvscheduler_socket_path)) >=
+		    sizeof(nvscheduler_socket_path))
+			log_fatal("%s is too long: %s",
+				  ENV_NVSHARE_SCHEDULER_ADDRESS, value);
+		log_info("Reaching nvshare-scheduler at %s", value);
+	}
 
 	out_msg.type = REGISTER;
+	snprintf(out_msg.data, sizeof(out_msg.data), "%s=%d",
+		 NVSHARE_VERSION_FIELD, NVSHARE_PROTOCOL_VERSION);
+	add_overflow_field(out_msg.data, sizeof(out_msg.data));
+	register_msg = out_msg;
+	read_identity();
+
+	if (fallback_timeout_ms >= 0) {
+		if (register_with_retries(&rsock, &out_msg, &in_msg,
+					  fallback_timeout_ms) != 0) {
+			log_warn("Could not register with nvshare-scheduler"
+				 " within %ld ms, falling back to standalone"
+				 " mode. This application will NOT share the"
+				 " GPU fairly with others.",
+				 fallback_timeout_ms);
+			true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+			go_standalone();
+			nvshare_client_id = NVSHARE_UNREGISTERED_ID;
+			true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+			true_or_exit(sem_post(&got_initial_sched_status) == 0);
+			return NULL;
+		}
+	} else {
+		if (connect_with_retries(&rsock) != 0)
+			log_fatal("Could not connect to nvshare-scheduler at"
+				  " %s. Is it running?",
+				  nvscheduler_socket_path);
+		true_or_exit(send_identity(rsock) == 0);
+		true_or_exit(write_whole(rsock, &out_msg, sizeof(out_msg)) == sizeof(out_msg));
+		log_debug("Sent %s", message_type_string[out_msg.type]);
 
-	true_or_exit(nvshare_connect(&rsock, nvscheduler_socket_path) == 0);
-	true_or_exit(write_whole(rsock, &out_msg, sizeof(out_msg)) == sizeof(out_msg));
-	log_debug("Sent %s", message_type_string[out_msg.type]);
-
-	/*
-	 * Obtain the inital nvshare-scheduler status
-	 */
-	true_or_exit(nvshare_receive_block(rsock, &in_msg, sizeof(in_msg)) == sizeof(in_msg));
-	switch (in_msg.type) {
-	case SCHED_ON:
-		log_debug("Received %s", message_type_string[in_msg.type]);
-
-		true_or_exit(sscanf(in_msg.data, "%" SCNx64, &nvshare_client_id) == 1);
-		log_info("Successfully initialized nvshare GPU");
-		log_info("Client ID = %016" PRIx64, nvshare_client_id);
-		scheduler_on = 1;
-		own_lock = 0;
-		need_lock = 0;
-		break;
-
-	case SCHED_OFF:
-		log_debug("Received %s", message_type_string[in_msg.type]);
-
-		true_or_exit(sscanf(in_msg.data, "%" SCNx64, &nvshare_client_id) == 1);
-		log_info("Successfully initialized nvshare GPU");
-		log_info("Client ID = %016" PRIx64, nvshare_client_id);
-		scheduler_on = 0;
-		own_lock = 1;
-		need_lock = 0;
-
-		break;
-	default:
-		log_fatal("Got message with type (%d) instead of initial"
-			  " nvshare-scheduler status", (int)in_msg.type);
-		break;
+		/*
+		 * Obtain the inital nvshare-scheduler status
+		 */
+		true_or_exit(nvshare_receive_block(rsock, &in_msg, sizeof(in_msg)) == sizeof(in_msg));
 	}
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	if (handle_initial_sched_status(&in_msg) != 0) {
+		close(rsock);
+		rsock = -1;
+		go_standalone();
+		nvshare_client_id = NVSHARE_UNREGISTERED_ID;
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		true_or_exit(sem_post(&got_initial_sched_status) == 0);
+		return NULL;
+	}
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+	log_info("Successfully initialized nvshare GPU");
+	log_info("Client ID = %016" PRIx64, nvshare_client_id);
+	send_client_name(rsock);
+	send_share(rsock);
+	send_workload_type(rsock);
+	send_reservation(rsock);
 
 	/* The ID will not change henceforth. Fill it in now. */
 	memset(&out_msg, 0, sizeof(out_msg));
@@ -290,7 +1393,11 @@ void *client_fn(void *arg __attribute__((unused)))
 	true_or_exit(sem_post(&got_initial_sched_status) == 0);
 
 	while (1) {
-		true_or_exit(nvshare_receive_block(rsock, &in_msg, sizeof(in_msg)) == sizeof(in_msg));
+		if (nvshare_receive_block(rsock, &in_msg, sizeof(in_msg)) !=
+		    sizeof(in_msg)) {
+			reattach();
+			continue;
+		}
 		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
 
 		switch (in_msg.type) {
@@ -309,10 +1416,15 @@ void *client_fn(void *arg __attribute__((unused)))
 
 			if (own_lock == 1) { /* Sanity check */
 				own_lock = 0; /* Block work submission */
-				cuda_sync_context(); /* Ensure all submitted work done */
+				cuda_sync_slice(); /* Ensure all submitted work done */
+				if (kernel_coalesce_window > 0)
+					log_debug("Coalesced %llu kernel launches"
+						  " so far", kernels_coalesced);
 				out_msg.type = LOCK_RELEASED;
-				true_or_exit(write_whole(rsock, &out_msg, sizeof(out_msg)) == sizeof(out_msg));
-				log_debug("Sent %s", message_type_string[out_msg.type]);
+				if (send_to_scheduler(rsock, &out_msg) != 0)
+					log_debug("Failed to release the GPU lock");
+				true_or_exit(clock_gettime(CLOCK_MONOTONIC,
+					     &lock_released_ts) == 0);
 			}
 
 			break;
@@ -339,6 +1451,57 @@ void *client_fn(void *arg __attribute__((unused)))
 			}
 			break;
 
+		case CLIENT_COUNT:
+			if (nvshare_msg_get_field(in_msg.data,
+						  NVSHARE_CLIENT_COUNT_FIELD,
+						  count, sizeof(count)) != 0 ||
+			    atoi(count) < 1) {
+				log_debug("Ignoring malformed %s",
+					  message_type_string[in_msg.type]);
+				break;
+			}
+			log_debug("%s registered clients", count);
+			__atomic_store_n(&registered_clients, atoi(count),
+					 __ATOMIC_RELAXED);
+			break;
+
+		case BACKPRESSURE:
+			if (nvshare_msg_get_field(in_msg.data,
+						  NVSHARE_BACKPRESSURE_FIELD,
+						  count, sizeof(count)) != 0 ||
+			    atol(count) < 0) {
+				log_debug("Ignoring malformed %s",
+					  message_type_string[in_msg.type]);
+				break;
+			}
+			backpressure_pause_ms = atol(count);
+			if (backpressure_pause_ms > 0)
+				log_info("The scheduler is under load, pausing"
+					 " for %ld ms after releasing the GPU"
+					 " lock", backpressure_pause_ms);
+			else log_info("The scheduler is no longer under load");
+			/* Waiters may be pausing for too long now */
+			true_or_exit(pthread_cond_broadcast(&own_lock_cv) == 0);
+			break;
+
+		case SCHED_ERROR:
+			/*
+			 * The scheduler closes the connection next. If it
+			 * evicted us, a newer instance of our container runs
+			 * in our place, so don't come back to fight it. If an
+			 * operator evicted us, coming back would undo it.
+			 */
+			switch (log_scheduler_error(&in_msg)) {
+			case NVSHARE_ERR_EVICTED:
+				log_fatal("Another instance of this container"
+					  " has taken over, exiting");
+				break;
+			case NVSHARE_ERR_KICKED:
+				log_fatal("Evicted from the GPU, exiting");
+				break;
+			}
+			break;
+
 		default:
 			log_warn("Unknown message type (%d)",
 				 (int)in_msg.type);
@@ -352,6 +1515,67 @@ void *client_fn(void *arg __attribute__((unused)))
 }
 
 
+/* An NVML function we didn't call, as one it depends on doesn't work */
+#define NVML_NOT_PROBED ((nvmlReturn_t)-1)
+
+static void log_nvml_capability(const char *name, int found, nvmlReturn_t ret)
+{
+	if (!found)
+		log_debug("NVML capability %s: missing", name);
+	else if (ret == NVML_NOT_PROBED)
+		log_debug("NVML capability %s: not probed", name);
+	else if (ret != NVML_SUCCESS)
+		log_debug("NVML capability %s: failed with %d", name, (int)ret);
+	else log_debug("NVML capability %s: available", name);
+}
+
+
+/*
+ * NVML may load, yet not support every query, e.g., the utilization of some
+ * GPUs, depending on the driver. Probe every NVML function we rely on once,
+ * in the order they depend on each other, log the lot and only turn off the
+ * features that depend on the functions that don't work. For now, that's
+ * telling whether the application keeps the GPU busy by its utilization,
+ * for which we fall back to timing cuCtxSynchronize().
+ *
+ * Returns whether we can get the utilization of the GPU through dev.
+ */
+static int probe_nvml(nvmlDevice_t *dev)
+{
+	nvmlReturn_t init_ret = NVML_NOT_PROBED;
+	nvmlReturn_t dev_ret = NVML_NOT_PROBED;
+	nvmlReturn_t util_ret = NVML_NOT_PROBED;
+	nvmlUtilization_t util;
+
+	if (!nvml_ok) {
+		log_debug("Could not find NVML, telling whether the GPU is"
+			  " busy by timing cuCtxSynchronize()");
+		return 0;
+	}
+	if (real_nvmlInit != NULL)
+		init_ret = real_nvmlInit();
+	if (init_ret == NVML_SUCCESS && real_nvmlDeviceGetHandleByIndex != NULL)
+		dev_ret = real_nvmlDeviceGetHandleByIndex(0, dev);
+	if (dev_ret == NVML_SUCCESS &&
+	    real_nvmlDeviceGetUtilizationRates != NULL)
+		util_ret = real_nvmlDeviceGetUtilizationRates(*dev, &util);
+
+	log_nvml_capability("nvmlInit", real_nvmlInit != NULL, init_ret);
+	log_nvml_capability("nvmlDeviceGetHandleByIndex",
+			    real_nvmlDeviceGetHandleByIndex != NULL, dev_ret);
+	log_nvml_capability("nvmlDeviceGetUtilizationRates",
+			    real_nvmlDeviceGetUtilizationRates != NULL,
+			    util_ret);
+	if (util_ret == NVML_SUCCESS) {
+		log_debug("Telling whether the GPU is busy by its utilization");
+		return 1;
+	}
+	log_warn("NVML can't tell the GPU utilization, telling whether the"
+		 " GPU is busy by timing cuCtxSynchronize() instead");
+	return 0;
+}
+
+
 void *release_early_fn(void *arg __attribute__((unused)))
 {
 	struct message release_msg = {0};
@@ -364,6 +1588,7 @@ void *release_early_fn(void *arg __attribute__((unused)))
 	nvmlReturn_t nvml_ret;
 	nvmlDevice_t nvml_dev;
 	nvmlUtilization_t nvml_util;
+	int nvml_util_ok;
 
 	release_msg.type = LOCK_RELEASED;
 	release_msg.id = nvshare_client_id;
@@ -376,20 +1601,7 @@ void *release_early_fn(void *arg __attribute__((unused)))
 	true_or_exit(sigfillset(&signal_set) == 0);
 	true_or_exit(pthread_sigmask(SIG_SETMASK, &signal_set, NULL) == 0);
 
-	if (nvml_ok) {
-		nvml_ret = real_nvmlInit();
-		if (nvml_ret != NVML_SUCCESS) {
-			log_warn("nvmlInit failed with %d", (int)nvml_ret);
-			goto check_nvml_ret;
-		}
-		nvml_ret = real_nvmlDeviceGetHandleByIndex(0, &nvml_dev);
-		if (nvml_ret != NVML_SUCCESS) {
-			log_warn("nvmlDeviceGetHandleByIndex returned %d",
-				 (int)nvml_ret);
-		}
-check_nvml_ret:
-		if (nvml_ret != NVML_SUCCESS) nvml_ok = 0;
-	}
+	nvml_util_ok = probe_nvml(&nvml_dev);
 	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
 
 	while (1) {
@@ -418,7 +1630,7 @@ wait_remainder:
 			 * use NVML to get the GPU utilization rate and
 			 * deduce whether the client is actually idle or not.
 			 */
-			if (nvml_ok) {
+			if (nvml_util_ok) {
 				nvml_ret = real_nvmlDeviceGetUtilizationRates(nvml_dev, &nvml_util);
 				if (nvml_ret != NVML_SUCCESS) {
 					/*
@@ -426,13 +1638,15 @@ wait_remainder:
 					 * thing.
 					 *
 					 * However, this is a bad thing
-					 * to happen, because if we've
-					 * reached this point then we've found
-					 * the NVML symbols, which indicates a
+					 * to happen, because it worked when
+					 * we probed it, which indicates a
 					 * deeper error.
 					 */
-					log_warn("nvmlInit failed with %d", (int)nvml_ret);
-					nvml_ok = 0; /* Stop using NVML */
+					log_warn("nvmlDeviceGetUtilizationRates"
+						 " failed with %d, timing"
+						 " cuCtxSynchronize() from now"
+						 " on", (int)nvml_ret);
+					nvml_util_ok = 0; /* Stop using NVML */
 					continue;
 				} else {
 					log_debug("GPU Utilization = %u %%", nvml_util.gpu);
@@ -470,9 +1684,11 @@ wait_remainder:
 
 			/* IDLE */
 			log_debug("Releasing the lock early due to inactivity");
-			true_or_exit(write_whole(rsock, &release_msg, sizeof(release_msg)) == sizeof(release_msg));
+			if (send_to_scheduler(rsock, &release_msg) != 0)
+				log_debug("Failed to release the GPU lock");
+			true_or_exit(clock_gettime(CLOCK_MONOTONIC,
+				     &lock_released_ts) == 0);
 			own_lock = 0;
-			log_debug("Sent %s", message_type_string[release_msg.type]);
 		} else if (ret != 0) { /* BAD */
 			errno = ret;
 			log_fatal_errno("pthread_cond_timedwait() failed");
@@ -17,8 +17,28 @@
 #ifndef _NVSHARE_CLIENT_H
 #define _NVSHARE_CLIENT_H
 
+#include <inttypes.h>
+
+#include "cuda_defs.h"
+
+#define ENV_NVSHARE_STANDALONE "NVSHARE_STANDALONE"
+#define ENV_NVSHARE_TIMESLICE  "NVSHARE_TIMESLICE"
+
+extern int timeslice;
+
+extern uint64_t nvshare_client_id;
+
 extern void continue_with_lock(void);
+extern void continue_with_lock_kernel(void);
+extern void track_stream(CUstream stream);
+extern void forget_stream(CUstream stream);
+extern void report_memory_usage(size_t committed, size_t total);
+extern void report_gpu_uuid(const char *uuid);
+extern void report_oom(size_t bytesize);
+extern void report_context_count(long contexts);
+extern int scheduler_client_count(void);
 extern void initialize_client(void);
+extern void log_client_diagnostics(void);
 
 #endif /* _NVSHARE_CLIENT_H */
 
@@ -28,11 +28,19 @@
 #include <stdio.h>
 #include <errno.h>
 #include <stdlib.h>
+#include <stddef.h>
 #include <unistd.h>
 #include <string.h>
 #include <inttypes.h>
 #include <sys/types.h>
 #include <sys/socket.h>
+#include <netdb.h>
+#include <netinet/in.h>
+#include <netinet/tcp.h>
+#include <poll.h>
+#include <time.h>
+#include <limits.h>
+#include <ctype.h>
 
 #include "comm.h"
 #include "common.h"
@@ -48,6 +56,24 @@ const char *message_type_string[] = {
 	[DROP_LOCK] = "DROP_LOCK",
 	[SET_TQ] = "SET_TQ",
 	[REGISTER] = "REGISTER",
+	[STATUS] = "STATUS",
+	[DRAIN] = "DRAIN",
+	[REATTACH] = "REATTACH",
+	[UNSUPPORTED_VERSION] = "UNSUPPORTED_VERSION",
+	[CLIENT_NAME] = "CLIENT_NAME",
+	[QUIESCE] = "QUIESCE",
+	[MEM_USAGE] = "MEM_USAGE",
+	[SCHED_ERROR] = "SCHED_ERROR",
+	[SHARE] = "SHARE",
+	[CLIENT_COUNT] = "CLIENT_COUNT",
+	[WORKLOAD] = "WORKLOAD",
+	[CONTEXTS] = "CONTEXTS",
+	[OOM] = "OOM",
+	[EVICT] = "EVICT",
+	[IDENTITY] = "IDENTITY",
+	[RESERVE] = "RESERVE",
+	[BACKPRESSURE] = "BACKPRESSURE",
+	[BOOST] = "BOOST",
 };
 
 
@@ -131,6 +157,7 @@ static int nvshare_unix_connect(int *sock, const char *path, int socket_type)
 {
 	int ret = 0;
 	struct sockaddr_un addr;
+	socklen_t addrlen = sizeof(addr);
 
 	if ((*sock = socket(AF_UNIX, socket_type, 0)) < 0) {
 		ret = -errno;
@@ -141,8 +168,14 @@ static int nvshare_unix_connect(int *sock, const char *path, int socket_type)
 	memset(&addr, 0, sizeof(addr));
 	addr.sun_family = AF_UNIX;
 	ret = strlcpy(addr.sun_path, path, sizeof(addr.sun_path));
+	/* Names in the abstract namespace start with a NULL byte */
+	if (path[0] == NVSHARE_ABSTRACT_PREFIX[0]) {
+		addr.sun_path[0] = '\0';
+		addrlen = offsetof(struct sockaddr_un, sun_path) +
+			  strlen(path);
+	}
 
-	ret = connect(*sock, (struct sockaddr *)&addr, sizeof(addr));
+	ret = connect(*sock, (struct sockaddr *)&addr, addrlen);
 	if (ret != 0) {
 		ret = -errno;
 		log_info("Failed to connect to UNIX socket at %s\n", path);
@@ -181,8 +214,68 @@ out:
 }
 
 
+/* Connect to "<host>:<port>", where host may be an [IPv6] address */
+static int nvshare_tcp_connect(int *sock, const char *hostport)
+{
+	char host[NVSHARE_SOCK_PATH_MAX], *port;
+	struct addrinfo hints, *res, *ai;
+	int ret, one = 1;
+
+	strlcpy(host, hostport, sizeof(host));
+	port = strrchr(host, ':');
+	if (port == NULL || port == host || port[1] == '\0') {
+		log_info("Malformed TCP address %s", hostport);
+		errno = EINVAL;
+		return -1;
+	}
+	*port++ = '\0';
+	if (host[0] == '[' && port[-2] == ']') {
+		port[-2] = '\0';
+		memmove(host, host + 1, strlen(host));
+	}
+
+	memset(&hints, 0, sizeof(hints));
+	hints.ai_family = AF_UNSPEC;
+	hints.ai_socktype = SOCK_STREAM;
+	ret = getaddrinfo(host, port, &hints, &res);
+	if (ret != 0) {
+		log_info("Failed to resolve %s: %s", hostport,
+			 gai_strerror(ret));
+		errno = (ret == EAI_SYSTEM) ? errno : EHOSTUNREACH;
+		return -1;
+	}
+	for (ai = res; ai != NULL; ai = ai->ai_next) {
+		*sock = socket(ai->ai_family, ai->ai_socktype,
+			       ai->ai_protocol);
+		if (*sock < 0) continue;
+		if (RETRY_INTR(connect(*sock, ai->ai_addr,
+		    ai->ai_addrlen)) == 0)
+			break;
+		ret = errno;
+		close(*sock);
+		errno = ret;
+	}
+	freeaddrinfo(res);
+	if (ai == NULL) {
+		log_info("Failed to connect to %s", hostport);
+		return -1;
+	}
+	/* Lock messages are small and latency matters */
+	(void)setsockopt(*sock, IPPROTO_TCP, TCP_NODELAY, &one, sizeof(one));
+	return 0;
+}
+
+
+/*
+ * Connect to the scheduler at rpath, a UNIX socket path or an address of the
+ * form ENV_NVSHARE_SCHEDULER_ADDRESS takes.
+ */
 int nvshare_connect(int *rsock, const char *rpath)
 {
+	if (strncmp(rpath, NVSHARE_TCP_PREFIX,
+		    strlen(NVSHARE_TCP_PREFIX)) == 0)
+		return nvshare_tcp_connect(rsock,
+			rpath + strlen(NVSHARE_TCP_PREFIX));
 	return RETRY_INTR(nvshare_unix_connect(rsock, rpath, SOCK_STREAM));
 }
 
@@ -202,6 +295,24 @@ int nvshare_accept(int lsock, int *rsock)
 }
 
 
+/*
+ * Get the credentials of the process at the other end of a Unix socket, as
+ * of when it connected. The kernel vouches for them, unlike for anything the
+ * peer tells us.
+ */
+int nvshare_peer_credentials(int sock, pid_t *pid, uid_t *uid)
+{
+	struct ucred cred;
+	socklen_t len = sizeof(cred);
+
+	if (getsockopt(sock, SOL_SOCKET, SO_PEERCRED, &cred, &len) < 0)
+		return -1;
+	*pid = cred.pid;
+	*uid = cred.uid;
+	return 0;
+}
+
+
 /* Send a message on a non-blocking socket. */
 ssize_t nvshare_send_noblock(int rsock, const void *msg_p, size_t count)
 {
@@ -209,6 +320,129 @@ ssize_t nvshare_send_noblock(int rsock, const void *msg_p, size_t count)
 }
 
 
+/*
+ * Send a whole message on a non-blocking socket.
+ *
+ * Messages are fixed-size, so a partial write would leave the peer with a
+ * truncated message. If the socket buffer fills up midway, wait up to
+ * timeout_ms in total for room for the rest of the message.
+ *
+ * Return count on success, or -1 with errno set. On timeout, errno is EAGAIN.
+ * If the peer has gone away, errno is EPIPE, instead of us getting SIGPIPE.
+ */
+ssize_t nvshare_send_whole_noblock(int rsock, const void *msg_p, size_t count,
+	int timeout_ms)
+{
+	ssize_t ret;
+	size_t sent = 0;
+	struct pollfd pfd = { .fd = rsock, .events = POLLOUT };
+	struct timespec start, now, elapsed;
+	int remaining_ms;
+
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &start) == 0);
+	while (sent < count) {
+		ret = RETRY_INTR(send(rsock, (const char *)msg_p + sent,
+				      count - sent, MSG_NOSIGNAL));
+		if (ret >= 0) {
+			sent += ret;
+			continue;
+		}
+		if (errno != EAGAIN && errno != EWOULDBLOCK) return -1;
+
+		true_or_exit(clock_gettime(CLOCK_MONOTONIC, &now) == 0);
+		timespecsub(&now, &start, &elapsed);
+		remaining_ms = timeout_ms - (int)(elapsed.tv_sec * 1000 +
+						  elapsed.tv_nsec / 1000000);
+		if (remaining_ms <= 0) {
+			errno = EAGAIN;
+			return -1;
+		}
+		ret = RETRY_INTR(poll(&pfd, 1, remaining_ms));
+		if (ret < 0) return -1;
+	}
+	return sent;
+}
+
+
+/*
+ * Find the value of field key among the key=value fields in the data
+ * segment of a message and copy it to value.
+ *
+ * Return 0 if the field exists, -1 otherwise.
+ */
+int nvshare_msg_get_field(const char *data, const char *key, char *value,
+	size_t size)
+{
+	char buf[MSG_DATA_LEN + 1];
+	char *field, *saveptr;
+	size_t keylen = strlen(key);
+
+	/* The data segment need not be NULL-terminated */
+	memcpy(buf, data, MSG_DATA_LEN);
+	buf[MSG_DATA_LEN] = '\0';
+
+	for (field = strtok_r(buf, " ", &saveptr); field != NULL;
+	     field = strtok_r(NULL, " ", &saveptr)) {
+		if (strncmp(field, key, keylen) == 0 && field[keylen] == '=') {
+			strlcpy(value, field + keylen + 1, size);
+			return 0;
+		}
+	}
+	return -1;
+}
+
+
+/*
+ * Check the framing of a message we received. Its pod_name and pod_namespace
+ * fields must be NULL-terminated, and its data segment too, unlike in the
+ * messages the scheduler sends, with only printable characters before that,
+ * so that nothing that parses it reads past the message.
+ *
+ * Return NULL if it's well-formed, or what is wrong with it otherwise.
+ */
+const char *nvshare_msg_check(const struct message *msg)
+{
+	const char *p, *end;
+
+	if (memchr(msg->pod_name, '\0', sizeof(msg->pod_name)) == NULL)
+		return "pod_name is not NULL-terminated";
+	if (memchr(msg->pod_namespace, '\0', sizeof(msg->pod_namespace)) == NULL)
+		return "pod_namespace is not NULL-terminated";
+	end = memchr(msg->data, '\0', sizeof(msg->data));
+	if (end == NULL)
+		return "data segment is not NULL-terminated";
+	for (p = msg->data; p < end; p++)
+		if (!isprint((unsigned char)*p))
+			return "data segment holds non-printable characters";
+	return NULL;
+}
+
+
+/*
+ * Get the protocol version a client speaks from the data segment of its
+ * REGISTER or REATTACH message.
+ *
+ * Return the version, or -1 if it's malformed.
+ */
+int nvshare_msg_get_version(const char *data)
+{
+	char value[MSG_DATA_LEN + 1];
+	char *endptr;
+	long version;
+
+	if (nvshare_msg_get_field(data, NVSHARE_VERSION_FIELD, value,
+				  sizeof(value)) != 0)
+		return NVSHARE_PROTOCOL_VERSION_MIN;
+
+	errno = 0;
+	version = strtol(value, &endptr, 10);
+	if (value == endptr || *endptr != '\0' || errno != 0 || version < 1 ||
+	    version > INT_MAX)
+		return -1;
+	return (int)version;
+}
+
+
 /* Receive a message from a non-blocking socket. */
 ssize_t nvshare_receive_noblock(int rsock, void *msg_p, size_t count)
 {
@@ -44,6 +44,255 @@
 
 #define NVSHARE_SOCK_DIR          "/var/run/nvshare/"
 
+/*
+ * Where clients reach the scheduler, instead of the socket in
+ * NVSHARE_SOCK_DIR: the path of a UNIX socket, "@<name>" for a socket in the
+ * abstract namespace, or "tcp:<host>:<port>", e.g., for a relay in front of
+ * the scheduler.
+ */
+#define ENV_NVSHARE_SCHEDULER_ADDRESS "NVSHARE_SCHEDULER_ADDRESS"
+#define NVSHARE_ABSTRACT_PREFIX "@"
+#define NVSHARE_TCP_PREFIX      "tcp:"
+
+/*
+ * How long to wait for a peer to make room in its socket buffer, when a
+ * message only partially fits in it.
+ */
+#define NVSHARE_SEND_TIMEOUT_MS   100
+
+/*
+ * Version of the protocol between libnvshare and nvshare-scheduler. Bump it
+ * on every change to the messages, and keep it in sync with
+ * ProtocolVersion in the device plugin.
+ *
+ * The scheduler accepts clients that speak any version from
+ * NVSHARE_PROTOCOL_VERSION_MIN up to NVSHARE_PROTOCOL_VERSION. Bump
+ * NVSHARE_PROTOCOL_VERSION_MIN when dropping support for older clients.
+ */
+#define NVSHARE_PROTOCOL_VERSION     18
+#define NVSHARE_PROTOCOL_VERSION_MIN 1
+
+/*
+ * REGISTER and REATTACH messages carry space-separated key=value fields in
+ * their data segment. Peers ignore the fields they don't know, which leaves
+ * room for future fields. Always present:
+ *
+ *   v=<protocol version of the client>
+ *
+ * Clients that predate version 2 send no fields at all. We consider them to
+ * speak version 1.
+ *
+ * The scheduler answers with SCHED_ON or SCHED_OFF if it accepts the client,
+ * or with UNSUPPORTED_VERSION, carrying "v=<min>-<max>", if it doesn't.
+ * Since NVSHARE_SCHED_VERSION_MIN_VERSION, the SCHED_ON or SCHED_OFF answer
+ * carries the protocol version of the scheduler, "v=<max>", in its pod_name
+ * field, which older clients ignore. Older schedulers leave it empty.
+ */
+#define NVSHARE_VERSION_FIELD "v"
+#define NVSHARE_SCHED_VERSION_MIN_VERSION 17
+
+/*
+ * Optional IDENTITY fields that identify the container of a client on
+ * Kubernetes, so that the scheduler can recognize a restarted container:
+ *
+ *   d=<slot of the nvshare device of the container>
+ *   g=<instance (generation) of the container, in hex>
+ *
+ * They take up to 17 characters (e.g., "d=1000 g=ffffffff"), so they don't
+ * fit in REGISTER along with the protocol version. The scheduler still takes
+ * them from REGISTER too.
+ */
+#define NVSHARE_SLOT_FIELD       "d"
+#define NVSHARE_GENERATION_FIELD "g"
+
+/*
+ * Optional REGISTER field of a client that runs without an nvshare device on
+ * Kubernetes, see ENV_NVSHARE_OVERFLOW:
+ *
+ *   o=1
+ */
+#define NVSHARE_OVERFLOW_FIELD "o"
+#define ENV_NVSHARE_OVERFLOW   "NVSHARE_OVERFLOW"
+
+#define ENV_NVSHARE_DEVICE_SLOT "NVSHARE_DEVICE_SLOT"
+
+/*
+ * Clients that know the UID of their Pod, and possibly the name of their
+ * container, or their device slot, send IDENTITY right before REGISTER or
+ * REATTACH, with "<Pod UID>/<container name>" in the pod_name field, as it
+ * doesn't fit in the data segment, and the device slot fields in the data
+ * segment. The pod_name field is empty if the client doesn't know its Pod
+ * UID. Along with the ID of the client, the Pod UID tells reattaching clients
+ * apart unambiguously.
+ */
+#define NVSHARE_POD_UID_LEN_MAX   36
+#define NVSHARE_CONTAINER_LEN_MAX 63
+#define ENV_NVSHARE_POD_UID        "NVSHARE_POD_UID"
+#define ENV_NVSHARE_CONTAINER_NAME "NVSHARE_CONTAINER_NAME"
+
+/*
+ * MEM_USAGE messages carry the GPU memory the client has committed and the
+ * physical GPU memory, both in MiB:
+ *
+ *   c=<committed> t=<total>
+ *
+ * Clients that speak version 11 or later also send the UUID of their GPU as
+ * nvidia-smi shows it, e.g., "GPU-5a2e...", so that the scheduler can account
+ * the memory of each GPU separately. It is too long for the data segment, so
+ * it travels in the pod_name field, which is empty if the client can't tell.
+ */
+#define NVSHARE_COMMITTED_FIELD "c"
+#define NVSHARE_TOTAL_FIELD     "t"
+#define NVSHARE_GPU_UUID_LEN    41 /* "GPU-" and 36 characters, plus NULL */
+
+/*
+ * The scheduler sends SCHED_ERROR to tell a client why it turns it away,
+ * right before closing the connection. The data segment carries the error
+ * code:
+ *
+ *   e=<code>
+ *
+ * The message is too long for the data segment, so it travels in the
+ * pod_name field. Only clients that speak NVSHARE_ERROR_MIN_VERSION or later
+ * get SCHED_ERROR. Version mismatches keep using UNSUPPORTED_VERSION, which
+ * every version understands.
+ */
+#define NVSHARE_ERROR_FIELD       "e"
+#define NVSHARE_ERROR_MIN_VERSION 6
+
+enum nvshare_error {
+	NVSHARE_ERR_DRAINING           = 1,
+	NVSHARE_ERR_MAX_CLIENTS        = 2,
+	NVSHARE_ERR_ALREADY_REGISTERED = 3,
+	NVSHARE_ERR_DUPLICATE_ID       = 4, /* Reattaching with an ID in use */
+	NVSHARE_ERR_EVICTED            = 5, /* The container has restarted */
+	NVSHARE_ERR_UNAUTHORIZED       = 6, /* The peer runs as the wrong user */
+	NVSHARE_ERR_NAMESPACE          = 7, /* The Pod's namespace isn't allowed */
+	NVSHARE_ERR_MEMORY_PRESSURE    = 8, /* A client ran out of GPU memory */
+	NVSHARE_ERR_KICKED             = 9, /* Evicted with nvsharectl */
+	NVSHARE_ERR_PROCESS_LIMIT      = 10, /* The GPU runs all it can */
+};
+
+
+/*
+ * SHARE messages carry the share of the GPU the client is entitled to, in
+ * thousandths of the GPU:
+ *
+ *   s=<millishares>
+ *
+ * The scheduler scales the slices of the client accordingly. Clients that
+ * don't send SHARE get the whole TQ, i.e., NVSHARE_FULL_SHARE.
+ */
+#define NVSHARE_SHARE_FIELD "s"
+#define NVSHARE_FULL_SHARE  1000
+#define ENV_NVSHARE_MILLISHARES "NVSHARE_MILLISHARES"
+
+/*
+ * The scheduler sends CLIENT_COUNT to every registered client whenever the
+ * number of registered clients changes, so that clients can account for the
+ * GPU memory that the contexts of the others take up:
+ *
+ *   n=<number of registered clients>
+ *
+ * Only clients that speak NVSHARE_CLIENT_COUNT_MIN_VERSION or later get it.
+ */
+#define NVSHARE_CLIENT_COUNT_FIELD       "n"
+#define NVSHARE_CLIENT_COUNT_MIN_VERSION 8
+
+/*
+ * The scheduler sends BACKPRESSURE to every registered client when it comes
+ * under load, i.e., too many clients or too many lock switches, see
+ * NVSHARE_BACKPRESSURE_CLIENTS and NVSHARE_BACKPRESSURE_SWITCH_RATE, and
+ * again when the load subsides:
+ *
+ *   p=<pause in milliseconds, 0 when backpressure is off>
+ *
+ * While backpressure is on, clients wait for at least the pause after they
+ * release the lock before they request it again.
+ *
+ * Only clients that speak NVSHARE_BACKPRESSURE_MIN_VERSION or later get it.
+ */
+#define NVSHARE_BACKPRESSURE_FIELD       "p"
+#define NVSHARE_BACKPRESSURE_MIN_VERSION 16
+
+/*
+ * WORKLOAD messages carry the type of workload the client runs, e.g.,
+ * "inference" or "training", which the scheduler maps to type-specific
+ * scheduling defaults:
+ *
+ *   w=<workload type>
+ */
+#define NVSHARE_WORKLOAD_FIELD    "w"
+#define NVSHARE_WORKLOAD_TYPE_MAX 16 /* Characters, so that it fits */
+#define ENV_NVSHARE_WORKLOAD_TYPE "NVSHARE_WORKLOAD_TYPE"
+
+/*
+ * CONTEXTS messages carry the number of live CUDA contexts that the client
+ * has created itself, i.e., not counting the primary context:
+ *
+ *   x=<contexts>
+ */
+#define NVSHARE_CONTEXTS_FIELD "x"
+
+/*
+ * RESERVE messages carry the GPU memory, in MiB, that the client reserves
+ * upfront, see NVSHARE_RESERVE_MEMORY_MIB:
+ *
+ *   r=<reserved>
+ *
+ * The scheduler counts the client as having committed at least that much
+ * from the moment it registers, before it allocates any memory.
+ */
+#define NVSHARE_RESERVED_FIELD "r"
+#define ENV_NVSHARE_RESERVE_MEMORY_MIB "NVSHARE_RESERVE_MEMORY_MIB"
+
+/*
+ * Clients send OOM whenever an allocation fails for lack of GPU memory, with
+ * the size of the allocation in MiB, rounded up:
+ *
+ *   m=<requested>
+ */
+#define NVSHARE_OOM_FIELD "m"
+
+/*
+ * STATUS messages from nvsharectl may carry fields that pick what the
+ * scheduler reports:
+ *
+ *   j=1  as JSON, instead of human-readable text
+ *   c=1  only the registered clients
+ */
+#define NVSHARE_STATUS_JSON_FIELD    "j"
+#define NVSHARE_STATUS_CLIENTS_FIELD "c"
+
+/*
+ * EVICT messages from nvsharectl carry the ID of the client to evict, in hex.
+ * The scheduler answers with EVICT, carrying the number of clients it has
+ * evicted, i.e., 0 if no registered client has that ID:
+ *
+ *   i=<client ID>    (request)
+ *   n=<0 or 1>       (answer)
+ */
+#define NVSHARE_EVICT_ID_FIELD "i"
+#define NVSHARE_EVICTED_FIELD  "n"
+
+/*
+ * BOOST messages from nvsharectl carry the ID of the client to boost, in hex,
+ * and, in the pod_name field, as the data segment is too small for both, for
+ * how many seconds, 0 to end its boost early. The scheduler answers with
+ * BOOST, carrying the number of clients it has boosted, i.e., 0 if no
+ * registered client has that ID:
+ *
+ *   i=<client ID>    (request, data)
+ *   d=<seconds>      (request, pod_name)
+ *   n=<0 or 1>       (answer)
+ */
+#define NVSHARE_BOOST_ID_FIELD       "i"
+#define NVSHARE_BOOST_DURATION_FIELD "d"
+#define NVSHARE_BOOSTED_FIELD        "n"
+#define NVSHARE_BOOST_MAX_S          86400 /* A day */
+
+#define ENV_NVSHARE_PROTOCOL_VERSION "NVSHARE_PROTOCOL_VERSION"
+
 
 extern const char *message_type_string[];
 extern uint64_t nvshare_generate_id(void);
@@ -51,7 +300,13 @@ extern int nvshare_get_scheduler_path(char *sock_path);
 extern int nvshare_bind_and_listen(int *lsock, const char *sock_path);
 extern int nvshare_connect(int *rsock, const char *rpath);
 extern int nvshare_accept(int lsock, int *rsock);
+extern int nvshare_peer_credentials(int sock, pid_t *pid, uid_t *uid);
 extern ssize_t nvshare_send_noblock(int rsock, const void *msg_p, size_t count);
+extern ssize_t nvshare_send_whole_noblock(int rsock, const void *msg_p,
+	size_t count, int timeout_ms);
+extern int nvshare_msg_get_field(const char *data, const char *key,
+	char *value, size_t size);
+extern int nvshare_msg_get_version(const char *data);
 extern ssize_t nvshare_receive_noblock(int rsock, void *msg_p, size_t count);
 extern int nvshare_receive_block(int rsock, void *msg_p, size_t count);
 
@@ -65,6 +320,28 @@ enum message_type {
 	DROP_LOCK      = 6,
 	LOCK_RELEASED  = 7,
 	SET_TQ         = 8,
+	STATUS         = 9,
+	DRAIN          = 10,
+	REATTACH       = 11,
+	UNSUPPORTED_VERSION = 12,
+	/*
+	 * A human-friendly name for a registered client. The data segment is
+	 * too small for it, so it travels in the pod_name field.
+	 */
+	CLIENT_NAME    = 13,
+	QUIESCE        = 14,
+	MEM_USAGE      = 15,
+	SCHED_ERROR    = 16,
+	SHARE          = 17,
+	CLIENT_COUNT   = 18,
+	WORKLOAD       = 19,
+	CONTEXTS       = 20,
+	OOM            = 21,
+	EVICT          = 22,
+	IDENTITY       = 23,
+	RESERVE        = 24,
+	BACKPRESSURE   = 25,
+	BOOST          = 26,
 } __attribute__((__packed__));
 
 struct message {
@@ -79,6 +356,8 @@ struct message {
 	char data[MSG_DATA_LEN];
 } __attribute__((__packed__));
 
+extern const char *nvshare_msg_check(const struct message *msg);
+
 
 #endif /* _NVSHARE_COMM_H_ */
 
@@ -17,13 +17,19 @@
  */
 
 #include <errno.h>
+#include <limits.h>
+#include <stdio.h>
 #include <unistd.h>
 #include <stdlib.h>
+#include <sys/utsname.h>
+#include <gnu/libc-version.h>
 
 #include "common.h"
 
 int __debug = 0;
 
+extern char **environ;
+
 
 /*
  * strlcpy() from FreeBSD:
@@ -108,3 +114,57 @@ ssize_t read_whole(int fd, void *buf, size_t cnt)
 	return readcnt;
 }
 
+
+/*
+ * Make room for a fresh log file at path, keeping up to files files in
+ * total: Shift every rotated file one place down (<path>.1 being the most
+ * recent one), dropping the oldest one. The caller then opens path anew.
+ */
+void rotate_files(const char *path, long long files)
+{
+	char from[PATH_MAX], to[PATH_MAX];
+	long long i;
+
+	for (i = files - 1; i >= 1; i--) {
+		if (i == 1) strlcpy(from, path, sizeof(from));
+		else snprintf(from, sizeof(from), "%s.%lld", path, i - 1);
+		snprintf(to, sizeof(to), "%s.%lld", path, i);
+		if (rename(from, to) != 0 && errno != ENOENT)
+			log_warn("Failed to rotate %s", from);
+	}
+	if (files == 1 && remove(path) != 0 && errno != ENOENT)
+		log_warn("Failed to rotate %s", path);
+}
+
+
+/* The host part of the diagnostics block, see NVSHARE_DIAG_BEGIN */
+void nvshare_log_diag_host(void)
+{
+	struct utsname u;
+
+	if (uname(&u) != 0) {
+		log_info("host: unknown");
+		return;
+	}
+	log_info("host: %s, %s %s %s, glibc %s", u.nodename, u.sysname,
+		 u.release, u.machine, gnu_get_libc_version());
+}
+
+
+/*
+ * The environment variables that change what nvshare does, for the verbose
+ * part of the diagnostics block. They hold paths and settings, not secrets.
+ */
+void nvshare_log_diag_env(void)
+{
+	char **e;
+
+	for (e = environ; e != NULL && *e != NULL; e++) {
+		if (strncmp(*e, "NVSHARE_", 8) == 0 ||
+		    strncmp(*e, "NVIDIA_", 7) == 0 ||
+		    strncmp(*e, "CUDA_", 5) == 0 ||
+		    strncmp(*e, "LD_PRELOAD=", 11) == 0)
+			log_debug("env: %s", *e);
+	}
+}
+
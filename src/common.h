@@ -7,11 +7,19 @@
 #include <time.h>
 #include <string.h>
 
+/* The Makefile sets it to the commit we were built from */
+#ifndef NVSHARE_VERSION
+#define NVSHARE_VERSION "unknown"
+#endif
+
 extern int __debug;
 extern int pending_kernel_window;
 extern ssize_t write_whole(int fd, const void *buf, size_t count);
 extern ssize_t read_whole(int fd, void *buf, size_t count);
 extern size_t strlcpy(char *dst, const char *src, size_t siz);
+extern void rotate_files(const char *path, long long files);
+extern void nvshare_log_diag_host(void);
+extern void nvshare_log_diag_env(void);
 
 
 #define log_fatal_errno(fmt, ...)                             \
@@ -89,5 +97,13 @@ do {                                                                       \
 
 #define ENV_NVSHARE_DEBUG         "NVSHARE_DEBUG"
 
+/*
+ * Every component logs a diagnostics block once when it starts, to copy into
+ * bug reports: versions, GPUs, paths and settings. The verbose lines, e.g.,
+ * the environment, are debug logs, so they only show with NVSHARE_DEBUG.
+ */
+#define NVSHARE_DIAG_BEGIN "----- nvshare diagnostics (%s) -----"
+#define NVSHARE_DIAG_END   "----- end of nvshare diagnostics -----"
+
 #endif /* _COMMON_H_ */
 
@@ -39,9 +39,14 @@
 #define cuMemcpyHtoDAsync           cuMemcpyHtoDAsync_v2
 #define cuMemcpyDtoHAsync           cuMemcpyDtoHAsync_v2
 #define cuMemcpyDtoDAsync           cuMemcpyDtoDAsync_v2
+#define cuStreamDestroy             cuStreamDestroy_v2
+#define cuCtxCreate                 cuCtxCreate_v2
+#define cuCtxDestroy                cuCtxDestroy_v2
 
 #define nvmlInit                    nvmlInit_v2
 #define nvmlDeviceGetHandleByIndex  nvmlDeviceGetHandleByIndex_v2
+#define nvmlDeviceGetCount          nvmlDeviceGetCount_v2
+#define cuDeviceTotalMem            cuDeviceTotalMem_v2
 
 #include <stdint.h>
 
@@ -54,12 +59,22 @@ typedef int CUdevice;
 typedef struct CUctx_st *CUcontext;
 typedef struct CUstream_st *CUstream;
 typedef struct CUfunc_st *CUfunction;
+typedef struct CUmod_st *CUmodule;
+
+typedef struct CUuuid_st {
+	char bytes[16];
+} CUuuid;
+
+/* Special stream handle for the per-thread default stream */
+#define CU_STREAM_PER_THREAD ((CUstream)0x2)
 typedef struct nvmlDevice_st* nvmlDevice_t;
 
 typedef enum cuda_drv_error_enum {
 	CUDA_SUCCESS               = 0,
+	CUDA_ERROR_INVALID_VALUE   = 1,
 	CUDA_ERROR_OUT_OF_MEMORY   = 2,
 	CUDA_ERROR_NOT_INITIALIZED = 3,
+	CUDA_ERROR_NOT_PERMITTED   = 800,
 	CUDA_ERROR_UNKNOWN         = 999
 } CUresult;
 
@@ -67,11 +82,44 @@ typedef enum CUmemAttach_flags_enum {
 	CU_MEM_ATTACH_GLOBAL = 0x1
 } CUmemAttach_flags;
 
+typedef enum CUjit_option_enum {
+	CU_JIT_MAX_REGISTERS = 0
+} CUjit_option;
+
 typedef enum nvmlReturn_t_enum {
 	NVML_SUCCESS = 0,
+	NVML_ERROR_NOT_SUPPORTED = 3,
+	NVML_ERROR_NO_PERMISSION = 4,
+	NVML_ERROR_INSUFFICIENT_SIZE = 7,
 	NVML_ERROR_UNKNOWN = 999
 } nvmlReturn_t;
 
+typedef enum nvmlClockType_enum {
+	NVML_CLOCK_GRAPHICS = 0
+} nvmlClockType_t;
+
+typedef enum nvmlTemperatureSensors_enum {
+	NVML_TEMPERATURE_GPU = 0
+} nvmlTemperatureSensors_t;
+
+typedef enum nvmlComputeMode_enum {
+	NVML_COMPUTEMODE_DEFAULT = 0,
+	NVML_COMPUTEMODE_EXCLUSIVE_THREAD = 1, /* Deprecated */
+	NVML_COMPUTEMODE_PROHIBITED = 2,
+	NVML_COMPUTEMODE_EXCLUSIVE_PROCESS = 3
+} nvmlComputeMode_t;
+
+/* Why the clocks of a GPU are below their maximum, as a bit mask */
+#define nvmlClocksThrottleReasonGpuIdle                   0x0000000000000001ULL
+#define nvmlClocksThrottleReasonApplicationsClocksSetting 0x0000000000000002ULL
+#define nvmlClocksThrottleReasonSwPowerCap                0x0000000000000004ULL
+#define nvmlClocksThrottleReasonHwSlowdown                0x0000000000000008ULL
+#define nvmlClocksThrottleReasonSyncBoost                 0x0000000000000010ULL
+#define nvmlClocksThrottleReasonSwThermalSlowdown         0x0000000000000020ULL
+#define nvmlClocksThrottleReasonHwThermalSlowdown         0x0000000000000040ULL
+#define nvmlClocksThrottleReasonHwPowerBrakeSlowdown      0x0000000000000080ULL
+#define nvmlClocksThrottleReasonDisplayClockSetting       0x0000000000000100ULL
+
 /*
  * Utilization information for a device.
  * Each sample period may be between 1 second and 1/6 second, depending on
@@ -90,18 +138,37 @@ typedef struct nvmlUtilization_st {
 	unsigned int memory;
 } nvmlUtilization_t;
 
+/* Memory allocation information for a device, in bytes */
+typedef struct nvmlMemory_st {
+	unsigned long long total;
+	unsigned long long free;
+	unsigned long long used;
+} nvmlMemory_t;
+
 /* typedefs for CUDA functions, to make hooking code cleaner */
 typedef CUresult (*cuGetProcAddress_func)(const char *symbol, void **pfn,
 	int cudaVersion, cuuint64_t flags);
 typedef CUresult (*cuMemAllocManaged_func)(CUdeviceptr *dptr, size_t bytesize,
 	unsigned int flags);
+typedef CUresult (*cuMemAlloc_func)(CUdeviceptr *dptr, size_t bytesize);
 typedef CUresult (*cuMemFree_func)(CUdeviceptr dptr);
 typedef CUresult (*cuMemGetInfo_func)(size_t *free, size_t *total);
 typedef CUresult (*cuGetErrorString_func)(CUresult error, const char **pStr);
 typedef CUresult (*cuGetErrorName_func)(CUresult error, const char **pStr);
 typedef CUresult (*cuCtxSetCurrent_func)(CUcontext ctx);
 typedef CUresult (*cuCtxGetCurrent_func)(CUcontext *pctx);
+typedef CUresult (*cuCtxGetDevice_func)(CUdevice *device);
+typedef CUresult (*cuDeviceGetUuid_func)(CUuuid *uuid, CUdevice dev);
+typedef CUresult (*cuDeviceGet_func)(CUdevice *device, int ordinal);
+typedef CUresult (*cuDeviceGetName_func)(char *name, int len, CUdevice dev);
+typedef CUresult (*cuDeviceTotalMem_func)(size_t *bytes, CUdevice dev);
+typedef CUresult (*cuCtxCreate_func)(CUcontext *pctx, unsigned int flags,
+	CUdevice dev);
+typedef CUresult (*cuCtxDestroy_func)(CUcontext ctx);
 typedef CUresult (*cuInit_func)(unsigned int flags);
+typedef CUresult (*cuDriverGetVersion_func)(int *driverVersion);
+/* From the CUDA Runtime API, which returns a cudaError_t */
+typedef int (*cudaRuntimeGetVersion_func)(int *runtimeVersion);
 typedef CUresult (*cuCtxSynchronize_func)(void);
 typedef CUresult (*cuLaunchKernel_func)(CUfunction f, unsigned int gridDimX,
 	unsigned int gridDimY, unsigned int gridDimZ, unsigned int blockDimX,
@@ -124,12 +191,59 @@ typedef CUresult (*cuMemcpyHtoDAsync_func)(CUdeviceptr dstDevice,
 	const void* srcHost, size_t ByteCount, CUstream hStream);
 typedef CUresult (*cuMemcpyDtoDAsync_func)(CUdeviceptr dstDevice,
 	CUdeviceptr srcDevice, size_t ByteCount, CUstream hStream);
+typedef CUresult (*cuStreamCreate_func)(CUstream *phStream,
+	unsigned int Flags);
+typedef CUresult (*cuStreamCreateWithPriority_func)(CUstream *phStream,
+	unsigned int flags, int priority);
+typedef CUresult (*cuStreamDestroy_func)(CUstream hStream);
+typedef CUresult (*cuStreamSynchronize_func)(CUstream hStream);
+typedef CUresult (*cuModuleLoad_func)(CUmodule *module, const char *fname);
+typedef CUresult (*cuModuleLoadData_func)(CUmodule *module, const void *image);
+typedef CUresult (*cuModuleLoadDataEx_func)(CUmodule *module,
+	const void *image, unsigned int numOptions, CUjit_option *options,
+	void **optionValues);
+typedef CUresult (*cuModuleLoadFatBinary_func)(CUmodule *module,
+	const void *fatCubin);
+typedef CUresult (*cuModuleUnload_func)(CUmodule hmod);
 
 typedef nvmlReturn_t (*nvmlDeviceGetUtilizationRates_func)(nvmlDevice_t device,
 	nvmlUtilization_t *utilization);
 typedef nvmlReturn_t (*nvmlInit_func)(void);
 typedef nvmlReturn_t (*nvmlDeviceGetHandleByIndex_func)(unsigned int index,
 	nvmlDevice_t *device);
+typedef nvmlReturn_t (*nvmlDeviceGetCount_func)(unsigned int *device_count);
+typedef nvmlReturn_t (*nvmlDeviceGetMemoryInfo_func)(nvmlDevice_t device,
+	nvmlMemory_t *memory);
+typedef nvmlReturn_t (*nvmlDeviceGetMaxClockInfo_func)(nvmlDevice_t device,
+	nvmlClockType_t type, unsigned int *clock);
+typedef nvmlReturn_t (*nvmlDeviceSetGpuLockedClocks_func)(nvmlDevice_t device,
+	unsigned int minGpuClockMHz, unsigned int maxGpuClockMHz);
+typedef nvmlReturn_t (*nvmlDeviceResetGpuLockedClocks_func)(
+	nvmlDevice_t device);
+typedef nvmlReturn_t (*nvmlDeviceGetCurrentClocksThrottleReasons_func)(
+	nvmlDevice_t device, unsigned long long *reasons);
+typedef nvmlReturn_t (*nvmlDeviceGetClockInfo_func)(nvmlDevice_t device,
+	nvmlClockType_t type, unsigned int *clock);
+typedef nvmlReturn_t (*nvmlDeviceGetTemperature_func)(nvmlDevice_t device,
+	nvmlTemperatureSensors_t sensor, unsigned int *temp);
+typedef nvmlReturn_t (*nvmlDeviceGetUUID_func)(nvmlDevice_t device,
+	char *uuid, unsigned int length);
+typedef nvmlReturn_t (*nvmlDeviceGetComputeMode_func)(nvmlDevice_t device,
+	nvmlComputeMode_t *mode);
+/* We only ask for the count, so the layout of the process info doesn't matter */
+typedef nvmlReturn_t (*nvmlDeviceGetComputeRunningProcesses_func)(
+	nvmlDevice_t device, unsigned int *infoCount, void *infos);
+typedef nvmlReturn_t (*nvmlDeviceGetName_func)(nvmlDevice_t device,
+	char *name, unsigned int length);
+typedef nvmlReturn_t (*nvmlSystemGetDriverVersion_func)(char *version,
+	unsigned int length);
+typedef nvmlReturn_t (*nvmlSystemGetNVMLVersion_func)(char *version,
+	unsigned int length);
+typedef nvmlReturn_t (*nvmlSystemGetCudaDriverVersion_func)(int *version);
+
+#define NVML_DEVICE_NAME_BUFFER_SIZE           96 /* The V2 size */
+#define NVML_SYSTEM_DRIVER_VERSION_BUFFER_SIZE 80
+#define NVML_SYSTEM_NVML_VERSION_BUFFER_SIZE   80
 
 
 /* Hooked CUDA functions */
@@ -160,16 +274,34 @@ extern CUresult cuMemcpyHtoDAsync(CUdeviceptr dstDevice,
 	const void* srcHost, size_t ByteCount, CUstream hStream);
 extern CUresult cuMemcpyDtoDAsync(CUdeviceptr dstDevice,
 	CUdeviceptr srcDevice, size_t ByteCount, CUstream hStream);
+extern CUresult cuStreamCreate(CUstream *phStream, unsigned int Flags);
+extern CUresult cuStreamCreateWithPriority(CUstream *phStream,
+	unsigned int flags, int priority);
+extern CUresult cuStreamDestroy(CUstream hStream);
+extern CUresult cuCtxCreate(CUcontext *pctx, unsigned int flags,
+	CUdevice dev);
+extern CUresult cuCtxDestroy(CUcontext ctx);
+extern CUresult cuModuleLoad(CUmodule *module, const char *fname);
+extern CUresult cuModuleLoadData(CUmodule *module, const void *image);
+extern CUresult cuModuleLoadDataEx(CUmodule *module, const void *image,
+	unsigned int numOptions, CUjit_option *options, void **optionValues);
+extern CUresult cuModuleLoadFatBinary(CUmodule *module, const void *fatCubin);
+extern CUresult cuModuleUnload(CUmodule hmod);
 
 /* Real CUDA functions */
 extern cuGetProcAddress_func real_cuGetProcAddress;
 extern cuMemAllocManaged_func real_cuMemAllocManaged;
+extern cuMemAlloc_func real_cuMemAlloc;
 extern cuMemFree_func real_cuMemFree;
 extern cuMemGetInfo_func real_cuMemGetInfo;
 extern cuGetErrorString_func real_cuGetErrorString;
 extern cuGetErrorName_func real_cuGetErrorName;
 extern cuCtxSetCurrent_func real_cuCtxSetCurrent;
 extern cuCtxGetCurrent_func real_cuCtxGetCurrent;
+extern cuCtxGetDevice_func real_cuCtxGetDevice;
+extern cuDeviceGetUuid_func real_cuDeviceGetUuid;
+extern cuCtxCreate_func real_cuCtxCreate;
+extern cuCtxDestroy_func real_cuCtxDestroy;
 extern cuInit_func real_cuInit;
 extern cuCtxSynchronize_func real_cuCtxSynchronize;
 extern cuLaunchKernel_func real_cuLaunchKernel;
@@ -181,6 +313,15 @@ extern cuMemcpyHtoD_func real_cuMemcpyHtoD;
 extern cuMemcpyHtoDAsync_func real_cuMemcpyHtoDAsync;
 extern cuMemcpyDtoD_func real_cuMemcpyDtoD;
 extern cuMemcpyDtoDAsync_func real_cuMemcpyDtoDAsync;
+extern cuStreamCreate_func real_cuStreamCreate;
+extern cuStreamCreateWithPriority_func real_cuStreamCreateWithPriority;
+extern cuStreamDestroy_func real_cuStreamDestroy;
+extern cuStreamSynchronize_func real_cuStreamSynchronize;
+extern cuModuleLoad_func real_cuModuleLoad;
+extern cuModuleLoadData_func real_cuModuleLoadData;
+extern cuModuleLoadDataEx_func real_cuModuleLoadDataEx;
+extern cuModuleLoadFatBinary_func real_cuModuleLoadFatBinary;
+extern cuModuleUnload_func real_cuModuleUnload;
 
 extern void cuda_driver_check_error(CUresult err, const char *func_name);
 
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Event log of the nvshare scheduler, for post-mortem analysis.
+ *
+ * The metrics tell us how things are, the event log tells us how they came
+ * to be. We append every event as a line of JSON to a file. To bound its
+ * size, we rotate the file once it grows past max_bytes, keeping up to
+ * max_files files in total (<path>.1 being the most recent rotated one).
+ */
+
+#include <stdio.h>
+#include <errno.h>
+#include <stdarg.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+#include <time.h>
+
+#include "common.h"
+#include "comm.h"
+#include "eventlog.h"
+#include "trace.h"
+
+#define DEFAULT_EVENT_LOG_MAX_BYTES (10 * 1024 * 1024)
+#define DEFAULT_EVENT_LOG_FILES 3
+
+static FILE *eventlog_fp = NULL;
+static char *eventlog_path;
+static enum nvshare_event_level eventlog_level = NVSHARE_EVENT_INFO;
+static long long max_bytes = DEFAULT_EVENT_LOG_MAX_BYTES;
+static long long max_files = DEFAULT_EVENT_LOG_FILES;
+static pthread_mutex_t eventlog_mutex = PTHREAD_MUTEX_INITIALIZER;
+
+
+static long long getenv_positive(const char *name, long long def)
+{
+	char *value, *endptr;
+	long long n;
+
+	value = getenv(name);
+	if (value == NULL) return def;
+
+	errno = 0;
+	n = strtoll(value, &endptr, 0);
+	if (value == endptr || *endptr != '\0' || errno != 0 || n <= 0)
+		log_fatal("Invalid value for %s: %s", name, value);
+	return n;
+}
+
+
+void nvshare_eventlog_init(void)
+{
+	char *level;
+
+	eventlog_path = getenv(ENV_NVSHARE_EVENT_LOG);
+	if (eventlog_path == NULL || *eventlog_path == '\0') return;
+
+	level = getenv(ENV_NVSHARE_EVENT_LOG_LEVEL);
+	if (level == NULL || strcmp(level, "info") == 0)
+		eventlog_level = NVSHARE_EVENT_INFO;
+	else if (strcmp(level, "debug") == 0)
+		eventlog_level = NVSHARE_EVENT_DEBUG;
+	else log_fatal("Invalid value for %s: %s. Must be one of \"info\" or"
+		       " \"debug\".", ENV_NVSHARE_EVENT_LOG_LEVEL, level);
+	max_bytes = getenv_positive(ENV_NVSHARE_EVENT_LOG_MAX_BYTES,
+				    DEFAULT_EVENT_LOG_MAX_BYTES);
+	max_files = getenv_positive(ENV_NVSHARE_EVENT_LOG_FILES,
+				    DEFAULT_EVENT_LOG_FILES);
+
+	eventlog_fp = fopen(eventlog_path, "a");
+	if (eventlog_fp == NULL)
+		log_fatal_errno("Could not open event log %s", eventlog_path);
+	log_info("Writing events to %s (up to %lld bytes per file, %lld"
+		 " files)", eventlog_path, max_bytes, max_files);
+}
+
+
+/*
+ * Shift every rotated file one place down, dropping the oldest one, and
+ * start a fresh file. If we can't, keep writing to whatever file we have.
+ */
+static void rotate_eventlog(void)
+{
+	FILE *fp;
+
+	rotate_files(eventlog_path, max_files);
+	fp = fopen(eventlog_path, "a");
+	if (fp == NULL) {
+		log_warn("Failed to reopen event log %s", eventlog_path);
+		return;
+	}
+	fclose(eventlog_fp);
+	eventlog_fp = fp;
+}
+
+
+/*
+ * Log an event, optionally about a client, with an optional free-form detail
+ * string. Pass NVSHARE_UNREGISTERED_ID and NULL Pod information for events
+ * that concern the scheduler as a whole, and a NULL fmt for no detail.
+ */
+void nvshare_event(enum nvshare_event_level level, const char *event,
+	uint64_t client_id, const char *pod_namespace, const char *pod_name,
+	const char *fmt, ...)
+{
+	struct timespec now;
+	struct tm tm;
+	char ts[32], detail[256];
+	va_list ap;
+
+	if (eventlog_fp == NULL || level > eventlog_level) return;
+
+	true_or_exit(clock_gettime(CLOCK_REALTIME, &now) == 0);
+	true_or_exit(gmtime_r(&now.tv_sec, &tm) != NULL);
+	strftime(ts, sizeof(ts), "%Y-%m-%dT%H:%M:%S", &tm);
+	detail[0] = '\0';
+	if (fmt != NULL) {
+		va_start(ap, fmt);
+		vsnprintf(detail, sizeof(detail), fmt, ap);
+		va_end(ap);
+	}
+
+	true_or_exit(pthread_mutex_lock(&eventlog_mutex) == 0);
+	fprintf(eventlog_fp, "{\"time\":\"%s.%03ldZ\",\"event\":", ts,
+		now.tv_nsec / 1000000);
+	nvshare_json_write_string(eventlog_fp, event);
+	if (client_id != NVSHARE_UNREGISTERED_ID)
+		fprintf(eventlog_fp, ",\"client_id\":\"%016" PRIx64 "\"",
+			client_id);
+	if (pod_namespace != NULL) {
+		fprintf(eventlog_fp, ",\"namespace\":");
+		nvshare_json_write_string(eventlog_fp, pod_namespace);
+	}
+	if (pod_name != NULL) {
+		fprintf(eventlog_fp, ",\"pod\":");
+		nvshare_json_write_string(eventlog_fp, pod_name);
+	}
+	if (detail[0] != '\0') {
+		fprintf(eventlog_fp, ",\"detail\":");
+		nvshare_json_write_string(eventlog_fp, detail);
+	}
+	fprintf(eventlog_fp, "}\n");
+	if (fflush(eventlog_fp) != 0)
+		log_warn("Failed to write to the event log");
+	if (ftell(eventlog_fp) >= max_bytes) rotate_eventlog();
+	true_or_exit(pthread_mutex_unlock(&eventlog_mutex) == 0);
+}
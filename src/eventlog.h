@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Event log of the nvshare scheduler, for post-mortem analysis.
+ */
+
+#ifndef _NVSHARE_EVENTLOG_H_
+#define _NVSHARE_EVENTLOG_H_
+
+#include <inttypes.h>
+
+#define ENV_NVSHARE_EVENT_LOG           "NVSHARE_EVENT_LOG"
+#define ENV_NVSHARE_EVENT_LOG_LEVEL     "NVSHARE_EVENT_LOG_LEVEL"
+#define ENV_NVSHARE_EVENT_LOG_MAX_BYTES "NVSHARE_EVENT_LOG_MAX_BYTES"
+#define ENV_NVSHARE_EVENT_LOG_FILES     "NVSHARE_EVENT_LOG_FILES"
+
+enum nvshare_event_level {
+	/* Client lifecycle, memory reports and changes to the settings */
+	NVSHARE_EVENT_INFO  = 1,
+	/* Every step of every lock cycle */
+	NVSHARE_EVENT_DEBUG = 2,
+};
+
+extern void nvshare_eventlog_init(void);
+extern void nvshare_event(enum nvshare_event_level level, const char *event,
+	uint64_t client_id, const char *pod_namespace, const char *pod_name,
+	const char *fmt, ...) __attribute__((format(printf, 6, 7)));
+
+#endif /* _NVSHARE_EVENTLOG_H_ */
@@ -0,0 +1,439 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Querying and tuning the GPUs of the node through NVML, for nvshare-scheduler.
+ *
+ * We load NVML at runtime, so that the scheduler still runs (without the
+ * features that need it) on nodes where it is missing.
+ */
+
+#include <stdio.h>
+#include <dlfcn.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "common.h"
+#include "cuda_defs.h"
+#include "gpu.h"
+
+static nvmlInit_func gpu_nvmlInit;
+static nvmlDeviceGetCount_func gpu_nvmlDeviceGetCount;
+static nvmlDeviceGetHandleByIndex_func gpu_nvmlDeviceGetHandleByIndex;
+static nvmlDeviceGetUtilizationRates_func gpu_nvmlDeviceGetUtilizationRates;
+static nvmlDeviceGetMemoryInfo_func gpu_nvmlDeviceGetMemoryInfo;
+/* Optional, we only need them to boost the clocks */
+static nvmlDeviceGetMaxClockInfo_func gpu_nvmlDeviceGetMaxClockInfo;
+static nvmlDeviceSetGpuLockedClocks_func gpu_nvmlDeviceSetGpuLockedClocks;
+static nvmlDeviceResetGpuLockedClocks_func gpu_nvmlDeviceResetGpuLockedClocks;
+/* Optional, we only need them to detect throttling */
+static nvmlDeviceGetCurrentClocksThrottleReasons_func
+	gpu_nvmlDeviceGetCurrentClocksThrottleReasons;
+static nvmlDeviceGetClockInfo_func gpu_nvmlDeviceGetClockInfo;
+static nvmlDeviceGetTemperature_func gpu_nvmlDeviceGetTemperature;
+/* Optional, we only need it to label the metrics of each GPU */
+static nvmlDeviceGetUUID_func gpu_nvmlDeviceGetUUID;
+/* Optional, we only need them to limit the processes on the GPU */
+static nvmlDeviceGetComputeMode_func gpu_nvmlDeviceGetComputeMode;
+static nvmlDeviceGetComputeRunningProcesses_func
+	gpu_nvmlDeviceGetComputeRunningProcesses;
+/* Optional, we only need them for the diagnostics block */
+static nvmlDeviceGetName_func gpu_nvmlDeviceGetName;
+static nvmlSystemGetDriverVersion_func gpu_nvmlSystemGetDriverVersion;
+static nvmlSystemGetNVMLVersion_func gpu_nvmlSystemGetNVMLVersion;
+static nvmlSystemGetCudaDriverVersion_func gpu_nvmlSystemGetCudaDriverVersion;
+
+/* 0 until we try to load NVML, then 1 on success and -1 on failure */
+static int gpu_state = 0;
+
+
+/*
+ * Load and initialize NVML. Return 0 on success, -1 if it is unavailable.
+ * We only try once.
+ */
+int nvshare_gpu_init(void)
+{
+	void *handle;
+	nvmlReturn_t ret;
+
+	if (gpu_state != 0) return (gpu_state > 0) ? 0 : -1;
+	gpu_state = -1;
+
+	handle = dlopen("libnvidia-ml.so.1", RTLD_LAZY);
+	if (handle == NULL) {
+		log_warn("Failed to load NVML: %s", dlerror());
+		return -1;
+	}
+	gpu_nvmlInit = (nvmlInit_func)dlsym(handle,
+		CUDA_SYMBOL_STRING(nvmlInit));
+	gpu_nvmlDeviceGetCount = (nvmlDeviceGetCount_func)dlsym(handle,
+		CUDA_SYMBOL_STRING(nvmlDeviceGetCount));
+	gpu_nvmlDeviceGetHandleByIndex = (nvmlDeviceGetHandleByIndex_func)
+		dlsym(handle, CUDA_SYMBOL_STRING(nvmlDeviceGetHandleByIndex));
+	gpu_nvmlDeviceGetUtilizationRates =
+		(nvmlDeviceGetUtilizationRates_func)dlsym(handle,
+		CUDA_SYMBOL_STRING(nvmlDeviceGetUtilizationRates));
+	gpu_nvmlDeviceGetMemoryInfo = (nvmlDeviceGetMemoryInfo_func)
+		dlsym(handle, CUDA_SYMBOL_STRING(nvmlDeviceGetMemoryInfo));
+	gpu_nvmlDeviceGetMaxClockInfo = (nvmlDeviceGetMaxClockInfo_func)
+		dlsym(handle, "nvmlDeviceGetMaxClockInfo");
+	gpu_nvmlDeviceSetGpuLockedClocks = (nvmlDeviceSetGpuLockedClocks_func)
+		dlsym(handle, "nvmlDeviceSetGpuLockedClocks");
+	gpu_nvmlDeviceResetGpuLockedClocks =
+		(nvmlDeviceResetGpuLockedClocks_func)dlsym(handle,
+		"nvmlDeviceResetGpuLockedClocks");
+	gpu_nvmlDeviceGetCurrentClocksThrottleReasons =
+		(nvmlDeviceGetCurrentClocksThrottleReasons_func)dlsym(handle,
+		"nvmlDeviceGetCurrentClocksThrottleReasons");
+	gpu_nvmlDeviceGetClockInfo = (nvmlDeviceGetClockInfo_func)
+		dlsym(handle, "nvmlDeviceGetClockInfo");
+	gpu_nvmlDeviceGetTemperature = (nvmlDeviceGetTemperature_func)
+		dlsym(handle, "nvmlDeviceGetTemperature");
+	gpu_nvmlDeviceGetUUID = (nvmlDeviceGetUUID_func)dlsym(handle,
+		"nvmlDeviceGetUUID");
+	gpu_nvmlDeviceGetComputeMode = (nvmlDeviceGetComputeMode_func)
+		dlsym(handle, "nvmlDeviceGetComputeMode");
+	/* Newer drivers version it, we only ask for the count anyway */
+	gpu_nvmlDeviceGetComputeRunningProcesses =
+		(nvmlDeviceGetComputeRunningProcesses_func)dlsym(handle,
+		"nvmlDeviceGetComputeRunningProcesses_v3");
+	if (gpu_nvmlDeviceGetComputeRunningProcesses == NULL)
+		gpu_nvmlDeviceGetComputeRunningProcesses =
+			(nvmlDeviceGetComputeRunningProcesses_func)dlsym(handle,
+			"nvmlDeviceGetComputeRunningProcesses_v2");
+	if (gpu_nvmlDeviceGetComputeRunningProcesses == NULL)
+		gpu_nvmlDeviceGetComputeRunningProcesses =
+			(nvmlDeviceGetComputeRunningProcesses_func)dlsym(handle,
+			"nvmlDeviceGetComputeRunningProcesses");
+	gpu_nvmlDeviceGetName = (nvmlDeviceGetName_func)dlsym(handle,
+		"nvmlDeviceGetName");
+	gpu_nvmlSystemGetDriverVersion = (nvmlSystemGetDriverVersion_func)
+		dlsym(handle, "nvmlSystemGetDriverVersion");
+	gpu_nvmlSystemGetNVMLVersion = (nvmlSystemGetNVMLVersion_func)
+		dlsym(handle, "nvmlSystemGetNVMLVersion");
+	gpu_nvmlSystemGetCudaDriverVersion =
+		(nvmlSystemGetCudaDriverVersion_func)dlsym(handle,
+		"nvmlSystemGetCudaDriverVersion");
+	if (gpu_nvmlInit == NULL || gpu_nvmlDeviceGetCount == NULL ||
+	    gpu_nvmlDeviceGetHandleByIndex == NULL ||
+	    gpu_nvmlDeviceGetUtilizationRates == NULL ||
+	    gpu_nvmlDeviceGetMemoryInfo == NULL) {
+		log_warn("Failed to find the NVML functions we need");
+		dlclose(handle);
+		return -1;
+	}
+
+	ret = gpu_nvmlInit();
+	if (ret != NVML_SUCCESS) {
+		log_warn("nvmlInit() failed with %d", (int)ret);
+		dlclose(handle);
+		return -1;
+	}
+	gpu_state = 1;
+	return 0;
+}
+
+
+/*
+ * Store the highest GPU utilization rate (percent) across the GPUs of the
+ * node in util. Return 0 on success, -1 on failure.
+ */
+int nvshare_gpu_utilization(unsigned int *util)
+{
+	unsigned int count, i;
+	nvmlDevice_t dev;
+	nvmlUtilization_t u;
+
+	if (nvshare_gpu_init() != 0) return -1;
+	if (gpu_nvmlDeviceGetCount(&count) != NVML_SUCCESS) return -1;
+
+	*util = 0;
+	for (i = 0; i < count; i++) {
+		if (gpu_nvmlDeviceGetHandleByIndex(i, &dev) != NVML_SUCCESS ||
+		    gpu_nvmlDeviceGetUtilizationRates(dev, &u) != NVML_SUCCESS)
+			return -1;
+		if (u.gpu > *util) *util = u.gpu;
+	}
+	return 0;
+}
+
+
+/*
+ * Store the UUID and utilization rate of each GPU of the node in gpus, up to
+ * max of them. Return the number of GPUs we stored, or -1 on failure.
+ */
+int nvshare_gpu_utilizations(struct nvshare_gpu_util *gpus, int max)
+{
+	unsigned int count, i;
+	nvmlDevice_t dev;
+	nvmlUtilization_t u;
+
+	if (nvshare_gpu_init() != 0 || gpu_nvmlDeviceGetUUID == NULL)
+		return -1;
+	if (gpu_nvmlDeviceGetCount(&count) != NVML_SUCCESS) return -1;
+
+	for (i = 0; i < count && i < (unsigned int)max; i++) {
+		if (gpu_nvmlDeviceGetHandleByIndex(i, &dev) != NVML_SUCCESS ||
+		    gpu_nvmlDeviceGetUUID(dev, gpus[i].uuid,
+		    sizeof(gpus[i].uuid)) != NVML_SUCCESS ||
+		    gpu_nvmlDeviceGetUtilizationRates(dev, &u) != NVML_SUCCESS)
+			return -1;
+		gpus[i].util = u.gpu;
+	}
+	return (int)i;
+}
+
+
+/*
+ * Store the versions of the NVIDIA driver and of NVML, as strings of up to
+ * len bytes, and the CUDA version that the driver supports, as the CUDA
+ * driver API reports it, e.g., 12020. Each is "unknown", or 0, if NVML can't
+ * tell. Return 0 on success, -1 if NVML is unavailable.
+ */
+int nvshare_gpu_versions(char *driver, char *nvml, size_t len, int *cuda)
+{
+	strlcpy(driver, "unknown", len);
+	strlcpy(nvml, "unknown", len);
+	*cuda = 0;
+	if (nvshare_gpu_init() != 0) return -1;
+
+	if (gpu_nvmlSystemGetDriverVersion == NULL ||
+	    gpu_nvmlSystemGetDriverVersion(driver, len) != NVML_SUCCESS)
+		strlcpy(driver, "unknown", len);
+	if (gpu_nvmlSystemGetNVMLVersion == NULL ||
+	    gpu_nvmlSystemGetNVMLVersion(nvml, len) != NVML_SUCCESS)
+		strlcpy(nvml, "unknown", len);
+	if (gpu_nvmlSystemGetCudaDriverVersion == NULL ||
+	    gpu_nvmlSystemGetCudaDriverVersion(cuda) != NVML_SUCCESS)
+		*cuda = 0;
+	return 0;
+}
+
+
+/*
+ * Store the UUID, model and memory of each GPU of the node in gpus, up to max
+ * of them. Whatever NVML can't tell is "unknown", or 0. Return the number of
+ * GPUs we stored, or -1 on failure.
+ */
+int nvshare_gpu_infos(struct nvshare_gpu_info *gpus, int max)
+{
+	unsigned int count, i;
+	nvmlDevice_t dev;
+	nvmlMemory_t mem;
+
+	if (nvshare_gpu_init() != 0) return -1;
+	if (gpu_nvmlDeviceGetCount(&count) != NVML_SUCCESS) return -1;
+
+	for (i = 0; i < count && i < (unsigned int)max; i++) {
+		if (gpu_nvmlDeviceGetHandleByIndex(i, &dev) != NVML_SUCCESS)
+			return -1;
+		if (gpu_nvmlDeviceGetUUID == NULL ||
+		    gpu_nvmlDeviceGetUUID(dev, gpus[i].uuid,
+		    sizeof(gpus[i].uuid)) != NVML_SUCCESS)
+			strlcpy(gpus[i].uuid, "unknown", sizeof(gpus[i].uuid));
+		if (gpu_nvmlDeviceGetName == NULL ||
+		    gpu_nvmlDeviceGetName(dev, gpus[i].name,
+		    sizeof(gpus[i].name)) != NVML_SUCCESS)
+			strlcpy(gpus[i].name, "unknown", sizeof(gpus[i].name));
+		if (gpu_nvmlDeviceGetMemoryInfo(dev, &mem) == NVML_SUCCESS)
+			gpus[i].memory_mib = mem.total / (1 MiB);
+		else gpus[i].memory_mib = 0;
+	}
+	return (int)i;
+}
+
+
+/*
+ * Store the number of compute processes on the busiest GPU of the node in
+ * procs, and the most processes that the compute mode of the most limited
+ * GPU allows in limit, or -1 if none of them limits the processes. Return 0
+ * on success, -1 on failure.
+ */
+int nvshare_gpu_processes(unsigned int *procs, int *limit)
+{
+	unsigned int count, i, n;
+	nvmlDevice_t dev;
+	nvmlComputeMode_t mode;
+	nvmlReturn_t ret;
+	int max;
+
+	if (nvshare_gpu_init() != 0 ||
+	    gpu_nvmlDeviceGetComputeRunningProcesses == NULL)
+		return -1;
+	if (gpu_nvmlDeviceGetCount(&count) != NVML_SUCCESS || count == 0)
+		return -1;
+
+	*procs = 0;
+	*limit = -1;
+	for (i = 0; i < count; i++) {
+		if (gpu_nvmlDeviceGetHandleByIndex(i, &dev) != NVML_SUCCESS)
+			return -1;
+		/* With no room for the processes, NVML tells us their count */
+		n = 0;
+		ret = gpu_nvmlDeviceGetComputeRunningProcesses(dev, &n, NULL);
+		if (ret != NVML_SUCCESS && ret != NVML_ERROR_INSUFFICIENT_SIZE)
+			return -1;
+		if (n > *procs) *procs = n;
+		if (gpu_nvmlDeviceGetComputeMode == NULL ||
+		    gpu_nvmlDeviceGetComputeMode(dev, &mode) != NVML_SUCCESS)
+			continue;
+		switch (mode) {
+		case NVML_COMPUTEMODE_PROHIBITED:
+			max = 0;
+			break;
+		case NVML_COMPUTEMODE_EXCLUSIVE_THREAD:
+		case NVML_COMPUTEMODE_EXCLUSIVE_PROCESS:
+			max = 1;
+			break;
+		default:
+			max = -1;
+			break;
+		}
+		if (max >= 0 && (*limit < 0 || max < *limit)) *limit = max;
+	}
+	return 0;
+}
+
+
+/*
+ * Store the lowest free GPU memory (MiB) across the GPUs of the node in
+ * free_mib. Return 0 on success, -1 on failure.
+ */
+int nvshare_gpu_free_memory(long long *free_mib)
+{
+	unsigned int count, i;
+	nvmlDevice_t dev;
+	nvmlMemory_t m;
+	long long mib;
+
+	if (nvshare_gpu_init() != 0) return -1;
+	if (gpu_nvmlDeviceGetCount(&count) != NVML_SUCCESS || count == 0)
+		return -1;
+
+	for (i = 0; i < count; i++) {
+		if (gpu_nvmlDeviceGetHandleByIndex(i, &dev) != NVML_SUCCESS ||
+		    gpu_nvmlDeviceGetMemoryInfo(dev, &m) != NVML_SUCCESS)
+			return -1;
+		mib = (long long)(m.free / (1024 * 1024));
+		if (i == 0 || mib < *free_mib) *free_mib = mib;
+	}
+	return 0;
+}
+
+
+static const char *nvml_power_error(nvmlReturn_t ret)
+{
+	switch (ret) {
+	case NVML_ERROR_NOT_SUPPORTED:
+		return "not supported by the GPU";
+	case NVML_ERROR_NO_PERMISSION:
+		return "permission denied";
+	default:
+		return "NVML error";
+	}
+}
+
+
+/*
+ * Lock the graphics clocks of the GPUs of the node at their maximum (boost =
+ * 1), or let the driver manage them again (boost = 0). Locking clocks needs
+ * root and a GPU that supports it. Return 0 on success, -1 on failure.
+ */
+int nvshare_gpu_set_boost(int boost)
+{
+	unsigned int count, i, clock;
+	nvmlDevice_t dev;
+	nvmlReturn_t ret;
+
+	if (nvshare_gpu_init() != 0) return -1;
+	if (gpu_nvmlDeviceGetMaxClockInfo == NULL ||
+	    gpu_nvmlDeviceSetGpuLockedClocks == NULL ||
+	    gpu_nvmlDeviceResetGpuLockedClocks == NULL) {
+		log_warn("This NVML can't lock the GPU clocks");
+		return -1;
+	}
+	if (gpu_nvmlDeviceGetCount(&count) != NVML_SUCCESS) return -1;
+
+	for (i = 0; i < count; i++) {
+		ret = gpu_nvmlDeviceGetHandleByIndex(i, &dev);
+		if (ret == NVML_SUCCESS && boost) {
+			ret = gpu_nvmlDeviceGetMaxClockInfo(dev,
+				NVML_CLOCK_GRAPHICS, &clock);
+			if (ret == NVML_SUCCESS)
+				ret = gpu_nvmlDeviceSetGpuLockedClocks(dev,
+					clock, clock);
+		} else if (ret == NVML_SUCCESS) {
+			ret = gpu_nvmlDeviceResetGpuLockedClocks(dev);
+		}
+		if (ret != NVML_SUCCESS) {
+			log_warn("Failed to %s the clocks of GPU %u: %s (%d)",
+				 boost ? "lock" : "reset", i,
+				 nvml_power_error(ret), (int)ret);
+			return -1;
+		}
+	}
+	return 0;
+}
+
+
+/*
+ * Find out whether the GPUs of the node are throttling, see struct
+ * nvshare_gpu_throttle. Return 0 on success, -1 if NVML can't tell us the
+ * throttle reasons.
+ */
+int nvshare_gpu_throttle(struct nvshare_gpu_throttle *t)
+{
+	unsigned int count, i, clock, max_clock, temp;
+	unsigned long long reasons;
+	nvmlDevice_t dev;
+
+	if (nvshare_gpu_init() != 0) return -1;
+	if (gpu_nvmlDeviceGetCurrentClocksThrottleReasons == NULL) return -1;
+	if (gpu_nvmlDeviceGetCount(&count) != NVML_SUCCESS || count == 0)
+		return -1;
+
+	memset(t, 0, sizeof(*t));
+	for (i = 0; i < count; i++) {
+		if (gpu_nvmlDeviceGetHandleByIndex(i, &dev) != NVML_SUCCESS ||
+		    gpu_nvmlDeviceGetCurrentClocksThrottleReasons(dev,
+		    &reasons) != NVML_SUCCESS)
+			return -1;
+		if (reasons & (nvmlClocksThrottleReasonSwThermalSlowdown |
+			       nvmlClocksThrottleReasonHwThermalSlowdown))
+			t->causes |= NVSHARE_GPU_THROTTLE_THERMAL;
+		if (reasons & (nvmlClocksThrottleReasonSwPowerCap |
+			       nvmlClocksThrottleReasonHwPowerBrakeSlowdown))
+			t->causes |= NVSHARE_GPU_THROTTLE_POWER;
+		if (reasons & nvmlClocksThrottleReasonHwSlowdown)
+			t->causes |= NVSHARE_GPU_THROTTLE_HW_SLOWDOWN;
+		if (gpu_nvmlDeviceGetClockInfo != NULL &&
+		    gpu_nvmlDeviceGetMaxClockInfo != NULL &&
+		    gpu_nvmlDeviceGetClockInfo(dev, NVML_CLOCK_GRAPHICS,
+		    &clock) == NVML_SUCCESS &&
+		    gpu_nvmlDeviceGetMaxClockInfo(dev, NVML_CLOCK_GRAPHICS,
+		    &max_clock) == NVML_SUCCESS && max_clock > 0 &&
+		    (t->max_clock_mhz == 0 || (unsigned long long)clock *
+		     t->max_clock_mhz < (unsigned long long)t->clock_mhz *
+		     max_clock)) {
+			t->clock_mhz = clock;
+			t->max_clock_mhz = max_clock;
+		}
+		if (gpu_nvmlDeviceGetTemperature != NULL &&
+		    gpu_nvmlDeviceGetTemperature(dev, NVML_TEMPERATURE_GPU,
+		    &temp) == NVML_SUCCESS && temp > t->temperature)
+			t->temperature = temp;
+	}
+	return 0;
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Querying and tuning the GPUs of the node through NVML, for nvshare-scheduler.
+ */
+
+#ifndef _NVSHARE_GPU_H_
+#define _NVSHARE_GPU_H_
+
+#include <stddef.h>
+
+extern int nvshare_gpu_init(void);
+extern int nvshare_gpu_utilization(unsigned int *util);
+extern int nvshare_gpu_free_memory(long long *free_mib);
+extern int nvshare_gpu_set_boost(int boost);
+extern int nvshare_gpu_processes(unsigned int *procs, int *limit);
+
+#define NVSHARE_GPU_UUID_BUF_LEN 80 /* NVML_DEVICE_UUID_V2_BUFFER_SIZE */
+
+/* The utilization of a single GPU of the node */
+struct nvshare_gpu_util {
+	char uuid[NVSHARE_GPU_UUID_BUF_LEN]; /* As nvidia-smi shows it */
+	unsigned int util; /* Percent */
+};
+
+extern int nvshare_gpu_utilizations(struct nvshare_gpu_util *gpus, int max);
+
+/* A GPU of the node, for the diagnostics block */
+struct nvshare_gpu_info {
+	char uuid[NVSHARE_GPU_UUID_BUF_LEN];
+	char name[96]; /* NVML_DEVICE_NAME_V2_BUFFER_SIZE */
+	unsigned long long memory_mib;
+};
+
+extern int nvshare_gpu_infos(struct nvshare_gpu_info *gpus, int max);
+
+#define NVSHARE_GPU_VERSION_BUF_LEN 80 /* NVML_SYSTEM_DRIVER_VERSION_BUFFER_SIZE */
+
+extern int nvshare_gpu_versions(char *driver, char *nvml, size_t len,
+	int *cuda);
+
+/*
+ * Why the GPUs of the node slow down their clocks, if they do. Other reasons
+ * for lower clocks, e.g., that a GPU is idle, don't slow down work.
+ */
+#define NVSHARE_GPU_THROTTLE_THERMAL     0x1
+#define NVSHARE_GPU_THROTTLE_POWER       0x2 /* Power cap or power brake */
+#define NVSHARE_GPU_THROTTLE_HW_SLOWDOWN 0x4
+
+/*
+ * Whether and why the GPUs of the node are throttling. The clocks are those
+ * of the GPU furthest below its maximum, the temperature that of the hottest
+ * GPU. Either is 0 if NVML can't tell.
+ */
+struct nvshare_gpu_throttle {
+	int causes; /* NVSHARE_GPU_THROTTLE_*, of all GPUs, 0 if none */
+	unsigned int clock_mhz;
+	unsigned int max_clock_mhz;
+	unsigned int temperature; /* Celsius */
+};
+
+extern int nvshare_gpu_throttle(struct nvshare_gpu_throttle *t);
+
+#endif /* _NVSHARE_GPU_H_ */
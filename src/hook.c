@@ -26,14 +26,20 @@
 #define _GNU_SOURCE
 #endif /* _GNU_SOURCE */
 
+#include <elf.h>
+#include <errno.h>
 #include <dlfcn.h>
 #include <stdio.h>
+#include <limits.h>
 #include <stdlib.h>
 #include <string.h>
 #include <unistd.h>
 #include <pthread.h>
 #include <inttypes.h>
+#include <sys/mman.h>
+#include <sys/stat.h>
 
+#include "calltrace.h"
 #include "comm.h"
 #include "common.h"
 #include "cuda_defs.h"
@@ -41,13 +47,24 @@
 #include "utlist.h"
 
 #define ENV_NVSHARE_ENABLE_SINGLE_OVERSUB  "NVSHARE_ENABLE_SINGLE_OVERSUB"
+#define ENV_NVSHARE_SAFE_MODE              "NVSHARE_SAFE_MODE"
+#define ENV_NVSHARE_MAX_STREAMS            "NVSHARE_MAX_STREAMS"
+#define ENV_NVSHARE_MLOCK                  "NVSHARE_MLOCK"
+#define ENV_NVSHARE_MAX_ALLOCATIONS        "NVSHARE_MAX_ALLOCATIONS"
+#define ENV_NVSHARE_MAX_CONTEXTS           "NVSHARE_MAX_CONTEXTS"
+#define ENV_NVSHARE_CONTEXT_OVERHEAD_MIB   "NVSHARE_CONTEXT_OVERHEAD_MIB"
+#define ENV_NVSHARE_MEMORY_MANAGE          "NVSHARE_MEMORY_MANAGE"
+#define ENV_KUBERNETES_SERVICE_HOST        "KUBERNETES_SERVICE_HOST"
 
 #define MEMINFO_RESERVE_MIB 1536           /* MiB */
 #define KERN_SYNC_DURATION_BIG 10          /* seconds */
 #define KERN_SYNC_WINDOW_STEPDOWN_THRESH 1 /* seconds */
 #define KERN_SYNC_WINDOW_MAX 2048          /* Pending Kernels */
+#define ALLOCATION_CHUNK_LEN 1024          /* Allocation records */
+#define RESERVATION_ALIGN 512              /* Bytes, like cuMemAlloc() */
 
 static void *real_dlsym_225(void *handle, const char *symbol);
+static void log_hooked_functions(void);
 
 cuCtxSynchronize_func real_cuCtxSynchronize = NULL;
 cuLaunchKernel_func real_cuLaunchKernel = NULL;
@@ -59,14 +76,37 @@ cuMemcpyHtoD_func real_cuMemcpyHtoD = NULL;
 cuMemcpyHtoDAsync_func real_cuMemcpyHtoDAsync = NULL;
 cuMemcpyDtoD_func real_cuMemcpyDtoD = NULL;
 cuMemcpyDtoDAsync_func real_cuMemcpyDtoDAsync = NULL;
+cuStreamCreate_func real_cuStreamCreate = NULL;
+cuStreamCreateWithPriority_func real_cuStreamCreateWithPriority = NULL;
+cuStreamDestroy_func real_cuStreamDestroy = NULL;
+cuStreamSynchronize_func real_cuStreamSynchronize = NULL;
+cuModuleLoad_func real_cuModuleLoad = NULL;
+cuModuleLoadData_func real_cuModuleLoadData = NULL;
+cuModuleLoadDataEx_func real_cuModuleLoadDataEx = NULL;
+cuModuleLoadFatBinary_func real_cuModuleLoadFatBinary = NULL;
+cuModuleUnload_func real_cuModuleUnload = NULL;
 cuGetProcAddress_func real_cuGetProcAddress = NULL;
 cuMemAllocManaged_func real_cuMemAllocManaged = NULL;
+cuMemAlloc_func real_cuMemAlloc = NULL;
 cuMemFree_func real_cuMemFree = NULL;
 cuMemGetInfo_func real_cuMemGetInfo = NULL;
 cuGetErrorString_func real_cuGetErrorString = NULL;
 cuGetErrorName_func real_cuGetErrorName = NULL;
 cuCtxSetCurrent_func real_cuCtxSetCurrent = NULL;
 cuCtxGetCurrent_func real_cuCtxGetCurrent = NULL;
+/* Optional, we only need them to tell the scheduler which GPU we use */
+cuCtxGetDevice_func real_cuCtxGetDevice = NULL;
+cuDeviceGetUuid_func real_cuDeviceGetUuid = NULL;
+/* Optional, we only need it to check the CUDA versions */
+cuDriverGetVersion_func real_cuDriverGetVersion = NULL;
+/* Optional, we only need them for the diagnostics block */
+static cuDeviceGet_func real_cuDeviceGet = NULL;
+static cuDeviceGetName_func real_cuDeviceGetName = NULL;
+static cuDeviceTotalMem_func real_cuDeviceTotalMem = NULL;
+static nvmlSystemGetDriverVersion_func real_nvmlSystemGetDriverVersion = NULL;
+static nvmlSystemGetNVMLVersion_func real_nvmlSystemGetNVMLVersion = NULL;
+cuCtxCreate_func real_cuCtxCreate = NULL;
+cuCtxDestroy_func real_cuCtxDestroy = NULL;
 cuInit_func real_cuInit = NULL;
 
 nvmlDeviceGetUtilizationRates_func real_nvmlDeviceGetUtilizationRates = NULL;
@@ -75,6 +115,7 @@ nvmlDeviceGetHandleByIndex_func real_nvmlDeviceGetHandleByIndex = NULL;
 
 size_t nvshare_size_mem_allocatable = 0;
 size_t sum_allocated = 0;
+size_t nvshare_size_mem_total = 0; /* Physical GPU memory */
 
 int kern_since_sync = 0;
 int pending_kernel_window = 1;
@@ -83,16 +124,124 @@ pthread_mutex_t kcount_mutex;
 int enable_single_oversub = 0;
 int nvml_ok = 1;
 
+/*
+ * In safe mode, we still register with the scheduler but pass every CUDA
+ * call through to the driver, without any synchronization or memory
+ * management logic. Useful to find out whether nvshare's interception is
+ * what breaks an application.
+ */
+int safe_mode = 0;
+
+/*
+ * On Kubernetes, the device plugin tells every container that it grants an
+ * nvshare device which slot it uses. A container without a slot (e.g., a
+ * sidecar that inherited LD_PRELOAD) must not become a client, so we stay
+ * out of its way: We pass every CUDA call through, like in safe mode, and
+ * never talk to the scheduler.
+ */
+int inert = 0;
+
+/*
+ * With NVSHARE_MEMORY_MANAGE=off, we don't manage GPU memory: Allocations
+ * are regular device allocations instead of Unified Memory, we don't check
+ * them against the capacity of the GPU, and cuMemGetInfo() reports what the
+ * driver does. Time-slicing is independent of it, see ENV_NVSHARE_TIMESLICE.
+ */
+int memory_manage = 1;
+
+/*
+ * Maximum number of live CUDA streams of the application. A pathological
+ * application that creates thousands of them stresses the shared GPU.
+ * 0 means no limit.
+ */
+long max_streams = 0;
+long live_streams = 0;
+pthread_mutex_t streams_mutex = PTHREAD_MUTEX_INITIALIZER;
+
+/*
+ * Maximum number of live GPU memory allocations of the application. Every
+ * allocation costs us a record, so this bounds our bookkeeping for
+ * applications that make huge numbers of small allocations. 0 means no
+ * limit.
+ */
+long max_allocations = 0;
+long live_allocations = 0;
+
+/*
+ * Maximum number of live CUDA contexts that the application creates itself,
+ * on top of the primary context that the CUDA runtime uses. Every context
+ * takes up GPU memory and contexts of the same GPU time-slice with each
+ * other, so an application that creates many of them stresses the shared
+ * GPU. 0 means no limit.
+ */
+long max_contexts = 0;
+long live_contexts = 0;
+pthread_mutex_t contexts_mutex = PTHREAD_MUTEX_INITIALIZER;
+
+/*
+ * Estimated GPU memory that the context of every other co-located client
+ * takes up, which cuMemGetInfo() hides on top of MEMINFO_RESERVE_MIB.
+ */
+long long context_overhead_mib = 0;
+
+/*
+ * Loaded CUDA modules take up GPU memory for their code and static data
+ * that never goes through cuMemAlloc(). We estimate it from the size of
+ * their image, see module_image_size(), and report it as committed memory
+ * along with the allocations.
+ */
+struct cuda_module {
+	CUmodule mod;
+	size_t size;
+	struct cuda_module *next;
+};
+struct cuda_module *cuda_module_list = NULL;
+size_t sum_modules = 0;
+pthread_mutex_t modules_mutex = PTHREAD_MUTEX_INITIALIZER;
+
 /* Representation of a CUDA memory allocation */
 struct cuda_mem_allocation {
 	CUdeviceptr ptr;
 	size_t size;
+	int reserved; /* Carved out of the reservation */
 	struct cuda_mem_allocation *next;
 };
 
+/*
+ * With NVSHARE_RESERVE_MEMORY_MIB, we allocate that much GPU memory as a
+ * single buffer at the first cuMemAlloc() and hold on to it. We carve the
+ * allocations of the application out of it for as long as they fit, so
+ * they can't fail later on, e.g., because more clients have joined the GPU
+ * and cuMemGetInfo() hides more memory by then. Allocations that don't fit
+ * go to the driver as usual. We report the reservation as committed memory
+ * as a whole, and the scheduler accounts it from the moment we register.
+ */
+struct reservation_range {
+	CUdeviceptr ptr;
+	size_t size;
+	struct reservation_range *next;
+};
+long long reserve_memory_mib = 0;
+size_t reservation_size = 0; /* 0 until we hold it */
+CUdeviceptr reservation_ptr = 0;
+size_t sum_reserved = 0; /* Allocated out of the reservation */
+/* The free ranges of the reservation, in address order */
+struct reservation_range *reservation_free = NULL;
+
 /* Linked list that holds all memory allocations of current application. */
 struct cuda_mem_allocation *cuda_allocation_list = NULL;
 
+/*
+ * With NVSHARE_MLOCK, we carve the allocation records out of chunks that we
+ * lock in RAM and recycle them through a free list, so that walking the
+ * allocation list never has to wait for the records to be swapped back in
+ * when the host is under memory pressure. Locking memory needs privileges
+ * (CAP_IPC_LOCK or a high enough RLIMIT_MEMLOCK), so it's optional.
+ */
+int mlock_bookkeeping = 0;
+int mlock_failed = 0;
+struct cuda_mem_allocation *free_allocations = NULL;
+
 /* Load real CUDA {Driver API, NVML} functions and bootstrap auxiliary stuff. */
 static void bootstrap_cuda(void)
 {
@@ -103,6 +252,10 @@ static void bootstrap_cuda(void)
 
 	true_or_exit(pthread_mutex_init(&kcount_mutex, NULL) == 0);
 
+	/*
+	 * Every NVML function is optional, the client probes which of them
+	 * work once it has started, see probe_nvml().
+	 */
 	nvml_handle = dlopen("libnvidia-ml.so.1", RTLD_LAZY);
 	if (!nvml_handle) {
 		error = dlerror();
@@ -114,25 +267,25 @@ static void bootstrap_cuda(void)
 			(nvmlDeviceGetUtilizationRates_func)real_dlsym_225(nvml_handle,
 			CUDA_SYMBOL_STRING(nvmlDeviceGetUtilizationRates));
 		error = dlerror();
-		if (error != NULL) {
-			log_debug("%s", error);
-			nvml_ok = 0;
-		}
+		if (error != NULL) log_debug("%s", error);
 		real_nvmlInit = (nvmlInit_func)
 		real_dlsym_225(nvml_handle,CUDA_SYMBOL_STRING(nvmlInit));
 		error = dlerror();
-		if (error != NULL) {
-			log_debug("%s", error);
-			nvml_ok = 0;
-		}
+		if (error != NULL) log_debug("%s", error);
 		real_nvmlDeviceGetHandleByIndex = (nvmlDeviceGetHandleByIndex_func)
 		real_dlsym_225(nvml_handle,
 			CUDA_SYMBOL_STRING(nvmlDeviceGetHandleByIndex));
 		error = dlerror();
-		if (error != NULL) {
-			log_debug("%s", error);
-			nvml_ok = 0;
-		}
+		if (error != NULL) log_debug("%s", error);
+		real_nvmlSystemGetDriverVersion =
+			(nvmlSystemGetDriverVersion_func)real_dlsym_225(
+			nvml_handle, "nvmlSystemGetDriverVersion");
+		error = dlerror();
+		if (error != NULL) log_debug("%s", error);
+		real_nvmlSystemGetNVMLVersion = (nvmlSystemGetNVMLVersion_func)
+			real_dlsym_225(nvml_handle, "nvmlSystemGetNVMLVersion");
+		error = dlerror();
+		if (error != NULL) log_debug("%s", error);
 	}
 	if (nvml_ok) log_debug("Found NVML");
 	else log_debug("Could not find NVML");
@@ -154,6 +307,11 @@ static void bootstrap_cuda(void)
 	real_cuMemAllocManaged = (cuMemAllocManaged_func)
 		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuMemAllocManaged));
 	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuMemAlloc = (cuMemAlloc_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuMemAlloc));
+	error = dlerror();
 	if (error != NULL)
 		log_fatal("%s", error);
 	real_cuMemFree = (cuMemFree_func)
@@ -189,6 +347,16 @@ static void bootstrap_cuda(void)
 	real_cuCtxSetCurrent = (cuCtxSetCurrent_func)
 		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuCtxSetCurrent));
 	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuCtxCreate = (cuCtxCreate_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuCtxCreate));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuCtxDestroy = (cuCtxDestroy_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuCtxDestroy));
+	error = dlerror();
 	if (error != NULL)
 		log_fatal("%s", error);
 	real_cuCtxGetCurrent = (cuCtxGetCurrent_func)
@@ -251,60 +419,496 @@ static void bootstrap_cuda(void)
 	error = dlerror();
 	if (error != NULL)
 		log_fatal("%s", error);
+	real_cuStreamCreate = (cuStreamCreate_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuStreamCreate));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuStreamCreateWithPriority = (cuStreamCreateWithPriority_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuStreamCreateWithPriority));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuStreamDestroy = (cuStreamDestroy_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuStreamDestroy));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuStreamSynchronize = (cuStreamSynchronize_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuStreamSynchronize));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuModuleLoad = (cuModuleLoad_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuModuleLoad));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuModuleLoadData = (cuModuleLoadData_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuModuleLoadData));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuModuleLoadDataEx = (cuModuleLoadDataEx_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuModuleLoadDataEx));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuModuleLoadFatBinary = (cuModuleLoadFatBinary_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuModuleLoadFatBinary));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuModuleUnload = (cuModuleUnload_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuModuleUnload));
+	error = dlerror();
+	if (error != NULL)
+		log_fatal("%s", error);
+	real_cuCtxGetDevice = (cuCtxGetDevice_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuCtxGetDevice));
+	error = dlerror();
+	if (error != NULL)
+		log_debug("%s", error);
+	real_cuDeviceGetUuid = (cuDeviceGetUuid_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuDeviceGetUuid));
+	error = dlerror();
+	if (error != NULL)
+		log_debug("%s", error);
+	real_cuDriverGetVersion = (cuDriverGetVersion_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuDriverGetVersion));
+	error = dlerror();
+	if (error != NULL)
+		log_debug("%s", error);
+	real_cuDeviceGet = (cuDeviceGet_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuDeviceGet));
+	error = dlerror();
+	if (error != NULL)
+		log_debug("%s", error);
+	real_cuDeviceGetName = (cuDeviceGetName_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuDeviceGetName));
+	error = dlerror();
+	if (error != NULL)
+		log_debug("%s", error);
+	real_cuDeviceTotalMem = (cuDeviceTotalMem_func)
+		real_dlsym_225(cuda_handle,CUDA_SYMBOL_STRING(cuDeviceTotalMem));
+	error = dlerror();
+	if (error != NULL)
+		log_debug("%s", error);
+}
+
+
+/* The CUDA runtime version that the application has loaded, 0 if unknown */
+static int cuda_runtime_version(void)
+{
+	cudaRuntimeGetVersion_func get_runtime_version;
+	int runtime = 0;
+
+	get_runtime_version = (cudaRuntimeGetVersion_func)
+		real_dlsym_225(RTLD_DEFAULT, "cudaRuntimeGetVersion");
+	if (get_runtime_version == NULL ||
+	    get_runtime_version(&runtime) != 0)
+		return 0;
+	return runtime;
+}
+
+
+/*
+ * Applications sometimes bundle a CUDA runtime that is newer than what the
+ * driver supports, and then fail in ways that get blamed on nvshare. Compare
+ * the two versions before we intercept anything, and say whose problem it
+ * is. A runtime with a newer major version can't work at all, a newer minor
+ * version mostly works thanks to minor version compatibility.
+ *
+ * The application has usually loaded its runtime by the time it calls
+ * cuInit(). If it hasn't, or links the runtime statically, we can't tell.
+ */
+static void check_cuda_versions(void)
+{
+	int driver = 0, runtime;
+
+	if (real_cuDriverGetVersion == NULL ||
+	    real_cuDriverGetVersion(&driver) != CUDA_SUCCESS) {
+		log_debug("Could not get the CUDA driver version");
+		return;
+	}
+	runtime = cuda_runtime_version();
+	if (runtime == 0) {
+		log_debug("CUDA driver supports CUDA %d.%d, could not find the"
+			  " CUDA runtime version", driver / 1000,
+			  (driver % 1000) / 10);
+		return;
+	}
+	if (runtime / 1000 > driver / 1000)
+		log_warn("The CUDA runtime of this application (CUDA %d.%d) is"
+			 " newer than what the CUDA driver supports (CUDA"
+			 " %d.%d), so its CUDA calls will fail. This is a"
+			 " problem of the CUDA environment, not of nvshare:"
+			 " upgrade the driver or use an older CUDA runtime.",
+			 runtime / 1000, (runtime % 1000) / 10,
+			 driver / 1000, (driver % 1000) / 10);
+	else if (runtime > driver)
+		log_warn("The CUDA runtime of this application (CUDA %d.%d) is"
+			 " newer than what the CUDA driver supports (CUDA"
+			 " %d.%d). Most things work, but newer features and"
+			 " PTX compiled for the newer runtime will fail. This"
+			 " is a problem of the CUDA environment, not of"
+			 " nvshare.", runtime / 1000, (runtime % 1000) / 10,
+			 driver / 1000, (driver % 1000) / 10);
+	else log_debug("CUDA driver supports CUDA %d.%d, runtime is CUDA"
+		       " %d.%d", driver / 1000, (driver % 1000) / 10,
+		       runtime / 1000, (runtime % 1000) / 10);
+}
+
+
+/* Add a chunk of locked allocation records to the free list */
+static void grow_free_allocations(void)
+{
+	struct cuda_mem_allocation *chunk;
+	size_t len = ALLOCATION_CHUNK_LEN * sizeof(*chunk);
+	int i;
+
+	true_or_exit(chunk = calloc(ALLOCATION_CHUNK_LEN, sizeof(*chunk)));
+	if (mlock(chunk, len) != 0) {
+		if (!mlock_failed)
+			log_warn("Failed to lock libnvshare's bookkeeping"
+				 " memory in RAM: %s", strerror(errno));
+		mlock_failed = 1;
+	} else log_debug("Locked %zu more bytes of bookkeeping memory in RAM",
+			 len);
+	for (i = 0; i < ALLOCATION_CHUNK_LEN; i++)
+		LL_PREPEND(free_allocations, &chunk[i]);
+}
+
+
+static struct cuda_mem_allocation *new_allocation_record(void)
+{
+	struct cuda_mem_allocation *a;
+
+	if (!mlock_bookkeeping) {
+		true_or_exit(a = malloc(sizeof(*a)));
+		return a;
+	}
+	if (free_allocations == NULL) grow_free_allocations();
+	a = free_allocations;
+	free_allocations = a->next;
+	return a;
+}
+
+
+static void free_allocation_record(struct cuda_mem_allocation *a)
+{
+	if (!mlock_bookkeeping) free(a);
+	else LL_PREPEND(free_allocations, a);
+}
+
+
+/*
+ * The GPU memory we report as committed: the reservation as a whole, the
+ * allocations that don't fit in it and the modules.
+ */
+static size_t committed_size(size_t modules)
+{
+	return reservation_size + (sum_allocated - sum_reserved) + modules;
+}
+
+
+/* Hold on to the reservation, see reservation_size */
+static CUresult make_reservation(void)
+{
+	CUresult result;
+	size_t size = (size_t)reserve_memory_mib MiB;
+	struct reservation_range *r;
+
+	if (size > nvshare_size_mem_allocatable) {
+		log_warn("Cannot reserve %lld MiB of GPU memory, only %.2f MiB"
+			 " are available", reserve_memory_mib,
+			 toMiB(nvshare_size_mem_allocatable));
+		return CUDA_ERROR_OUT_OF_MEMORY;
+	}
+	result = real_cuMemAllocManaged(&reservation_ptr, size,
+					CU_MEM_ATTACH_GLOBAL);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemAllocManaged));
+	if (result != CUDA_SUCCESS) {
+		reservation_ptr = 0;
+		return result;
+	}
+	true_or_exit(r = malloc(sizeof(*r)));
+	r->ptr = reservation_ptr;
+	r->size = size;
+	r->next = NULL;
+	reservation_free = r;
+	reservation_size = size;
+	log_info("Reserved %lld MiB of GPU memory", reserve_memory_mib);
+	report_memory_usage(committed_size(sum_modules),
+			    nvshare_size_mem_total);
+	return CUDA_SUCCESS;
+}
+
+
+static size_t reservation_aligned(size_t size)
+{
+	return (size + RESERVATION_ALIGN - 1) & ~(size_t)(RESERVATION_ALIGN - 1);
+}
+
+
+/* Carve size bytes out of the reservation, first fit. 0 if they don't fit. */
+static CUdeviceptr reservation_alloc(size_t size)
+{
+	struct reservation_range *r;
+	CUdeviceptr ptr;
+
+	size = reservation_aligned(size);
+	LL_FOREACH(reservation_free, r) {
+		if (r->size < size) continue;
+		ptr = r->ptr;
+		r->ptr += size;
+		r->size -= size;
+		if (r->size == 0) {
+			LL_DELETE(reservation_free, r);
+			free(r);
+		}
+		return ptr;
+	}
+	return 0;
+}
+
+
+/* Give an allocation back to the reservation, merging adjacent free ranges */
+static void reservation_release(CUdeviceptr ptr, size_t size)
+{
+	struct reservation_range *r, *prev = NULL, *n;
+
+	size = reservation_aligned(size);
+	/* Find the free ranges right before and right after ptr */
+	LL_FOREACH(reservation_free, r) {
+		if (r->ptr > ptr) break;
+		prev = r;
+	}
+	if (prev != NULL && prev->ptr + prev->size == ptr) {
+		prev->size += size;
+		if (r != NULL && prev->ptr + prev->size == r->ptr) {
+			prev->size += r->size;
+			LL_DELETE(reservation_free, r);
+			free(r);
+		}
+		return;
+	}
+	if (r != NULL && ptr + size == r->ptr) {
+		r->ptr = ptr;
+		r->size += size;
+		return;
+	}
+	true_or_exit(n = malloc(sizeof(*n)));
+	n->ptr = ptr;
+	n->size = size;
+	if (prev == NULL) LL_PREPEND(reservation_free, n);
+	else LL_APPEND_ELEM(reservation_free, prev, n);
+}
+
+
+static int in_reservation(CUdeviceptr ptr)
+{
+	return (reservation_ptr != 0 && ptr >= reservation_ptr &&
+		ptr < reservation_ptr + reservation_size);
 }
 
 
 /* Append a new CUDA memory allocation at the end of the list. */
-static void insert_cuda_allocation(CUdeviceptr dptr, size_t bytesize)
+static void insert_cuda_allocation(CUdeviceptr dptr, size_t bytesize,
+				   int reserved)
 {
 	struct cuda_mem_allocation *allocation;
 
 
 	sum_allocated += bytesize;
+	if (reserved) sum_reserved += bytesize;
+	live_allocations++;
 	log_debug("Total allocated memory on GPU is %.2f MiB",
 		  toMiB(sum_allocated));
 
-	true_or_exit(allocation = malloc(sizeof(*allocation)));
+	allocation = new_allocation_record();
 
 	allocation->ptr = dptr;
 	allocation->size = bytesize;
+	allocation->reserved = reserved;
 	allocation->next = NULL;
 	LL_APPEND(cuda_allocation_list, allocation);
+	report_memory_usage(committed_size(sum_modules),
+			    nvshare_size_mem_total);
 }
 
-/* Remove a CUDA memory allocation given the pointer it starts at */
-static void remove_cuda_allocation(CUdeviceptr rm_ptr)
+/*
+ * Remove a CUDA memory allocation given the pointer it starts at. Return -1
+ * if there is none.
+ */
+static int remove_cuda_allocation(CUdeviceptr rm_ptr)
 {
 	struct cuda_mem_allocation *tmp, *a;
+	int ret = -1;
 
 
 	LL_FOREACH_SAFE(cuda_allocation_list, a, tmp) {
 		if (a->ptr == rm_ptr) {
 			sum_allocated -= a->size;
+			if (a->reserved) {
+				sum_reserved -= a->size;
+				reservation_release(a->ptr, a->size);
+			}
+			live_allocations--;
+			ret = 0;
 			log_debug("Total allocated memory on GPU is %.2f MiB",
 				  toMiB(sum_allocated));
 			LL_DELETE(cuda_allocation_list, a);
-			free(a);
+			free_allocation_record(a);
 		}
 	}
+	report_memory_usage(committed_size(sum_modules),
+			    nvshare_size_mem_total);
+	return ret;
+}
+
+
+/* Parse an "on"/"off" envvar, def if it's unset */
+static int getenv_on_off(const char *name, int def)
+{
+	char *value = getenv(name);
+
+	if (value == NULL) return def;
+	if (strcmp(value, "on") == 0) return 1;
+	if (strcmp(value, "off") == 0) return 0;
+	log_fatal("Invalid value for %s: %s", name, value);
+	return def;
 }
 
 
-/* Toggle debug mode and single process oversubscription based on envvars */
+/*
+ * Toggle debug mode, single process oversubscription, time-slicing, memory
+ * management, safe mode and memory locking and set the stream, allocation
+ * and context limits based on envvars
+ */
 static void initialize_libnvshare(void)
 {
-	char *value;
+	char *value, *endptr;
 	value = getenv(ENV_NVSHARE_DEBUG);
 	if (value != NULL)
 		__debug = 1;	
+	timeslice = getenv_on_off(ENV_NVSHARE_TIMESLICE, 1);
+	memory_manage = getenv_on_off(ENV_NVSHARE_MEMORY_MANAGE, 1);
+	if (!memory_manage)
+		log_info("GPU memory management is off, passing GPU memory"
+			 " allocations through to the driver");
 	value = getenv(ENV_NVSHARE_ENABLE_SINGLE_OVERSUB);
 	if (value != NULL) {
 		enable_single_oversub = 1;
 		log_warn("Enabling GPU memory oversubscription for this"
 		         " application");
 	}
+	if (getenv(ENV_KUBERNETES_SERVICE_HOST) != NULL &&
+	    getenv(ENV_NVSHARE_DEVICE_SLOT) == NULL &&
+	    getenv(ENV_NVSHARE_STANDALONE) == NULL && timeslice) {
+		/*
+		 * In overflow mode, the container shares the GPU without a
+		 * device, and only the max clients cap of the scheduler
+		 * holds it back.
+		 */
+		if (getenv(ENV_NVSHARE_OVERFLOW) != NULL) {
+			log_warn("This container was not granted an nvshare"
+				 " device, sharing the GPU in overflow mode");
+		} else {
+			inert = 1;
+			safe_mode = 1;
+			log_info("This container was not granted an nvshare"
+				 " device, passing all CUDA calls through");
+		}
+	}
+	value = getenv(ENV_NVSHARE_SAFE_MODE);
+	if (value != NULL && !inert) {
+		safe_mode = 1;
+		log_warn("**********************************************************");
+		log_warn("SAFE MODE: nvshare passes all CUDA calls through to the");
+		log_warn("driver. It does NOT manage GPU memory or synchronize with");
+		log_warn("other applications. Use this only for troubleshooting!");
+		log_warn("**********************************************************");
+	}
+	value = getenv(ENV_NVSHARE_MAX_STREAMS);
+	if (value != NULL) {
+		errno = 0;
+		max_streams = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    max_streams < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_MAX_STREAMS, value);
+		if (max_streams > 0)
+			log_info("Limiting this application to %ld live CUDA"
+				 " streams", max_streams);
+	}
+	value = getenv(ENV_NVSHARE_MAX_ALLOCATIONS);
+	if (value != NULL) {
+		errno = 0;
+		max_allocations = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    max_allocations < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_MAX_ALLOCATIONS, value);
+		if (max_allocations > 0)
+			log_info("Limiting this application to %ld live GPU"
+				 " memory allocations", max_allocations);
+	}
+	value = getenv(ENV_NVSHARE_MAX_CONTEXTS);
+	if (value != NULL) {
+		errno = 0;
+		max_contexts = strtol(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    max_contexts < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_MAX_CONTEXTS, value);
+		if (max_contexts > 0)
+			log_info("Limiting this application to %ld live CUDA"
+				 " contexts", max_contexts);
+	}
+	value = getenv(ENV_NVSHARE_CONTEXT_OVERHEAD_MIB);
+	if (value != NULL) {
+		errno = 0;
+		context_overhead_mib = strtoll(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    context_overhead_mib < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_CONTEXT_OVERHEAD_MIB, value);
+		if (context_overhead_mib > 0)
+			log_info("Hiding %lld MiB of GPU memory per co-located"
+				 " client", context_overhead_mib);
+	}
+	value = getenv(ENV_NVSHARE_RESERVE_MEMORY_MIB);
+	if (value != NULL) {
+		errno = 0;
+		reserve_memory_mib = strtoll(value, &endptr, 10);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    reserve_memory_mib < 0 ||
+		    reserve_memory_mib > INT_MAX)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_RESERVE_MEMORY_MIB, value);
+		if (reserve_memory_mib > 0 && !memory_manage) {
+			log_warn("GPU memory management is off, ignoring %s",
+				 ENV_NVSHARE_RESERVE_MEMORY_MIB);
+			reserve_memory_mib = 0;
+		}
+		if (reserve_memory_mib > 0)
+			log_info("Reserving %lld MiB of GPU memory upfront",
+				 reserve_memory_mib);
+	}
+	value = getenv(ENV_NVSHARE_MLOCK);
+	if (value != NULL) {
+		mlock_bookkeeping = 1;
+		grow_free_allocations();
+		if (!mlock_failed)
+			log_info("Locked libnvshare's bookkeeping memory in"
+				 " RAM");
+	}
+	nvshare_call_trace_init();
 
 	bootstrap_cuda();
+	log_hooked_functions();
+	check_cuda_versions();
 }
 
 
@@ -400,6 +1004,97 @@ static void *real_dlsym_234(void *handle, const char *symbol)
 }
 
 
+/*
+ * The Driver API functions we interpose, i.e., for which dlsym() and
+ * cuGetProcAddress() hand out our function instead of the real one. dlsym()
+ * looks them up by the symbol of the variant we know, e.g., cuMemAlloc_v2,
+ * cuGetProcAddress() by their base name, e.g., cuMemAlloc. Depending on the
+ * CUDA version the application asks for, the base name of some functions
+ * resolves to a newer variant with a different signature, so for those
+ * (by_name = 0) cuGetProcAddress() only interposes the variant we know.
+ */
+#define HOOKED_FUNCTION(f, by_name) \
+	{ #f, CUDA_SYMBOL_STRING(f), (void *)(&f), (void **)(&real_##f), by_name }
+
+static const struct {
+	const char *name;
+	const char *symbol;
+	void *hook;
+	void **real;
+	int by_name;
+} hooked_functions[] = {
+	HOOKED_FUNCTION(cuMemAlloc, 1),
+	HOOKED_FUNCTION(cuMemFree, 1),
+	HOOKED_FUNCTION(cuMemGetInfo, 1),
+	HOOKED_FUNCTION(cuGetProcAddress, 1),
+	HOOKED_FUNCTION(cuInit, 1),
+	HOOKED_FUNCTION(cuLaunchKernel, 1),
+	HOOKED_FUNCTION(cuMemcpy, 1),
+	HOOKED_FUNCTION(cuMemcpyAsync, 1),
+	HOOKED_FUNCTION(cuMemcpyDtoH, 1),
+	HOOKED_FUNCTION(cuMemcpyDtoHAsync, 1),
+	HOOKED_FUNCTION(cuMemcpyHtoD, 1),
+	HOOKED_FUNCTION(cuMemcpyHtoDAsync, 1),
+	HOOKED_FUNCTION(cuMemcpyDtoD, 1),
+	HOOKED_FUNCTION(cuMemcpyDtoDAsync, 1),
+	HOOKED_FUNCTION(cuStreamCreate, 1),
+	HOOKED_FUNCTION(cuStreamCreateWithPriority, 1),
+	HOOKED_FUNCTION(cuStreamDestroy, 1),
+	HOOKED_FUNCTION(cuCtxCreate, 0),
+	HOOKED_FUNCTION(cuCtxDestroy, 0),
+	HOOKED_FUNCTION(cuModuleLoad, 1),
+	HOOKED_FUNCTION(cuModuleLoadData, 1),
+	HOOKED_FUNCTION(cuModuleLoadDataEx, 1),
+	HOOKED_FUNCTION(cuModuleLoadFatBinary, 1),
+	HOOKED_FUNCTION(cuModuleUnload, 1),
+};
+
+#define HOOKED_FUNCTIONS_CNT \
+	(sizeof(hooked_functions) / sizeof(hooked_functions[0]))
+
+
+/* Our function for a symbol (dlsym()) or base name (cuGetProcAddress()) */
+static void *find_hook(const char *symbol, int by_name)
+{
+	size_t i;
+
+	for (i = 0; i < HOOKED_FUNCTIONS_CNT; i++) {
+		if (by_name && hooked_functions[i].by_name &&
+		    strcmp(symbol, hooked_functions[i].name) == 0)
+			return hooked_functions[i].hook;
+		if (!by_name && strcmp(symbol, hooked_functions[i].symbol) == 0)
+			return hooked_functions[i].hook;
+	}
+	return NULL;
+}
+
+
+/*
+ * In debug mode, list the functions we interpose, along with where the real
+ * ones live, so that users can check whether a call that misbehaves even
+ * goes through us. cuGetProcAddress() also logs every function it doesn't
+ * interpose.
+ */
+static void log_hooked_functions(void)
+{
+	Dl_info info;
+	size_t i;
+
+	if (!__debug) return;
+	log_debug("Interposing %zu CUDA Driver API functions:",
+		  HOOKED_FUNCTIONS_CNT);
+	for (i = 0; i < HOOKED_FUNCTIONS_CNT; i++) {
+		if (dladdr(*hooked_functions[i].real, &info) == 0 ||
+		    info.dli_fname == NULL)
+			info.dli_fname = "?";
+		log_debug("  %s (%s): %p, real %p in %s",
+			  hooked_functions[i].name, hooked_functions[i].symbol,
+			  hooked_functions[i].hook, *hooked_functions[i].real,
+			  info.dli_fname);
+	}
+}
+
+
 /*
  * CUDA Runtime API uses dlopen()/dlsym() to obtain addresses of the Driver API
  * functions.
@@ -416,74 +1111,24 @@ static void *real_dlsym_234(void *handle, const char *symbol)
  */
 void *dlsym_225(void *handle, const char *symbol)
 {
-	if (strncmp(symbol, "cu", 2) != 0) {
+	void *hook;
+
+	if (strncmp(symbol, "cu", 2) != 0)
 		return (real_dlsym_225(handle, symbol));
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemAlloc)) == 0) {
-		return (void *)(&cuMemAlloc);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemFree)) == 0) {
-		return (void *)(&cuMemFree);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemGetInfo)) == 0) {
-		return (void *)(&cuMemGetInfo);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuGetProcAddress)) == 0) {
-		return (void *)(&cuGetProcAddress);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuInit)) == 0) {
-		return (void *)(&cuInit);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuLaunchKernel)) == 0) {
-		return (void *)(&cuLaunchKernel);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpy)) == 0) {
-		return (void *)(&cuMemcpy);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyAsync)) == 0) {
-		return (void *)(&cuMemcpyAsync);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoH)) == 0) {
-		return (void *)(&cuMemcpyDtoH);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoHAsync)) == 0) {
-		return (void *)(&cuMemcpyDtoHAsync);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyHtoD)) == 0) {
-		return (void *)(&cuMemcpyHtoD);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyHtoDAsync)) == 0) {
-		return (void *)(&cuMemcpyHtoDAsync);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoD)) == 0) {
-		return (void *)(&cuMemcpyDtoD);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoDAsync)) == 0) {
-		return (void *)(&cuMemcpyDtoDAsync);
-	}
+	hook = find_hook(symbol, 0);
+	if (hook != NULL) return hook;
 
 	return (real_dlsym_225(handle, symbol));
 }
 
 void *dlsym_234(void *handle, const char *symbol)
 {
-	if (strncmp(symbol, "cu", 2) != 0) {
+	void *hook;
+
+	if (strncmp(symbol, "cu", 2) != 0)
 		return (real_dlsym_234(handle, symbol));
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemAlloc)) == 0) {
-		return (void *)(&cuMemAlloc);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemFree)) == 0) {
-		return (void *)(&cuMemFree);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemGetInfo)) == 0) {
-		return (void *)(&cuMemGetInfo);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuGetProcAddress)) == 0) {
-		return (void *)(&cuGetProcAddress);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuInit)) == 0) {
-		return (void *)(&cuInit);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuLaunchKernel)) == 0) {
-		return (void *)(&cuLaunchKernel);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpy)) == 0) {
-		return (void *)(&cuMemcpy);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyAsync)) == 0) {
-		return (void *)(&cuMemcpyAsync);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoH)) == 0) {
-		return (void *)(&cuMemcpyDtoH);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoHAsync)) == 0) {
-		return (void *)(&cuMemcpyDtoHAsync);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyHtoD)) == 0) {
-		return (void *)(&cuMemcpyHtoD);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyHtoDAsync)) == 0) {
-		return (void *)(&cuMemcpyHtoDAsync);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoD)) == 0) {
-		return (void *)(&cuMemcpyDtoD);
-	} else if (strcmp(symbol, CUDA_SYMBOL_STRING(cuMemcpyDtoDAsync)) == 0) {
-		return (void *)(&cuMemcpyDtoDAsync);
-	}
+	hook = find_hook(symbol, 0);
+	if (hook != NULL) return hook;
 
 	return (real_dlsym_234(handle, symbol));
 }
@@ -511,63 +1156,218 @@ CUresult cuGetProcAddress(const char *symbol, void **pfn, int cudaVersion,
 	cuuint64_t flags)
 {
 	CUresult result = CUDA_SUCCESS;
+	void *hook;
+	size_t i;
 
 	if (real_cuGetProcAddress == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	if (strcmp(symbol, "cuMemAlloc") == 0) {
-		*pfn = (void *)(&cuMemAlloc);
-	} else if (strcmp(symbol, "cuMemFree") == 0) {
-		*pfn = (void *)(&cuMemFree);
-	} else if (strcmp(symbol, "cuMemGetInfo") == 0) {
-		*pfn = (void *)(&cuMemGetInfo);
-	} else if (strcmp(symbol, "cuGetProcAddress") == 0) {
-		*pfn = (void *)(&cuGetProcAddress);
-	} else if (strcmp(symbol, "cuInit") == 0) {
-		*pfn = (void *)(&cuInit);
-	} else if (strcmp(symbol, "cuLaunchKernel") == 0) {
-		*pfn = (void *)(&cuLaunchKernel);
-	} else if (strcmp(symbol, "cuMemcpy") == 0) {
-		*pfn = (void *)(&cuMemcpy);
-	} else if (strcmp(symbol, "cuMemcpyAsync") == 0) {
-		*pfn = (void *)(&cuMemcpyAsync);
-	} else if (strcmp(symbol, "cuMemcpyDtoH") == 0) {
-		*pfn = (void *)(&cuMemcpyDtoH);
-	} else if (strcmp(symbol, "cuMemcpyDtoHAsync") == 0) {
-		*pfn = (void *)(&cuMemcpyDtoHAsync);
-	} else if (strcmp(symbol, "cuMemcpyHtoD") == 0) {
-		*pfn = (void *)(&cuMemcpyHtoD);
-	} else if (strcmp(symbol, "cuMemcpyHtoDAsync") == 0) {
-		*pfn = (void *)(&cuMemcpyHtoDAsync);
-	} else if (strcmp(symbol, "cuMemcpyDtoD") == 0) {
-		*pfn = (void *)(&cuMemcpyDtoD);
-	} else if (strcmp(symbol, "cuMemcpyDtoDAsync") == 0) {
-		*pfn = (void *)(&cuMemcpyDtoDAsync);
-	} else {
-		result = real_cuGetProcAddress(symbol, pfn, cudaVersion, flags);
+	hook = find_hook(symbol, 1);
+	if (hook != NULL) {
+		*pfn = hook;
+		return result;
+	}
+
+	result = real_cuGetProcAddress(symbol, pfn, cudaVersion, flags);
+	if (result != CUDA_SUCCESS) return result;
+	/*
+	 * Depending on cudaVersion, e.g., "cuCtxCreate" may resolve to a
+	 * newer variant with a different signature. Only interpose the
+	 * variant we know.
+	 */
+	for (i = 0; i < HOOKED_FUNCTIONS_CNT; i++) {
+		if (!hooked_functions[i].by_name &&
+		    *pfn == *hooked_functions[i].real) {
+			*pfn = hooked_functions[i].hook;
+			return result;
+		}
 	}
+	log_debug("Not intercepting %s (CUDA version %d)", symbol, cudaVersion);
 
 	return result;
 }
 
 
+/*
+ * Store the UUID of dev in str, in the form that nvidia-smi shows. Return 0
+ * on success, -1 on failure.
+ */
+static int gpu_uuid_string(CUdevice dev, char *str)
+{
+	CUuuid uuid;
+	const unsigned char *b = (const unsigned char *)uuid.bytes;
+
+	if (real_cuDeviceGetUuid == NULL ||
+	    real_cuDeviceGetUuid(&uuid, dev) != CUDA_SUCCESS)
+		return -1;
+	snprintf(str, NVSHARE_GPU_UUID_LEN, "GPU-%02x%02x%02x%02x-%02x%02x-"
+		 "%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x", b[0], b[1],
+		 b[2], b[3], b[4], b[5], b[6], b[7], b[8], b[9], b[10], b[11],
+		 b[12], b[13], b[14], b[15]);
+	return 0;
+}
+
+
+/*
+ * Tell the scheduler which GPU we use, so that it can account the memory of
+ * the clients of each GPU separately.
+ */
+static void report_gpu(void)
+{
+	CUdevice dev;
+	char str[NVSHARE_GPU_UUID_LEN];
+
+	if (real_cuCtxGetDevice == NULL) return;
+	if (real_cuCtxGetDevice(&dev) != CUDA_SUCCESS ||
+	    gpu_uuid_string(dev, str) != 0) {
+		log_debug("Failed to get the UUID of our GPU");
+		return;
+	}
+	log_debug("Our GPU is %s", str);
+	report_gpu_uuid(str);
+}
+
+
+/*
+ * Log the diagnostics block of libnvshare, once the driver is up and we have
+ * registered with the scheduler, or given up on it. We describe the first
+ * GPU that the application sees, which is the one that nvshare shares.
+ */
+static void log_diagnostics(void)
+{
+	CUdevice dev;
+	size_t total;
+	int driver = 0, runtime;
+	char name[NVML_DEVICE_NAME_BUFFER_SIZE];
+	char uuid[NVSHARE_GPU_UUID_LEN];
+	char nvidia[NVML_SYSTEM_DRIVER_VERSION_BUFFER_SIZE] = "unknown";
+	char nvml[NVML_SYSTEM_NVML_VERSION_BUFFER_SIZE] = "unknown";
+	char cudart[32] = "unknown";
+
+	log_info(NVSHARE_DIAG_BEGIN, "libnvshare");
+	log_info("nvshare: libnvshare %s, protocol version %d",
+		 NVSHARE_VERSION, NVSHARE_PROTOCOL_VERSION);
+	nvshare_log_diag_host();
+	log_info("process: PID %d, %s", (int)getpid(),
+		 program_invocation_name);
+
+	if (real_nvmlInit != NULL && real_nvmlInit() == NVML_SUCCESS) {
+		if (real_nvmlSystemGetDriverVersion == NULL ||
+		    real_nvmlSystemGetDriverVersion(nvidia,
+		    sizeof(nvidia)) != NVML_SUCCESS)
+			strlcpy(nvidia, "unknown", sizeof(nvidia));
+		if (real_nvmlSystemGetNVMLVersion == NULL ||
+		    real_nvmlSystemGetNVMLVersion(nvml,
+		    sizeof(nvml)) != NVML_SUCCESS)
+			strlcpy(nvml, "unknown", sizeof(nvml));
+	}
+	if (real_cuDriverGetVersion != NULL)
+		real_cuDriverGetVersion(&driver);
+	runtime = cuda_runtime_version();
+	if (runtime != 0)
+		snprintf(cudart, sizeof(cudart), "CUDA %d.%d",
+			 runtime / 1000, (runtime % 1000) / 10);
+	log_info("driver: NVIDIA %s, NVML %s, CUDA %d.%d (driver), %s"
+		 " (runtime)", nvidia, nvml, driver / 1000,
+		 (driver % 1000) / 10, cudart);
+
+	if (real_cuDeviceGet != NULL &&
+	    real_cuDeviceGet(&dev, 0) == CUDA_SUCCESS) {
+		if (real_cuDeviceGetName == NULL ||
+		    real_cuDeviceGetName(name, sizeof(name), dev) !=
+		    CUDA_SUCCESS)
+			strlcpy(name, "unknown", sizeof(name));
+		if (real_cuDeviceTotalMem == NULL ||
+		    real_cuDeviceTotalMem(&total, dev) != CUDA_SUCCESS)
+			total = 0;
+		if (gpu_uuid_string(dev, uuid) != 0)
+			strlcpy(uuid, "unknown", sizeof(uuid));
+		log_info("GPU 0: %s, %.0f MiB, %s", name, toMiB(total), uuid);
+	} else log_info("GPU 0: unknown, the CUDA driver can't see any GPU");
+
+	if (inert)
+		log_info("mode: no nvshare device, passing all CUDA calls"
+			 " through");
+	else log_client_diagnostics();
+	if (safe_mode && !inert)
+		log_info("safe mode: passing all CUDA calls through");
+	log_debug("config: memory management = %d, single oversubscription"
+		  " = %d, max streams = %ld, max allocations = %ld, max"
+		  " contexts = %ld, context overhead = %lld MiB, reservation"
+		  " = %lld MiB, mlock = %d", memory_manage,
+		  enable_single_oversub, max_streams, max_allocations,
+		  max_contexts, context_overhead_mib, reserve_memory_mib,
+		  mlock_bookkeeping);
+	nvshare_log_diag_env();
+	log_info(NVSHARE_DIAG_END);
+}
+
+
 CUresult cuMemAlloc(CUdeviceptr *dptr, size_t bytesize)
 {
 	static int got_max_mem_size = 0;
-        size_t junk;
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemAllocManaged == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
+	if (safe_mode) return real_cuMemAlloc(dptr, bytesize);
+
 	if (got_max_mem_size == 0) {
-		result = cuMemGetInfo(&nvshare_size_mem_allocatable, &junk);
+		result = cuMemGetInfo(&nvshare_size_mem_allocatable,
+				      &nvshare_size_mem_total);
 		cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemGetInfo));
 		got_max_mem_size = 1;
+		report_gpu();
+	}
+
+	/* Until we get the reservation, we fail every allocation */
+	if (reserve_memory_mib > 0 && reservation_ptr == 0) {
+		result = make_reservation();
+		if (result != CUDA_SUCCESS) {
+			if (result == CUDA_ERROR_OUT_OF_MEMORY)
+				report_oom(bytesize);
+			return result;
+		}
+	}
+
+	/*
+	 * Frameworks react to CUDA_ERROR_OUT_OF_MEMORY by freeing their
+	 * cached allocations and retrying, which is what we want here too.
+	 */
+	if (max_allocations > 0 && live_allocations >= max_allocations) {
+		log_warn("Client %016" PRIx64 " reached the limit of %ld live GPU"
+			 " memory allocations, failing cuMemAlloc",
+			 nvshare_client_id, max_allocations);
+		return CUDA_ERROR_OUT_OF_MEMORY;
+	}
+
+	if (!memory_manage) {
+		nvshare_call_trace_begin(&sample);
+		result = real_cuMemAlloc(dptr, bytesize);
+		cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemAlloc));
+		if (result == CUDA_SUCCESS) {
+			insert_cuda_allocation(*dptr, bytesize, 0);
+		} else if (result == CUDA_ERROR_OUT_OF_MEMORY) {
+			report_oom(bytesize);
+		}
+		nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemAlloc),
+				       result);
+		return result;
 	}
 
-	if ((sum_allocated + bytesize) > nvshare_size_mem_allocatable) {
+	if (bytesize > 0 && (*dptr = reservation_alloc(bytesize)) != 0) {
+		log_debug("Allocated %zu bytes at 0x%llx out of the"
+			  " reservation", bytesize, *dptr);
+		insert_cuda_allocation(*dptr, bytesize, 1);
+		return CUDA_SUCCESS;
+	}
+
+	if ((reservation_size + sum_allocated - sum_reserved + bytesize) >
+	    nvshare_size_mem_allocatable) {
 		if (enable_single_oversub == 0) {
+			report_oom(bytesize);
 			return CUDA_ERROR_OUT_OF_MEMORY;
 		} else {
 			log_warn("Memory allocations exceeded physical GPU"
@@ -577,13 +1377,17 @@ CUresult cuMemAlloc(CUdeviceptr *dptr, size_t bytesize)
 	}
 
 	log_debug("cuMemAlloc requested %zu bytes", bytesize);
+	nvshare_call_trace_begin(&sample);
 	result = real_cuMemAllocManaged(dptr, bytesize, CU_MEM_ATTACH_GLOBAL);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemAllocManaged));
 	log_debug("cuMemAllocManaged allocated %zu bytes at 0x%llx",
 		bytesize, *dptr);
 	if (result == CUDA_SUCCESS) {
-		insert_cuda_allocation(*dptr, bytesize);
+		insert_cuda_allocation(*dptr, bytesize, 0);
+	} else if (result == CUDA_ERROR_OUT_OF_MEMORY) {
+		report_oom(bytesize);
 	}
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemAlloc), result);
 
 	return result;
 }
@@ -592,11 +1396,19 @@ CUresult cuMemAlloc(CUdeviceptr *dptr, size_t bytesize)
 CUresult cuMemFree(CUdeviceptr dptr)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	if (real_cuMemFree == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuMemFree(dptr);
+	/* We hold on to the reservation */
+	if (in_reservation(dptr))
+		return (remove_cuda_allocation(dptr) == 0) ? CUDA_SUCCESS :
+		       CUDA_ERROR_INVALID_VALUE;
+	nvshare_call_trace_begin(&sample);
 	result = real_cuMemFree(dptr);
-	if (result == CUDA_SUCCESS) remove_cuda_allocation(dptr);
+	if (result == CUDA_SUCCESS) (void)remove_cuda_allocation(dptr);
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemFree), result);
 
 	return result;
 }
@@ -605,11 +1417,13 @@ CUresult cuMemFree(CUdeviceptr dptr)
 CUresult cuMemGetInfo(size_t *free, size_t *total)
 {
 	long long reserve_mib;
+	int others;
 	CUresult result = CUDA_SUCCESS;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemGetInfo == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode || !memory_manage) return real_cuMemGetInfo(free, total);
 
 	result = real_cuMemGetInfo(free, total);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemGetInfo));
@@ -643,9 +1457,16 @@ CUresult cuMemGetInfo(size_t *free, size_t *total)
 	 *
 	 * To avoid internal thrashing, we empirically choose a sane value for
 	 * MEMINFO_RESERVE_MIB.
+	 *
+	 * If the user gave us an estimate of the context overhead, also hide
+	 * that much for every other client the scheduler has told us about.
 	 */
-	reserve_mib = (MEMINFO_RESERVE_MIB) MiB;
-	*free = *total - (size_t) reserve_mib;
+	reserve_mib = MEMINFO_RESERVE_MIB;
+	others = scheduler_client_count() - 1;
+	if (context_overhead_mib > 0 && others > 0)
+		reserve_mib += context_overhead_mib * others;
+	if ((size_t)reserve_mib MiB >= *total) *free = 0;
+	else *free = *total - (size_t)reserve_mib MiB;
 
 	log_debug("nvshare's cuMemGetInfo returning free=%.2f MiB,"
 		  " total=%.2f MiB", toMiB(*free), toMiB(*total));
@@ -661,12 +1482,17 @@ CUresult cuInit(unsigned int flags)
 	CUresult result = CUDA_SUCCESS;
 	static pthread_once_t init_libnvshare_done = PTHREAD_ONCE_INIT;
 	static pthread_once_t init_done = PTHREAD_ONCE_INIT;
+	static pthread_once_t diagnostics_done = PTHREAD_ONCE_INIT;
 
 	true_or_exit(pthread_once(&init_libnvshare_done, initialize_libnvshare) == 0);
-	true_or_exit(pthread_once(&init_done, initialize_client) == 0);
+	if (!inert)
+		true_or_exit(pthread_once(&init_done, initialize_client) == 0);
 
 	result = real_cuInit(flags);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuInit));
+	if (result == CUDA_SUCCESS)
+		true_or_exit(pthread_once(&diagnostics_done,
+			     log_diagnostics) == 0);
 
 	return result;
 }
@@ -679,11 +1505,18 @@ CUresult cuLaunchKernel(CUfunction f, unsigned int gridDimX,
 	void **extra)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 	/* Return immediately if not initialized */
 	if (real_cuLaunchKernel == NULL) return CUDA_ERROR_NOT_INITIALIZED;
-
-	continue_with_lock();
+	if (safe_mode)
+		return real_cuLaunchKernel(f, gridDimX, gridDimY, gridDimZ,
+			blockDimX, blockDimY, blockDimZ, sharedMemBytes,
+			hStream, kernelParams, extra);
+
+	nvshare_call_trace_begin(&sample);
+	continue_with_lock_kernel();
+	track_stream(hStream);
 	result = real_cuLaunchKernel(f, gridDimX, gridDimY, gridDimZ, blockDimX,
 		blockDimY, blockDimZ, sharedMemBytes, hStream, kernelParams, extra);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuLaunchKernel));
@@ -745,6 +1578,9 @@ CUresult cuLaunchKernel(CUfunction f, unsigned int gridDimX,
 	}
 
 	true_or_exit(pthread_mutex_unlock(&kcount_mutex) == 0);
+	/* Includes the sync of the pending kernel window, if any */
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuLaunchKernel),
+			       result);
 	return result;
 }
 
@@ -756,14 +1592,21 @@ CUresult cuLaunchKernel(CUfunction f, unsigned int gridDimX,
 CUresult cuMemcpy(CUdeviceptr dst, CUdeviceptr src, size_t ByteCount)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	if (real_cuMemcpy == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(NULL);
+	}
 
 	result = real_cuMemcpy(dst, src, ByteCount);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpy));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpy),
+			       result);
 
 	return result;
 }
@@ -772,14 +1615,21 @@ CUresult cuMemcpyAsync(CUdeviceptr dst, CUdeviceptr src, size_t ByteCount,
 	CUstream hStream)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	if (real_cuMemcpyAsync == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(hStream);
+	}
 
 	result = real_cuMemcpyAsync(dst, src, ByteCount, hStream);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpyAsync));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpyAsync),
+			       result);
 
 	return result;
 }
@@ -787,14 +1637,21 @@ CUresult cuMemcpyAsync(CUdeviceptr dst, CUdeviceptr src, size_t ByteCount,
 CUresult cuMemcpyDtoH(void *dstHost, CUdeviceptr srcDevice, size_t ByteCount)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemcpyDtoH == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(NULL);
+	}
 	result = real_cuMemcpyDtoH(dstHost, srcDevice, ByteCount);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpyDtoH));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpyDtoH),
+			       result);
 
 	return result;
 }
@@ -803,14 +1660,21 @@ CUresult cuMemcpyDtoHAsync(void* dstHost, CUdeviceptr srcDevice,
 	size_t ByteCount, CUstream hStream)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemcpyDtoHAsync == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(hStream);
+	}
 	result = real_cuMemcpyDtoHAsync(dstHost, srcDevice, ByteCount, hStream);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpyDtoHAsync));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpyDtoHAsync),
+			       result);
 
 	return result;
 }
@@ -819,14 +1683,21 @@ CUresult cuMemcpyHtoD(CUdeviceptr dstDevice, const void* srcHost,
 	size_t ByteCount)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemcpyHtoD == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(NULL);
+	}
 	result = real_cuMemcpyHtoD(dstDevice, srcHost, ByteCount);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpyHtoD));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpyHtoD),
+			       result);
 
 	return result;
 }
@@ -835,14 +1706,21 @@ CUresult cuMemcpyHtoDAsync(CUdeviceptr dstDevice, const void* srcHost,
 	size_t ByteCount, CUstream hStream)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemcpyHtoDAsync == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(hStream);
+	}
 	result = real_cuMemcpyHtoDAsync(dstDevice, srcHost, ByteCount, hStream);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpyHtoDAsync));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpyHtoDAsync),
+			       result);
 
 	return result;
 }
@@ -851,14 +1729,21 @@ CUresult cuMemcpyDtoD(CUdeviceptr dstDevice, CUdeviceptr srcDevice,
 	size_t ByteCount)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemcpyDtoD == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(NULL);
+	}
 	result = real_cuMemcpyDtoD(dstDevice, srcDevice, ByteCount);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpyDtoD));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpyDtoD),
+			       result);
 
 	return result;
 }
@@ -867,15 +1752,398 @@ CUresult cuMemcpyDtoDAsync(CUdeviceptr dstDevice, CUdeviceptr srcDevice,
 	size_t ByteCount, CUstream hStream)
 {
 	CUresult result = CUDA_SUCCESS;
+	struct call_sample sample;
 
 
 	/* Return immediately if not initialized */
 	if (real_cuMemcpyDtoDAsync == NULL) return CUDA_ERROR_NOT_INITIALIZED;
 
-	continue_with_lock();
+	nvshare_call_trace_begin(&sample);
+	if (!safe_mode) {
+		continue_with_lock();
+		track_stream(hStream);
+	}
 	result = real_cuMemcpyDtoDAsync(dstDevice, srcDevice, ByteCount, hStream);
 	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuMemcpyDtoDAsync));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuMemcpyDtoDAsync),
+			       result);
+
+	return result;
+}
+
+
+/*
+ * Reserve a slot for a new CUDA stream, if the application hasn't reached
+ * its limit.
+ *
+ * Return 0 on success, -1 if the application is at its limit.
+ */
+static int reserve_stream(void)
+{
+	int ret = 0;
+
+	true_or_exit(pthread_mutex_lock(&streams_mutex) == 0);
+	if (max_streams > 0 && live_streams >= max_streams) {
+		log_warn("Client %016" PRIx64 " reached the limit of %ld live"
+			 " CUDA streams, failing stream creation",
+			 nvshare_client_id, max_streams);
+		ret = -1;
+	} else live_streams++;
+	true_or_exit(pthread_mutex_unlock(&streams_mutex) == 0);
+
+	return ret;
+}
+
+
+static void release_stream(void)
+{
+	true_or_exit(pthread_mutex_lock(&streams_mutex) == 0);
+	if (live_streams > 0) live_streams--;
+	true_or_exit(pthread_mutex_unlock(&streams_mutex) == 0);
+}
+
+
+/*
+ * Count the live CUDA streams of the application, to enforce max_streams.
+ */
+CUresult cuStreamCreate(CUstream *phStream, unsigned int Flags)
+{
+	CUresult result = CUDA_SUCCESS;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuStreamCreate == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuStreamCreate(phStream, Flags);
+
+	if (reserve_stream() != 0) return CUDA_ERROR_NOT_PERMITTED;
+	result = real_cuStreamCreate(phStream, Flags);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuStreamCreate));
+	if (result != CUDA_SUCCESS) release_stream();
+
+	return result;
+}
+
+CUresult cuStreamCreateWithPriority(CUstream *phStream, unsigned int flags,
+	int priority)
+{
+	CUresult result = CUDA_SUCCESS;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuStreamCreateWithPriority == NULL)
+		return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode)
+		return real_cuStreamCreateWithPriority(phStream, flags,
+						       priority);
+
+	if (reserve_stream() != 0) return CUDA_ERROR_NOT_PERMITTED;
+	result = real_cuStreamCreateWithPriority(phStream, flags, priority);
+	cuda_driver_check_error(result,
+		CUDA_SYMBOL_STRING(cuStreamCreateWithPriority));
+	if (result != CUDA_SUCCESS) release_stream();
+
+	return result;
+}
+
+CUresult cuStreamDestroy(CUstream hStream)
+{
+	CUresult result = CUDA_SUCCESS;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuStreamDestroy == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuStreamDestroy(hStream);
+
+	forget_stream(hStream);
+	result = real_cuStreamDestroy(hStream);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuStreamDestroy));
+	if (result == CUDA_SUCCESS) release_stream();
+
+	return result;
+}
+
+
+/*
+ * Count the live CUDA contexts that the application creates, to enforce
+ * max_contexts and to let the scheduler know about context-heavy clients.
+ */
+CUresult cuCtxCreate(CUcontext *pctx, unsigned int flags, CUdevice dev)
+{
+	CUresult result = CUDA_SUCCESS;
+	long contexts;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuCtxCreate == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuCtxCreate(pctx, flags, dev);
+
+	true_or_exit(pthread_mutex_lock(&contexts_mutex) == 0);
+	if (max_contexts > 0 && live_contexts >= max_contexts) {
+		log_warn("Client %016" PRIx64 " reached the limit of %ld live"
+			 " CUDA contexts, failing context creation",
+			 nvshare_client_id, max_contexts);
+		true_or_exit(pthread_mutex_unlock(&contexts_mutex) == 0);
+		return CUDA_ERROR_NOT_PERMITTED;
+	}
+	result = real_cuCtxCreate(pctx, flags, dev);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuCtxCreate));
+	if (result == CUDA_SUCCESS) live_contexts++;
+	contexts = live_contexts;
+	true_or_exit(pthread_mutex_unlock(&contexts_mutex) == 0);
+
+	if (result == CUDA_SUCCESS) {
+		log_debug("The application has %ld live CUDA contexts",
+			  contexts);
+		report_context_count(contexts);
+	}
+	return result;
+}
+
+CUresult cuCtxDestroy(CUcontext ctx)
+{
+	CUresult result = CUDA_SUCCESS;
+	long contexts;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuCtxDestroy == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuCtxDestroy(ctx);
+
+	true_or_exit(pthread_mutex_lock(&contexts_mutex) == 0);
+	result = real_cuCtxDestroy(ctx);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuCtxDestroy));
+	if (result == CUDA_SUCCESS && live_contexts > 0) live_contexts--;
+	contexts = live_contexts;
+	true_or_exit(pthread_mutex_unlock(&contexts_mutex) == 0);
+
+	if (result == CUDA_SUCCESS) report_context_count(contexts);
+	return result;
+}
+
+
+/* Magic numbers of the CUDA fat binary formats */
+#define FATBIN_MAGIC         0xBA55ED50
+#define FATBIN_WRAPPER_MAGIC 0x466243B1
+
+struct fatbin_header {
+	uint32_t magic;
+	uint16_t version;
+	uint16_t header_size;
+	uint64_t fat_size;
+};
+
+/* What the CUDA runtime passes to cuModuleLoadFatBinary() */
+struct fatbin_wrapper {
+	uint32_t magic;
+	uint32_t version;
+	const struct fatbin_header *data;
+	void *filename_or_fatbins;
+};
+
+/*
+ * Estimate the GPU memory that a module takes up from the size of its image:
+ * the extent of a cubin (ELF) or the size of a fat binary, which is an upper
+ * bound, as it may carry code for several architectures. Return 0 for PTX,
+ * as we can't tell how big the code that the driver compiles it to is.
+ */
+static size_t module_image_size(const void *image)
+{
+	const Elf64_Ehdr *ehdr = image;
+	const struct fatbin_header *fatbin = image;
+	const struct fatbin_wrapper *wrapper = image;
+	size_t size;
+
+	if (image == NULL) return 0;
+	if (wrapper->magic == FATBIN_WRAPPER_MAGIC) fatbin = wrapper->data;
+	if (fatbin != NULL && fatbin->magic == FATBIN_MAGIC)
+		return fatbin->header_size + fatbin->fat_size;
+	if (memcmp(ehdr->e_ident, ELFMAG, SELFMAG) == 0 &&
+	    ehdr->e_ident[EI_CLASS] == ELFCLASS64) {
+		size = ehdr->e_shoff + (size_t)ehdr->e_shnum * ehdr->e_shentsize;
+		return max(size, ehdr->e_phoff +
+			   (size_t)ehdr->e_phnum * ehdr->e_phentsize);
+	}
+	return 0;
+}
+
+
+/* Like module_image_size(), for an image in a file */
+static size_t module_file_size(const char *fname)
+{
+	unsigned char magic[SELFMAG];
+	struct stat st;
+	FILE *fp;
+	size_t n;
+
+	if (fname == NULL || stat(fname, &st) != 0) return 0;
+	fp = fopen(fname, "r");
+	if (fp == NULL) return 0;
+	n = fread(magic, 1, sizeof(magic), fp);
+	fclose(fp);
+	if (n == sizeof(magic) && (memcmp(magic, ELFMAG, SELFMAG) == 0 ||
+	    *(uint32_t *)magic == FATBIN_MAGIC))
+		return (size_t)st.st_size;
+	return 0;
+}
+
+
+static void insert_cuda_module(CUmodule mod, size_t size, const char *func)
+{
+	struct cuda_module *m;
+	size_t modules;
+
+	true_or_exit(m = malloc(sizeof(*m)));
+	m->mod = mod;
+	m->size = size;
+	true_or_exit(pthread_mutex_lock(&modules_mutex) == 0);
+	LL_PREPEND(cuda_module_list, m);
+	sum_modules += size;
+	modules = sum_modules;
+	true_or_exit(pthread_mutex_unlock(&modules_mutex) == 0);
+
+	log_debug("%s loaded a module of %.2f MiB. Modules take up %.2f MiB"
+		  " of GPU memory, data allocations %.2f MiB", func,
+		  toMiB(size), toMiB(modules), toMiB(sum_allocated));
+	if (size > 0)
+		report_memory_usage(committed_size(modules),
+				    nvshare_size_mem_total);
+}
+
+
+static void remove_cuda_module(CUmodule mod)
+{
+	struct cuda_module *m, *tmp;
+	size_t size = 0, modules;
+
+	true_or_exit(pthread_mutex_lock(&modules_mutex) == 0);
+	LL_FOREACH_SAFE(cuda_module_list, m, tmp) {
+		if (m->mod == mod) {
+			size = m->size;
+			sum_modules -= size;
+			LL_DELETE(cuda_module_list, m);
+			free(m);
+			break;
+		}
+	}
+	modules = sum_modules;
+	true_or_exit(pthread_mutex_unlock(&modules_mutex) == 0);
+
+	log_debug("Unloaded a module of %.2f MiB. Modules take up %.2f MiB"
+		  " of GPU memory, data allocations %.2f MiB", toMiB(size),
+		  toMiB(modules), toMiB(sum_allocated));
+	if (size > 0)
+		report_memory_usage(committed_size(modules),
+				    nvshare_size_mem_total);
+}
+
+
+CUresult cuModuleLoad(CUmodule *module, const char *fname)
+{
+	CUresult result;
+	struct call_sample sample;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuModuleLoad == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuModuleLoad(module, fname);
+
+	nvshare_call_trace_begin(&sample);
+	result = real_cuModuleLoad(module, fname);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuModuleLoad));
+	if (result == CUDA_SUCCESS)
+		insert_cuda_module(*module, module_file_size(fname),
+				   CUDA_SYMBOL_STRING(cuModuleLoad));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuModuleLoad),
+			       result);
+	return result;
+}
+
+
+CUresult cuModuleLoadData(CUmodule *module, const void *image)
+{
+	CUresult result;
+	struct call_sample sample;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuModuleLoadData == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuModuleLoadData(module, image);
+
+	nvshare_call_trace_begin(&sample);
+	result = real_cuModuleLoadData(module, image);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuModuleLoadData));
+	if (result == CUDA_SUCCESS)
+		insert_cuda_module(*module, module_image_size(image),
+				   CUDA_SYMBOL_STRING(cuModuleLoadData));
+	nvshare_call_trace_end(&sample, CUDA_SYMBOL_STRING(cuModuleLoadData),
+			       result);
+	return result;
+}
+
+
+CUresult cuModuleLoadDataEx(CUmodule *module, const void *image,
+	unsigned int numOptions, CUjit_option *options, void **optionValues)
+{
+	CUresult result;
+	struct call_sample sample;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuModuleLoadDataEx == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode)
+		return real_cuModuleLoadDataEx(module, image, numOptions,
+					       options, optionValues);
+
+	nvshare_call_trace_begin(&sample);
+	result = real_cuModuleLoadDataEx(module, image, numOptions, options,
+					 optionValues);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuModuleLoadDataEx));
+	if (result == CUDA_SUCCESS)
+		insert_cuda_module(*module, module_image_size(image),
+				   CUDA_SYMBOL_STRING(cuModuleLoadDataEx));
+	nvshare_call_trace_end(&sample,
+			       CUDA_SYMBOL_STRING(cuModuleLoadDataEx), result);
+	return result;
+}
+
+
+CUresult cuModuleLoadFatBinary(CUmodule *module, const void *fatCubin)
+{
+	CUresult result;
+	struct call_sample sample;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuModuleLoadFatBinary == NULL)
+		return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuModuleLoadFatBinary(module, fatCubin);
+
+	nvshare_call_trace_begin(&sample);
+	result = real_cuModuleLoadFatBinary(module, fatCubin);
+	cuda_driver_check_error(result,
+				CUDA_SYMBOL_STRING(cuModuleLoadFatBinary));
+	if (result == CUDA_SUCCESS)
+		insert_cuda_module(*module, module_image_size(fatCubin),
+				   CUDA_SYMBOL_STRING(cuModuleLoadFatBinary));
+	nvshare_call_trace_end(&sample,
+			       CUDA_SYMBOL_STRING(cuModuleLoadFatBinary),
+			       result);
+	return result;
+}
+
+
+CUresult cuModuleUnload(CUmodule hmod)
+{
+	CUresult result;
+
+
+	/* Return immediately if not initialized */
+	if (real_cuModuleUnload == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+	if (safe_mode) return real_cuModuleUnload(hmod);
 
+	result = real_cuModuleUnload(hmod);
+	cuda_driver_check_error(result, CUDA_SYMBOL_STRING(cuModuleUnload));
+	if (result == CUDA_SUCCESS) remove_cuda_module(hmod);
 	return result;
 }
 
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Client lifecycle hook of the nvshare scheduler.
+ *
+ * For integration with external systems (notifications, accounting, dynamic
+ * configuration), we run a command whenever a client registers, reattaches
+ * or goes away:
+ *
+ *     /bin/sh -c "$NVSHARE_CLIENT_HOOK" sh <event> <client ID> <namespace>
+ *         <Pod> <name>
+ *
+ * The scheduler only queues the hooks. Our own thread runs them one at a
+ * time, in order, and kills any that takes longer than the timeout, so that
+ * a slow hook can never stall scheduling. If the hooks can't keep up, we
+ * drop the ones that don't fit in the queue.
+ */
+
+#include <errno.h>
+#include <stdio.h>
+#include <signal.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <sys/wait.h>
+
+#include "comm.h"
+#include "common.h"
+#include "lifecycle.h"
+#include "utlist.h"
+
+/* Queued hooks beyond this are dropped */
+#define CLIENT_HOOK_QUEUE_MAX 1024
+#define CLIENT_HOOK_POLL_MS 10
+
+struct client_hook {
+	char event[16];
+	char client_id[HEX_STR_LEN(uint64_t)];
+	char pod_namespace[POD_NAMESPACE_LEN_MAX];
+	char pod_name[POD_NAME_LEN_MAX];
+	char name[POD_NAME_LEN_MAX];
+	struct client_hook *next;
+};
+
+static char *hook_command = NULL;
+static long long hook_timeout_ms = NVSHARE_DEFAULT_CLIENT_HOOK_TIMEOUT_MS;
+static struct client_hook *hook_queue = NULL;
+static int hook_queue_len = 0;
+static unsigned long long hooks_dropped = 0;
+static pthread_mutex_t hook_mutex = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t hook_cv = PTHREAD_COND_INITIALIZER;
+static pthread_t hook_tid;
+
+
+/* Run a hook and wait for it, for at most hook_timeout_ms */
+static void run_hook(const struct client_hook *h)
+{
+	pid_t pid, ret;
+	int status;
+	long long waited_ms = 0;
+	sigset_t empty;
+
+	pid = fork();
+	if (pid < 0) {
+		log_warn("Failed to run the client hook: %s", strerror(errno));
+		return;
+	}
+	if (pid == 0) {
+		/* Own process group, so that we can kill what it spawns too */
+		setpgid(0, 0);
+		/* Don't let the command inherit our blocked SIGTERM */
+		sigemptyset(&empty);
+		sigprocmask(SIG_SETMASK, &empty, NULL);
+		execl("/bin/sh", "sh", "-c", hook_command, "sh", h->event,
+		      h->client_id, h->pod_namespace, h->pod_name, h->name,
+		      NULL);
+		_exit(127);
+	}
+	/* Also set it here, in case we get to kill it before the child does */
+	setpgid(pid, pid);
+
+	while (1) {
+		ret = waitpid(pid, &status, WNOHANG);
+		if (ret == pid) break;
+		if (ret < 0 && errno != EINTR) {
+			log_warn("Failed to wait for the client hook: %s",
+				 strerror(errno));
+			return;
+		}
+		if (hook_timeout_ms > 0 && waited_ms >= hook_timeout_ms) {
+			log_warn("The client hook for %s of client %s timed out"
+				 " after %lld ms, killing it", h->event,
+				 h->client_id, hook_timeout_ms);
+			kill(-pid, SIGKILL);
+			while (waitpid(pid, &status, 0) < 0 && errno == EINTR);
+			return;
+		}
+		usleep(CLIENT_HOOK_POLL_MS * 1000);
+		waited_ms += CLIENT_HOOK_POLL_MS;
+	}
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+		log_warn("The client hook failed for %s of client %s (status"
+			 " %d)", h->event, h->client_id, status);
+}
+
+
+static void *hook_thr_fn(void *arg __attribute__((unused)))
+{
+	struct client_hook *h;
+
+	true_or_exit(pthread_mutex_lock(&hook_mutex) == 0);
+	while (1) {
+		while (hook_queue == NULL)
+			true_or_exit(pthread_cond_wait(&hook_cv,
+				     &hook_mutex) == 0);
+		h = hook_queue;
+		LL_DELETE(hook_queue, h);
+		hook_queue_len--;
+		true_or_exit(pthread_mutex_unlock(&hook_mutex) == 0);
+
+		run_hook(h);
+		free(h);
+
+		true_or_exit(pthread_mutex_lock(&hook_mutex) == 0);
+	}
+	return NULL;
+}
+
+
+/*
+ * Set up the hook that ENV_NVSHARE_CLIENT_HOOK names, if any. Call it after
+ * blocking the signals that the scheduler threads must not handle.
+ */
+void nvshare_lifecycle_init(void)
+{
+	char *value, *endptr;
+
+	hook_command = getenv(ENV_NVSHARE_CLIENT_HOOK);
+	if (hook_command == NULL || *hook_command == '\0') {
+		hook_command = NULL;
+		return;
+	}
+
+	value = getenv(ENV_NVSHARE_CLIENT_HOOK_TIMEOUT_MS);
+	if (value != NULL) {
+		errno = 0;
+		hook_timeout_ms = strtoll(value, &endptr, 0);
+		if (value == endptr || *endptr != '\0' || errno != 0 ||
+		    hook_timeout_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_CLIENT_HOOK_TIMEOUT_MS, value);
+	}
+
+	true_or_exit(pthread_create(&hook_tid, NULL, hook_thr_fn, NULL) == 0);
+	log_info("Running a client hook on client registration and"
+		 " deregistration, with a timeout of %lld ms",
+		 hook_timeout_ms);
+}
+
+
+/* Queue the hook for a client event. Never blocks on the hook itself. */
+void nvshare_lifecycle_hook(const char *event, uint64_t client_id,
+	const char *pod_namespace, const char *pod_name, const char *name)
+{
+	struct client_hook *h;
+
+	if (hook_command == NULL) return;
+
+	true_or_exit(pthread_mutex_lock(&hook_mutex) == 0);
+	if (hook_queue_len >= CLIENT_HOOK_QUEUE_MAX) {
+		if (hooks_dropped++ % CLIENT_HOOK_QUEUE_MAX == 0)
+			log_warn("The client hook can't keep up, dropping"
+				 " hooks (%llu so far)", hooks_dropped);
+		true_or_exit(pthread_mutex_unlock(&hook_mutex) == 0);
+		return;
+	}
+	true_or_exit(h = calloc(1, sizeof(*h)));
+	strlcpy(h->event, event, sizeof(h->event));
+	snprintf(h->client_id, sizeof(h->client_id), "%016" PRIx64,
+		 client_id);
+	strlcpy(h->pod_namespace, pod_namespace, sizeof(h->pod_namespace));
+	strlcpy(h->pod_name, pod_name, sizeof(h->pod_name));
+	strlcpy(h->name, name, sizeof(h->name));
+	LL_APPEND(hook_queue, h);
+	hook_queue_len++;
+	true_or_exit(pthread_cond_signal(&hook_cv) == 0);
+	true_or_exit(pthread_mutex_unlock(&hook_mutex) == 0);
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Client lifecycle hook of the nvshare scheduler.
+ */
+
+#ifndef _NVSHARE_LIFECYCLE_H_
+#define _NVSHARE_LIFECYCLE_H_
+
+#include <inttypes.h>
+
+#define ENV_NVSHARE_CLIENT_HOOK            "NVSHARE_CLIENT_HOOK"
+#define ENV_NVSHARE_CLIENT_HOOK_TIMEOUT_MS "NVSHARE_CLIENT_HOOK_TIMEOUT_MS"
+
+#define NVSHARE_DEFAULT_CLIENT_HOOK_TIMEOUT_MS 10000
+
+extern void nvshare_lifecycle_init(void);
+extern void nvshare_lifecycle_hook(const char *event, uint64_t client_id,
+	const char *pod_namespace, const char *pod_name, const char *name);
+
+#endif /* _NVSHARE_LIFECYCLE_H_ */
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Log file of the nvshare scheduler, with rotation.
+ *
+ * The scheduler logs to stderr. If NVSHARE_LOG_FILE is set, we point stderr
+ * at that file instead, so that every log line ends up there without the
+ * logging macros knowing about it. With debug logging, a busy scheduler
+ * would eventually fill the disk, so the log thread rotates the file once
+ * it grows past max_bytes or gets older than max_age_s, keeping up to
+ * max_files files in total, like the event log.
+ *
+ * Rotating means pointing fd 2 at a fresh file with dup2(), which is atomic,
+ * so threads that log meanwhile write either to the old file or to the new
+ * one.
+ */
+
+#include <errno.h>
+#include <fcntl.h>
+#include <pthread.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <unistd.h>
+#include <sys/stat.h>
+
+#include "common.h"
+#include "logfile.h"
+
+#define DEFAULT_LOG_MAX_BYTES (100 * 1024 * 1024)
+#define DEFAULT_LOG_FILES 5
+
+/* How often the log thread checks whether the file is due for rotation */
+#define LOG_ROTATE_POLL_MS 1000
+
+static char *logfile_path = NULL;
+static long long max_bytes = DEFAULT_LOG_MAX_BYTES;
+static long long max_age_s = 0;
+static long long max_files = DEFAULT_LOG_FILES;
+static struct timespec opened_ts; /* When we started the current file */
+
+
+static long long getenv_nonnegative(const char *name, long long def)
+{
+	char *value, *endptr;
+	long long n;
+
+	value = getenv(name);
+	if (value == NULL) return def;
+
+	errno = 0;
+	n = strtoll(value, &endptr, 0);
+	if (value == endptr || *endptr != '\0' || errno != 0 || n < 0)
+		log_fatal("Invalid value for %s: %s", name, value);
+	return n;
+}
+
+
+/* Point stderr at a newly opened logfile_path */
+static int open_logfile(void)
+{
+	int fd;
+
+	fd = open(logfile_path, O_WRONLY | O_CREAT | O_APPEND | O_CLOEXEC,
+		  S_IRUSR | S_IWUSR | S_IRGRP | S_IROTH);
+	if (fd < 0) return -1;
+	if (dup2(fd, STDERR_FILENO) < 0) {
+		close(fd);
+		return -1;
+	}
+	close(fd);
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &opened_ts) == 0);
+	return 0;
+}
+
+
+static long long logfile_bytes(void)
+{
+	struct stat st;
+
+	if (fstat(STDERR_FILENO, &st) != 0) return -1;
+	return st.st_size;
+}
+
+
+/*
+ * Start a fresh file. If we can't, keep writing to whatever file we have,
+ * and try again next time.
+ */
+static void rotate_logfile(const char *reason)
+{
+	int saved_errno;
+
+	rotate_files(logfile_path, max_files);
+	if (open_logfile() != 0) {
+		saved_errno = errno;
+		log_warn("Failed to reopen log file %s: %s", logfile_path,
+			 strerror(saved_errno));
+		return;
+	}
+	log_info("Rotated log file %s (%s)", logfile_path, reason);
+}
+
+
+static void *logfile_thr_fn(void *arg __attribute__((unused)))
+{
+	struct timespec now;
+	long long bytes;
+
+	while (1) {
+		usleep(LOG_ROTATE_POLL_MS * 1000);
+		bytes = logfile_bytes();
+		true_or_exit(clock_gettime(CLOCK_MONOTONIC, &now) == 0);
+		if (bytes >= max_bytes)
+			rotate_logfile("size");
+		else if (max_age_s > 0 &&
+			 now.tv_sec - opened_ts.tv_sec >= max_age_s)
+			rotate_logfile("age");
+	}
+	return NULL;
+}
+
+
+/*
+ * Call first thing, so that everything we log goes to the file. Without
+ * NVSHARE_LOG_FILE, we leave stderr alone.
+ */
+void nvshare_logfile_init(void)
+{
+	pthread_t tid;
+
+	logfile_path = getenv(ENV_NVSHARE_LOG_FILE);
+	if (logfile_path == NULL || *logfile_path == '\0') {
+		logfile_path = NULL;
+		return;
+	}
+	max_bytes = getenv_nonnegative(ENV_NVSHARE_LOG_MAX_BYTES,
+				       DEFAULT_LOG_MAX_BYTES);
+	max_age_s = getenv_nonnegative(ENV_NVSHARE_LOG_MAX_AGE_S, 0);
+	max_files = getenv_nonnegative(ENV_NVSHARE_LOG_FILES,
+				       DEFAULT_LOG_FILES);
+	if (max_bytes == 0)
+		log_fatal("Invalid value for %s: 0", ENV_NVSHARE_LOG_MAX_BYTES);
+	if (max_files == 0)
+		log_fatal("Invalid value for %s: 0", ENV_NVSHARE_LOG_FILES);
+
+	if (open_logfile() != 0)
+		log_fatal_errno("Could not open log file %s", logfile_path);
+	log_info("Logging to %s (up to %lld bytes per file, %lld files)",
+		 logfile_path, max_bytes, max_files);
+	if (max_age_s > 0)
+		log_info("Rotating the log file at least every %lld s",
+			 max_age_s);
+
+	true_or_exit(pthread_create(&tid, NULL, logfile_thr_fn, NULL) == 0);
+	true_or_exit(pthread_detach(tid) == 0);
+}
+
+
+/* Returns -1 if we don't log to a file */
+int nvshare_logfile_info(struct nvshare_logfile_info *info)
+{
+	if (logfile_path == NULL) return -1;
+
+	info->path = logfile_path;
+	info->bytes = logfile_bytes();
+	info->max_bytes = max_bytes;
+	info->max_age_s = max_age_s;
+	info->files = max_files;
+	return 0;
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Log file of the nvshare scheduler, with rotation.
+ */
+
+#ifndef _NVSHARE_LOGFILE_H_
+#define _NVSHARE_LOGFILE_H_
+
+#define ENV_NVSHARE_LOG_FILE      "NVSHARE_LOG_FILE"
+#define ENV_NVSHARE_LOG_MAX_BYTES "NVSHARE_LOG_MAX_BYTES"
+#define ENV_NVSHARE_LOG_MAX_AGE_S "NVSHARE_LOG_MAX_AGE_S"
+#define ENV_NVSHARE_LOG_FILES     "NVSHARE_LOG_FILES"
+
+struct nvshare_logfile_info {
+	const char *path;
+	long long bytes;     /* Size of the current file */
+	long long max_bytes;
+	long long max_age_s; /* 0 means no age limit */
+	long long files;     /* Including the current one */
+};
+
+extern void nvshare_logfile_init(void);
+extern int nvshare_logfile_info(struct nvshare_logfile_info *info);
+
+#endif /* _NVSHARE_LOGFILE_H_ */
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Prometheus metrics endpoint for the nvshare scheduler.
+ *
+ * A minimal HTTP/1.0 server that answers every request with the current
+ * metrics, in the Prometheus text exposition format. It runs in its own
+ * thread, so that a slow scraper can never stall scheduling.
+ */
+
+#include <stdio.h>
+#include <errno.h>
+#include <netdb.h>
+#include <stdlib.h>
+#include <string.h>
+#include <signal.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <sys/time.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+
+#include "common.h"
+#include "metrics.h"
+
+static int metrics_lsock;
+static nvshare_metrics_fn metrics_fn;
+static pthread_t metrics_tid;
+
+
+static void serve_one(int sock)
+{
+	char req[1024];
+	char *body = NULL;
+	size_t body_len = 0;
+	FILE *fp;
+	struct timeval tv = {1, 0};
+
+	/* Don't let a misbehaving scraper block us for long */
+	(void)setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+	(void)setsockopt(sock, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
+
+	/* We serve the same thing for every path, ignore the request */
+	if (RETRY_INTR(read(sock, req, sizeof(req))) < 0) return;
+
+	true_or_exit(fp = open_memstream(&body, &body_len));
+	metrics_fn(fp);
+	true_or_exit(fclose(fp) == 0);
+
+	dprintf(sock, "HTTP/1.0 200 OK\r\n"
+		"Content-Type: text/plain; version=0.0.4\r\n"
+		"Content-Length: %zu\r\n\r\n", body_len);
+	(void)write_whole(sock, body, body_len);
+	free(body);
+}
+
+
+static void *metrics_thr_fn(void *arg __attribute__((unused)))
+{
+	int sock;
+	sigset_t signal_set;
+
+	true_or_exit(sigfillset(&signal_set) == 0);
+	true_or_exit(pthread_sigmask(SIG_SETMASK, &signal_set, NULL) == 0);
+
+	for (;;) {
+		sock = RETRY_INTR(accept(metrics_lsock, NULL, NULL));
+		if (sock < 0) {
+			log_warn("Metrics endpoint failed to accept() a"
+				 " connection");
+			continue;
+		}
+		serve_one(sock);
+		close(sock);
+	}
+	return NULL;
+}
+
+
+/*
+ * Start serving metrics on the address in NVSHARE_METRICS_ADDR, which has the
+ * form <host>:<port> (e.g., 127.0.0.1:9402).
+ *
+ * Does nothing if the variable is unset.
+ */
+void nvshare_metrics_start(nvshare_metrics_fn fn)
+{
+	char *addr, *host, *port;
+	int ret, one = 1;
+	struct addrinfo hints, *res;
+
+	addr = getenv(ENV_NVSHARE_METRICS_ADDR);
+	if (addr == NULL || *addr == '\0') return;
+
+	true_or_exit(host = strdup(addr));
+	port = strrchr(host, ':');
+	if (port == NULL)
+		log_fatal("Invalid value for %s: %s. Must be <host>:<port>.",
+			  ENV_NVSHARE_METRICS_ADDR, addr);
+	*port++ = '\0';
+
+	memset(&hints, 0, sizeof(hints));
+	hints.ai_family = AF_UNSPEC;
+	hints.ai_socktype = SOCK_STREAM;
+	hints.ai_flags = AI_PASSIVE;
+	ret = getaddrinfo(*host ? host : NULL, port, &hints, &res);
+	if (ret != 0)
+		log_fatal("Could not resolve metrics address %s: %s", addr,
+			  gai_strerror(ret));
+
+	metrics_lsock = socket(res->ai_family, res->ai_socktype,
+			       res->ai_protocol);
+	if (metrics_lsock < 0)
+		log_fatal_errno("Could not create metrics socket");
+	true_or_exit(setsockopt(metrics_lsock, SOL_SOCKET, SO_REUSEADDR, &one,
+				sizeof(one)) == 0);
+	if (bind(metrics_lsock, res->ai_addr, res->ai_addrlen) != 0)
+		log_fatal_errno("Could not bind metrics socket to %s", addr);
+	if (listen(metrics_lsock, 8) != 0)
+		log_fatal_errno("Could not listen on metrics socket");
+	freeaddrinfo(res);
+	free(host);
+
+	metrics_fn = fn;
+	true_or_exit(pthread_create(&metrics_tid, NULL, metrics_thr_fn,
+				    NULL) == 0);
+	log_info("Serving Prometheus metrics on %s", addr);
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Prometheus metrics endpoint for the nvshare scheduler.
+ */
+
+#ifndef _NVSHARE_METRICS_H_
+#define _NVSHARE_METRICS_H_
+
+#include <stdio.h>
+
+#define ENV_NVSHARE_METRICS_ADDR "NVSHARE_METRICS_ADDR"
+
+/* Writes all metrics in the Prometheus text exposition format to fp */
+typedef void (*nvshare_metrics_fn)(FILE *fp);
+
+extern void nvshare_metrics_start(nvshare_metrics_fn fn);
+
+#endif /* _NVSHARE_METRICS_H_ */
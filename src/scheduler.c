@@ -18,23 +18,124 @@
  */
 
 #include <dirent.h>
+#include <fcntl.h>
 #include <pthread.h>
+#include <signal.h>
 #include <inttypes.h>
 #include <sys/stat.h>
 #include <sys/epoll.h>
+#include <sys/signalfd.h>
+#include <sys/socket.h>
+#include <sys/time.h>
+#include <sys/wait.h>
 #include <time.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <unistd.h>
 #include <limits.h>
 #include <errno.h>
+#include <stdarg.h>
 
 #include "comm.h"
 #include "common.h"
+#include "eventlog.h"
+#include "gpu.h"
+#include "metrics.h"
+#include "trace.h"
+#include "tod.h"
+#include "snapshot.h"
+#include "logfile.h"
+#include "lifecycle.h"
 #include "utlist.h"
+#include "workload.h"
 
 #define NVSHARE_DEFAULT_TQ 30
 
+#define ENV_NVSHARE_TTFS_SLO_MS "NVSHARE_TTFS_SLO_MS"
+#define ENV_NVSHARE_DRAIN_COMPLETE_FILE "NVSHARE_DRAIN_COMPLETE_FILE"
+#define ENV_NVSHARE_BURST_ACCRUAL_PERCENT "NVSHARE_BURST_ACCRUAL_PERCENT"
+#define ENV_NVSHARE_BURST_CAP_MS "NVSHARE_BURST_CAP_MS"
+#define ENV_NVSHARE_ACCOUNTING_FILE "NVSHARE_ACCOUNTING_FILE"
+#define ENV_NVSHARE_QUIESCE_TIMEOUT_MS "NVSHARE_QUIESCE_TIMEOUT_MS"
+#define ENV_NVSHARE_OVERSUB_WARN_RATIO "NVSHARE_OVERSUB_WARN_RATIO"
+#define ENV_NVSHARE_OVERSUB_WARN_INTERVAL_S "NVSHARE_OVERSUB_WARN_INTERVAL_S"
+#define ENV_NVSHARE_MIN_DWELL_MS "NVSHARE_MIN_DWELL_MS"
+#define ENV_NVSHARE_OVERRUN_THRESHOLD_MS "NVSHARE_OVERRUN_THRESHOLD_MS"
+#define ENV_NVSHARE_OVERRUN_DENY "NVSHARE_OVERRUN_DENY"
+#define ENV_NVSHARE_OVERRUN_ACTION "NVSHARE_OVERRUN_ACTION"
+#define ENV_NVSHARE_OVERRUN_REPEAT "NVSHARE_OVERRUN_REPEAT"
+#define ENV_NVSHARE_SCHEDULING_POLICY "NVSHARE_SCHEDULING_POLICY"
+#define ENV_NVSHARE_FAIR_SHARE_IDLE_RESET_S "NVSHARE_FAIR_SHARE_IDLE_RESET_S"
+#define ENV_NVSHARE_SERIALIZE_INIT_MS "NVSHARE_SERIALIZE_INIT_MS"
+#define ENV_NVSHARE_ALLOWED_UIDS "NVSHARE_ALLOWED_UIDS"
+#define ENV_NVSHARE_ADMIN_UIDS "NVSHARE_ADMIN_UIDS"
+#define ENV_NVSHARE_ALLOWED_NAMESPACES "NVSHARE_ALLOWED_NAMESPACES"
+#define ENV_NVSHARE_IDLE_COMMAND "NVSHARE_IDLE_COMMAND"
+#define ENV_NVSHARE_IDLE_FILE "NVSHARE_IDLE_FILE"
+#define ENV_NVSHARE_IDLE_DEBOUNCE_MS "NVSHARE_IDLE_DEBOUNCE_MS"
+#define ENV_NVSHARE_MIN_FREE_MEMORY_MIB "NVSHARE_MIN_FREE_MEMORY_MIB"
+#define ENV_NVSHARE_MIN_FREE_MEMORY_WAIT_MS "NVSHARE_MIN_FREE_MEMORY_WAIT_MS"
+#define ENV_NVSHARE_POWER_MANAGEMENT "NVSHARE_POWER_MANAGEMENT"
+#define ENV_NVSHARE_WARMUP_MS "NVSHARE_WARMUP_MS"
+#define ENV_NVSHARE_WARMUP_COOLDOWN_S "NVSHARE_WARMUP_COOLDOWN_S"
+#define ENV_NVSHARE_OOM_ADMISSION_PAUSE_S "NVSHARE_OOM_ADMISSION_PAUSE_S"
+#define ENV_NVSHARE_RECLAIM_POLICY "NVSHARE_RECLAIM_POLICY"
+#define ENV_NVSHARE_CLIENT_SEND_TIMEOUT_MS "NVSHARE_CLIENT_SEND_TIMEOUT_MS"
+#define ENV_NVSHARE_CLIENT_RECV_TIMEOUT_MS "NVSHARE_CLIENT_RECV_TIMEOUT_MS"
+#define ENV_NVSHARE_EXCLUSIVE_TIMEOUT_MS "NVSHARE_EXCLUSIVE_TIMEOUT_MS"
+#define ENV_NVSHARE_THROTTLE_POLL_MS "NVSHARE_THROTTLE_POLL_MS"
+#define ENV_NVSHARE_BACKPRESSURE_CLIENTS "NVSHARE_BACKPRESSURE_CLIENTS"
+#define ENV_NVSHARE_BACKPRESSURE_SWITCH_RATE "NVSHARE_BACKPRESSURE_SWITCH_RATE"
+#define ENV_NVSHARE_BACKPRESSURE_PAUSE_MS "NVSHARE_BACKPRESSURE_PAUSE_MS"
+#define ENV_NVSHARE_BOOST_FACTOR "NVSHARE_BOOST_FACTOR"
+#define ENV_NVSHARE_GPU_PROCESS_LIMIT "NVSHARE_GPU_PROCESS_LIMIT"
+
+#define NVSHARE_DEFAULT_BURST_CAP_MS 60000
+#define NVSHARE_DEFAULT_QUIESCE_TIMEOUT_MS 25000
+#define NVSHARE_DEFAULT_OVERSUB_WARN_INTERVAL_S 60
+#define NVSHARE_DEFAULT_IDLE_DEBOUNCE_MS 60000
+#define NVSHARE_DEFAULT_MIN_FREE_MEMORY_WAIT_MS 30000
+#define NVSHARE_DEFAULT_WARMUP_COOLDOWN_S 600
+#define NVSHARE_DEFAULT_CLIENT_RECV_TIMEOUT_MS 10000
+#define NVSHARE_DEFAULT_EXCLUSIVE_TIMEOUT_MS 600000
+#define NVSHARE_DEFAULT_THROTTLE_POLL_MS 5000
+#define NVSHARE_DEFAULT_OVERRUN_REPEAT 3
+#define NVSHARE_DEFAULT_BACKPRESSURE_PAUSE_MS 1000
+#define NVSHARE_DEFAULT_BOOST_FACTOR 4
+
+/* A warmup keeps everyone else off the GPU, so don't let it grow unbounded */
+#define NVSHARE_MAX_WARMUP_MS 600000
+
+/* Keep boosted slices within reason, they scale with the factor */
+#define NVSHARE_MAX_BOOST_FACTOR 100
+
+/* We send to clients from the main loop, so a send must never block for long */
+#define NVSHARE_MAX_CLIENT_SEND_TIMEOUT_MS 10000
+
+/* How often the main loop checks for clients stuck in the middle of a message */
+#define RECV_TIMEOUT_POLL_MS 1000
+
+/* The GPUs count as idle at or below this utilization rate (percent) */
+#define QUIESCE_IDLE_UTIL_PERCENT 5
+#define QUIESCE_POLL_MS 500
+
+/* How often we check the free GPU memory while a client waits for it */
+#define MIN_FREE_POLL_MS 200
+
+/*
+ * How long the GPU clocks stay boosted after the lock leaves a boosted
+ * client, so that we don't drop them between two boosted clients.
+ */
+#define POWER_RELAX_DELAY_MS 1000
+
+/* Log an event about a client */
+#define client_event(level, event, c, ...) \
+	nvshare_event(level, event, (c)->id, (c)->pod_namespace, \
+		      (c)->pod_name, __VA_ARGS__)
+
+/* Number of recent time-to-first-slice samples we keep for percentiles */
+#define TTFS_SAMPLES_MAX 1024
+
 int lock_held;
 int must_reset_timer;
 pthread_cond_t timer_cv;
@@ -42,8 +143,439 @@ int scheduler_on;
 int tq;
 unsigned int scheduling_round = 0;
 
+/*
+ * We never take the lock away from a client before it has held it for
+ * min_dwell_ms, however short its slice would otherwise be, to bound the
+ * time the GPU spends switching contexts. 0 means no minimum.
+ *
+ * lock_switches counts the times the lock passed to a different client.
+ */
+long long min_dwell_ms = 0;
+unsigned long long lock_switches = 0;
+uint64_t last_holder_id = NVSHARE_UNREGISTERED_ID;
+
+/*
+ * A new client holds the lock for at least warmup_ms in its first slice, so
+ * that it can, e.g., load its model without being preempted midway. Every Pod
+ * gets a warmup at most once every warmup_cooldown_s, so that clients can't
+ * get more of them by reconnecting. 0 means no warmup.
+ */
+long long warmup_ms = 0;
+long long warmup_cooldown_s = NVSHARE_DEFAULT_WARMUP_COOLDOWN_S;
+unsigned long long warmups = 0;
+
+/*
+ * Clients of workload types with preempt=off are exclusive: they keep the
+ * lock until they are done with the GPU. They wait in FCFS order among
+ * themselves, but ahead of all other clients, so that the others only get
+ * the GPU while no exclusive client wants it. So that exclusive clients
+ * can't keep the others off the GPU for good, once the first of the others
+ * has waited for exclusive_timeout_ms, it goes next, and an exclusive lock
+ * holder must drop the lock at the end of its slice. 0 means no limit.
+ */
+long long exclusive_timeout_ms = NVSHARE_DEFAULT_EXCLUSIVE_TIMEOUT_MS;
+unsigned long long exclusive_timeouts = 0;
+int exclusive_dropped = 0; /* We asked the exclusive lock holder to drop it */
+
+/*
+ * Clients tell us when they run out of GPU memory. If oom_admission_pause_s
+ * is set, we turn new clients away for that long after the last time, so
+ * that they don't add to the memory pressure. 0 means we don't.
+ */
+unsigned long long ooms = 0;
+struct timespec last_oom_ts;
+long long oom_admission_pause_s = 0;
+
+/*
+ * Memory reclaim: When a client runs out of GPU memory, we may evict another
+ * client of the same GPU, so that its application exits and frees up its
+ * memory. reclaim_policy picks the victim among the clients that hold GPU
+ * memory and whose workload type allows it: the least recently active one
+ * (lru), the one that has gotten the fewest slices per minute since it
+ * registered (lfu), or the one with the smallest share, and among those
+ * the least recently active one (priority). We evict at most one client
+ * every RECLAIM_COOLDOWN_S, to give the application of the victim time to
+ * exit, and remember the last RECLAIM_HISTORY evictions for the status.
+ * Off by default.
+ */
+#define RECLAIM_COOLDOWN_S 10
+#define RECLAIM_HISTORY 8
+
+enum reclaim_policy {
+	RECLAIM_OFF,
+	RECLAIM_LRU,
+	RECLAIM_LFU,
+	RECLAIM_PRIORITY,
+};
+
+static const char *reclaim_policies[] = {
+	[RECLAIM_OFF] = "off",
+	[RECLAIM_LRU] = "lru",
+	[RECLAIM_LFU] = "lfu",
+	[RECLAIM_PRIORITY] = "priority",
+};
+
+struct reclaim_record {
+	uint64_t id;
+	char pod_name[POD_NAME_LEN_MAX];
+	char pod_namespace[POD_NAMESPACE_LEN_MAX];
+	long long mem_committed_mib;
+	uint64_t oom_id; /* The client that ran out of memory */
+	struct timespec ts;
+};
+
+enum reclaim_policy reclaim_policy = RECLAIM_OFF;
+unsigned long long reclaims = 0;
+/* The next eviction goes to reclaims % RECLAIM_HISTORY */
+struct reclaim_record reclaim_history[RECLAIM_HISTORY];
+
+/*
+ * Socket timeouts: We hand the lock over from the main loop, so a client
+ * that stops reading from its socket (e.g., a hung application) must not
+ * stall everyone else. We give up sending a message to a client after
+ * client_send_timeout_ms, and evict a client that leaves a message half-sent
+ * for client_recv_timeout_ms (0 means we wait forever).
+ *
+ * Several stuck clients could still stall us for client_send_timeout_ms each,
+ * e.g., when we broadcast to all clients. So a round of the main loop, or a
+ * broadcast, sends all its messages between begin_sends() and end_sends(),
+ * and they wait for room out of send_budget_ms, which starts out at
+ * client_send_timeout_ms. Once it runs out, we drop any client whose socket
+ * is full right away. Clients that keep reading never have us wait, so only
+ * stuck clients use up the budget. A single message we send outside of
+ * such a batch, e.g., a DROP_LOCK from the timer thread, gets the whole
+ * client_send_timeout_ms.
+ */
+long long client_send_timeout_ms = NVSHARE_SEND_TIMEOUT_MS;
+long long send_budget_ms = NVSHARE_SEND_TIMEOUT_MS;
+int send_batches = 0; /* Nesting depth of begin_sends() */
+long long client_recv_timeout_ms = NVSHARE_DEFAULT_CLIENT_RECV_TIMEOUT_MS;
+unsigned long long socket_timeouts = 0;
+
+/* Messages we dropped a client for, see receive_message() */
+unsigned long long invalid_messages = 0;
+
+/*
+ * We can't preempt a kernel that never returns, but we can notice it: A
+ * client that still holds the lock overrun_threshold_ms after we asked it to
+ * drop the lock has overrun its slice. We flag it and, if overrun_deny is
+ * set, never grant it the lock again, so that it can't keep wedging the GPU.
+ * A threshold of 0 disables the check.
+ */
+long long overrun_threshold_ms = 0;
+int overrun_deny = 0;
+unsigned long long overruns = 0;
+
+/*
+ * A client whose kernels keep overrunning its slices monopolizes the GPU all
+ * the same. We remember which of its last OVERRUN_HISTORY slices it overran
+ * and, once it has overrun overrun_repeat of them, take overrun_action
+ * against it until it behaves again: flag it for the operator, halve its
+ * slices, or send it to the back of the line. No action by default.
+ */
+#define OVERRUN_HISTORY 16
+
+enum overrun_action {
+	OVERRUN_ACTION_NONE,
+	OVERRUN_ACTION_FLAG,
+	OVERRUN_ACTION_SHORTEN,
+	OVERRUN_ACTION_DEPRIORITIZE,
+};
+
+static const struct {
+	const char *name;
+	const char *applied; /* How the status shows a client it applies to */
+} overrun_actions[] = {
+	[OVERRUN_ACTION_NONE] = { "none", "" },
+	[OVERRUN_ACTION_FLAG] = { "flag", "flagged" },
+	[OVERRUN_ACTION_SHORTEN] = { "shorten", "shortened" },
+	[OVERRUN_ACTION_DEPRIORITIZE] = { "deprioritize", "deprioritized" },
+};
+
+enum overrun_action overrun_action = OVERRUN_ACTION_NONE;
+long long overrun_repeat = NVSHARE_DEFAULT_OVERRUN_REPEAT;
+
+/*
+ * Serialized initialization: Clients tend to allocate most of their GPU
+ * memory right after they start, so many clients starting at once make the
+ * memory usage spike. If serialize_init_ms is set, we admit one new client
+ * at a time. The init phase of a client lasts until it releases the lock for
+ * the first time, or for at most serialize_init_ms. We hold back the
+ * REGISTER of other clients until then. 0 disables this.
+ *
+ * init_phases counts the init phases we have started, which also tells the
+ * init thread whether the phase it waits on is still the current one.
+ */
+long long serialize_init_ms = 0;
+struct nvshare_client *initializing = NULL;
+struct timespec init_ts;
+unsigned long long init_phases = 0;
+unsigned long long init_seq_next = 0;
+pthread_cond_t init_cv;
+
 struct message out_msg = {0};
 
+/*
+ * The kernel tells us the PID and user of the process at the other end of
+ * every connection, which, unlike the client ID, a process can't fake. If
+ * allowed_uids_cnt > 0, only processes that run as one of allowed_uids or as
+ * our own user may register with us or control us.
+ */
+uid_t *allowed_uids = NULL;
+int allowed_uids_cnt = 0;
+
+/*
+ * Only processes that run as our own user or as one of admin_uids may change
+ * how we schedule (e.g., drain, evict or boost clients). Anyone we accept may
+ * still ask for our status.
+ */
+uid_t *admin_uids = NULL;
+int admin_uids_cnt = 0;
+
+/*
+ * If allowed_namespaces_cnt > 0, only clients of Pods in one of
+ * allowed_namespaces may register with us. Clients report their namespace
+ * themselves, so this only means something along with allowed_uids.
+ */
+char **allowed_namespaces = NULL;
+int allowed_namespaces_cnt = 0;
+
+/*
+ * Idle notifications: Tell external tooling (e.g., for GPU power management)
+ * when the GPU goes idle, i.e., no registered clients remain, and when it
+ * becomes active again, by running idle_command with "idle" or "active" as
+ * its argument and/or writing the state to idle_file. We only report the GPU
+ * idle once it has had no clients for idle_debounce_ms, so that clients
+ * coming and going don't make the state flap, but report it active as soon
+ * as a client registers.
+ *
+ * idle_state is the state we last reported, -1 if none. no_clients_since
+ * tells when the last registered client went away, if none remain.
+ */
+char *idle_command = NULL;
+char *idle_file = NULL;
+long long idle_debounce_ms = NVSHARE_DEFAULT_IDLE_DEBOUNCE_MS;
+int idle_state = -1;
+struct timespec no_clients_since;
+pthread_cond_t idle_cv;
+
+/*
+ * Minimum free GPU memory: Before we grant the lock to a client, make sure
+ * that NVML reports at least min_free_mib MiB of GPU memory free, or as much
+ * as the workload type of the client asks for, so that we don't hand the
+ * lock to a client that will fail to allocate right away. Other clients keep
+ * waiting behind it. Nothing may ever free the memory, so after
+ * min_free_wait_ms we grant the lock anyway. 0 disables the check.
+ *
+ * mem_waiting is the client at the head of the requests list while we wait
+ * for memory on its behalf, NULL otherwise.
+ */
+long long min_free_mib = 0;
+long long min_free_wait_ms = NVSHARE_DEFAULT_MIN_FREE_MEMORY_WAIT_MS;
+struct nvshare_client *mem_waiting = NULL;
+struct timespec mem_wait_ts;
+int mem_wait_logged;
+unsigned long long mem_waits = 0;
+pthread_cond_t mem_cv;
+
+/*
+ * Power management: While a client whose workload type asks for a boost
+ * holds the lock, e.g., an inference server, lock the GPU clocks at their
+ * maximum, and let the driver manage them otherwise. The power thread talks
+ * to NVML. power_boost is the state we want, power_state the one we last
+ * applied, -1 if none. Locking clocks needs root and a GPU that supports it,
+ * so if NVML fails us, we stop managing power for good.
+ */
+int power_mgmt = 0;
+int power_failed = 0;
+int power_boost = 0;
+int power_state = -1;
+unsigned long long power_boosts = 0;
+pthread_cond_t power_cv;
+
+/*
+ * Throttle monitoring: Under sustained load, the GPU may lower its clocks
+ * because it runs hot or hits its power cap, and users would blame the
+ * slowdown on nvshare. The throttle thread asks NVML why the clocks are
+ * lowered every throttle_poll_ms and logs when the GPU starts and stops
+ * throttling, so that slowdowns can be told apart from scheduling overhead.
+ * throttle holds what we found last, throttled_ms the time the GPU has spent
+ * throttling in the episodes that are over.
+ */
+long long throttle_poll_ms = NVSHARE_DEFAULT_THROTTLE_POLL_MS;
+int throttle_failed = 0;
+int throttle_known = 0;
+struct nvshare_gpu_throttle throttle;
+int throttling = 0;
+struct timespec throttle_ts; /* Since when the GPU has been throttling */
+unsigned long long throttle_episodes = 0;
+long long throttled_ms = 0;
+
+static const struct {
+	int mask;
+	const char *name;
+} throttle_causes[] = {
+	{ NVSHARE_GPU_THROTTLE_THERMAL, "thermal" },
+	{ NVSHARE_GPU_THROTTLE_POWER, "power" },
+	{ NVSHARE_GPU_THROTTLE_HW_SLOWDOWN, "hw_slowdown" },
+};
+
+/*
+ * Backpressure: With many clients, or clients that keep requesting the lock
+ * for short bursts of work, the lock changes hands so often that the GPU
+ * spends more time switching contexts than computing. The backpressure
+ * thread checks every second whether at least backpressure_clients clients
+ * are registered, or the lock has switched more than
+ * backpressure_switch_rate times per second over the last
+ * BACKPRESSURE_WINDOW_S seconds. While either holds, we ask clients to wait
+ * for backpressure_pause_ms after they release the lock before they request
+ * it again. 0 disables a threshold.
+ */
+#define BACKPRESSURE_WINDOW_S 10
+long long backpressure_clients = 0;
+double backpressure_switch_rate = 0;
+long long backpressure_pause_ms = NVSHARE_DEFAULT_BACKPRESSURE_PAUSE_MS;
+int backpressure = 0;
+struct timespec backpressure_ts; /* Since when backpressure has been on */
+unsigned long long backpressure_activations = 0;
+double switch_rate = 0; /* Lock switches per second, over the window */
+
+/*
+ * Boosts: An operator can multiply the share of a client by boost_factor
+ * for a while with nvsharectl --boost, e.g., to get a workload through an
+ * incident, on top of the configured policy. The boost thread ends the
+ * boosts as they expire. boosts counts the boosts we have granted.
+ */
+long long boost_factor = NVSHARE_DEFAULT_BOOST_FACTOR;
+unsigned long long boosts = 0;
+pthread_cond_t boost_cv;
+
+/*
+ * While draining, we reject new clients. The drain is complete once no
+ * registered clients remain.
+ */
+int draining = 0;
+int drain_complete = 0;
+char *drain_complete_file = NULL;
+
+/*
+ * While quiescing, we grant no new slices. The quiesce is complete once the
+ * lock holder has released the lock and the GPUs are idle.
+ */
+int quiescing = 0;
+int quiesce_complete = 0;
+long long quiesce_timeout_ms = NVSHARE_DEFAULT_QUIESCE_TIMEOUT_MS;
+pthread_cond_t quiesce_cv;
+
+/*
+ * Node-wide oversubscription check: Warn when the GPU memory that all
+ * clients have committed exceeds the physical GPU memory by
+ * oversub_warn_ratio, at most once every oversub_warn_interval_s. A ratio of
+ * 0 disables the check.
+ */
+double oversub_warn_ratio = 0;
+long long oversub_warn_interval_s = NVSHARE_DEFAULT_OVERSUB_WARN_INTERVAL_S;
+unsigned long long oversub_warnings = 0;
+int oversub_warned = 0;
+struct timespec oversub_warn_ts;
+
+/*
+ * Time to first slice (TTFS): Time from the registration of a client until
+ * it first gets to use the GPU.
+ */
+long long ttfs_slo_ms = 0; /* 0 means no SLO */
+unsigned long long ttfs_slo_violations = 0;
+unsigned long long ttfs_count = 0;
+long long ttfs_sum_ms = 0;
+long long ttfs_samples[TTFS_SAMPLES_MAX];
+unsigned int ttfs_samples_cnt = 0;
+unsigned int ttfs_samples_next = 0;
+
+/*
+ * Burst credits: Clients accrue GPU time credits while idle, i.e., while
+ * they don't request the GPU lock after having released it. A client with credits jumps ahead of the
+ * clients without credits when it requests the lock, and its slice is
+ * extended by its credits. Credits are spent for the time the client holds
+ * the lock.
+ *
+ * A client accrues burst_accrual_pct ms of credits per 100 ms of idle time,
+ * up to burst_cap_ms. An accrual percentage of 0 disables burst credits.
+ */
+long long burst_accrual_pct = 0;
+long long burst_cap_ms = NVSHARE_DEFAULT_BURST_CAP_MS;
+long long slice_extra_ms = 0; /* Burst extension of the current slice */
+
+/*
+ * With the fair-share policy, a client that has been idle for
+ * fair_share_idle_reset_s starts afresh, like a new client, instead of
+ * paying for the GPU time it had long ago. 0 means it never does.
+ */
+long long fair_share_idle_reset_s = 0;
+
+/*
+ * Time-of-day policies override the defaults below while their window is
+ * active. max_clients == 0 means no limit.
+ */
+int max_clients = 0;
+int default_tq;
+int active_policy = -1;
+
+/*
+ * GPU process limit: Some GPUs run only so many processes at a time, e.g.,
+ * a single one in the EXCLUSIVE_PROCESS compute mode, and context creation
+ * fails for the rest with CUDA errors that are hard to make sense of. If
+ * gpu_process_limit is set, the process thread asks NVML for the processes
+ * on the GPU every GPU_PROCESS_POLL_MS, and we turn new clients away while
+ * the GPU is at the limit. GPU_PROCESS_LIMIT_AUTO takes the limit from the
+ * compute mode of the GPU. A client only shows up in NVML once it creates
+ * its CUDA context, so we count our registered clients instead if there are
+ * more of them.
+ */
+#define GPU_PROCESS_LIMIT_OFF  0
+#define GPU_PROCESS_LIMIT_AUTO -1
+#define GPU_PROCESS_POLL_MS 1000
+long long gpu_process_limit = GPU_PROCESS_LIMIT_OFF;
+int gpu_processes = -1; /* On the busiest GPU, -1 until NVML tells us */
+int gpu_mode_limit = -1; /* What the compute mode allows, -1 for no limit */
+unsigned long long process_limit_rejections = 0;
+
+/*
+ * GPU time accounting: How long each Pod has held the GPU lock, for
+ * chargeback. We keep the totals of Pods after their clients are gone, so
+ * that the counters we export never go backwards.
+ */
+struct pod_account {
+	char pod_name[POD_NAME_LEN_MAX];
+	char pod_namespace[POD_NAMESPACE_LEN_MAX];
+	long long gpu_ms;
+	int warmed_up; /* The Pod has had a warmup, at warmup_ts */
+	struct timespec warmup_ts;
+	struct pod_account *next;
+};
+
+struct pod_account *pod_accounts = NULL;
+FILE *accounting_fp = NULL;
+
+/*
+ * The same for each GPU of the node, for the metrics that we label with the
+ * UUID of the GPU. The UUIDs come from the clients and NVML, so we keep at
+ * most GPU_ACCOUNTS_MAX of them, more than a node has GPUs, and count
+ * everything else under unknown_gpu. This bounds the number of series we
+ * export, even if clients report bogus UUIDs.
+ */
+#define GPU_ACCOUNTS_MAX 32
+
+struct gpu_account {
+	char uuid[NVSHARE_GPU_UUID_LEN];
+	unsigned long long lock_switches;
+	long long gpu_ms;
+	struct gpu_account *next;
+};
+
+struct gpu_account *gpu_accounts = NULL;
+int num_gpu_accounts = 0;
+struct gpu_account unknown_gpu = { .uuid = "unknown" };
+
 char nvscheduler_socket_path[NVSHARE_SOCK_PATH_MAX];
 
 pthread_mutex_t global_mutex;
@@ -57,12 +589,76 @@ struct nvshare_client {
 	uint64_t id; /* Unique */
 	char pod_name[POD_NAME_LEN_MAX];
 	char pod_namespace[POD_NAMESPACE_LEN_MAX];
+	char name[POD_NAME_LEN_MAX]; /* Human-friendly, defaults to pod_name */
+	struct timespec register_ts;
+	int proto_version; /* Protocol version the client speaks */
+	/* The device slot and instance of the container, if known */
+	char slot[MSG_DATA_LEN + 1];
+	char generation[MSG_DATA_LEN + 1];
+	/* The UID of the Pod and the container, empty if unknown, see IDENTITY */
+	char pod_uid[NVSHARE_POD_UID_LEN_MAX + 1];
+	char container[NVSHARE_CONTAINER_LEN_MAX + 1];
+	int overflow; /* Runs without an nvshare device, see comm.h */
+	int evicted; /* We've shut down the connection of this client */
+	/* Credentials of the peer process, -1 if unknown */
+	pid_t peer_pid;
+	uid_t peer_uid;
+	/* GPU memory the client has committed and physical GPU memory, MiB */
+	long long mem_committed_mib;
+	long long mem_total_mib;
+	long long mem_reserved_mib; /* Reserved upfront, see RESERVE */
+	char gpu_uuid[NVSHARE_GPU_UUID_LEN]; /* Empty if the client can't tell */
+	/* Share of the GPU, in thousandths, which scales the slices */
+	long long millishares;
+	/* Policy of the declared workload type, NULL for the defaults */
+	const struct workload_policy *workload;
+	long long contexts; /* CUDA contexts the client has created itself */
+	long long ooms; /* Times it has run out of GPU memory */
+	long long ttfs_ms; /* -1 until the client gets its first slice */
+	int warmup; /* Its current slice is a warmup */
+	int drain_waiter; /* nvsharectl waiting for the drain to complete */
+	int quiesce_waiter; /* nvsharectl waiting for the GPU to quiesce */
+	unsigned int overruns; /* Times the client overran its slice */
+	int denied; /* We no longer grant the lock to this client */
+	/* Bit i is set if it overran its i-th to last slice */
+	unsigned int overrun_history;
+	unsigned int history_slices; /* Slices in overrun_history */
+	int slice_overran; /* It has overrun its current slice */
+	int repeat_overrunner; /* overrun_action applies to it */
+	int mem_admitted; /* Enough GPU memory is free for its next slice */
+	unsigned long long slices; /* Times it got the lock */
+	/* Non-zero while the REGISTER of the client waits for its turn */
+	unsigned long long init_seq;
+	struct message init_msg;
+	/* Tracing state for the current lock cycle of the client */
+	uint64_t lock_cycle;
+	int trace_sampled;
+	struct timespec req_ts;
+	struct timespec grant_ts;
+	/* Burst credits */
+	long long credits_ms;
+	struct timespec idle_ts; /* Since when the client has been idle */
+	int has_idled; /* Clients don't accrue credits before their first slice */
+	struct timespec slice_ts; /* When the client got the lock */
+	long long gpu_ms; /* Total time the client has held the GPU lock */
+	/* GPU time per full share that counts against it, see fair-share */
+	long long fair_ms;
+	struct timespec boost_until; /* CLOCK_REALTIME, 0 if not boosted */
+	/* A message may arrive in pieces, so we assemble it here */
+	struct message in_msg;
+	size_t in_len;
+	struct timespec in_ts; /* When the first piece of it arrived */
 	struct nvshare_client *next;
 };
 
-/* Holds the requests for the GPU lock, which we serve in an FCFS manner */
+/*
+ * Holds the requests for the GPU lock, which we serve in an FCFS manner.
+ * Bursting requests go before all non-bursting ones.
+ */
 struct nvshare_request {
 	struct nvshare_client *client;
+	int burst;
+	struct timespec since; /* When the client requested the lock */
 	struct nvshare_request *next;
 };
 
@@ -70,23 +666,143 @@ struct nvshare_client *clients = NULL;
 struct nvshare_request *requests = NULL;
 
 void *timer_thr_fn(void *arg __attribute__((unused)));
+void *policy_thr_fn(void *arg __attribute__((unused)));
+void *quiesce_thr_fn(void *arg __attribute__((unused)));
+void *init_thr_fn(void *arg __attribute__((unused)));
+void *idle_thr_fn(void *arg __attribute__((unused)));
+void *mem_thr_fn(void *arg __attribute__((unused)));
+void *power_thr_fn(void *arg __attribute__((unused)));
+void *throttle_thr_fn(void *arg __attribute__((unused)));
+void *backpressure_thr_fn(void *arg __attribute__((unused)));
+void *boost_thr_fn(void *arg __attribute__((unused)));
+void *process_thr_fn(void *arg __attribute__((unused)));
+void *signal_thr_fn(void *arg);
+void *dump_thr_fn(void *arg);
 
 static void bcast_status(void);
+static void bcast_client_count(void);
+static void send_backpressure(struct nvshare_client *client);
 static int send_message(struct nvshare_client *client, struct message *msg_p);
+static void begin_sends(void);
+static void end_sends(void);
 static int receive_message(struct nvshare_client *client, struct message *msg_p);
 static void try_schedule(void);
+static void grant_lock(void);
 static int register_client(struct nvshare_client *client, const struct message *in_msg);
+static int complete_registration(struct nvshare_client *client,
+	const struct message *in_msg);
+static void end_init(const char *reason);
+static void admit_next_init(void);
 static int has_registered(struct nvshare_client *client);
 static void client_id_as_string(char *buf, size_t buflen, uint64_t id);
 static void delete_client(struct nvshare_client *client);
 static void insert_req(struct nvshare_client *client);
+static int request_rank(struct nvshare_request *r);
+static struct nvshare_request *overdue_request(void);
 static void remove_req(struct nvshare_client *client);
+static void record_ttfs(struct nvshare_client *client);
+static void write_status(FILE *fp);
+static void send_status(struct nvshare_client *client, const char *fields);
+static void write_clients(FILE *fp);
+static long long client_gpu_ms(struct nvshare_client *c);
+static void write_metrics(FILE *fp);
+static void write_snapshot(FILE *fp);
+static void write_queue(FILE *fp);
+static void write_exclusive_status(FILE *fp);
+static void write_throttle_status(FILE *fp);
+static void throttle_causes_string(char *buf, size_t buflen, int causes);
+static long long throttled_total_ms(void);
+static int num_registered_clients(void);
+static int num_waiting_init(void);
+static void check_drain_complete(void);
+static void check_idle(void);
+static void start_quiesce(void);
+static void set_quiesce_complete(void);
+static void committed_memory(long long *committed_mib, long long *total_mib);
+static void check_oversubscription(void);
+static void set_scheduler_on(int on);
+static void set_tq(int newtq);
+static void apply_policy(int idx);
+static long long elapsed_ms_since(const struct timespec *ts);
+static long long client_credits(struct nvshare_client *client);
+static long long client_tq(struct nvshare_client *client);
+static long long client_slice_ms(struct nvshare_client *client);
+static long long client_turn_ms(struct nvshare_client *client);
+static double client_effective_share(struct nvshare_client *client);
+static long long client_burst_pct(struct nvshare_client *client);
+static int client_preemptible(struct nvshare_client *client);
+static long long client_min_free_mib(struct nvshare_client *client);
+static int client_boost(struct nvshare_client *client);
+static void update_power(void);
+static struct pod_account *get_pod_account(struct nvshare_client *client);
+static void account_slice(struct nvshare_client *client);
+static int oom_admission_paused(void);
+static int grant_warmup(struct nvshare_client *client);
+static void write_accounting_record(struct nvshare_client *client);
+static void evict_stale_clients(struct nvshare_client *client);
+static void evict_client(struct nvshare_client *c);
+static int same_container(struct nvshare_client *a, struct nvshare_client *b);
+static void set_container_fields(struct nvshare_client *client,
+	const char *data);
+static void set_identity(struct nvshare_client *client,
+			 const struct message *in_msg);
+static int kick_client(uint64_t id);
+static void send_error(struct nvshare_client *client, enum nvshare_error code,
+	const char *fmt, ...) __attribute__((format(printf, 3, 4)));
 
 static int has_registered(struct nvshare_client *client)
 {
 	return (client->id != NVSHARE_UNREGISTERED_ID);
 }
 
+
+static int peer_allowed(struct nvshare_client *client)
+{
+	if (allowed_uids_cnt == 0) return 1;
+	if (client->peer_uid == (uid_t)-1) return 0;
+	if (client->peer_uid == geteuid()) return 1;
+	for (int i = 0; i < allowed_uids_cnt; i++)
+		if (client->peer_uid == allowed_uids[i]) return 1;
+	return 0;
+}
+
+
+static int peer_admin(struct nvshare_client *client)
+{
+	if (client->peer_uid == (uid_t)-1) return 0;
+	if (client->peer_uid == geteuid()) return 1;
+	for (int i = 0; i < admin_uids_cnt; i++)
+		if (client->peer_uid == admin_uids[i]) return 1;
+	return 0;
+}
+
+
+/* The nvsharectl commands that change how we schedule */
+static int admin_command(enum message_type type)
+{
+	switch (type) {
+	case SCHED_ON:
+	case SCHED_OFF:
+	case SET_TQ:
+	case DRAIN:
+	case QUIESCE:
+	case EVICT:
+	case BOOST:
+		return 1;
+	default:
+		return 0;
+	}
+}
+
+
+static int namespace_allowed(const char *pod_namespace)
+{
+	if (allowed_namespaces_cnt == 0) return 1;
+	for (int i = 0; i < allowed_namespaces_cnt; i++)
+		if (strcmp(pod_namespace, allowed_namespaces[i]) == 0) return 1;
+	return 0;
+}
+
 /* Print an nvshare client ID as a hex string */
 static void client_id_as_string(char *buf, size_t buflen, uint64_t id)
 {
@@ -98,13 +814,22 @@ static void client_id_as_string(char *buf, size_t buflen, uint64_t id)
 static void delete_client(struct nvshare_client *client)
 {
 	int cfd = client->fd;
+	int registered = has_registered(client);
+	int was_initializing = (client == initializing);
 	char id_str[HEX_STR_LEN(client->id)];
 	struct nvshare_client *tmp, *c;
 
 
 	client_id_as_string(id_str, sizeof(id_str), client->id);
 	log_info("Removing client %s", id_str);
+	if (registered) {
+		client_event(NVSHARE_EVENT_INFO, "deregister", client, NULL);
+		nvshare_lifecycle_hook("deregister", client->id,
+				       client->pod_namespace, client->pod_name,
+				       client->name);
+	}
 	remove_req(client);
+	if (registered) write_accounting_record(client);
 
 	/* Remove from clients list */
 	LL_FOREACH_SAFE(clients, c, tmp) {
@@ -118,134 +843,2804 @@ static void delete_client(struct nvshare_client *client)
 	/* See man close(2) for EINTR behavior on Linux */
 	if (close(cfd) < 0 && errno != EINTR)
 		log_fatal_errno("Failed to close FD %d", cfd);
-}
 
-static void insert_req(struct nvshare_client *client)
-{
-	struct nvshare_request *r;
-	LL_FOREACH(requests, r) {
-		if (r->client->fd == client->fd) {
-			log_warn("Client %016" PRIx64 " has already requested"
-				 " the lock", r->client->id);
-			return;
-		}
+	if (registered) bcast_client_count();
+	if (was_initializing) {
+		initializing = NULL;
+		admit_next_init();
 	}
-	true_or_exit(r = malloc(sizeof *r));
-	r->next = NULL;
-	r->client = client;
-	LL_APPEND(requests, r);
+	check_drain_complete();
+	if (registered) check_idle();
 }
 
-static void remove_req(struct nvshare_client *client)
+
+static int num_registered_clients(void)
 {
-	struct nvshare_request *tmp, *r;
-	if (requests != NULL) {
-		/*
-		 * This client was holding the GPU lock, as it was the head of
-		 * the requests list.
-		 */
-		if (requests->client->fd == client->fd) lock_held = 0;
-	}
-	LL_FOREACH_SAFE(requests, r, tmp) {
-		if (r->client->fd == client->fd) {
-			LL_DELETE(requests, r);
-			free(r);
-		}
-	}
-}
+	int n = 0;
+	struct nvshare_client *c;
 
+	LL_FOREACH(clients, c) if (has_registered(c)) n++;
+	return n;
+}
 
 
-static int register_client(struct nvshare_client *client, const struct message *in_msg)
+/*
+ * If we are draining and the last registered client is gone, mark the drain
+ * as complete and notify whoever is interested.
+ *
+ * We don't close the connections of the waiting nvsharectl instances here,
+ * as we may be called while iterating over the clients list. They close
+ * the connection on their end when they receive our message.
+ */
+static void check_drain_complete(void)
 {
-	int ret;
+	FILE *fp;
 	struct nvshare_client *c;
-	uint64_t nvshare_client_id;
+	struct message drain_msg = {0};
 
-	if (has_registered(client)) {
-		log_warn("Client %016" PRIx64 " is already registered",
-			 client->id);
-		return -1;
+	if (!draining || drain_complete) return;
+	if (num_registered_clients() > 0) return;
+
+	drain_complete = 1;
+	log_info("Drain complete, no registered clients remain");
+	nvshare_event(NVSHARE_EVENT_INFO, "drain_complete",
+		      NVSHARE_UNREGISTERED_ID, NULL, NULL, NULL);
+
+	if (drain_complete_file != NULL) {
+		fp = fopen(drain_complete_file, "w");
+		if (fp == NULL || fprintf(fp, "%lld\n", (long long)time(NULL)) < 0)
+			log_warn("Failed to write drain completion file %s",
+				 drain_complete_file);
+		if (fp != NULL) fclose(fp);
 	}
 
-again:
-	nvshare_client_id = nvshare_generate_id();
-	if (nvshare_client_id == NVSHARE_UNREGISTERED_ID) /* Tough luck */
-		goto again;
+	drain_msg.type = DRAIN;
+	begin_sends();
 	LL_FOREACH(clients, c) {
-		if (c->id == nvshare_client_id) { /* ID clash */
-			goto again;
-		}
+		if (c->drain_waiter && send_message(c, &drain_msg) == 0)
+			c->drain_waiter = 0;
 	}
+	end_sends();
+}
 
-	/*
-	 * Store the rest of the client information.
-	 */
-	client->id = nvshare_client_id;
-	strlcpy(client->pod_name, in_msg->pod_name,
-		sizeof(client->pod_name));
-	strlcpy(client->pod_namespace, in_msg->pod_namespace,
-		sizeof(client->pod_namespace));
 
-	/*
-	 * Inform the client of the current status of our current status, as
-	 * well as the ID we generated for it.
-	 *
-	 * It will henceforth present this ID to interact with us.
-	 */
-	true_or_exit(snprintf(out_msg.data, 16+1, "%016" PRIx64, nvshare_client_id) == 16);
-	out_msg.type = scheduler_on ? SCHED_ON : SCHED_OFF;
-	if ((ret = send_message(client, &out_msg)) < 0)
-		goto out_with_msg;
+/*
+ * Stop granting slices and ask the lock holder to finish up. The quiesce
+ * thread takes it from there.
+ *
+ * When the scheduler is OFF, every client thinks it has the lock, so turn it
+ * ON to take the lock away from them.
+ */
+static void start_quiesce(void)
+{
+	struct message drop_msg = {0};
 
-out_with_msg:
-	/* out_msg is global, so make sure we've zeroed it out */
-	memset(&out_msg.data, 0, sizeof(out_msg.data));
+	if (quiescing) return;
+	quiescing = 1;
+	quiesce_complete = 0;
+	log_info("Quiescing, granting no new slices");
+	nvshare_event(NVSHARE_EVENT_INFO, "quiesce", NVSHARE_UNREGISTERED_ID,
+		      NULL, NULL, NULL);
 
-	return ret;
+	set_scheduler_on(1);
+	if (lock_held && requests != NULL) {
+		drop_msg.type = DROP_LOCK;
+		client_event(NVSHARE_EVENT_DEBUG, "drop_lock",
+			     requests->client, "quiesce");
+		if (send_message(requests->client, &drop_msg) < 0)
+			delete_client(requests->client);
+	}
+	pthread_cond_broadcast(&quiesce_cv);
 }
 
 
-static void bcast_status(void)
+/* Mark the quiesce as complete and notify whoever is interested */
+static void set_quiesce_complete(void)
 {
-	struct nvshare_client *tmp, *c;
-	LL_FOREACH_SAFE(clients, c, tmp) {
-		if (!has_registered(c)) continue;
+	struct nvshare_client *c;
+	struct message quiesce_msg = {0};
 
-		out_msg.type = scheduler_on ? SCHED_ON : SCHED_OFF;
-		if (send_message(c, &out_msg) < 0)
-			delete_client(c);
+	quiesce_complete = 1;
+	log_info("Quiesce complete, the GPU is idle");
+	nvshare_event(NVSHARE_EVENT_INFO, "quiesce_complete",
+		      NVSHARE_UNREGISTERED_ID, NULL, NULL, NULL);
+
+	quiesce_msg.type = QUIESCE;
+	begin_sends();
+	LL_FOREACH(clients, c) {
+		if (c->quiesce_waiter && send_message(c, &quiesce_msg) == 0)
+			c->quiesce_waiter = 0;
 	}
+	end_sends();
+	pthread_cond_broadcast(&quiesce_cv);
 }
 
-
 /*
- * Send a given message to a given client.
- *
- * We are particularly strict and consider the client dead if we encounter any
- * (even possibly recoverable if we were more lenient) error.
+ * The GPU memory the client has committed. A client that reserves memory
+ * upfront counts with its reservation until it reports more.
  */
-static int send_message(struct nvshare_client *client, struct message *msg_p)
+static long long client_committed_mib(struct nvshare_client *c)
 {
-	ssize_t ret;
-	char id_str[HEX_STR_LEN(client->id)];
+	return (c->mem_reserved_mib > c->mem_committed_mib) ?
+	       c->mem_reserved_mib : c->mem_committed_mib;
+}
 
-	client_id_as_string(id_str, sizeof(id_str), client->id);
 
-	ret = nvshare_send_noblock(client->fd, msg_p, sizeof(*msg_p));
+/*
+ * Sum up the GPU memory that the clients have committed. Clients that have
+ * reported no memory usage yet don't count.
+ */
+static void committed_memory(long long *committed_mib, long long *total_mib)
+{
+	struct nvshare_client *c;
 
-	if (ret >= 0 && (size_t)ret < sizeof(*msg_p))/* Partial send */
-		return -1;
-	else if (ret < 0) {
-		if (errno == EAGAIN ||
-		    errno == EWOULDBLOCK ||
-		    errno == ECONNRESET ||
-		    errno == EPIPE) { /* Recoverable errors, but we're strict */
-			log_info("Failed to send message to client %s",
+	*committed_mib = 0;
+	*total_mib = 0;
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		*committed_mib += client_committed_mib(c);
+		if (c->mem_total_mib > *total_mib) *total_mib = c->mem_total_mib;
+	}
+}
+
+
+/*
+ * Warn if the clients have collectively committed too much GPU memory. Past
+ * the physical GPU memory, their memory spills over to host RAM, and they
+ * can end up thrashing it.
+ */
+static void check_oversubscription(void)
+{
+	long long committed_mib, total_mib;
+
+	if (oversub_warn_ratio <= 0) return;
+
+	committed_memory(&committed_mib, &total_mib);
+	if (total_mib == 0 || committed_mib <= oversub_warn_ratio * total_mib)
+		return;
+	if (oversub_warned &&
+	    elapsed_ms_since(&oversub_warn_ts) < oversub_warn_interval_s * 1000)
+		return;
+
+	oversub_warnings++;
+	oversub_warned = 1;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &oversub_warn_ts) == 0);
+	log_warn("Clients have committed %lld MiB of GPU memory, %.2fx the"
+		 " physical %lld MiB. Expect thrashing!", committed_mib,
+		 (double)committed_mib / total_mib, total_mib);
+	nvshare_event(NVSHARE_EVENT_INFO, "oversubscribed",
+		      NVSHARE_UNREGISTERED_ID, NULL, NULL,
+		      "committed=%lldMiB total=%lldMiB", committed_mib,
+		      total_mib);
+}
+
+
+static long long elapsed_ms_since(const struct timespec *ts)
+{
+	struct timespec now, elapsed;
+
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &now) == 0);
+	timespecsub(&now, ts, &elapsed);
+	return (long long)elapsed.tv_sec * 1000 + elapsed.tv_nsec / 1000000;
+}
+
+
+/*
+ * Return the burst credits of a client, including whatever it has accrued
+ * since it last became idle.
+ */
+static long long client_credits(struct nvshare_client *client)
+{
+	struct nvshare_request *r;
+	long long credits = client->credits_ms;
+	long long accrual_pct = client_burst_pct(client);
+
+	if (accrual_pct == 0) return 0;
+	if (!client->has_idled) return credits;
+	LL_FOREACH(requests, r)
+		if (r->client == client) return credits; /* Not idle */
+
+	credits += elapsed_ms_since(&client->idle_ts) * accrual_pct / 100;
+	return credits > burst_cap_ms ? burst_cap_ms : credits;
+}
+
+
+/*
+ * The workload type of a client, if it declared one we know, overrides the
+ * scheduler-wide TQ, burst credit accrual and preemption.
+ */
+static long long client_tq(struct nvshare_client *client)
+{
+	if (client->workload != NULL && client->workload->tq > 0)
+		return client->workload->tq;
+	return tq;
+}
+
+
+static int client_boosted(struct nvshare_client *client)
+{
+	return (client->boost_until.tv_sec != 0);
+}
+
+
+/* The seconds left of the boost of a client, rounded up */
+static long long boost_left_s(struct nvshare_client *client)
+{
+	struct timespec now;
+	long long left_s;
+
+	true_or_exit(clock_gettime(CLOCK_REALTIME, &now) == 0);
+	left_s = client->boost_until.tv_sec - now.tv_sec +
+		 (client->boost_until.tv_nsec > now.tv_nsec);
+	return left_s > 0 ? left_s : 0;
+}
+
+
+static int num_boosted(void)
+{
+	int n = 0;
+	struct nvshare_client *c;
+
+	LL_FOREACH(clients, c) if (has_registered(c) && client_boosted(c)) n++;
+	return n;
+}
+
+
+/* The millishares of a client, times boost_factor while it is boosted */
+static long long client_millishares(struct nvshare_client *client)
+{
+	if (client_boosted(client))
+		return client->millishares * boost_factor;
+	return client->millishares;
+}
+
+
+/*
+ * The slice of a client, i.e., how long it holds the GPU lock at a time,
+ * before burst credits: the TQ of its workload type (or the scheduler-wide
+ * TQ), scaled by its millishares, i.e., the devices it requested in
+ * millishares mode, and by its boost. Every client's weight comes from here
+ * alone.
+ */
+static long long client_slice_ms(struct nvshare_client *client)
+{
+	long long slice_ms = client_tq(client) * 1000 *
+			     client_millishares(client) / NVSHARE_FULL_SHARE;
+
+	if (client->repeat_overrunner &&
+	    overrun_action == OVERRUN_ACTION_SHORTEN)
+		slice_ms /= 2;
+	return slice_ms;
+}
+
+
+/* How long a client holds the GPU lock per turn, its slice or the dwell */
+static long long client_turn_ms(struct nvshare_client *client)
+{
+	long long slice_ms = client_slice_ms(client);
+
+	return slice_ms > min_dwell_ms ? slice_ms : min_dwell_ms;
+}
+
+
+/*
+ * The fraction of the GPU time a client gets while every registered client
+ * keeps asking for the GPU. The clients take turns, so each gets its turn
+ * out of the turns of all of them. Denied clients get no turns. Burst
+ * credits and warmups only shift GPU time around for a while, so they don't
+ * count.
+ */
+static double client_effective_share(struct nvshare_client *client)
+{
+	struct nvshare_client *c;
+	long long total_ms = 0;
+
+	if (client->denied) return 0;
+	LL_FOREACH(clients, c) {
+		if (has_registered(c) && !c->denied)
+			total_ms += client_turn_ms(c);
+	}
+	return total_ms > 0 ? (double)client_turn_ms(client) / total_ms : 0;
+}
+
+
+static long long client_burst_pct(struct nvshare_client *client)
+{
+	if (client->workload != NULL && client->workload->burst_pct >= 0)
+		return client->workload->burst_pct;
+	return burst_accrual_pct;
+}
+
+
+static int client_preemptible(struct nvshare_client *client)
+{
+	return (client->workload == NULL || client->workload->preempt != 0);
+}
+
+
+static long long client_min_free_mib(struct nvshare_client *client)
+{
+	if (client->workload != NULL && client->workload->min_free_mib >= 0)
+		return client->workload->min_free_mib;
+	return min_free_mib;
+}
+
+
+static int client_boost(struct nvshare_client *client)
+{
+	return (client->workload != NULL && client->workload->boost);
+}
+
+
+static struct gpu_account *get_gpu_account(const char *uuid)
+{
+	struct gpu_account *a;
+
+	if (uuid[0] == '\0' || strcmp(uuid, unknown_gpu.uuid) == 0)
+		return &unknown_gpu;
+	LL_FOREACH(gpu_accounts, a) {
+		if (strcmp(a->uuid, uuid) == 0) return a;
+	}
+	if (num_gpu_accounts >= GPU_ACCOUNTS_MAX) {
+		log_debug("Already tracking %d GPUs, counting GPU %s as"
+			  " unknown", num_gpu_accounts, uuid);
+		return &unknown_gpu;
+	}
+	true_or_exit(a = calloc(1, sizeof(*a)));
+	strlcpy(a->uuid, uuid, sizeof(a->uuid));
+	LL_APPEND(gpu_accounts, a);
+	num_gpu_accounts++;
+	return a;
+}
+
+
+static struct pod_account *get_pod_account(struct nvshare_client *client)
+{
+	struct pod_account *a;
+
+	LL_FOREACH(pod_accounts, a) {
+		if (strcmp(a->pod_name, client->pod_name) == 0 &&
+		    strcmp(a->pod_namespace, client->pod_namespace) == 0)
+			return a;
+	}
+	true_or_exit(a = calloc(1, sizeof(*a)));
+	strlcpy(a->pod_name, client->pod_name, sizeof(a->pod_name));
+	strlcpy(a->pod_namespace, client->pod_namespace,
+		sizeof(a->pod_namespace));
+	LL_APPEND(pod_accounts, a);
+	return a;
+}
+
+
+/*
+ * Whether the client gets a warmup with its first slice. Its Pod mustn't have
+ * had one within warmup_cooldown_s, e.g., through a previous instance of the
+ * client that reconnected.
+ */
+static int grant_warmup(struct nvshare_client *client)
+{
+	struct pod_account *a;
+	long long since_ms;
+
+	if (warmup_ms == 0) return 0;
+	a = get_pod_account(client);
+	if (a->warmed_up) {
+		since_ms = elapsed_ms_since(&a->warmup_ts);
+		if (since_ms < warmup_cooldown_s * 1000) {
+			log_info("Client %016" PRIx64 " gets no warmup, Pod"
+				 " %s/%s had one %lld s ago", client->id,
+				 client->pod_namespace, client->pod_name,
+				 since_ms / 1000);
+			return 0;
+		}
+	}
+	a->warmed_up = 1;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &a->warmup_ts) == 0);
+	warmups++;
+	log_info("Client %016" PRIx64 " holds the GPU lock for at least %lld ms"
+		 " to warm up", client->id, warmup_ms);
+	client_event(NVSHARE_EVENT_INFO, "warmup", client, "duration=%lldms",
+		     warmup_ms);
+	return 1;
+}
+
+
+/* The reclaim policy and the clients we have evicted lately */
+static void write_reclaim_status(FILE *fp)
+{
+	struct reclaim_record *rec;
+
+	fprintf(fp, "Memory reclaim: %s (%llu evictions)\n",
+		reclaim_policies[reclaim_policy], reclaims);
+	for (unsigned long long i = 0; i < reclaims && i < RECLAIM_HISTORY;
+	     i++) {
+		rec = &reclaim_history[(reclaims - 1 - i) % RECLAIM_HISTORY];
+		fprintf(fp, "  %016" PRIx64 " of Pod %s/%s, %lld MiB, for"
+			" %016" PRIx64 ", %lld s ago\n", rec->id,
+			rec->pod_namespace, rec->pod_name,
+			rec->mem_committed_mib, rec->oom_id,
+			elapsed_ms_since(&rec->ts) / 1000);
+	}
+}
+
+
+/* Whether we turn new clients away, as a client ran out of memory lately */
+static int oom_admission_paused(void)
+{
+	return (oom_admission_pause_s > 0 && ooms > 0 &&
+		elapsed_ms_since(&last_oom_ts) < oom_admission_pause_s * 1000);
+}
+
+
+/* The most processes we let the GPU run, -1 if we don't limit them */
+static int process_limit(void)
+{
+	if (gpu_process_limit == GPU_PROCESS_LIMIT_AUTO) return gpu_mode_limit;
+	if (gpu_process_limit > 0) return (int)gpu_process_limit;
+	return -1;
+}
+
+
+/* The processes on the GPU, or our registered clients if there are more */
+static int gpu_process_count(void)
+{
+	int n = num_registered_clients();
+
+	return gpu_processes > n ? gpu_processes : n;
+}
+
+
+/*
+ * Whether we turn a client away, as the GPU runs all the processes it can.
+ * If the process of the client already runs on the GPU, on_gpu is set, and
+ * it doesn't count twice.
+ */
+static int gpu_at_process_limit(int on_gpu)
+{
+	int limit = process_limit();
+
+	/* Until NVML tells us, we know too little to turn anyone away */
+	if (limit < 0 || gpu_processes < 0) return 0;
+	return (max(gpu_processes - !!on_gpu, num_registered_clients()) >=
+		limit);
+}
+
+
+/* The GPU process limit, and how close to it the GPU is */
+static void write_process_limit_status(FILE *fp)
+{
+	int limit = process_limit();
+
+	fprintf(fp, "GPU process limit: ");
+	if (gpu_process_limit == GPU_PROCESS_LIMIT_OFF) {
+		fprintf(fp, "off\n");
+		return;
+	}
+	if (limit >= 0) fprintf(fp, "%d", limit);
+	else fprintf(fp, "none");
+	if (gpu_process_limit == GPU_PROCESS_LIMIT_AUTO)
+		fprintf(fp, " (from the compute mode)");
+	if (gpu_processes >= 0)
+		fprintf(fp, ", processes = %d", gpu_process_count());
+	else fprintf(fp, ", processes = unknown");
+	fprintf(fp, " (%llu clients turned away)\n", process_limit_rejections);
+}
+
+
+/* Charge the client that holds the lock for its current slice */
+static void account_slice(struct nvshare_client *client)
+{
+	long long held_ms = elapsed_ms_since(&client->slice_ts);
+
+	client->gpu_ms += held_ms;
+	get_pod_account(client)->gpu_ms += held_ms;
+	get_gpu_account(client->gpu_uuid)->gpu_ms += held_ms;
+}
+
+
+/*
+ * Append a JSON line with the GPU time of a client that is going away to the
+ * accounting file, for consumption by external accounting systems.
+ */
+static void write_accounting_record(struct nvshare_client *client)
+{
+	if (accounting_fp == NULL) return;
+
+	fprintf(accounting_fp, "{\"time\":%lld,\"client_id\":\"%016" PRIx64
+		"\",\"name\":", (long long)time(NULL), client->id);
+	nvshare_json_write_string(accounting_fp, client->name);
+	fprintf(accounting_fp, ",\"namespace\":");
+	nvshare_json_write_string(accounting_fp, client->pod_namespace);
+	fprintf(accounting_fp, ",\"pod\":");
+	nvshare_json_write_string(accounting_fp, client->pod_name);
+	fprintf(accounting_fp, ",\"gpu_seconds\":%.3f}\n",
+		client->gpu_ms / 1000.0);
+	if (fflush(accounting_fp) != 0)
+		log_warn("Failed to write to the accounting file");
+}
+
+
+/* Write a Prometheus label value, escaping whatever needs it */
+static void prom_write_label_value(FILE *fp, const char *s)
+{
+	for (; *s != '\0'; s++) {
+		if (*s == '"' || *s == '\\') fprintf(fp, "\\%c", *s);
+		else if (*s == '\n') fprintf(fp, "\\n");
+		else fputc(*s, fp);
+	}
+}
+
+
+/*
+ * The order in which waiting clients get the lock: exclusive clients first,
+ * then bursting clients, then everyone else, then deprioritized repeat
+ * overrunners, each in FCFS order.
+ */
+static int request_rank(struct nvshare_request *r)
+{
+	if (!client_preemptible(r->client)) return 0;
+	if (r->client->repeat_overrunner &&
+	    overrun_action == OVERRUN_ACTION_DEPRIORITIZE)
+		return 3;
+	return r->burst ? 1 : 2;
+}
+
+
+static void parse_overrun_action(const char *s)
+{
+	size_t i;
+
+	for (i = 0; i < sizeof(overrun_actions) / sizeof(overrun_actions[0]);
+	     i++) {
+		if (strcmp(s, overrun_actions[i].name) == 0) {
+			overrun_action = i;
+			return;
+		}
+	}
+	log_fatal("Invalid value for %s: %s", ENV_NVSHARE_OVERRUN_ACTION, s);
+}
+
+
+static void parse_reclaim_policy(const char *s)
+{
+	size_t i;
+
+	for (i = 0; i < sizeof(reclaim_policies) / sizeof(reclaim_policies[0]);
+	     i++) {
+		if (strcmp(s, reclaim_policies[i]) == 0) {
+			reclaim_policy = i;
+			return;
+		}
+	}
+	log_fatal("Invalid value for %s: %s", ENV_NVSHARE_RECLAIM_POLICY, s);
+}
+
+
+/*
+ * A scheduling policy decides which of the waiting clients of the same rank,
+ * see request_rank(), gets the lock first. Its hooks may be NULL:
+ *
+ * before:      Whether a new request of client a goes before the waiting
+ *              request of client b. Without it, the clients go FCFS.
+ * on_register: The client has registered.
+ * on_request:  The client is about to request the lock.
+ * on_yield:    The client is about to release the lock, or go away while
+ *              holding it.
+ */
+struct sched_policy {
+	const char *name;
+	int (*before)(struct nvshare_client *a, struct nvshare_client *b);
+	void (*on_register)(struct nvshare_client *client);
+	void (*on_request)(struct nvshare_client *client);
+	void (*on_yield)(struct nvshare_client *client);
+};
+
+
+/*
+ * Fair-share: The client that has had the least GPU time for its share goes
+ * first. A new client starts off even with the client that has had the
+ * least, so that it doesn't get the GPU to itself until it catches up with
+ * the clients that have been around for long.
+ */
+static int fair_share_before(struct nvshare_client *a,
+			     struct nvshare_client *b)
+{
+	return a->fair_ms < b->fair_ms;
+}
+
+
+static void fair_share_on_register(struct nvshare_client *client)
+{
+	struct nvshare_client *c;
+	int first = 1;
+
+	LL_FOREACH(clients, c) {
+		if (c == client || !has_registered(c)) continue;
+		if (first || c->fair_ms < client->fair_ms)
+			client->fair_ms = c->fair_ms;
+		first = 0;
+	}
+}
+
+
+/*
+ * While a client was idle, the clients that kept using the GPU have caught
+ * up with it. Bring it up to the one of them that has had the least, so that
+ * it doesn't get the GPU to itself to make up for the GPU time it didn't
+ * need. If it has been idle for fair_share_idle_reset_s, it may also have
+ * had more than them, from long ago, so it starts afresh first.
+ */
+static void fair_share_on_request(struct nvshare_client *client)
+{
+	struct nvshare_request *r;
+	int first = 1;
+	long long least = 0;
+
+	if (fair_share_idle_reset_s > 0 && client->has_idled &&
+	    elapsed_ms_since(&client->idle_ts) >=
+	    fair_share_idle_reset_s * 1000) {
+		log_debug("Client %016" PRIx64 " has been idle for %lld s or"
+			  " longer, forgetting its %lld ms of GPU time",
+			  client->id, fair_share_idle_reset_s, client->fair_ms);
+		client->fair_ms = 0;
+		fair_share_on_register(client);
+	}
+
+	LL_FOREACH(requests, r) {
+		if (r->client == client) continue;
+		if (first || r->client->fair_ms < least)
+			least = r->client->fair_ms;
+		first = 0;
+	}
+	if (!first && client->fair_ms < least) client->fair_ms = least;
+}
+
+
+static void fair_share_on_yield(struct nvshare_client *client)
+{
+	client->fair_ms += elapsed_ms_since(&client->slice_ts) *
+			   NVSHARE_FULL_SHARE / client_millishares(client);
+}
+
+
+static const struct sched_policy sched_policies[] = {
+	{ "round-robin", NULL, NULL, NULL, NULL },
+	{ "fair-share", fair_share_before, fair_share_on_register,
+	  fair_share_on_request, fair_share_on_yield },
+};
+
+static const struct sched_policy *sched_policy = &sched_policies[0];
+
+
+static void parse_sched_policy(const char *s)
+{
+	size_t i;
+
+	for (i = 0; i < sizeof(sched_policies) / sizeof(sched_policies[0]);
+	     i++) {
+		if (strcmp(s, sched_policies[i].name) == 0) {
+			sched_policy = &sched_policies[i];
+			return;
+		}
+	}
+	log_fatal("Invalid value for %s: %s", ENV_NVSHARE_SCHEDULING_POLICY,
+		  s);
+}
+
+
+static int recent_overruns(struct nvshare_client *client)
+{
+	return __builtin_popcount(client->overrun_history);
+}
+
+
+/*
+ * The slice of the client has ended: Add it to the overrun history of the
+ * client, then take overrun_action against the client or lift it.
+ */
+static void record_slice(struct nvshare_client *client)
+{
+	char id_str[HEX_STR_LEN(client->id)];
+	int recent;
+
+	if (overrun_threshold_ms == 0) return;
+	client->overrun_history = ((client->overrun_history << 1) |
+				   (client->slice_overran ? 1 : 0)) &
+				  ((1U << OVERRUN_HISTORY) - 1);
+	client->slice_overran = 0;
+	if (client->history_slices < OVERRUN_HISTORY)
+		client->history_slices++;
+	if (overrun_action == OVERRUN_ACTION_NONE) return;
+
+	client_id_as_string(id_str, sizeof(id_str), client->id);
+	recent = recent_overruns(client);
+	if (!client->repeat_overrunner && recent >= overrun_repeat) {
+		client->repeat_overrunner = 1;
+		log_warn("Client %s (%s) has overrun %d of its last %u slices"
+			 " and is now %s", id_str, client->name, recent,
+			 client->history_slices,
+			 overrun_actions[overrun_action].applied);
+		client_event(NVSHARE_EVENT_INFO, "overrun_repeat", client,
+			     "overruns=%d slices=%u action=%s", recent,
+			     client->history_slices,
+			     overrun_actions[overrun_action].name);
+	} else if (client->repeat_overrunner && recent < overrun_repeat) {
+		client->repeat_overrunner = 0;
+		log_info("Client %s (%s) has overrun %d of its last %u slices"
+			 " and is no longer %s", id_str, client->name, recent,
+			 client->history_slices,
+			 overrun_actions[overrun_action].applied);
+		client_event(NVSHARE_EVENT_INFO, "overrun_repeat_end", client,
+			     "overruns=%d slices=%u", recent,
+			     client->history_slices);
+	}
+}
+
+
+/*
+ * The first waiting client that isn't exclusive, if it has waited for
+ * exclusive_timeout_ms, NULL otherwise. Only exclusive clients can wait
+ * ahead of it.
+ */
+static struct nvshare_request *overdue_request(void)
+{
+	struct nvshare_request *r;
+
+	if (exclusive_timeout_ms == 0 || requests == NULL) return NULL;
+	for (r = lock_held ? requests->next : requests; r != NULL; r = r->next)
+		if (client_preemptible(r->client))
+			return elapsed_ms_since(&r->since) >=
+			       exclusive_timeout_ms ? r : NULL;
+	return NULL;
+}
+
+
+static void insert_req(struct nvshare_client *client)
+{
+	struct nvshare_request *r, *tmp, *prev = NULL;
+	LL_FOREACH(requests, r) {
+		if (r->client->fd == client->fd) {
+			log_warn("Client %016" PRIx64 " has already requested"
+				 " the lock", r->client->id);
+			return;
+		}
+	}
+	/* Bank the credits accrued while idle */
+	client->credits_ms = client_credits(client);
+	if (sched_policy->on_request != NULL)
+		sched_policy->on_request(client);
+
+	true_or_exit(r = malloc(sizeof *r));
+	r->next = NULL;
+	r->client = client;
+	r->burst = (client->credits_ms > 0);
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &r->since) == 0);
+	/*
+	 * Go after the lock holder and any clients of a higher rank, as well
+	 * as the clients of the same rank the scheduling policy puts first,
+	 * but before everyone else.
+	 */
+	LL_FOREACH(requests, tmp) {
+		if (!(tmp == requests && lock_held) &&
+		    (request_rank(tmp) > request_rank(r) ||
+		     (request_rank(tmp) == request_rank(r) &&
+		      sched_policy->before != NULL &&
+		      sched_policy->before(client, tmp->client))))
+			break;
+		prev = tmp;
+	}
+	if (prev == NULL) LL_PREPEND(requests, r); /* Nobody to go after */
+	else LL_APPEND_ELEM(requests, prev, r);
+	if (r->burst)
+		log_debug("Client %016" PRIx64 " bursts with %lld ms of"
+			  " credits", client->id, client->credits_ms);
+
+	client->lock_cycle++;
+	client->trace_sampled = nvshare_trace_sample();
+	if (client->trace_sampled)
+		true_or_exit(clock_gettime(CLOCK_REALTIME, &client->req_ts) == 0);
+}
+
+static void remove_req(struct nvshare_client *client)
+{
+	struct nvshare_request *tmp, *r;
+	struct timespec now;
+	if (requests != NULL) {
+		/*
+		 * This client was holding the GPU lock, as it was the head of
+		 * the requests list.
+		 */
+		if (requests->client->fd == client->fd) {
+			if (lock_held) {
+				account_slice(client);
+				record_slice(client);
+				if (sched_policy->on_yield != NULL)
+					sched_policy->on_yield(client);
+			}
+			if (lock_held && requests->burst) {
+				client->credits_ms -=
+					elapsed_ms_since(&client->slice_ts);
+				if (client->credits_ms < 0)
+					client->credits_ms = 0;
+			}
+			if (lock_held && client->trace_sampled) {
+				true_or_exit(clock_gettime(CLOCK_REALTIME, &now) == 0);
+				nvshare_trace_span("nvshare.lock.hold", client->id,
+					client->lock_cycle, client->pod_name,
+					client->pod_namespace, &client->grant_ts,
+					&now);
+			}
+			lock_held = 0;
+		}
+	}
+	LL_FOREACH_SAFE(requests, r, tmp) {
+		if (r->client->fd == client->fd) {
+			LL_DELETE(requests, r);
+			free(r);
+		}
+	}
+	/* A new request needs a new check of the free memory */
+	if (client == mem_waiting) mem_waiting = NULL;
+	client->mem_admitted = 0;
+	update_power();
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &client->idle_ts) == 0);
+	client->has_idled = 1;
+}
+
+
+/* Record the time it took for a client to get its first slice of the GPU */
+static void record_ttfs(struct nvshare_client *client)
+{
+	struct timespec now, elapsed;
+
+	if (client->ttfs_ms >= 0) return; /* Not the first slice */
+
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &now) == 0);
+	timespecsub(&now, &client->register_ts, &elapsed);
+	client->ttfs_ms = (long long)elapsed.tv_sec * 1000 +
+			  elapsed.tv_nsec / 1000000;
+
+	ttfs_count++;
+	ttfs_sum_ms += client->ttfs_ms;
+	ttfs_samples[ttfs_samples_next] = client->ttfs_ms;
+	ttfs_samples_next = (ttfs_samples_next + 1) % TTFS_SAMPLES_MAX;
+	if (ttfs_samples_cnt < TTFS_SAMPLES_MAX) ttfs_samples_cnt++;
+
+	log_debug("Client %016" PRIx64 " got its first slice after %lld ms",
+		  client->id, client->ttfs_ms);
+	if (ttfs_slo_ms > 0 && client->ttfs_ms > ttfs_slo_ms) {
+		ttfs_slo_violations++;
+		log_warn("Client %016" PRIx64 " (Pod %s/%s) got its first slice"
+			 " after %lld ms, exceeding the SLO of %lld ms",
+			 client->id, client->pod_namespace, client->pod_name,
+			 client->ttfs_ms, ttfs_slo_ms);
+	}
+}
+
+
+static int cmp_ll(const void *a, const void *b)
+{
+	long long x = *(const long long *)a, y = *(const long long *)b;
+	return (x > y) - (x < y);
+}
+
+
+/*
+ * Return the p-th percentile (0 < p <= 1) of the recent TTFS samples, or -1
+ * if we have no samples yet.
+ */
+static long long ttfs_percentile(double p)
+{
+	long long sorted[TTFS_SAMPLES_MAX];
+	unsigned int idx;
+
+	if (ttfs_samples_cnt == 0) return -1;
+
+	memcpy(sorted, ttfs_samples, ttfs_samples_cnt * sizeof(sorted[0]));
+	qsort(sorted, ttfs_samples_cnt, sizeof(sorted[0]), cmp_ll);
+	idx = (unsigned int)(p * ttfs_samples_cnt + 0.999999);
+	if (idx > 0) idx--;
+	return sorted[idx];
+}
+
+
+/*
+ * Who holds and who waits for the GPU in exclusive mode, and for how long
+ * the others have waited behind them. Hold the global mutex.
+ */
+static void write_exclusive_status(FILE *fp)
+{
+	struct nvshare_request *r, *first_other = NULL;
+	int waiting = 0, holding;
+
+	fprintf(fp, "Exclusive clients: ");
+	if (exclusive_timeout_ms > 0)
+		fprintf(fp, "timeout = %lld ms", exclusive_timeout_ms);
+	else fprintf(fp, "timeout = none");
+	r = (lock_held && requests != NULL) ? requests->next : requests;
+	for (; r != NULL; r = r->next) {
+		if (!client_preemptible(r->client)) waiting++;
+		else if (first_other == NULL) first_other = r;
+	}
+	holding = (lock_held && requests != NULL &&
+		   !client_preemptible(requests->client));
+	if (holding) fprintf(fp, ", holding the lock");
+	fprintf(fp, ", %d waiting", waiting);
+	if (first_other != NULL && (holding || waiting > 0))
+		fprintf(fp, ", others waiting for %lld ms",
+			elapsed_ms_since(&first_other->since));
+	fprintf(fp, " (%llu timeouts)\n", exclusive_timeouts);
+}
+
+
+/* Whether the GPU is throttling and why. Hold the global mutex. */
+static void write_throttle_status(FILE *fp)
+{
+	char causes[64];
+
+	fprintf(fp, "GPU throttling: ");
+	if (throttle_poll_ms == 0) {
+		fprintf(fp, "not monitored\n");
+		return;
+	}
+	if (throttle_failed) {
+		fprintf(fp, "unknown, NVML can't tell\n");
+		return;
+	}
+	if (!throttle_known) {
+		fprintf(fp, "unknown yet\n");
+		return;
+	}
+	if (throttling) {
+		throttle_causes_string(causes, sizeof(causes),
+				       throttle.causes);
+		fprintf(fp, "yes (%s) for %lld s", causes,
+			elapsed_ms_since(&throttle_ts) / 1000);
+	} else fprintf(fp, "no");
+	if (throttle.max_clock_mhz > 0)
+		fprintf(fp, ", clock = %u/%u MHz", throttle.clock_mhz,
+			throttle.max_clock_mhz);
+	if (throttle.temperature > 0)
+		fprintf(fp, ", temperature = %u C", throttle.temperature);
+	fprintf(fp, " (%llu episodes, %.1f s in total)\n", throttle_episodes,
+		throttled_total_ms() / 1000.0);
+}
+
+
+/* Human-readable snapshot of the scheduler state, for `nvsharectl -s` */
+static void write_status(FILE *fp)
+{
+	int num_clients = num_registered_clients();
+	long long committed_mib, total_mib;
+	const struct workload_policy *w;
+	struct nvshare_logfile_info logfile;
+	char id_str[HEX_STR_LEN(requests->client->id)];
+
+	fprintf(fp, "Scheduler: %s\n", scheduler_on ? "ON" : "OFF");
+	fprintf(fp, "Version: %s\n", NVSHARE_VERSION);
+	fprintf(fp, "Protocol versions: %d to %d\n",
+		NVSHARE_PROTOCOL_VERSION_MIN, NVSHARE_PROTOCOL_VERSION);
+	fprintf(fp, "TQ: %d seconds\n", tq);
+	fprintf(fp, "Scheduling policy: %s\n", sched_policy->name);
+	if (lock_held && requests != NULL) {
+		client_id_as_string(id_str, sizeof(id_str), requests->client->id);
+		fprintf(fp, "Lock holder: %s (%s)\n", id_str,
+			requests->client->name);
+	} else fprintf(fp, "Lock holder: none\n");
+	fprintf(fp, "Registered clients: %d\n", num_clients);
+	if (max_clients > 0) fprintf(fp, "Max clients: %d\n", max_clients);
+	else fprintf(fp, "Max clients: unlimited\n");
+	write_process_limit_status(fp);
+	if (active_policy >= 0)
+		fprintf(fp, "Policy window: %s (%02d:%02d-%02d:%02d)\n",
+			tod_policies[active_policy].name,
+			tod_policies[active_policy].start_min / 60,
+			tod_policies[active_policy].start_min % 60,
+			tod_policies[active_policy].end_min / 60,
+			tod_policies[active_policy].end_min % 60);
+	else if (tod_policies_cnt > 0)
+		fprintf(fp, "Policy window: none (defaults)\n");
+	if (!draining) fprintf(fp, "Drain: off\n");
+	else if (drain_complete) fprintf(fp, "Drain: complete\n");
+	else fprintf(fp, "Drain: in progress (%d clients remaining)\n",
+		     num_clients);
+	if (oversub_warn_ratio > 0) {
+		committed_memory(&committed_mib, &total_mib);
+		fprintf(fp, "Oversubscription warnings: ratio = %.2f, committed"
+			" = %lld MiB of %lld MiB (%llu warnings)\n",
+			oversub_warn_ratio, committed_mib, total_mib,
+			oversub_warnings);
+	} else fprintf(fp, "Oversubscription warnings: off\n");
+	fprintf(fp, "Out-of-memory errors: %llu", ooms);
+	if (oom_admission_pause_s > 0 && oom_admission_paused())
+		fprintf(fp, ", admitting no new clients for %lld s",
+			oom_admission_pause_s -
+			elapsed_ms_since(&last_oom_ts) / 1000);
+	fprintf(fp, "\n");
+	write_reclaim_status(fp);
+	fprintf(fp, "Boosts: x%lld, %d active (%llu granted)\n", boost_factor,
+		num_boosted(), boosts);
+	fprintf(fp, "Socket timeouts: send %lld ms, receive ",
+		client_send_timeout_ms);
+	if (client_recv_timeout_ms > 0)
+		fprintf(fp, "%lld ms", client_recv_timeout_ms);
+	else fprintf(fp, "off");
+	fprintf(fp, ", %llu timed out\n", socket_timeouts);
+	fprintf(fp, "Malformed messages: %llu\n", invalid_messages);
+	write_exclusive_status(fp);
+	if (!quiescing) fprintf(fp, "Quiesce: off\n");
+	else if (quiesce_complete) fprintf(fp, "Quiesce: complete\n");
+	else fprintf(fp, "Quiesce: in progress\n");
+
+	if (ttfs_samples_cnt > 0)
+		fprintf(fp, "Time to first slice: p50 = %lld ms, p90 = %lld ms,"
+			" p99 = %lld ms (last %u clients)\n",
+			ttfs_percentile(0.5), ttfs_percentile(0.9),
+			ttfs_percentile(0.99), ttfs_samples_cnt);
+	else fprintf(fp, "Time to first slice: no samples\n");
+	if (ttfs_slo_ms > 0)
+		fprintf(fp, "Time to first slice SLO: %lld ms (%llu"
+			" violations)\n", ttfs_slo_ms, ttfs_slo_violations);
+	else fprintf(fp, "Time to first slice SLO: none\n");
+	if (burst_accrual_pct > 0)
+		fprintf(fp, "Burst credits: accrual = %lld%%, cap = %lld"
+			" ms\n", burst_accrual_pct, burst_cap_ms);
+	else fprintf(fp, "Burst credits: off\n");
+	if (min_dwell_ms > 0)
+		fprintf(fp, "Minimum dwell: %lld ms\n", min_dwell_ms);
+	else fprintf(fp, "Minimum dwell: none\n");
+	if (warmup_ms > 0)
+		fprintf(fp, "Warmup: %lld ms, once every %lld s per Pod (%llu"
+			" granted)\n", warmup_ms, warmup_cooldown_s, warmups);
+	else fprintf(fp, "Warmup: none\n");
+	fprintf(fp, "Lock switches: %llu\n", lock_switches);
+	if (backpressure_clients > 0 || backpressure_switch_rate > 0) {
+		fprintf(fp, "Backpressure: %s, at", backpressure ? "on" :
+			"off");
+		if (backpressure_clients > 0)
+			fprintf(fp, " %lld clients", backpressure_clients);
+		if (backpressure_clients > 0 && backpressure_switch_rate > 0)
+			fprintf(fp, " or");
+		if (backpressure_switch_rate > 0)
+			fprintf(fp, " %.1f lock switches/s",
+				backpressure_switch_rate);
+		fprintf(fp, ", pause = %lld ms (%.1f lock switches/s, %llu"
+			" times)\n", backpressure_pause_ms, switch_rate,
+			backpressure_activations);
+	} else fprintf(fp, "Backpressure: none\n");
+	if (overrun_threshold_ms > 0) {
+		fprintf(fp, "Overrun threshold: %lld ms (%llu overruns%s)\n",
+			overrun_threshold_ms, overruns, overrun_deny ?
+			", overrunning clients are denied the lock" : "");
+		if (overrun_action != OVERRUN_ACTION_NONE)
+			fprintf(fp, "Repeat overrunners: %lld of the last %d"
+				" slices, %s\n", overrun_repeat,
+				OVERRUN_HISTORY,
+				overrun_actions[overrun_action].applied);
+	} else fprintf(fp, "Overrun threshold: none\n");
+	if (serialize_init_ms > 0) {
+		fprintf(fp, "Serialized initialization: up to %lld ms per"
+			" client, %d waiting", serialize_init_ms,
+			num_waiting_init());
+		if (initializing != NULL)
+			fprintf(fp, ", %016" PRIx64 " initializing",
+				initializing->id);
+		fprintf(fp, "\n");
+	} else fprintf(fp, "Serialized initialization: off\n");
+	if (idle_command == NULL && idle_file == NULL)
+		fprintf(fp, "Idle notifications: off\n");
+	else fprintf(fp, "Idle notifications: GPU %s, debounce = %lld ms\n",
+		     idle_state < 0 ? "unknown" : idle_state ? "idle" : "active",
+		     idle_debounce_ms);
+	if (min_free_mib > 0)
+		fprintf(fp, "Minimum free memory: %lld MiB", min_free_mib);
+	else fprintf(fp, "Minimum free memory: none by default");
+	fprintf(fp, ", wait up to %lld ms (%llu waits)", min_free_wait_ms,
+		mem_waits);
+	if (mem_waiting != NULL)
+		fprintf(fp, ", %016" PRIx64 " waiting", mem_waiting->id);
+	fprintf(fp, "\n");
+	if (!power_mgmt)
+		fprintf(fp, "Power management: off\n");
+	else if (power_failed)
+		fprintf(fp, "Power management: unavailable, cannot lock the GPU"
+			" clocks\n");
+	else fprintf(fp, "Power management: on, GPU clocks %s (%llu boosts)\n",
+		     power_state < 0 ? "unknown" : power_state ? "boosted" :
+		     "relaxed", power_boosts);
+	write_throttle_status(fp);
+	if (nvshare_logfile_info(&logfile) == 0) {
+		fprintf(fp, "Log file: %s, %lld of %lld bytes, %lld files",
+			logfile.path, logfile.bytes, logfile.max_bytes,
+			logfile.files);
+		if (logfile.max_age_s > 0)
+			fprintf(fp, ", rotated every %lld s",
+				logfile.max_age_s);
+		fprintf(fp, "\n");
+	} else fprintf(fp, "Log file: none\n");
+	fprintf(fp, "Workload types:");
+	for (int i = 0; i < workload_policies_cnt; i++) {
+		w = &workload_policies[i];
+		fprintf(fp, "%s %s (", i > 0 ? "," : "", w->name);
+		if (w->tq > 0) fprintf(fp, "tq = %d s", w->tq);
+		else fprintf(fp, "tq = default");
+		if (w->burst_pct >= 0)
+			fprintf(fp, ", burst = %d%%", w->burst_pct);
+		if (w->preempt == 0) fprintf(fp, ", no preemption");
+		if (w->min_free_mib >= 0)
+			fprintf(fp, ", min free = %d MiB", w->min_free_mib);
+		if (w->boost) fprintf(fp, ", boost");
+		if (!w->reclaim) fprintf(fp, ", no reclaim");
+		fprintf(fp, ")");
+	}
+	fprintf(fp, "\n");
+
+	write_clients(fp);
+}
+
+
+/* The GPU time of a client so far, including its current slice */
+static long long client_gpu_ms(struct nvshare_client *c)
+{
+	if (lock_held && requests != NULL && requests->client == c)
+		return c->gpu_ms + elapsed_ms_since(&c->slice_ts);
+	return c->gpu_ms;
+}
+
+
+/* The registered clients, one per line. Hold the global mutex. */
+static void write_clients(FILE *fp)
+{
+	struct nvshare_client *c;
+	char id_str[HEX_STR_LEN(c->id)];
+
+	fprintf(fp, "Clients:\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		client_id_as_string(id_str, sizeof(id_str), c->id);
+		fprintf(fp, "  %s (%s)  Pod %s/%s  PID = %d  protocol = v%d",
+			id_str, c->name, c->pod_namespace, c->pod_name,
+			(int)c->peer_pid, c->proto_version);
+		if (c->pod_uid[0] != '\0')
+			fprintf(fp, "  container = %s", c->container);
+		if (c->ttfs_ms >= 0)
+			fprintf(fp, "  time to first slice = %lld ms",
+				c->ttfs_ms);
+		else fprintf(fp, "  time to first slice = pending");
+		fprintf(fp, "  GPU time = %.1f s", client_gpu_ms(c) / 1000.0);
+		fprintf(fp, "  memory = %lld MiB", c->mem_committed_mib);
+		if (c->mem_reserved_mib > 0)
+			fprintf(fp, "  reserved = %lld MiB",
+				c->mem_reserved_mib);
+		if (c->overruns > 0) {
+			fprintf(fp, "  overruns = %u, %d of last %u slices",
+				c->overruns, recent_overruns(c),
+				c->history_slices);
+			if (c->denied) fprintf(fp, " (denied)");
+			if (c->repeat_overrunner)
+				fprintf(fp, " (%s)",
+					overrun_actions[overrun_action].applied);
+		}
+		if (c->millishares != NVSHARE_FULL_SHARE)
+			fprintf(fp, "  share = %lld/%d", c->millishares,
+				NVSHARE_FULL_SHARE);
+		if (c->workload != NULL)
+			fprintf(fp, "  workload = %s", c->workload->name);
+		if (client_boosted(c))
+			fprintf(fp, "  boosted x%lld for %lld more s",
+				boost_factor, boost_left_s(c));
+		fprintf(fp, "  slice = %lld ms  effective share = %.1f%%",
+			client_turn_ms(c), client_effective_share(c) * 100);
+		if (c->overflow) fprintf(fp, "  overflow");
+		if (c->contexts > 0)
+			fprintf(fp, "  contexts = %lld", c->contexts);
+		if (c->ooms > 0) fprintf(fp, "  ooms = %lld", c->ooms);
+		if (client_burst_pct(c) > 0)
+			fprintf(fp, "  burst credits = %lld ms",
+				client_credits(c));
+		fprintf(fp, "\n");
+	}
+}
+
+
+static void write_client_json(FILE *fp, struct nvshare_client *c)
+{
+	fprintf(fp, "{\"id\": \"%016" PRIx64 "\", \"name\": ", c->id);
+	nvshare_json_write_string(fp, c->name);
+	fprintf(fp, ", \"namespace\": ");
+	nvshare_json_write_string(fp, c->pod_namespace);
+	fprintf(fp, ", \"pod\": ");
+	nvshare_json_write_string(fp, c->pod_name);
+	fprintf(fp, ", \"pod_uid\": ");
+	if (c->pod_uid[0] != '\0') {
+		nvshare_json_write_string(fp, c->pod_uid);
+		fprintf(fp, ", \"container\": ");
+		nvshare_json_write_string(fp, c->container);
+	} else fprintf(fp, "null, \"container\": null");
+	fprintf(fp, ", \"pid\": %d, \"protocol_version\": %d",
+		(int)c->peer_pid, c->proto_version);
+	if (c->ttfs_ms >= 0)
+		fprintf(fp, ", \"time_to_first_slice_ms\": %lld", c->ttfs_ms);
+	else fprintf(fp, ", \"time_to_first_slice_ms\": null");
+	fprintf(fp, ", \"gpu_seconds\": %.1f, \"memory_mib\": %lld,"
+		" \"reserved_mib\": %lld", client_gpu_ms(c) / 1000.0,
+		c->mem_committed_mib, c->mem_reserved_mib);
+	fprintf(fp, ", \"millishares\": %lld, \"workload\": ",
+		c->millishares);
+	if (c->workload != NULL)
+		nvshare_json_write_string(fp, c->workload->name);
+	else fprintf(fp, "null");
+	fprintf(fp, ", \"boost_seconds_left\": ");
+	if (client_boosted(c)) fprintf(fp, "%lld", boost_left_s(c));
+	else fprintf(fp, "null");
+	fprintf(fp, ", \"exclusive\": %s, \"slice_ms\": %lld,"
+		" \"effective_share\": %.4f",
+		client_preemptible(c) ? "false" : "true", client_turn_ms(c),
+		client_effective_share(c));
+	fprintf(fp, ", \"overruns\": %u, \"recent_overruns\": %d,"
+		" \"recent_slices\": %u, \"overrun_action\": ", c->overruns,
+		recent_overruns(c), c->history_slices);
+	if (c->repeat_overrunner)
+		nvshare_json_write_string(fp,
+			overrun_actions[overrun_action].name);
+	else fprintf(fp, "null");
+	fprintf(fp, ", \"denied\": %s, \"overflow\": %s",
+		c->denied ? "true" : "false", c->overflow ? "true" : "false");
+	fprintf(fp, ", \"contexts\": %lld, \"ooms\": %lld,"
+		" \"burst_credits_ms\": %lld}", c->contexts, c->ooms,
+		client_burst_pct(c) > 0 ? client_credits(c) : 0);
+}
+
+
+/*
+ * The registered clients as a JSON array, one per line, indented by indent.
+ * Hold the global mutex.
+ */
+static void write_clients_json(FILE *fp, const char *indent)
+{
+	struct nvshare_client *c;
+	int n = 0;
+
+	fprintf(fp, "[");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		fprintf(fp, "%s\n%s  ", n++ > 0 ? "," : "", indent);
+		write_client_json(fp, c);
+	}
+	if (n > 0) fprintf(fp, "\n%s", indent);
+	fprintf(fp, "]");
+}
+
+
+/*
+ * The gist of the status as a JSON object, for scripts. The text status
+ * tells the whole story. Hold the global mutex.
+ */
+static void write_status_json(FILE *fp)
+{
+	struct nvshare_request *r;
+	struct nvshare_logfile_info logfile;
+	struct reclaim_record *rec;
+	int n = 0;
+
+	fprintf(fp, "{\n  \"scheduler\": \"%s\",\n", scheduler_on ? "on" : "off");
+	fprintf(fp, "  \"version\": ");
+	nvshare_json_write_string(fp, NVSHARE_VERSION);
+	fprintf(fp, ",\n  \"protocol_versions\": {\"min\": %d, \"max\": %d},\n",
+		NVSHARE_PROTOCOL_VERSION_MIN, NVSHARE_PROTOCOL_VERSION);
+	fprintf(fp, "  \"tq_seconds\": %d,\n", tq);
+	fprintf(fp, "  \"scheduling_policy\": \"%s\",\n", sched_policy->name);
+	fprintf(fp, "  \"max_clients\": %d,\n", max_clients);
+	fprintf(fp, "  \"gpu_process_limit\": ");
+	if (gpu_process_limit != GPU_PROCESS_LIMIT_OFF)
+		fprintf(fp, "{\"limit\": %d, \"auto\": %s, \"processes\": %d,"
+			" \"rejections\": %llu},\n", process_limit(),
+			gpu_process_limit == GPU_PROCESS_LIMIT_AUTO ? "true" :
+			"false", gpu_processes < 0 ? -1 : gpu_process_count(),
+			process_limit_rejections);
+	else fprintf(fp, "null,\n");
+	fprintf(fp, "  \"reclaim\": {\"policy\": \"%s\", \"evictions\": %llu,"
+		" \"recent\": [", reclaim_policies[reclaim_policy], reclaims);
+	for (unsigned long long i = 0; i < reclaims && i < RECLAIM_HISTORY;
+	     i++) {
+		rec = &reclaim_history[(reclaims - 1 - i) % RECLAIM_HISTORY];
+		fprintf(fp, "%s{\"id\": \"%016" PRIx64 "\", \"namespace\": ",
+			i > 0 ? ", " : "", rec->id);
+		nvshare_json_write_string(fp, rec->pod_namespace);
+		fprintf(fp, ", \"pod\": ");
+		nvshare_json_write_string(fp, rec->pod_name);
+		fprintf(fp, ", \"memory_mib\": %lld, \"for\": \"%016" PRIx64
+			"\", \"seconds_ago\": %lld}", rec->mem_committed_mib,
+			rec->oom_id, elapsed_ms_since(&rec->ts) / 1000);
+	}
+	fprintf(fp, "]},\n");
+	fprintf(fp, "  \"boosts\": {\"factor\": %lld, \"active\": %d,"
+		" \"granted\": %llu},\n", boost_factor, num_boosted(), boosts);
+	fprintf(fp, "  \"drain\": \"%s\",\n", !draining ? "off" :
+		drain_complete ? "complete" : "in_progress");
+	fprintf(fp, "  \"quiesce\": \"%s\",\n", !quiescing ? "off" :
+		quiesce_complete ? "complete" : "in_progress");
+	fprintf(fp, "  \"backpressure\": ");
+	if (backpressure_clients > 0 || backpressure_switch_rate > 0)
+		fprintf(fp, "{\"active\": %s, \"pause_ms\": %lld,"
+			" \"lock_switch_rate\": %.1f, \"activations\": %llu},\n",
+			backpressure ? "true" : "false",
+			backpressure_pause_ms, switch_rate,
+			backpressure_activations);
+	else fprintf(fp, "null,\n");
+	fprintf(fp, "  \"lock_holder\": ");
+	r = requests;
+	if (lock_held && r != NULL) {
+		fprintf(fp, "{\"id\": \"%016" PRIx64 "\", \"held_ms\": %lld}",
+			r->client->id, elapsed_ms_since(&r->client->slice_ts));
+		r = r->next;
+	} else fprintf(fp, "null");
+	fprintf(fp, ",\n  \"queue\": [");
+	for (; r != NULL; r = r->next)
+		fprintf(fp, "%s\n    {\"id\": \"%016" PRIx64 "\", \"waiting_ms\":"
+			" %lld, \"bursting\": %s}", n++ > 0 ? "," : "",
+			r->client->id, elapsed_ms_since(&r->since),
+			r->burst ? "true" : "false");
+	fprintf(fp, "%s],\n", n > 0 ? "\n  " : "");
+	fprintf(fp, "  \"throttle\": ");
+	if (throttle_known) {
+		fprintf(fp, "{\"throttling\": %s, \"causes\": [",
+			throttling ? "true" : "false");
+		n = 0;
+		for (size_t i = 0; i < sizeof(throttle_causes) /
+		     sizeof(throttle_causes[0]); i++)
+			if (throttle.causes & throttle_causes[i].mask)
+				fprintf(fp, "%s\"%s\"", n++ > 0 ? ", " : "",
+					throttle_causes[i].name);
+		fprintf(fp, "], \"clock_mhz\": %u, \"max_clock_mhz\": %u,"
+			" \"temperature_celsius\": %u, \"episodes\": %llu,"
+			" \"throttled_seconds\": %.1f}", throttle.clock_mhz,
+			throttle.max_clock_mhz, throttle.temperature,
+			throttle_episodes, throttled_total_ms() / 1000.0);
+	} else fprintf(fp, "null");
+	fprintf(fp, ",\n");
+	fprintf(fp, "  \"log_file\": ");
+	if (nvshare_logfile_info(&logfile) == 0) {
+		nvshare_json_write_string(fp, logfile.path);
+		fprintf(fp, ", \"log_file_bytes\": %lld,\n", logfile.bytes);
+	} else fprintf(fp, "null,\n");
+	fprintf(fp, "  \"registered_clients\": %d,\n", num_registered_clients());
+	fprintf(fp, "  \"clients\": ");
+	write_clients_json(fp, "  ");
+	fprintf(fp, "\n}\n");
+}
+
+
+/*
+ * Send the status to a client (nvsharectl) and let the caller close the
+ * connection. The fields of the STATUS message pick what to send.
+ *
+ * The status may not fit in the socket buffer all at once, so switch to
+ * blocking mode with a send timeout to avoid stalling on a stuck peer.
+ */
+static void send_status(struct nvshare_client *client, const char *fields)
+{
+	char *buf = NULL;
+	size_t len = 0;
+	FILE *fp;
+	int flags, json, only_clients;
+	char value[MSG_DATA_LEN + 1];
+	struct timeval tv = {1, 0};
+
+	json = (nvshare_msg_get_field(fields, NVSHARE_STATUS_JSON_FIELD, value,
+				      sizeof(value)) == 0 && atoi(value) == 1);
+	only_clients = (nvshare_msg_get_field(fields,
+		NVSHARE_STATUS_CLIENTS_FIELD, value, sizeof(value)) == 0 &&
+		atoi(value) == 1);
+
+	true_or_exit(fp = open_memstream(&buf, &len));
+	if (json && only_clients) {
+		write_clients_json(fp, "");
+		fprintf(fp, "\n");
+	} else if (json) write_status_json(fp);
+	else if (only_clients) write_clients(fp);
+	else write_status(fp);
+	true_or_exit(fclose(fp) == 0);
+
+	flags = fcntl(client->fd, F_GETFL);
+	if (flags < 0 ||
+	    fcntl(client->fd, F_SETFL, flags & ~O_NONBLOCK) < 0 ||
+	    setsockopt(client->fd, SOL_SOCKET, SO_SNDTIMEO, &tv,
+		       sizeof(tv)) < 0 ||
+	    write_whole(client->fd, buf, len) != (ssize_t)len)
+		log_info("Failed to send status");
+	free(buf);
+}
+
+
+/* Called from the metrics thread, so take the global mutex */
+/* Write a metric name with the labels that identify a client */
+static void write_client_labels(FILE *fp, const char *metric,
+				struct nvshare_client *c)
+{
+	fprintf(fp, "%s{client_id=\"%016" PRIx64 "\",namespace=\"", metric,
+		c->id);
+	prom_write_label_value(fp, c->pod_namespace);
+	fprintf(fp, "\",pod=\"");
+	prom_write_label_value(fp, c->pod_name);
+	fprintf(fp, "\"}");
+}
+
+
+/*
+ * Who has the GPU and who waits for it, in a nutshell, for the snapshot
+ * socket. nvsharectl --status tells the whole story.
+ */
+static void write_snapshot(FILE *fp)
+{
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+
+	fprintf(fp, "Scheduler: %s\n", scheduler_on ? "ON" : "OFF");
+	fprintf(fp, "TQ: %d seconds\n", tq);
+	fprintf(fp, "Registered clients: %d\n", num_registered_clients());
+	write_queue(fp);
+
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+}
+
+
+/* Write the lock holder and the queue. Hold the global mutex. */
+static void write_queue(FILE *fp)
+{
+	struct nvshare_request *r;
+	char id_str[HEX_STR_LEN(r->client->id)];
+	int pos = 0;
+
+	r = requests;
+	if (lock_held && r != NULL) {
+		client_id_as_string(id_str, sizeof(id_str), r->client->id);
+		fprintf(fp, "Lock holder: %s (%s)  Pod %s/%s  held for %.1f s\n",
+			id_str, r->client->name, r->client->pod_namespace,
+			r->client->pod_name,
+			elapsed_ms_since(&r->client->slice_ts) / 1000.0);
+		r = r->next;
+	} else fprintf(fp, "Lock holder: none\n");
+	fprintf(fp, "Queue:%s\n", r == NULL ? " empty" : "");
+	for (; r != NULL; r = r->next) {
+		client_id_as_string(id_str, sizeof(id_str), r->client->id);
+		fprintf(fp, "  %d. %s (%s)  Pod %s/%s  waiting for %.1f s%s\n",
+			++pos, id_str, r->client->name,
+			r->client->pod_namespace, r->client->pod_name,
+			elapsed_ms_since(&r->since) / 1000.0,
+			!client_preemptible(r->client) ? "  exclusive" :
+			r->burst ? "  bursting" : "");
+	}
+}
+
+
+/* Write a metric name with the label of a GPU */
+static void write_gpu_metric(FILE *fp, const char *metric,
+			     struct gpu_account *g)
+{
+	fprintf(fp, "%s{gpu_uuid=\"", metric);
+	prom_write_label_value(fp, g->uuid);
+	fprintf(fp, "\"}");
+}
+
+
+/*
+ * The number of registered clients of a GPU, the memory they have committed
+ * in total and the physical memory of the GPU, as the clients report it.
+ * Clients that don't know their GPU count as using unknown_gpu.
+ */
+static void gpu_usage(struct gpu_account *g, int *num_clients,
+		      long long *committed_mib, long long *total_mib)
+{
+	struct nvshare_client *c;
+
+	*num_clients = 0;
+	*committed_mib = 0;
+	*total_mib = 0;
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c) || get_gpu_account(c->gpu_uuid) != g)
+			continue;
+		(*num_clients)++;
+		*committed_mib += client_committed_mib(c);
+		if (c->mem_total_mib > *total_mib) *total_mib = c->mem_total_mib;
+	}
+}
+
+
+/* The time the clients of a GPU have held the lock, with the ongoing slice */
+static long long gpu_held_ms(struct gpu_account *g)
+{
+	long long held_ms = g->gpu_ms;
+
+	if (lock_held && requests != NULL &&
+	    get_gpu_account(requests->client->gpu_uuid) == g)
+		held_ms += elapsed_ms_since(&requests->client->slice_ts);
+	return held_ms;
+}
+
+
+/*
+ * The metrics of each GPU of the node: its clients, how much memory they have
+ * committed against its physical memory (past 1, they thrash host RAM), how
+ * often the lock has passed to them, how long they have held it, and its
+ * utilization, if NVML can tell. utils holds num_utils GPUs from NVML.
+ */
+static void write_gpu_metrics(FILE *fp, struct nvshare_gpu_util *utils,
+			      int num_utils)
+{
+	struct gpu_account *gpus[GPU_ACCOUNTS_MAX + 1], *g;
+	struct gpu_account *util_gpus[GPU_ACCOUNTS_MAX];
+	int num_gpus = 0, i, n[GPU_ACCOUNTS_MAX + 1];
+	long long committed_mib[GPU_ACCOUNTS_MAX + 1];
+	long long total_mib[GPU_ACCOUNTS_MAX + 1];
+
+	/* Also export the GPUs that no client has reported yet */
+	for (i = 0; i < num_utils; i++)
+		util_gpus[i] = get_gpu_account(utils[i].uuid);
+	LL_FOREACH(gpu_accounts, g) {
+		gpus[num_gpus++] = g;
+	}
+	gpus[num_gpus++] = &unknown_gpu;
+	for (i = 0; i < num_gpus; i++)
+		gpu_usage(gpus[i], &n[i], &committed_mib[i], &total_mib[i]);
+	/* Only export unknown_gpu if anything counts under it */
+	if (n[num_gpus - 1] == 0 && unknown_gpu.lock_switches == 0 &&
+	    unknown_gpu.gpu_ms == 0)
+		num_gpus--;
+
+	fprintf(fp, "# HELP nvshare_gpu_clients Number of registered clients"
+		" of each GPU.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_clients gauge\n");
+	for (i = 0; i < num_gpus; i++) {
+		write_gpu_metric(fp, "nvshare_gpu_clients", gpus[i]);
+		fprintf(fp, " %d\n", n[i]);
+	}
+	fprintf(fp, "# HELP nvshare_gpu_memory_committed_bytes GPU memory the"
+		" registered clients of each GPU have committed in total.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_memory_committed_bytes gauge\n");
+	for (i = 0; i < num_gpus; i++) {
+		if (total_mib[i] == 0) continue;
+		write_gpu_metric(fp, "nvshare_gpu_memory_committed_bytes",
+				 gpus[i]);
+		fprintf(fp, " %lld\n", committed_mib[i] * 1024 * 1024);
+	}
+	fprintf(fp, "# HELP nvshare_gpu_memory_total_bytes Physical memory of"
+		" each GPU.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_memory_total_bytes gauge\n");
+	for (i = 0; i < num_gpus; i++) {
+		if (total_mib[i] == 0) continue;
+		write_gpu_metric(fp, "nvshare_gpu_memory_total_bytes", gpus[i]);
+		fprintf(fp, " %lld\n", total_mib[i] * 1024 * 1024);
+	}
+	fprintf(fp, "# HELP nvshare_gpu_memory_commit_ratio GPU memory the"
+		" registered clients of each GPU have committed, over its"
+		" physical memory.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_memory_commit_ratio gauge\n");
+	for (i = 0; i < num_gpus; i++) {
+		if (total_mib[i] == 0) continue;
+		write_gpu_metric(fp, "nvshare_gpu_memory_commit_ratio",
+				 gpus[i]);
+		fprintf(fp, " %.3f\n", (double)committed_mib[i] / total_mib[i]);
+	}
+	fprintf(fp, "# HELP nvshare_gpu_lock_switches_total Number of times the"
+		" GPU lock passed to a different client, by the GPU of that"
+		" client.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_lock_switches_total counter\n");
+	for (i = 0; i < num_gpus; i++) {
+		write_gpu_metric(fp, "nvshare_gpu_lock_switches_total",
+				 gpus[i]);
+		fprintf(fp, " %llu\n", gpus[i]->lock_switches);
+	}
+	fprintf(fp, "# HELP nvshare_gpu_lock_held_seconds_total Time the"
+		" clients of each GPU have held the GPU lock.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_lock_held_seconds_total counter\n");
+	for (i = 0; i < num_gpus; i++) {
+		write_gpu_metric(fp, "nvshare_gpu_lock_held_seconds_total",
+				 gpus[i]);
+		fprintf(fp, " %.3f\n", gpu_held_ms(gpus[i]) / 1000.0);
+	}
+	if (num_utils <= 0) return;
+	fprintf(fp, "# HELP nvshare_gpu_utilization_ratio Fraction of the time"
+		" each GPU ran kernels, over the last NVML sample period.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_utilization_ratio gauge\n");
+	for (i = 0; i < num_utils; i++) {
+		/* One series per GPU, even past GPU_ACCOUNTS_MAX */
+		if (util_gpus[i] == &unknown_gpu) continue;
+		write_gpu_metric(fp, "nvshare_gpu_utilization_ratio",
+				 util_gpus[i]);
+		fprintf(fp, " %.2f\n", utils[i].util / 100.0);
+	}
+}
+
+
+static void write_metrics(FILE *fp)
+{
+	int num_clients;
+	struct pod_account *a;
+	struct nvshare_client *c;
+	long long held_ms;
+	struct nvshare_logfile_info logfile;
+	struct nvshare_gpu_util utils[GPU_ACCOUNTS_MAX];
+	int num_utils;
+
+	/* Don't hold the global mutex while talking to NVML */
+	num_utils = nvshare_gpu_utilizations(utils, GPU_ACCOUNTS_MAX);
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+
+	num_clients = num_registered_clients();
+
+	fprintf(fp, "# HELP nvshare_scheduler_build_info The version the"
+		" scheduler was built from, always 1.\n");
+	fprintf(fp, "# TYPE nvshare_scheduler_build_info gauge\n");
+	fprintf(fp, "nvshare_scheduler_build_info{version=\"%s\","
+		"protocol_version=\"%d\"} 1\n", NVSHARE_VERSION,
+		NVSHARE_PROTOCOL_VERSION);
+	fprintf(fp, "# HELP nvshare_scheduler_on Whether the anti-thrashing"
+		" scheduler is on.\n");
+	fprintf(fp, "# TYPE nvshare_scheduler_on gauge\n");
+	fprintf(fp, "nvshare_scheduler_on %d\n", scheduler_on);
+	fprintf(fp, "# HELP nvshare_registered_clients Number of registered"
+		" clients.\n");
+	fprintf(fp, "# TYPE nvshare_registered_clients gauge\n");
+	fprintf(fp, "nvshare_registered_clients %d\n", num_clients);
+	fprintf(fp, "# HELP nvshare_draining Whether the scheduler is draining"
+		" (rejecting new clients).\n");
+	fprintf(fp, "# TYPE nvshare_draining gauge\n");
+	fprintf(fp, "nvshare_draining %d\n", draining);
+	fprintf(fp, "# HELP nvshare_drain_complete Whether a requested drain"
+		" has completed.\n");
+	fprintf(fp, "# TYPE nvshare_drain_complete gauge\n");
+	fprintf(fp, "nvshare_drain_complete %d\n", drain_complete);
+	fprintf(fp, "# HELP nvshare_quiescing Whether the scheduler is"
+		" quiescing (granting no new slices).\n");
+	fprintf(fp, "# TYPE nvshare_quiescing gauge\n");
+	fprintf(fp, "nvshare_quiescing %d\n", quiescing);
+	fprintf(fp, "# HELP nvshare_quiesce_complete Whether a requested"
+		" quiesce has completed, i.e., the GPU is idle.\n");
+	fprintf(fp, "# TYPE nvshare_quiesce_complete gauge\n");
+	fprintf(fp, "nvshare_quiesce_complete %d\n", quiesce_complete);
+	fprintf(fp, "# HELP nvshare_oversubscription_warnings_total Number of"
+		" times the committed GPU memory exceeded the warning"
+		" ratio.\n");
+	fprintf(fp, "# TYPE nvshare_oversubscription_warnings_total"
+		" counter\n");
+	fprintf(fp, "nvshare_oversubscription_warnings_total %llu\n",
+		oversub_warnings);
+	if (gpu_process_limit != GPU_PROCESS_LIMIT_OFF) {
+		fprintf(fp, "# HELP nvshare_gpu_processes Processes on the GPU,"
+			" or registered clients if there are more.\n");
+		fprintf(fp, "# TYPE nvshare_gpu_processes gauge\n");
+		if (gpu_processes >= 0)
+			fprintf(fp, "nvshare_gpu_processes %d\n",
+				gpu_process_count());
+		fprintf(fp, "# HELP nvshare_gpu_process_limit_rejections_total"
+			" Number of clients turned away as the GPU ran all the"
+			" processes it can.\n");
+		fprintf(fp, "# TYPE nvshare_gpu_process_limit_rejections_total"
+			" counter\n");
+		fprintf(fp, "nvshare_gpu_process_limit_rejections_total %llu\n",
+			process_limit_rejections);
+	}
+	fprintf(fp, "# HELP nvshare_oom_errors_total Number of times a client"
+		" ran out of GPU memory.\n");
+	fprintf(fp, "# TYPE nvshare_oom_errors_total counter\n");
+	fprintf(fp, "nvshare_oom_errors_total %llu\n", ooms);
+	fprintf(fp, "# HELP nvshare_reclaim_evictions_total Number of clients"
+		" evicted to reclaim GPU memory.\n");
+	fprintf(fp, "# TYPE nvshare_reclaim_evictions_total counter\n");
+	fprintf(fp, "nvshare_reclaim_evictions_total %llu\n", reclaims);
+	fprintf(fp, "# HELP nvshare_client_socket_timeouts_total Number of"
+		" times a client stopped reading or writing its socket.\n");
+	fprintf(fp, "# TYPE nvshare_client_socket_timeouts_total counter\n");
+	fprintf(fp, "nvshare_client_socket_timeouts_total %llu\n",
+		socket_timeouts);
+	fprintf(fp, "# HELP nvshare_invalid_messages_total Number of malformed"
+		" messages that clients have sent.\n");
+	fprintf(fp, "# TYPE nvshare_invalid_messages_total counter\n");
+	fprintf(fp, "nvshare_invalid_messages_total %llu\n", invalid_messages);
+	fprintf(fp, "# HELP nvshare_exclusive_timeouts_total Number of times"
+		" a client got the GPU lock ahead of exclusive clients after"
+		" waiting for too long.\n");
+	fprintf(fp, "# TYPE nvshare_exclusive_timeouts_total counter\n");
+	fprintf(fp, "nvshare_exclusive_timeouts_total %llu\n",
+		exclusive_timeouts);
+	fprintf(fp, "# HELP nvshare_lock_switches_total Number of times the"
+		" GPU lock passed to a different client.\n");
+	fprintf(fp, "# TYPE nvshare_lock_switches_total counter\n");
+	fprintf(fp, "nvshare_lock_switches_total %llu\n", lock_switches);
+	if (backpressure_clients > 0 || backpressure_switch_rate > 0) {
+		fprintf(fp, "# HELP nvshare_lock_switch_rate Lock switches per"
+			" second over the last %d seconds.\n",
+			BACKPRESSURE_WINDOW_S);
+		fprintf(fp, "# TYPE nvshare_lock_switch_rate gauge\n");
+		fprintf(fp, "nvshare_lock_switch_rate %.3f\n", switch_rate);
+		fprintf(fp, "# HELP nvshare_backpressure_active Whether clients"
+			" are asked to pause before they request the GPU lock"
+			" again.\n");
+		fprintf(fp, "# TYPE nvshare_backpressure_active gauge\n");
+		fprintf(fp, "nvshare_backpressure_active %d\n", backpressure);
+		fprintf(fp, "# HELP nvshare_backpressure_activations_total"
+			" Number of times backpressure turned on.\n");
+		fprintf(fp, "# TYPE nvshare_backpressure_activations_total"
+			" counter\n");
+		fprintf(fp, "nvshare_backpressure_activations_total %llu\n",
+			backpressure_activations);
+	}
+	fprintf(fp, "# HELP nvshare_lock_overruns_total Number of times a"
+		" client held the GPU lock past the overrun threshold.\n");
+	fprintf(fp, "# TYPE nvshare_lock_overruns_total counter\n");
+	fprintf(fp, "nvshare_lock_overruns_total %llu\n", overruns);
+	fprintf(fp, "# HELP nvshare_clients_waiting_to_initialize Number of"
+		" new clients waiting for another client to initialize.\n");
+	fprintf(fp, "# TYPE nvshare_clients_waiting_to_initialize gauge\n");
+	fprintf(fp, "nvshare_clients_waiting_to_initialize %d\n",
+		num_waiting_init());
+	fprintf(fp, "# HELP nvshare_min_dwell_seconds Minimum time a client"
+		" holds the GPU lock before the scheduler takes it away.\n");
+	fprintf(fp, "# TYPE nvshare_min_dwell_seconds gauge\n");
+	fprintf(fp, "nvshare_min_dwell_seconds %.3f\n", min_dwell_ms / 1000.0);
+
+	fprintf(fp, "# HELP nvshare_time_to_first_slice_seconds Time from"
+		" client registration until its first GPU slice.\n");
+	fprintf(fp, "# TYPE nvshare_time_to_first_slice_seconds summary\n");
+	if (ttfs_samples_cnt > 0) {
+		fprintf(fp, "nvshare_time_to_first_slice_seconds"
+			"{quantile=\"0.5\"} %.3f\n",
+			ttfs_percentile(0.5) / 1000.0);
+		fprintf(fp, "nvshare_time_to_first_slice_seconds"
+			"{quantile=\"0.9\"} %.3f\n",
+			ttfs_percentile(0.9) / 1000.0);
+		fprintf(fp, "nvshare_time_to_first_slice_seconds"
+			"{quantile=\"0.99\"} %.3f\n",
+			ttfs_percentile(0.99) / 1000.0);
+	}
+	fprintf(fp, "nvshare_time_to_first_slice_seconds_sum %.3f\n",
+		ttfs_sum_ms / 1000.0);
+	fprintf(fp, "nvshare_time_to_first_slice_seconds_count %llu\n",
+		ttfs_count);
+	fprintf(fp, "# HELP nvshare_time_to_first_slice_slo_violations_total"
+		" Number of clients whose time to first slice exceeded the"
+		" SLO.\n");
+	fprintf(fp, "# TYPE nvshare_time_to_first_slice_slo_violations_total"
+		" counter\n");
+	fprintf(fp, "nvshare_time_to_first_slice_slo_violations_total %llu\n",
+		ttfs_slo_violations);
+
+	fprintf(fp, "# HELP nvshare_gpu_time_seconds_total Time each Pod has"
+		" held the GPU lock.\n");
+	fprintf(fp, "# TYPE nvshare_gpu_time_seconds_total counter\n");
+	LL_FOREACH(pod_accounts, a) {
+		held_ms = a->gpu_ms;
+		/* Include the ongoing slice, so that the counter moves along */
+		if (lock_held && requests != NULL &&
+		    strcmp(requests->client->pod_name, a->pod_name) == 0 &&
+		    strcmp(requests->client->pod_namespace,
+			   a->pod_namespace) == 0)
+			held_ms += elapsed_ms_since(&requests->client->slice_ts);
+		fprintf(fp, "nvshare_gpu_time_seconds_total{namespace=\"");
+		prom_write_label_value(fp, a->pod_namespace);
+		fprintf(fp, "\",pod=\"");
+		prom_write_label_value(fp, a->pod_name);
+		fprintf(fp, "\"} %.3f\n", held_ms / 1000.0);
+	}
+
+	fprintf(fp, "# HELP nvshare_client_info The name and Pod of each"
+		" registered client.\n");
+	fprintf(fp, "# TYPE nvshare_client_info gauge\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		fprintf(fp, "nvshare_client_info{client_id=\"%016" PRIx64
+			"\",name=\"", c->id);
+		prom_write_label_value(fp, c->name);
+		fprintf(fp, "\",namespace=\"");
+		prom_write_label_value(fp, c->pod_namespace);
+		fprintf(fp, "\",pod=\"");
+		prom_write_label_value(fp, c->pod_name);
+		fprintf(fp, "\"} 1\n");
+	}
+
+	write_gpu_metrics(fp, utils, num_utils);
+
+	if (nvshare_logfile_info(&logfile) == 0) {
+		fprintf(fp, "# HELP nvshare_log_file_bytes Size of the current"
+			" log file of the scheduler.\n");
+		fprintf(fp, "# TYPE nvshare_log_file_bytes gauge\n");
+		fprintf(fp, "nvshare_log_file_bytes %lld\n", logfile.bytes);
+	}
+
+	if (throttle_known) {
+		fprintf(fp, "# HELP nvshare_gpu_throttling Whether the GPU is"
+			" throttling, by cause.\n");
+		fprintf(fp, "# TYPE nvshare_gpu_throttling gauge\n");
+		for (size_t i = 0; i < sizeof(throttle_causes) /
+		     sizeof(throttle_causes[0]); i++)
+			fprintf(fp, "nvshare_gpu_throttling{cause=\"%s\"} %d\n",
+				throttle_causes[i].name,
+				(throttle.causes & throttle_causes[i].mask) ?
+				1 : 0);
+		fprintf(fp, "# HELP nvshare_gpu_throttle_episodes_total Number"
+			" of times the GPU started throttling.\n");
+		fprintf(fp, "# TYPE nvshare_gpu_throttle_episodes_total"
+			" counter\n");
+		fprintf(fp, "nvshare_gpu_throttle_episodes_total %llu\n",
+			throttle_episodes);
+		fprintf(fp, "# HELP nvshare_gpu_throttled_seconds_total Time"
+			" the GPU has spent throttling.\n");
+		fprintf(fp, "# TYPE nvshare_gpu_throttled_seconds_total"
+			" counter\n");
+		fprintf(fp, "nvshare_gpu_throttled_seconds_total %.3f\n",
+			throttled_total_ms() / 1000.0);
+		fprintf(fp, "# HELP nvshare_gpu_clock_ratio Graphics clock of"
+			" the GPU as a fraction of its maximum.\n");
+		fprintf(fp, "# TYPE nvshare_gpu_clock_ratio gauge\n");
+		if (throttle.max_clock_mhz > 0)
+			fprintf(fp, "nvshare_gpu_clock_ratio %.3f\n",
+				(double)throttle.clock_mhz /
+				throttle.max_clock_mhz);
+		fprintf(fp, "# HELP nvshare_gpu_temperature_celsius Temperature"
+			" of the hottest GPU.\n");
+		fprintf(fp, "# TYPE nvshare_gpu_temperature_celsius gauge\n");
+		if (throttle.temperature > 0)
+			fprintf(fp, "nvshare_gpu_temperature_celsius %u\n",
+				throttle.temperature);
+	}
+
+	/* Who is using the GPU right now, and how much of it */
+	fprintf(fp, "# HELP nvshare_client_memory_committed_bytes GPU memory"
+		" each registered client has committed.\n");
+	fprintf(fp, "# TYPE nvshare_client_memory_committed_bytes gauge\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		write_client_labels(fp, "nvshare_client_memory_committed_bytes",
+				    c);
+		fprintf(fp, " %lld\n", c->mem_committed_mib * 1024 * 1024);
+	}
+	fprintf(fp, "# HELP nvshare_client_share Share of the GPU each"
+		" registered client is entitled to, in [0, 1].\n");
+	fprintf(fp, "# TYPE nvshare_client_share gauge\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		write_client_labels(fp, "nvshare_client_share", c);
+		fprintf(fp, " %.3f\n", (double)c->millishares /
+			NVSHARE_FULL_SHARE);
+	}
+	fprintf(fp, "# HELP nvshare_client_contexts CUDA contexts each"
+		" registered client has created, besides the primary one.\n");
+	fprintf(fp, "# TYPE nvshare_client_contexts gauge\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		write_client_labels(fp, "nvshare_client_contexts", c);
+		fprintf(fp, " %lld\n", c->contexts);
+	}
+	fprintf(fp, "# HELP nvshare_client_oom_errors_total Number of times"
+		" each registered client ran out of GPU memory.\n");
+	fprintf(fp, "# TYPE nvshare_client_oom_errors_total counter\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		write_client_labels(fp, "nvshare_client_oom_errors_total", c);
+		fprintf(fp, " %lld\n", c->ooms);
+	}
+	fprintf(fp, "# HELP nvshare_client_overruns_total Number of times"
+		" each registered client held the GPU lock past the overrun"
+		" threshold.\n");
+	fprintf(fp, "# TYPE nvshare_client_overruns_total counter\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		write_client_labels(fp, "nvshare_client_overruns_total", c);
+		fprintf(fp, " %u\n", c->overruns);
+	}
+	fprintf(fp, "# HELP nvshare_client_recent_overruns How many of its"
+		" last %d slices each registered client overran.\n",
+		OVERRUN_HISTORY);
+	fprintf(fp, "# TYPE nvshare_client_recent_overruns gauge\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		write_client_labels(fp, "nvshare_client_recent_overruns", c);
+		fprintf(fp, " %d\n", recent_overruns(c));
+	}
+	fprintf(fp, "# HELP nvshare_client_repeat_overrunner Whether the"
+		" overrun action applies to each registered client.\n");
+	fprintf(fp, "# TYPE nvshare_client_repeat_overrunner gauge\n");
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c)) continue;
+		write_client_labels(fp, "nvshare_client_repeat_overrunner", c);
+		fprintf(fp, " %d\n", c->repeat_overrunner);
+	}
+
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+}
+
+
+/*
+ * Whether we take in a client that isn't registered yet, i.e., one that
+ * registers, or one that reattaches without an existing client to take the
+ * place of. If not, tell it why.
+ *
+ * A reattaching client already runs on the GPU, so it doesn't count against
+ * the GPU process limit twice.
+ */
+static int admit_client(struct nvshare_client *client,
+	const struct message *in_msg)
+{
+	const char *what = (in_msg->type == REATTACH) ? "reattachment" :
+			   "registration";
+
+	if (draining) {
+		log_warn("Rejecting %s of Pod %s/%s, the scheduler is"
+			 " draining", what, in_msg->pod_namespace,
+			 in_msg->pod_name);
+		send_error(client, NVSHARE_ERR_DRAINING, "nvshare-scheduler is"
+			   " draining and accepts no new clients");
+		return 0;
+	}
+
+	if (oom_admission_paused()) {
+		log_warn("Rejecting %s of Pod %s/%s, a client ran out of GPU"
+			 " memory %lld s ago", what, in_msg->pod_namespace,
+			 in_msg->pod_name, elapsed_ms_since(&last_oom_ts) / 1000);
+		send_error(client, NVSHARE_ERR_MEMORY_PRESSURE,
+			   "nvshare-scheduler accepts no new clients for %lld s"
+			   " after a client ran out of GPU memory",
+			   oom_admission_pause_s);
+		return 0;
+	}
+
+	if (max_clients > 0 && num_registered_clients() >= max_clients) {
+		log_warn("Rejecting %s of Pod %s/%s, the maximum of %d clients"
+			 " has been reached", what, in_msg->pod_namespace,
+			 in_msg->pod_name, max_clients);
+		send_error(client, NVSHARE_ERR_MAX_CLIENTS, "nvshare-scheduler"
+			   " has reached its maximum of %d clients",
+			   max_clients);
+		return 0;
+	}
+
+	if (gpu_at_process_limit(in_msg->type == REATTACH)) {
+		process_limit_rejections++;
+		log_warn("Rejecting %s of Pod %s/%s, the GPU already runs as"
+			 " many processes as it can (%d)", what,
+			 in_msg->pod_namespace, in_msg->pod_name,
+			 process_limit());
+		send_error(client, NVSHARE_ERR_PROCESS_LIMIT, "The GPU already"
+			   " runs as many processes as it can (%d), it can't"
+			   " create a CUDA context for another one",
+			   process_limit());
+		return 0;
+	}
+	return 1;
+}
+
+
+static int register_client(struct nvshare_client *client, const struct message *in_msg)
+{
+	int ret;
+	int replaced = 0;
+	struct nvshare_client *c;
+	uint64_t nvshare_client_id;
+	char value[MSG_DATA_LEN + 1];
+
+	if (has_registered(client)) {
+		log_warn("Client %016" PRIx64 " is already registered",
+			 client->id);
+		send_error(client, NVSHARE_ERR_ALREADY_REGISTERED,
+			   "Already registered as client %016" PRIx64,
+			   client->id);
+		return -1;
+	}
+
+	client->proto_version = nvshare_msg_get_version(in_msg->data);
+	if (client->proto_version < 0)
+		log_warn("Rejecting Pod %s/%s, its protocol version is"
+			 " malformed", in_msg->pod_namespace, in_msg->pod_name);
+	else if (client->proto_version < NVSHARE_PROTOCOL_VERSION_MIN ||
+		 client->proto_version > NVSHARE_PROTOCOL_VERSION)
+		log_warn("Rejecting Pod %s/%s, it speaks protocol version %d,"
+			 " but we support versions %d to %d",
+			 in_msg->pod_namespace, in_msg->pod_name,
+			 client->proto_version, NVSHARE_PROTOCOL_VERSION_MIN,
+			 NVSHARE_PROTOCOL_VERSION);
+	if (client->proto_version < NVSHARE_PROTOCOL_VERSION_MIN ||
+	    client->proto_version > NVSHARE_PROTOCOL_VERSION) {
+		/* Tell the client why, so it can fail with a clear error */
+		out_msg.type = UNSUPPORTED_VERSION;
+		snprintf(out_msg.data, sizeof(out_msg.data), "%s=%d-%d",
+			 NVSHARE_VERSION_FIELD, NVSHARE_PROTOCOL_VERSION_MIN,
+			 NVSHARE_PROTOCOL_VERSION);
+		(void)send_message(client, &out_msg);
+		memset(&out_msg.data, 0, sizeof(out_msg.data));
+		return -1;
+	}
+
+	/* Whatever ID or Pod it claims, the process must be one we trust */
+	if (!peer_allowed(client)) {
+		log_warn("Rejecting Pod %s/%s, its process (PID %d) runs as"
+			 " user %d, which is not allowed", in_msg->pod_namespace,
+			 in_msg->pod_name, (int)client->peer_pid,
+			 (int)client->peer_uid);
+		send_error(client, NVSHARE_ERR_UNAUTHORIZED, "nvshare-scheduler"
+			   " doesn't accept clients that run as user %d",
+			   (int)client->peer_uid);
+		return -1;
+	}
+
+	/* Applies to reattaching clients too, the list may have changed */
+	if (!namespace_allowed(in_msg->pod_namespace)) {
+		log_warn("Rejecting Pod %s/%s, its namespace is not allowed",
+			 in_msg->pod_namespace, in_msg->pod_name);
+		send_error(client, NVSHARE_ERR_NAMESPACE, "nvshare-scheduler"
+			   " doesn't accept clients from namespace %s",
+			   in_msg->pod_namespace);
+		return -1;
+	}
+
+	/*
+	 * A client that reattaches after a restart of the scheduler keeps its
+	 * ID. It was already running, so we don't count it as a new client.
+	 *
+	 * If another client has the ID, and we know the containers of both,
+	 * we can tell which is which. If it's the same container, we haven't
+	 * noticed that the old connection is gone yet, so drop it. If not,
+	 * the IDs clash, e.g., because a new client got the ID before the
+	 * client reattached, so give the reattaching client a new one.
+	 * Otherwise, we can't tell, so reject it.
+	 *
+	 * Unless it takes the place of its old connection, it joins like a
+	 * registering client would, so it has to pass the same checks.
+	 */
+	if (in_msg->type == REATTACH) {
+		nvshare_client_id = in_msg->id;
+		if (nvshare_client_id == NVSHARE_UNREGISTERED_ID) {
+			log_warn("Rejecting reattachment of Pod %s/%s without"
+				 " a client ID", in_msg->pod_namespace,
+				 in_msg->pod_name);
+			return -1;
+		}
+		LL_FOREACH(clients, c) {
+			if (c == client || c->evicted ||
+			    c->id != nvshare_client_id)
+				continue;
+			if (same_container(client, c)) {
+				log_info("Client %016" PRIx64 " reattaches over"
+					 " a new connection, dropping the old"
+					 " one", nvshare_client_id);
+				client_event(NVSHARE_EVENT_INFO, "evict", c,
+					     "reattached over a new connection");
+				send_error(c, NVSHARE_ERR_EVICTED, "Evicted, this"
+					   " client has reattached over a new"
+					   " connection");
+				evict_client(c);
+				replaced = 1;
+				continue;
+			}
+			if (client->pod_uid[0] != '\0' &&
+			    c->pod_uid[0] != '\0') {
+				log_warn("Client %016" PRIx64 " of Pod %s/%s"
+					 " reattaches with the ID of a client"
+					 " of another container, assigning it a"
+					 " new ID", nvshare_client_id,
+					 in_msg->pod_namespace,
+					 in_msg->pod_name);
+				if (!admit_client(client, in_msg)) return -1;
+				goto again;
+			}
+			log_warn("Rejecting reattachment of Pod %s/%s, client"
+				 " %016" PRIx64 " is already registered",
+				 in_msg->pod_namespace, in_msg->pod_name,
+				 nvshare_client_id);
+			send_error(client, NVSHARE_ERR_DUPLICATE_ID, "Client ID"
+				   " %016" PRIx64 " is already in use",
+				   nvshare_client_id);
+			return -1;
+		}
+		if (!replaced && !admit_client(client, in_msg)) return -1;
+		goto store;
+	}
+
+	if (!admit_client(client, in_msg)) return -1;
+
+again:
+	nvshare_client_id = nvshare_generate_id();
+	if (nvshare_client_id == NVSHARE_UNREGISTERED_ID) /* Tough luck */
+		goto again;
+	LL_FOREACH(clients, c) {
+		if (c->id == nvshare_client_id) { /* ID clash */
+			goto again;
+		}
+	}
+
+store:
+	/*
+	 * Store the rest of the client information.
+	 */
+	client->id = nvshare_client_id;
+	strlcpy(client->pod_name, in_msg->pod_name,
+		sizeof(client->pod_name));
+	strlcpy(client->pod_namespace, in_msg->pod_namespace,
+		sizeof(client->pod_namespace));
+	strlcpy(client->name, client->pod_name, sizeof(client->name));
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &client->register_ts) == 0);
+	/* A reattaching client has already had its first slice */
+	client->ttfs_ms = (in_msg->type == REATTACH) ? 0 : -1;
+	client->warmup = 0;
+	client->credits_ms = 0;
+	client->has_idled = 0;
+	client->gpu_ms = 0;
+	client->fair_ms = 0;
+	client->boost_until.tv_sec = 0;
+	client->boost_until.tv_nsec = 0;
+	client->millishares = NVSHARE_FULL_SHARE;
+	client->workload = NULL;
+	client->contexts = 0;
+	client->ooms = 0;
+	client->slices = 0;
+	client->overruns = 0;
+	client->denied = 0;
+	client->overrun_history = 0;
+	client->history_slices = 0;
+	client->slice_overran = 0;
+	client->repeat_overrunner = 0;
+	(void)get_pod_account(client); /* Export the Pod from the start */
+	/* Unless IDENTITY carried them already */
+	set_container_fields(client, in_msg->data);
+	client->overflow = (nvshare_msg_get_field(in_msg->data,
+		NVSHARE_OVERFLOW_FIELD, value, sizeof(value)) == 0 &&
+		strcmp(value, "1") == 0);
+	if (client->overflow)
+		log_info("Client %016" PRIx64 " runs without an nvshare"
+			 " device, in overflow mode", nvshare_client_id);
+	evict_stale_clients(client);
+
+	/*
+	 * Inform the client of the current status of our current status, as
+	 * well as the ID we generated for it.
+	 *
+	 * It will henceforth present this ID to interact with us.
+	 */
+	true_or_exit(snprintf(out_msg.data, 16+1, "%016" PRIx64, nvshare_client_id) == 16);
+	/* So that the client can tell whether we check its version */
+	snprintf(out_msg.pod_name, sizeof(out_msg.pod_name), "%s=%d",
+		 NVSHARE_VERSION_FIELD, NVSHARE_PROTOCOL_VERSION);
+	out_msg.type = scheduler_on ? SCHED_ON : SCHED_OFF;
+	if ((ret = send_message(client, &out_msg)) < 0)
+		goto out_with_msg;
+
+	/* With the scheduler OFF, the client can use the GPU right away */
+	if (!scheduler_on) record_ttfs(client);
+
+out_with_msg:
+	/* out_msg is global, so make sure we've zeroed it out */
+	memset(&out_msg.data, 0, sizeof(out_msg.data));
+	memset(&out_msg.pod_name, 0, sizeof(out_msg.pod_name));
+
+	return ret;
+}
+
+
+/*
+ * Register a client and announce it. On failure, the caller gets rid of the
+ * client.
+ */
+static int complete_registration(struct nvshare_client *client,
+	const struct message *in_msg)
+{
+	if (register_client(client, in_msg) < 0) {
+		nvshare_event(NVSHARE_EVENT_INFO, "reject",
+			      NVSHARE_UNREGISTERED_ID, in_msg->pod_namespace,
+			      in_msg->pod_name, "%s",
+			      message_type_string[in_msg->type]);
+		return -1;
+	}
+	if (sched_policy->on_register != NULL)
+		sched_policy->on_register(client);
+	client_event(NVSHARE_EVENT_INFO, in_msg->type == REATTACH ?
+		     "reattach" : "register", client,
+		     "protocol=v%d slot=%s generation=%s overflow=%d pid=%d"
+		     " uid=%d", client->proto_version, client->slot,
+		     client->generation, client->overflow,
+		     (int)client->peer_pid, (int)client->peer_uid);
+	nvshare_lifecycle_hook(in_msg->type == REATTACH ? "reattach" :
+			       "register", client->id, client->pod_namespace,
+			       client->pod_name, client->name);
+	/* A reattaching client is past its init phase */
+	if (in_msg->type == REGISTER && serialize_init_ms > 0) {
+		initializing = client;
+		init_phases++;
+		true_or_exit(clock_gettime(CLOCK_REALTIME, &init_ts) == 0);
+		true_or_exit(pthread_cond_signal(&init_cv) == 0);
+		log_debug("Client %016" PRIx64 " is initializing", client->id);
+	}
+	/* We may have evicted the lock holder */
+	if (!lock_held && scheduler_on) try_schedule();
+	log_info("%s client %016" PRIx64 " (PID %d) with Pod name = %s,"
+		 " Pod namespace = %s", in_msg->type == REATTACH ?
+		 "Reattached" : "Registered", client->id,
+		 (int)client->peer_pid, client->pod_name,
+		 client->pod_namespace);
+	bcast_client_count();
+	if (backpressure) send_backpressure(client);
+	check_idle();
+	return 0;
+}
+
+
+/* The client that was initializing is done, let the next one in */
+static void end_init(const char *reason)
+{
+	if (initializing == NULL) return;
+
+	log_info("Client %016" PRIx64 " is done initializing (%s)",
+		 initializing->id, reason);
+	client_event(NVSHARE_EVENT_DEBUG, "init_done", initializing, "%s",
+		     reason);
+	initializing = NULL;
+	admit_next_init();
+}
+
+
+/*
+ * Register the client that has been waiting the longest to initialize.
+ *
+ * We may get here while the main loop is handling a batch of events, so
+ * we don't delete the clients we reject. We shut down their connection
+ * instead and let the main loop delete them when it sees the hangup, as
+ * evict_stale_clients() does.
+ */
+static void admit_next_init(void)
+{
+	struct nvshare_client *c, *next;
+
+	while (initializing == NULL) {
+		next = NULL;
+		LL_FOREACH(clients, c) {
+			if (c->init_seq == 0 || c->evicted) continue;
+			if (next == NULL || c->init_seq < next->init_seq)
+				next = c;
+		}
+		if (next == NULL) return;
+
+		next->init_seq = 0;
+		log_info("Admitting Pod %s/%s to initialize",
+			 next->init_msg.pod_namespace,
+			 next->init_msg.pod_name);
+		if (complete_registration(next, &next->init_msg) < 0) {
+			next->evicted = 1;
+			if (shutdown(next->fd, SHUT_RDWR) < 0)
+				log_warn("Failed to shut down the connection"
+					 " of Pod %s/%s",
+					 next->init_msg.pod_namespace,
+					 next->init_msg.pod_name);
+		}
+	}
+}
+
+
+static int num_waiting_init(void)
+{
+	int n = 0;
+	struct nvshare_client *c;
+
+	LL_FOREACH(clients, c) if (c->init_seq > 0 && !c->evicted) n++;
+	return n;
+}
+
+
+/*
+ * Take the client out of the queue and shut down its connection. The main
+ * loop deletes it when it sees the hangup, see evict_stale_clients().
+ */
+static void evict_client(struct nvshare_client *c)
+{
+	remove_req(c);
+	c->evicted = 1;
+	if (shutdown(c->fd, SHUT_RDWR) < 0)
+		log_warn("Failed to shut down the connection of client %016"
+			 PRIx64, c->id);
+}
+
+
+/* Whether two clients come from the same container of the same Pod */
+static int same_container(struct nvshare_client *a, struct nvshare_client *b)
+{
+	return (a->pod_uid[0] != '\0' && strcmp(a->pod_uid, b->pod_uid) == 0 &&
+		strcmp(a->container, b->container) == 0);
+}
+
+
+/* Store the device slot and container instance in data, if it has them */
+static void set_container_fields(struct nvshare_client *client,
+	const char *data)
+{
+	char slot[MSG_DATA_LEN + 1], generation[MSG_DATA_LEN + 1];
+
+	if (nvshare_msg_get_field(data, NVSHARE_SLOT_FIELD, slot,
+				  sizeof(slot)) != 0 ||
+	    nvshare_msg_get_field(data, NVSHARE_GENERATION_FIELD, generation,
+				  sizeof(generation)) != 0)
+		return;
+	strlcpy(client->slot, slot, sizeof(client->slot));
+	strlcpy(client->generation, generation, sizeof(client->generation));
+}
+
+
+/*
+ * Store the Pod UID and container, and the device slot and container
+ * instance, that an IDENTITY message carries
+ */
+static void set_identity(struct nvshare_client *client,
+			 const struct message *in_msg)
+{
+	char identity[POD_NAME_LEN_MAX + 1];
+	char *container;
+
+	set_container_fields(client, in_msg->data);
+	snprintf(identity, sizeof(identity), "%.*s",
+		 (int)sizeof(in_msg->pod_name), in_msg->pod_name);
+	if (identity[0] == '\0') return; /* No Pod UID */
+	container = strchr(identity, '/');
+	if (container == NULL) {
+		log_warn("Ignoring malformed %s",
+			 message_type_string[in_msg->type]);
+		return;
+	}
+	*container++ = '\0';
+	if (identity[0] == '\0' ||
+	    strlen(identity) > NVSHARE_POD_UID_LEN_MAX ||
+	    strlen(container) > NVSHARE_CONTAINER_LEN_MAX) {
+		log_warn("Ignoring malformed %s",
+			 message_type_string[in_msg->type]);
+		return;
+	}
+	strlcpy(client->pod_uid, identity, sizeof(client->pod_uid));
+	strlcpy(client->container, container, sizeof(client->container));
+}
+
+
+/*
+ * When a container restarts, the kubelet may hand its nvshare device to the
+ * new instance of the container before we notice that the client of the
+ * previous instance is gone. Such a ghost client holds its place in the
+ * queue, but will never use the GPU.
+ *
+ * libnvshare tells us the device slot of its container and which instance
+ * of the container it runs in. Evict every client of the same Pod and slot
+ * that comes from another instance.
+ *
+ * We don't free the evicted clients here, as we may be in the middle of
+ * handling a batch of events that refer to them. Instead, we shut down
+ * their connection and let the main loop delete them when it sees the
+ * hangup.
+ */
+static void evict_stale_clients(struct nvshare_client *client)
+{
+	struct nvshare_client *c;
+
+	if (client->slot[0] == '\0') return;
+
+	LL_FOREACH(clients, c) {
+		if (c == client || !has_registered(c) || c->evicted) continue;
+		if (strcmp(c->slot, client->slot) != 0 ||
+		    strcmp(c->generation, client->generation) == 0 ||
+		    strcmp(c->pod_namespace, client->pod_namespace) != 0 ||
+		    strcmp(c->pod_name, client->pod_name) != 0)
+			continue;
+
+		log_warn("Evicting stale client %016" PRIx64 " of Pod %s/%s,"
+			 " its container has restarted", c->id,
+			 c->pod_namespace, c->pod_name);
+		client_event(NVSHARE_EVENT_INFO, "evict", c,
+			     "replaced by client %016" PRIx64, client->id);
+		send_error(c, NVSHARE_ERR_EVICTED, "Evicted, a newer instance"
+			   " of this container has registered");
+		evict_client(c);
+	}
+}
+
+
+/*
+ * Evict the registered client with the given ID on behalf of an operator
+ * (nvsharectl --evict), e.g., because it hogs the GPU. Like
+ * evict_stale_clients(), leave it to the main loop to delete the client.
+ *
+ * Return 1 if we evicted a client, 0 if no registered client has that ID.
+ */
+static int kick_client(uint64_t id)
+{
+	struct nvshare_client *c;
+
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c) || c->evicted || c->id != id) continue;
+
+		log_warn("Evicting client %016" PRIx64 " (%s) of Pod %s/%s on"
+			 " request", c->id, c->name, c->pod_namespace,
+			 c->pod_name);
+		client_event(NVSHARE_EVENT_INFO, "evict", c, "on request");
+		send_error(c, NVSHARE_ERR_KICKED, "Evicted by an operator");
+		evict_client(c);
+		/* It may have held the lock */
+		if (!lock_held && scheduler_on) try_schedule();
+		return 1;
+	}
+	return 0;
+}
+
+
+static void end_boost(struct nvshare_client *c, const char *why)
+{
+	c->boost_until.tv_sec = 0;
+	c->boost_until.tv_nsec = 0;
+	log_info("The boost of client %016" PRIx64 " (%s) of Pod %s/%s has"
+		 " %s, its slice is back to %lld ms", c->id, c->name,
+		 c->pod_namespace, c->pod_name, why, client_turn_ms(c));
+	client_event(NVSHARE_EVENT_INFO, "boost_end", c, "%s", why);
+}
+
+
+/*
+ * Boost the registered client with the given ID for duration_s on behalf of
+ * an operator (nvsharectl --boost), or end its boost early if duration_s is
+ * 0. A new boost replaces the one the client has.
+ *
+ * Return 1 if we boosted the client, 0 if no registered client has that ID.
+ */
+static int boost_client(uint64_t id, long long duration_s)
+{
+	struct nvshare_client *c;
+
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c) || c->evicted || c->id != id) continue;
+
+		if (duration_s == 0) {
+			if (client_boosted(c)) end_boost(c, "ended on request");
+			return 1;
+		}
+		true_or_exit(clock_gettime(CLOCK_REALTIME,
+			     &c->boost_until) == 0);
+		c->boost_until.tv_sec += duration_s;
+		boosts++;
+		log_warn("Boosting client %016" PRIx64 " (%s) of Pod %s/%s on"
+			 " request for %lld s, its slice is now %lld ms and its"
+			 " effective share %.1f%%", c->id, c->name,
+			 c->pod_namespace, c->pod_name, duration_s,
+			 client_turn_ms(c), client_effective_share(c) * 100);
+		client_event(NVSHARE_EVENT_INFO, "boost", c,
+			     "duration=%llds factor=%lld", duration_s,
+			     boost_factor);
+		true_or_exit(pthread_cond_signal(&boost_cv) == 0);
+		return 1;
+	}
+	return 0;
+}
+
+
+/* Whether we may evict the client to reclaim memory, see reclaim_policy */
+static int client_reclaimable(struct nvshare_client *client)
+{
+	return (client->workload == NULL || client->workload->reclaim);
+}
+
+
+/* How long the client hasn't wanted the GPU, 0 if it wants it now */
+static long long client_idle_ms(struct nvshare_client *client)
+{
+	struct nvshare_request *r;
+
+	LL_FOREACH(requests, r)
+		if (r->client == client) return 0;
+	return elapsed_ms_since(client->has_idled ? &client->idle_ts :
+				&client->register_ts);
+}
+
+
+/* Slices the client has gotten per minute since it registered */
+static double client_slice_rate(struct nvshare_client *client)
+{
+	long long ms = elapsed_ms_since(&client->register_ts);
+
+	return client->slices * 60000.0 / (ms > 0 ? ms : 1);
+}
+
+
+/* Whether a makes a better victim than b, according to reclaim_policy */
+static int reclaim_before(struct nvshare_client *a, struct nvshare_client *b)
+{
+	switch (reclaim_policy) {
+	case RECLAIM_LFU:
+		return client_slice_rate(a) < client_slice_rate(b);
+	case RECLAIM_PRIORITY:
+		if (a->millishares != b->millishares)
+			return a->millishares < b->millishares;
+		/* Fall through */
+	default:
+		return client_idle_ms(a) > client_idle_ms(b);
+	}
+}
+
+
+/*
+ * A client ran out of GPU memory. Evict the victim that reclaim_policy
+ * picks among the other clients of its GPU, unless we did so lately. Like
+ * kick_client(), leave it to the main loop to delete the victim.
+ */
+static void reclaim_memory(struct nvshare_client *client)
+{
+	static struct timespec last_reclaim_ts;
+	struct nvshare_client *c, *victim = NULL;
+	struct reclaim_record *rec;
+
+	if (reclaims > 0 &&
+	    elapsed_ms_since(&last_reclaim_ts) < RECLAIM_COOLDOWN_S * 1000) {
+		log_debug("Evicted a client to reclaim GPU memory less than"
+			  " %d s ago, not evicting another", RECLAIM_COOLDOWN_S);
+		return;
+	}
+	LL_FOREACH(clients, c) {
+		if (c == client || !has_registered(c) || c->evicted ||
+		    !client_reclaimable(c) || c->mem_committed_mib <= 0)
+			continue;
+		if (client->gpu_uuid[0] != '\0' && c->gpu_uuid[0] != '\0' &&
+		    strcmp(client->gpu_uuid, c->gpu_uuid) != 0)
+			continue;
+		if (victim == NULL || reclaim_before(c, victim)) victim = c;
+	}
+	if (victim == NULL) {
+		log_info("No client to evict to reclaim GPU memory for client"
+			 " %016" PRIx64, client->id);
+		return;
+	}
+
+	log_warn("Evicting client %016" PRIx64 " (%s) of Pod %s/%s to reclaim"
+		 " its %lld MiB of GPU memory for client %016" PRIx64 " (%s)",
+		 victim->id, victim->name, victim->pod_namespace,
+		 victim->pod_name, victim->mem_committed_mib, client->id,
+		 reclaim_policies[reclaim_policy]);
+	client_event(NVSHARE_EVENT_INFO, "evict", victim,
+		     "reclaim policy=%s for=%016" PRIx64 " committed=%lldMiB",
+		     reclaim_policies[reclaim_policy], client->id,
+		     victim->mem_committed_mib);
+	rec = &reclaim_history[reclaims % RECLAIM_HISTORY];
+	rec->id = victim->id;
+	strlcpy(rec->pod_name, victim->pod_name, sizeof(rec->pod_name));
+	strlcpy(rec->pod_namespace, victim->pod_namespace,
+		sizeof(rec->pod_namespace));
+	rec->mem_committed_mib = victim->mem_committed_mib;
+	rec->oom_id = client->id;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &rec->ts) == 0);
+	last_reclaim_ts = rec->ts;
+	reclaims++;
+
+	send_error(victim, NVSHARE_ERR_KICKED, "Evicted to reclaim GPU memory");
+	evict_client(victim);
+	/* It may have held the lock */
+	if (!lock_held && scheduler_on) try_schedule();
+}
+
+
+/*
+ * Tell a client why we are turning it away, if it speaks a protocol version
+ * that knows SCHED_ERROR. The caller closes the connection.
+ */
+static void send_error(struct nvshare_client *client, enum nvshare_error code,
+	const char *fmt, ...)
+{
+	struct message msg = {0};
+	va_list ap;
+
+	if (client->proto_version < NVSHARE_ERROR_MIN_VERSION) return;
+
+	msg.type = SCHED_ERROR;
+	msg.id = client->id;
+	snprintf(msg.data, sizeof(msg.data), "%s=%d", NVSHARE_ERROR_FIELD,
+		 (int)code);
+	va_start(ap, fmt);
+	vsnprintf(msg.pod_name, sizeof(msg.pod_name), fmt, ap);
+	va_end(ap);
+	if (send_message(client, &msg) < 0)
+		log_debug("Failed to send %s to client %016" PRIx64,
+			  message_type_string[msg.type], client->id);
+}
+
+
+/*
+ * Tell every registered client how many registered clients there are.
+ *
+ * We may get here from delete_client(), so leave dead clients for the main
+ * loop to clean up instead of deleting them here.
+ */
+static void bcast_client_count(void)
+{
+	struct message msg = {0};
+	struct nvshare_client *c;
+
+	msg.type = CLIENT_COUNT;
+	snprintf(msg.data, sizeof(msg.data), "%s=%d",
+		 NVSHARE_CLIENT_COUNT_FIELD, num_registered_clients());
+	begin_sends();
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c) || c->evicted ||
+		    c->proto_version < NVSHARE_CLIENT_COUNT_MIN_VERSION)
+			continue;
+		msg.id = c->id;
+		if (send_message(c, &msg) < 0) {
+			/* It won't read the hand-off messages either */
+			c->evicted = 1;
+			if (shutdown(c->fd, SHUT_RDWR) < 0)
+				log_warn("Failed to shut down the connection"
+					 " of client %016" PRIx64, c->id);
+		}
+	}
+	end_sends();
+}
+
+
+/*
+ * Tell a client how long to pause before it requests the lock again, 0 if
+ * there is no backpressure. Like bcast_client_count(), leave a client we
+ * fail to reach for the main loop to clean up.
+ */
+static void send_backpressure(struct nvshare_client *client)
+{
+	struct message msg = {0};
+
+	if (client->proto_version < NVSHARE_BACKPRESSURE_MIN_VERSION) return;
+	msg.type = BACKPRESSURE;
+	msg.id = client->id;
+	snprintf(msg.data, sizeof(msg.data), "%s=%lld",
+		 NVSHARE_BACKPRESSURE_FIELD,
+		 backpressure ? backpressure_pause_ms : 0);
+	if (send_message(client, &msg) < 0) {
+		client->evicted = 1;
+		if (shutdown(client->fd, SHUT_RDWR) < 0)
+			log_warn("Failed to shut down the connection of"
+				 " client %016" PRIx64, client->id);
+	}
+}
+
+
+/*
+ * Turn backpressure on or off, according to the thresholds, and tell every
+ * registered client if that changes anything. Hold the global mutex.
+ */
+static void update_backpressure(void)
+{
+	struct nvshare_client *c;
+	int clients_cnt = num_registered_clients();
+	int over;
+	long long ms;
+
+	over = (backpressure_clients > 0 &&
+		clients_cnt >= backpressure_clients) ||
+	       (backpressure_switch_rate > 0 &&
+		switch_rate > backpressure_switch_rate);
+	if (over == backpressure) return;
+
+	backpressure = over;
+	if (backpressure) {
+		backpressure_activations++;
+		true_or_exit(clock_gettime(CLOCK_MONOTONIC,
+			     &backpressure_ts) == 0);
+		log_warn("Under load with %d clients and %.1f lock switches/s,"
+			 " asking clients to pause for %lld ms before they"
+			 " request the GPU lock again", clients_cnt,
+			 switch_rate, backpressure_pause_ms);
+		nvshare_event(NVSHARE_EVENT_INFO, "backpressure",
+			      NVSHARE_UNREGISTERED_ID, NULL, NULL,
+			      "clients=%d switch_rate=%.1f pause=%lldms",
+			      clients_cnt, switch_rate, backpressure_pause_ms);
+	} else {
+		ms = elapsed_ms_since(&backpressure_ts);
+		log_info("Load subsided after %.1f s, lifting backpressure",
+			 ms / 1000.0);
+		nvshare_event(NVSHARE_EVENT_INFO, "backpressure_end",
+			      NVSHARE_UNREGISTERED_ID, NULL, NULL,
+			      "duration=%lldms", ms);
+	}
+	LL_FOREACH(clients, c) {
+		if (!has_registered(c) || c->evicted) continue;
+		send_backpressure(c);
+	}
+}
+
+
+/*
+ * Evict the clients that have left a message half-sent for longer than
+ * client_recv_timeout_ms. Call from the main loop, after it has handled a
+ * batch of events, as we free the clients here.
+ */
+static void check_recv_timeouts(void)
+{
+	struct nvshare_client *c, *tmp;
+	char id_str[HEX_STR_LEN(c->id)];
+	int deleted = 0;
+
+	LL_FOREACH_SAFE(clients, c, tmp) {
+		if (c->in_len == 0 ||
+		    elapsed_ms_since(&c->in_ts) < client_recv_timeout_ms)
+			continue;
+		client_id_as_string(id_str, sizeof(id_str), c->id);
+		socket_timeouts++;
+		log_warn("Client %s sent %zu/%zu bytes of a message and nothing"
+			 " more for %lld ms, evicting it", id_str, c->in_len,
+			 sizeof(c->in_msg), client_recv_timeout_ms);
+		client_event(NVSHARE_EVENT_INFO, "recv_timeout", c,
+			     "bytes=%zu", c->in_len);
+		delete_client(c);
+		deleted = 1;
+	}
+	if (deleted && !lock_held && scheduler_on) try_schedule();
+}
+
+
+static void bcast_status(void)
+{
+	struct nvshare_client *tmp, *c;
+
+	begin_sends();
+	LL_FOREACH_SAFE(clients, c, tmp) {
+		if (!has_registered(c)) continue;
+
+		out_msg.type = scheduler_on ? SCHED_ON : SCHED_OFF;
+		if (send_message(c, &out_msg) < 0)
+			delete_client(c);
+	}
+	end_sends();
+}
+
+
+/* Start a batch of messages that share send_budget_ms, they may nest */
+static void begin_sends(void)
+{
+	if (send_batches++ == 0) send_budget_ms = client_send_timeout_ms;
+}
+
+
+static void end_sends(void)
+{
+	send_batches--;
+}
+
+
+/*
+ * Send a given message to a given client.
+ *
+ * We are particularly strict and consider the client dead if we encounter any
+ * (even possibly recoverable if we were more lenient) error.
+ */
+static int send_message(struct nvshare_client *client, struct message *msg_p)
+{
+	ssize_t ret;
+	long long waited_ms, timeout_ms;
+	struct timespec start;
+	char id_str[HEX_STR_LEN(client->id)];
+
+	client_id_as_string(id_str, sizeof(id_str), client->id);
+
+	timeout_ms = send_batches > 0 ? send_budget_ms : client_send_timeout_ms;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &start) == 0);
+	ret = nvshare_send_whole_noblock(client->fd, msg_p, sizeof(*msg_p),
+		(int)timeout_ms);
+	waited_ms = elapsed_ms_since(&start);
+	if (send_batches > 0)
+		send_budget_ms = waited_ms < send_budget_ms ?
+			send_budget_ms - waited_ms : 0;
+
+	if (ret < 0) {
+		if (errno == EAGAIN || errno == EWOULDBLOCK) {
+			/* It has stopped reading its messages */
+			socket_timeouts++;
+			log_warn("Timed out sending %s to client %s after %lld"
+				 " ms", message_type_string[msg_p->type],
+				 id_str, waited_ms);
+			client_event(NVSHARE_EVENT_INFO, "send_timeout", client,
+				     "%s", message_type_string[msg_p->type]);
+			return -1;
+		}
+		if (errno == ECONNRESET ||
+		    errno == EPIPE) { /* Recoverable errors, but we're strict */
+			log_info("Failed to send message to client %s",
 				 id_str);
 			return -1;
 		} else log_fatal("nvshare_send_noblock() failed unrecoverably");
-	} else { /* ret == 0 */
+	} else { /* ret == sizeof(*msg_p) */
 		log_info("Sent %s to client %s",
 		         message_type_string[msg_p->type], id_str);
 	}
@@ -253,7 +3648,16 @@ static int send_message(struct nvshare_client *client, struct message *msg_p)
 }
 
 /*
- * Send a given message to a given client.
+ * Receive a message from a given client.
+ *
+ * Messages are fixed-size, but they may arrive in pieces. We keep the partial
+ * message in the client struct and return 1 until all of it has arrived. We
+ * return 0 once a whole message is in msg_p. We never read more than one
+ * message at a time, so a client can't make us buffer more than that.
+ *
+ * A message whose fields aren't NULL-terminated would have us read past it
+ * when we parse it, so we drop a client that sends one, as a buggy or hostile
+ * client is better off gone than misunderstood.
  *
  * We are particularly strict and consider the client dead if we encounter any
  * (even possibly recoverable if we were more lenient) error.
@@ -261,22 +3665,52 @@ static int send_message(struct nvshare_client *client, struct message *msg_p)
 static int receive_message(struct nvshare_client *client, struct message *msg_p)
 {
 	ssize_t ret;
+	const char *reason;
 	char id_str[HEX_STR_LEN(client->id)];
 
 	client_id_as_string(id_str, sizeof(id_str), client->id);
 
-	ret = nvshare_receive_noblock(client->fd, msg_p, sizeof(*msg_p));
+	ret = nvshare_receive_noblock(client->fd,
+		(char *)&client->in_msg + client->in_len,
+		sizeof(client->in_msg) - client->in_len);
 
 	if (ret == 0) { /* Client closed the other end of the connection */
 		errno = ENOTCONN;
-		log_debug("Client %s has closed the connection", id_str);
+		if (client->in_len > 0)
+			log_info("Client %s closed the connection in the"
+				 " middle of a message", id_str);
+		else log_debug("Client %s has closed the connection", id_str);
 		return -1;
-	} else if (ret > 0 && (size_t)ret < sizeof(*msg_p)) { /* Partial receive */
-		return -1;
-	} else if (ret < 0) {
-		if (errno == EAGAIN ||
-		    errno == EWOULDBLOCK ||
-		    errno == ECONNRESET ||
+	} else if (ret > 0) {
+		if (client->in_len == 0)
+			true_or_exit(clock_gettime(CLOCK_MONOTONIC,
+				     &client->in_ts) == 0);
+		client->in_len += ret;
+		if (client->in_len < sizeof(client->in_msg)) { /* Partial */
+			log_debug("Received %zu/%zu bytes of a message from"
+				  " client %s", client->in_len,
+				  sizeof(client->in_msg), id_str);
+			return 1;
+		}
+		memcpy(msg_p, &client->in_msg, sizeof(*msg_p));
+		client->in_len = 0;
+		reason = nvshare_msg_check(msg_p);
+		if (reason != NULL) {
+			invalid_messages++;
+			log_warn("Dropping client %s (PID %d), which sent a"
+				 " malformed message of type %d: %s", id_str,
+				 (int)client->peer_pid, (int)msg_p->type,
+				 reason);
+			client_event(NVSHARE_EVENT_INFO, "invalid_message",
+				     client, "type=%d %s", (int)msg_p->type,
+				     reason);
+			errno = EPROTO;
+			return -1;
+		}
+	} else if (errno == EAGAIN || errno == EWOULDBLOCK) {
+		return 1; /* Spurious wakeup, nothing to read yet */
+	} else {
+		if (errno == ECONNRESET ||
 		    errno == EPIPE) {
 			log_info("Failed to receive message from client %s",
 				 id_str);
@@ -286,32 +3720,220 @@ static int receive_message(struct nvshare_client *client, struct message *msg_p)
 	return 0;
 }
 
+/*
+ * Have the memory thread check the free GPU memory for the client at the
+ * head of the requests list.
+ */
+static void wait_for_memory(struct nvshare_client *client)
+{
+	if (client == mem_waiting) return;
+	mem_waiting = client;
+	mem_wait_logged = 0;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &mem_wait_ts) == 0);
+	pthread_cond_broadcast(&mem_cv);
+}
+
+
+/*
+ * Have the power thread boost the GPU clocks while a boosted client holds
+ * the lock, and relax them otherwise.
+ */
+static void update_power(void)
+{
+	int boost;
+
+	if (!power_mgmt || power_failed) return;
+	boost = (lock_held && requests != NULL &&
+		 client_boost(requests->client));
+	if (boost == power_boost) return;
+	power_boost = boost;
+	pthread_cond_broadcast(&power_cv);
+}
+
+
+/*
+ * Why the client at the head of the requests list goes next, for fairness
+ * debugging: a short reason for the event log, returned, and an explanation
+ * for the log in buf. promoted tells whether it has waited behind exclusive
+ * clients for too long, see overdue_request().
+ */
+static const char *grant_reason(int promoted, char *buf, size_t len)
+{
+	struct nvshare_request *r = requests, *o;
+	struct nvshare_client *c = r->client;
+	int rank = request_rank(r), peers = 0, others = 0;
+
+	LL_FOREACH(r->next, o) {
+		others++;
+		if (request_rank(o) == rank) peers++;
+	}
+	if (promoted) {
+		snprintf(buf, len, "it has waited behind exclusive clients for"
+			 " %lld ms", elapsed_ms_since(&r->since));
+		return "exclusive_timeout";
+	}
+	if (others == 0) {
+		snprintf(buf, len, "it is the only client waiting");
+		return "only";
+	}
+	switch (rank) {
+	case 0:
+		snprintf(buf, len, "its workload type %s is exclusive, so it"
+			 " goes before preemptible clients",
+			 c->workload->name);
+		return "exclusive";
+	case 1:
+		snprintf(buf, len, "it has %lld ms of burst credits, so it goes"
+			 " before clients without", c->credits_ms);
+		return "burst";
+	case 3:
+		snprintf(buf, len, "it is a repeat overrunner, but so are the"
+			 " %d other waiting client(s)", others);
+		return "deprioritized";
+	}
+	if (peers == 0) {
+		snprintf(buf, len, "the %d other waiting client(s) are"
+			 " deprioritized repeat overrunners", others);
+		return "others_deprioritized";
+	}
+	if (sched_policy->before == fair_share_before) {
+		snprintf(buf, len, "it has had the least GPU time for its share"
+			 " (%lld ms) of the %d client(s) of its rank", c->fair_ms,
+			 peers + 1);
+		return "fair_share";
+	}
+	snprintf(buf, len, "it requested the lock first of the %d client(s) of"
+		 " its rank, %lld ms ago", peers + 1,
+		 elapsed_ms_since(&r->since));
+	return "fcfs";
+}
+
+
 /*
  * Try to assign the GPU lock to a client in the requests list in FCFS order.
- *
- * Return only on successful assignment of GPU lock to a client or if the
- * requests list is empty.
+ * If we drop stuck clients on the way, they share a single send timeout.
  */
 static void try_schedule(void)
 {
-	int ret;
+	begin_sends();
+	grant_lock();
+	end_sends();
+}
+
+
+/*
+ * Return only on successful assignment of GPU lock to a client, if the
+ * requests list is empty, or if the client must wait for GPU memory.
+ */
+static void grant_lock(void)
+{
+	int ret, promoted;
+	struct nvshare_client *c;
+	struct nvshare_request *r;
+	const char *reason;
+	char why[256];
+	char id_str[HEX_STR_LEN(uint64_t)];
 
 try_again:
-	if (requests == NULL) {
+	if (quiescing) {
+		log_debug("try_schedule() called while quiescing");
+		return;
+	} else if (requests == NULL) {
 		log_debug("try_schedule() called with no pending requests");
 		return;
 	} else {
-		out_msg.type = LOCK_OK;
+		/* Don't let exclusive clients keep the others waiting forever */
+		r = overdue_request();
+		promoted = (r != NULL && (r != requests || exclusive_dropped));
+		if (promoted) {
+			log_info("Client %016" PRIx64 " has waited behind"
+				 " exclusive clients for %lld ms, it goes next",
+				 r->client->id, elapsed_ms_since(&r->since));
+			client_event(NVSHARE_EVENT_INFO, "exclusive_timeout",
+				     r->client, "waited=%lldms",
+				     elapsed_ms_since(&r->since));
+			exclusive_timeouts++;
+			LL_DELETE(requests, r);
+			LL_PREPEND(requests, r);
+		}
+		exclusive_dropped = 0;
 		/* FCFS, use head of requests list */
-		ret = send_message(requests->client, &out_msg);
+		c = requests->client;
+		if (!c->mem_admitted && client_min_free_mib(c) > 0) {
+			/* The memory thread calls us again once it's free */
+			wait_for_memory(c);
+			return;
+		}
+		reason = grant_reason(promoted, why, sizeof(why));
+		out_msg.type = LOCK_OK;
+		ret = send_message(c, &out_msg);
 		if (ret < 0) { /* Client's dead to us */
-			delete_client(requests->client);
+			delete_client(c);
 			goto try_again;
 		}
+		c->mem_admitted = 0;
+		client_event(NVSHARE_EVENT_DEBUG, "lock_ok", c, "reason=%s",
+			     reason);
 		scheduling_round++;
+		if (c->id != last_holder_id) {
+			lock_switches++;
+			get_gpu_account(c->gpu_uuid)->lock_switches++;
+		}
+		c->slices++;
+		last_holder_id = c->id;
 		lock_held = 1;
+		update_power();
+		true_or_exit(clock_gettime(CLOCK_MONOTONIC, &c->slice_ts) == 0);
+		slice_extra_ms = requests->burst ? c->credits_ms : 0;
+		c->warmup = (c->ttfs_ms < 0 && grant_warmup(c));
+		client_id_as_string(id_str, sizeof(id_str), c->id);
+		log_debug("Client %s (%s) gets the GPU lock because %s. Its"
+			  " slice is %lld ms%s%s, its effective share %.1f%%",
+			  id_str, c->name, why,
+			  client_slice_ms(c) + slice_extra_ms,
+			  slice_extra_ms > 0 ? " with burst credits" : "",
+			  c->warmup ? ", plus a warmup grace" : "",
+			  client_effective_share(c) * 100);
 		must_reset_timer = 1;
 		pthread_cond_broadcast(&timer_cv);
+
+		record_ttfs(c);
+		if (c->trace_sampled) {
+			true_or_exit(clock_gettime(CLOCK_REALTIME, &c->grant_ts) == 0);
+			nvshare_trace_span("nvshare.lock.wait", c->id,
+				c->lock_cycle, c->pod_name, c->pod_namespace,
+				&c->req_ts, &c->grant_ts);
+		}
+	}
+}
+
+
+/*
+ * The lock holder hasn't released the lock overrun_threshold_ms after we
+ * asked it to, most likely because it's running a kernel that is too long
+ * to share the GPU with others.
+ *
+ * Called with global_mutex held.
+ */
+static void flag_overrun(struct nvshare_client *client)
+{
+	char id_str[HEX_STR_LEN(client->id)];
+	long long held_ms = elapsed_ms_since(&client->slice_ts);
+
+	client_id_as_string(id_str, sizeof(id_str), client->id);
+	client->overruns++;
+	client->slice_overran = 1;
+	overruns++;
+	log_warn("Client %s (%s) has held the GPU lock for %lld ms and hasn't"
+		 " released it %lld ms after being asked to. It may be"
+		 " running a kernel that is too long to share the GPU.",
+		 id_str, client->name, held_ms, overrun_threshold_ms);
+	client_event(NVSHARE_EVENT_INFO, "overrun", client, "held=%lldms",
+		     held_ms);
+	if (overrun_deny && !client->denied) {
+		client->denied = 1;
+		log_warn("Client %s (%s) will not get the GPU lock again",
+			 id_str, client->name);
 	}
 }
 
@@ -333,6 +3955,8 @@ void *timer_thr_fn(void *arg __attribute__((unused)))
 	struct timespec timer_end_ts = {0, 0};
 	int ret;
 	int drop_lock_sent = 0;
+	int overrun_flagged = 0;
+	long long slice_ms;
 
 	t_msg.id = 1337; /* Nobody checks this */
 	t_msg.type = DROP_LOCK;
@@ -342,14 +3966,44 @@ void *timer_thr_fn(void *arg __attribute__((unused)))
 		must_reset_timer = 0;
 		round_at_start = scheduling_round;
 		true_or_exit(clock_gettime(CLOCK_REALTIME, &timer_end_ts) == 0);
-		timer_end_ts.tv_sec += tq;
+		/*
+		 * The lock holder keeps the lock for its share of its TQ.
+		 * Bursting clients get to keep it for longer.
+		 */
+		slice_ms = (long long)tq * 1000;
+		if (lock_held && requests != NULL)
+			slice_ms = client_slice_ms(requests->client) +
+				   slice_extra_ms;
+		if (lock_held && slice_ms < min_dwell_ms)
+			slice_ms = min_dwell_ms;
+		if (lock_held && requests != NULL && requests->client->warmup &&
+		    slice_ms < warmup_ms)
+			slice_ms = warmup_ms;
+		/* Give the lock holder a deadline to comply with DROP_LOCK */
+		if (drop_lock_sent && overrun_threshold_ms > 0 &&
+		    !overrun_flagged)
+			slice_ms = overrun_threshold_ms;
+		timer_end_ts.tv_sec += slice_ms / 1000;
+		timer_end_ts.tv_nsec += (slice_ms % 1000) * 1000000;
+		if (timer_end_ts.tv_nsec >= 1000000000) {
+			timer_end_ts.tv_sec++;
+			timer_end_ts.tv_nsec -= 1000000000;
+		}
 remainder:
 		ret = pthread_cond_timedwait(&timer_cv, &global_mutex, &timer_end_ts);
 		/* Wake up with global_mutex held, can do whatever we want */
 		if (ret == ETIMEDOUT) { /* TQ elapsed */
 			log_debug("TQ elapsed");
 			if (!lock_held) continue; /* Life is meaningless :( */
-			if (drop_lock_sent) continue; /* Send it only once */
+			if (drop_lock_sent) { /* Send it only once */
+				if (overrun_threshold_ms > 0 &&
+				    !overrun_flagged && requests != NULL &&
+				    round_at_start == scheduling_round) {
+					flag_overrun(requests->client);
+					overrun_flagged = 1;
+				}
+				continue;
+			}
 			/*
 			 * We use round_at_stat and scheduling_round to enable
 			 * us to uniquely order (and by extent identify) every
@@ -362,12 +4016,23 @@ remainder:
 			 */
 			if (round_at_start != scheduling_round) {
 				drop_lock_sent = 0;
+				overrun_flagged = 0;
 				continue;
 			}
+			/*
+			 * An exclusive lock holder keeps the lock until it's
+			 * done, unless it has kept others waiting for too long.
+			 */
+			if (!client_preemptible(requests->client)) {
+				if (overdue_request() == NULL) continue;
+				exclusive_dropped = 1;
+			}
 			/*
 			 * Strict handling of clients. If something goes wrong,
 			 * clean them up.
 			 */
+			client_event(NVSHARE_EVENT_DEBUG, "drop_lock",
+				     requests->client, "tq");
 			if (send_message(requests->client, &t_msg) < 0) {
 				delete_client(requests->client);
 				try_schedule();
@@ -378,72 +4043,933 @@ remainder:
 		} else if (ret != 0) { /* Unrecoverable error */
 			errno = ret;
 			log_fatal("pthread_cond_timedwait()");
-		} else { /* ret == 0, someone signaled the condvar */
-			if (must_reset_timer) {
-				drop_lock_sent = 0;
-				continue;
-			} else { /* Spurious wakeup */
-				goto remainder;
-			}
+		} else { /* ret == 0, someone signaled the condvar */
+			if (must_reset_timer) {
+				drop_lock_sent = 0;
+				overrun_flagged = 0;
+				continue;
+			} else { /* Spurious wakeup */
+				goto remainder;
+			}
+		}
+	}
+}
+
+
+static void set_scheduler_on(int on)
+{
+	struct nvshare_request *tmp, *r;
+
+	/*
+	 * Ensure status actually changed before broadcasting, otherwise it is
+	 * a no-op.
+	 */
+	if (on && !scheduler_on) {
+		scheduler_on = 1;
+		log_info("Scheduler turned ON, broadcasting it...");
+		nvshare_event(NVSHARE_EVENT_INFO, "sched_on",
+			      NVSHARE_UNREGISTERED_ID, NULL, NULL, NULL);
+		bcast_status();
+	} else if (!on && scheduler_on) {
+		if (quiescing) {
+			log_warn("Not turning the scheduler OFF while"
+				 " quiescing");
+			return;
+		}
+		if (lock_held && requests != NULL)
+			account_slice(requests->client);
+		log_info("Scheduler turned OFF, broadcasting it...");
+		nvshare_event(NVSHARE_EVENT_INFO, "sched_off",
+			      NVSHARE_UNREGISTERED_ID, NULL, NULL, NULL);
+		scheduler_on = 0;
+		bcast_status();
+		/*
+		 * When the scheduler is OFF, every client thinks they have the
+		 * lock, so the requests list instantaneously becomes invalid.
+		 * Empty it.
+		 */
+		LL_FOREACH_SAFE(requests, r, tmp) {
+			LL_DELETE(requests, r);
+			free(r);
+		}
+		lock_held = 0;
+		update_power();
+	}
+}
+
+
+static void set_tq(int newtq)
+{
+	tq = newtq;
+	must_reset_timer = 1;
+	pthread_cond_broadcast(&timer_cv); /* Reset timer on TQ change */
+	log_info("New TQ = %d", tq);
+	nvshare_event(NVSHARE_EVENT_INFO, "set_tq", NVSHARE_UNREGISTERED_ID,
+		      NULL, NULL, "tq=%d", tq);
+}
+
+
+/*
+ * Switch to the settings of a policy window (or the defaults, if idx is -1).
+ *
+ * We only touch the settings on transitions, so changes through nvsharectl
+ * stick until the next transition.
+ */
+static void apply_policy(int idx)
+{
+	struct tod_policy *p;
+
+	if (idx < 0) {
+		log_info("Leaving policy window %s, restoring defaults",
+			 tod_policies[active_policy].name);
+		nvshare_event(NVSHARE_EVENT_INFO, "policy_leave",
+			      NVSHARE_UNREGISTERED_ID, NULL, NULL, "%s",
+			      tod_policies[active_policy].name);
+		active_policy = -1;
+		if (tq != default_tq) set_tq(default_tq);
+		max_clients = 0;
+		set_scheduler_on(1);
+		return;
+	}
+
+	p = &tod_policies[idx];
+	log_info("Entering policy window %s (%02d:%02d-%02d:%02d)", p->name,
+		 p->start_min / 60, p->start_min % 60, p->end_min / 60,
+		 p->end_min % 60);
+	nvshare_event(NVSHARE_EVENT_INFO, "policy_enter",
+		      NVSHARE_UNREGISTERED_ID, NULL, NULL, "%s", p->name);
+	active_policy = idx;
+	set_tq(p->tq >= 0 ? p->tq : default_tq);
+	max_clients = p->max_clients >= 0 ? p->max_clients : 0;
+	if (max_clients > 0) log_info("Max clients = %d", max_clients);
+	set_scheduler_on(p->scheduler_on >= 0 ? p->scheduler_on : 1);
+}
+
+
+/*
+ * The policy thread checks which time-of-day policy window is active at the
+ * start of every minute and applies it on transitions.
+ */
+void *policy_thr_fn(void *arg __attribute__((unused)))
+{
+	time_t now;
+	struct tm tm;
+	int idx;
+
+	while (1) {
+		now = time(NULL);
+		true_or_exit(localtime_r(&now, &tm) != NULL);
+		idx = nvshare_tod_active(&tm);
+
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		if (idx != active_policy) {
+			apply_policy(idx);
+			if (!lock_held && scheduler_on) try_schedule();
+		}
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+
+		sleep(60 - (tm.tm_sec % 60));
+	}
+}
+
+
+/*
+ * The quiesce thread waits for the lock holder to release the lock and then
+ * polls NVML until the GPUs are idle. If we can't query NVML, the released
+ * lock is all we have to go by.
+ *
+ * We don't hold the global mutex while talking to NVML, as it may be slow.
+ */
+void *quiesce_thr_fn(void *arg __attribute__((unused)))
+{
+	unsigned int util;
+	int idle, nvml_warned = 0;
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	while (1) {
+		while (!quiescing || quiesce_complete)
+			true_or_exit(pthread_cond_wait(&quiesce_cv,
+				     &global_mutex) == 0);
+
+		if (!lock_held) {
+			true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+			if (nvshare_gpu_utilization(&util) == 0) {
+				idle = (util <= QUIESCE_IDLE_UTIL_PERCENT);
+				log_debug("GPU utilization while quiescing is"
+					  " %u%%", util);
+			} else {
+				if (!nvml_warned)
+					log_warn("Cannot query the GPU"
+						 " utilization, assuming the"
+						 " GPU is idle once the lock is"
+						 " released");
+				nvml_warned = 1;
+				idle = 1;
+			}
+			true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+			if (idle && quiescing && !quiesce_complete &&
+			    !lock_held)
+				set_quiesce_complete();
+		}
+		if (quiesce_complete) continue;
+
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		usleep(QUIESCE_POLL_MS * 1000);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	}
+}
+
+
+/*
+ * The memory thread polls NVML until enough GPU memory is free for the
+ * client at the head of the requests list, or until it has waited for
+ * min_free_wait_ms, and then lets try_schedule() grant it the lock. If we
+ * can't query NVML, we don't hold anyone back.
+ *
+ * Like the quiesce thread, we don't hold the global mutex while talking to
+ * NVML.
+ */
+void *mem_thr_fn(void *arg __attribute__((unused)))
+{
+	struct nvshare_client *c;
+	uint64_t id;
+	long long need_mib, free_mib, waited_ms;
+	int ret, nvml_warned = 0;
+	char id_str[HEX_STR_LEN(id)];
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	while (1) {
+		while (mem_waiting == NULL)
+			true_or_exit(pthread_cond_wait(&mem_cv,
+				     &global_mutex) == 0);
+
+		c = mem_waiting;
+		id = c->id;
+		need_mib = client_min_free_mib(c);
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		ret = nvshare_gpu_free_memory(&free_mib);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+
+		/* The client is gone or no longer first in line */
+		if (c != mem_waiting || c->id != id) continue;
+		if (!scheduler_on) {
+			mem_waiting = NULL;
+			continue;
+		}
+
+		client_id_as_string(id_str, sizeof(id_str), id);
+		waited_ms = elapsed_ms_since(&mem_wait_ts);
+		if (ret != 0) {
+			if (!nvml_warned)
+				log_warn("Cannot query the free GPU memory,"
+					 " granting the GPU lock without"
+					 " checking it");
+			nvml_warned = 1;
+		} else if (free_mib < need_mib && waited_ms < min_free_wait_ms) {
+			if (!mem_wait_logged) {
+				log_info("Client %s (%s) needs %lld MiB of free"
+					 " GPU memory, waiting for it (%lld MiB"
+					 " free)", id_str, c->name, need_mib,
+					 free_mib);
+				client_event(NVSHARE_EVENT_INFO, "mem_wait", c,
+					     "free=%lldMiB need=%lldMiB",
+					     free_mib, need_mib);
+				mem_waits++;
+				mem_wait_logged = 1;
+			}
+			true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+			usleep(MIN_FREE_POLL_MS * 1000);
+			true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+			continue;
+		} else if (free_mib < need_mib) {
+			log_warn("Client %s (%s) has waited %lld ms for %lld MiB"
+				 " of free GPU memory, granting it the GPU lock"
+				 " anyway (%lld MiB free)", id_str, c->name,
+				 waited_ms, need_mib, free_mib);
+		} else if (mem_wait_logged) {
+			log_info("Client %s (%s) waited %lld ms for free GPU"
+				 " memory", id_str, c->name, waited_ms);
+		}
+
+		c->mem_admitted = 1;
+		mem_waiting = NULL;
+		if (!lock_held) try_schedule();
+	}
+}
+
+
+/*
+ * The power thread applies the GPU clock state that update_power() asks for.
+ * We start by letting the driver manage the clocks, which also tells us
+ * early on if we can't control them.
+ *
+ * Like the memory thread, we don't hold the global mutex while talking to
+ * NVML.
+ */
+void *power_thr_fn(void *arg __attribute__((unused)))
+{
+	int boost, ret;
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	while (1) {
+		while (power_boost == power_state)
+			true_or_exit(pthread_cond_wait(&power_cv,
+				     &global_mutex) == 0);
+
+		boost = power_boost;
+		if (!boost && power_state > 0) {
+			true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+			usleep(POWER_RELAX_DELAY_MS * 1000);
+			true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+			if (power_boost != boost) continue;
+		}
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		ret = nvshare_gpu_set_boost(boost);
+		/* We may have locked the clocks of some GPUs */
+		if (ret != 0 && boost) nvshare_gpu_set_boost(0);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+
+		if (ret != 0) {
+			log_warn("Cannot control the GPU clocks, turning power"
+				 " management off");
+			nvshare_event(NVSHARE_EVENT_INFO, "power_failed",
+				      NVSHARE_UNREGISTERED_ID, NULL, NULL,
+				      NULL);
+			power_failed = 1;
+			break;
+		}
+		power_state = boost;
+		if (boost) power_boosts++;
+		log_debug("GPU clocks %s", boost ? "boosted" : "relaxed");
+	}
+	true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+	return NULL;
+}
+
+
+/* The causes of a throttle, e.g., "thermal,power", or "none" */
+static void throttle_causes_string(char *buf, size_t buflen, int causes)
+{
+	size_t i, len = 0;
+
+	for (i = 0; i < sizeof(throttle_causes) / sizeof(throttle_causes[0]);
+	     i++) {
+		if (!(causes & throttle_causes[i].mask) || len >= buflen)
+			continue;
+		len += snprintf(buf + len, buflen - len, "%s%s",
+				len > 0 ? "," : "", throttle_causes[i].name);
+	}
+	if (len == 0) strlcpy(buf, "none", buflen);
+}
+
+
+/* The time the GPU has spent throttling in total. Hold the global mutex. */
+static long long throttled_total_ms(void)
+{
+	return throttled_ms + (throttling ? elapsed_ms_since(&throttle_ts) : 0);
+}
+
+
+/* Take note of what NVML told us. Hold the global mutex. */
+static void update_throttle(const struct nvshare_gpu_throttle *t)
+{
+	char causes[64];
+	long long ms;
+	int now = (t->causes != 0);
+	int changed = (t->causes != throttle.causes);
+
+	throttle = *t;
+	throttle_known = 1;
+	throttle_causes_string(causes, sizeof(causes), t->causes);
+	if (now && !throttling) {
+		throttling = 1;
+		throttle_episodes++;
+		true_or_exit(clock_gettime(CLOCK_MONOTONIC, &throttle_ts) == 0);
+		log_warn("The GPU is throttling (%s), its graphics clock is at"
+			 " %u of %u MHz at %u C. This slows down its clients"
+			 " regardless of nvshare", causes, t->clock_mhz,
+			 t->max_clock_mhz, t->temperature);
+		nvshare_event(NVSHARE_EVENT_INFO, "throttle",
+			      NVSHARE_UNREGISTERED_ID, NULL, NULL,
+			      "causes=%s clock=%uMHz max_clock=%uMHz"
+			      " temperature=%uC", causes, t->clock_mhz,
+			      t->max_clock_mhz, t->temperature);
+	} else if (now && changed) {
+		log_info("The GPU is now throttling (%s), its graphics clock is"
+			 " at %u of %u MHz at %u C", causes, t->clock_mhz,
+			 t->max_clock_mhz, t->temperature);
+	} else if (!now && throttling) {
+		ms = elapsed_ms_since(&throttle_ts);
+		throttled_ms += ms;
+		throttling = 0;
+		log_info("The GPU stopped throttling after %.1f s", ms / 1000.0);
+		nvshare_event(NVSHARE_EVENT_INFO, "throttle_end",
+			      NVSHARE_UNREGISTERED_ID, NULL, NULL,
+			      "duration=%lldms", ms);
+	}
+}
+
+
+/*
+ * The throttle thread polls NVML, see throttle_poll_ms. If NVML can't tell
+ * us why the clocks are lowered from the start, we stop monitoring for good.
+ *
+ * Like the power thread, we don't hold the global mutex while talking to
+ * NVML.
+ */
+void *throttle_thr_fn(void *arg __attribute__((unused)))
+{
+	struct nvshare_gpu_throttle t;
+	int ret;
+
+	while (1) {
+		ret = nvshare_gpu_throttle(&t);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		if (ret != 0 && !throttle_known) {
+			log_warn("Cannot query why the GPU clocks are lowered,"
+				 " not monitoring GPU throttling");
+			throttle_failed = 1;
+			true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+			return NULL;
+		}
+		if (ret != 0) log_debug("Failed to query GPU throttling");
+		else update_throttle(&t);
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		usleep(throttle_poll_ms * 1000);
+	}
+}
+
+
+/*
+ * The backpressure thread samples lock_switches every second to compute the
+ * lock switch rate over the last BACKPRESSURE_WINDOW_S seconds, and turns
+ * backpressure on or off accordingly.
+ */
+void *backpressure_thr_fn(void *arg __attribute__((unused)))
+{
+	unsigned long long samples[BACKPRESSURE_WINDOW_S + 1];
+	int next = 0, cnt = 0, oldest;
+
+	while (1) {
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		samples[next] = lock_switches;
+		if (cnt <= BACKPRESSURE_WINDOW_S) cnt++;
+		oldest = (next + BACKPRESSURE_WINDOW_S + 2 - cnt) %
+			 (BACKPRESSURE_WINDOW_S + 1);
+		if (cnt > 1)
+			switch_rate = (double)(lock_switches -
+				      samples[oldest]) / (cnt - 1);
+		next = (next + 1) % (BACKPRESSURE_WINDOW_S + 1);
+		update_backpressure();
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		sleep(1);
+	}
+}
+
+
+/*
+ * The process thread polls NVML for the processes on the GPU, and the limit
+ * of its compute mode, see gpu_process_limit. If NVML can't tell us from the
+ * start, we stop polling for good and don't limit the processes.
+ *
+ * Like the power thread, we don't hold the global mutex while talking to
+ * NVML.
+ */
+void *process_thr_fn(void *arg __attribute__((unused)))
+{
+	unsigned int procs;
+	int limit, ret;
+
+	while (1) {
+		ret = nvshare_gpu_processes(&procs, &limit);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		if (ret != 0 && gpu_processes < 0) {
+			log_warn("Cannot query the processes on the GPU, not"
+				 " limiting them");
+			true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+			return NULL;
+		}
+		if (ret != 0) {
+			log_debug("Failed to query the processes on the GPU");
+		} else {
+			if (gpu_process_limit == GPU_PROCESS_LIMIT_AUTO &&
+			    (gpu_processes < 0 || limit != gpu_mode_limit)) {
+				if (limit >= 0)
+					log_info("The compute mode of the GPU"
+						 " allows %d process%s", limit,
+						 limit == 1 ? "" : "es");
+				else log_info("The compute mode of the GPU"
+					      " doesn't limit its processes");
+			}
+			gpu_processes = (int)procs;
+			gpu_mode_limit = limit;
+		}
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		usleep(GPU_PROCESS_POLL_MS * 1000);
+	}
+}
+
+
+/*
+ * The boost thread ends the boosts of the clients as they expire. It sleeps
+ * until the first of them expires, or until an operator boosts a client.
+ */
+void *boost_thr_fn(void *arg __attribute__((unused)))
+{
+	struct nvshare_client *c;
+	struct timespec now, deadline;
+	int ret, pending;
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	while (1) {
+		true_or_exit(clock_gettime(CLOCK_REALTIME, &now) == 0);
+		pending = 0;
+		LL_FOREACH(clients, c) {
+			if (!has_registered(c) || !client_boosted(c)) continue;
+			if (c->boost_until.tv_sec < now.tv_sec ||
+			    (c->boost_until.tv_sec == now.tv_sec &&
+			     c->boost_until.tv_nsec <= now.tv_nsec)) {
+				end_boost(c, "expired");
+				continue;
+			}
+			if (!pending ||
+			    c->boost_until.tv_sec < deadline.tv_sec ||
+			    (c->boost_until.tv_sec == deadline.tv_sec &&
+			     c->boost_until.tv_nsec < deadline.tv_nsec))
+				deadline = c->boost_until;
+			pending = 1;
+		}
+		if (!pending)
+			ret = pthread_cond_wait(&boost_cv, &global_mutex);
+		else ret = pthread_cond_timedwait(&boost_cv, &global_mutex,
+						  &deadline);
+		if (ret != 0 && ret != ETIMEDOUT) {
+			errno = ret;
+			log_fatal("pthread_cond_timedwait()");
+		}
+	}
+}
+
+
+/*
+ * The init thread ends the init phase of a client that takes longer than
+ * serialize_init_ms, so that a client that never releases the lock doesn't
+ * hold back the others forever.
+ */
+void *init_thr_fn(void *arg __attribute__((unused)))
+{
+	struct timespec deadline;
+	unsigned long long phase;
+	int ret;
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	while (1) {
+		while (initializing == NULL)
+			true_or_exit(pthread_cond_wait(&init_cv,
+				     &global_mutex) == 0);
+
+		phase = init_phases;
+		deadline = init_ts;
+		deadline.tv_sec += serialize_init_ms / 1000;
+		deadline.tv_nsec += (serialize_init_ms % 1000) * 1000000;
+		if (deadline.tv_nsec >= 1000000000) {
+			deadline.tv_sec++;
+			deadline.tv_nsec -= 1000000000;
+		}
+		ret = pthread_cond_timedwait(&init_cv, &global_mutex,
+					     &deadline);
+		if (ret == ETIMEDOUT) {
+			if (initializing != NULL && phase == init_phases)
+				end_init("timed out");
+		} else if (ret != 0) {
+			errno = ret;
+			log_fatal("pthread_cond_timedwait()");
+		}
+	}
+}
+
+
+/*
+ * Wake up the idle thread if the GPU went idle or became active. Call after
+ * registering or deleting a registered client.
+ */
+static void check_idle(void)
+{
+	if (idle_command == NULL && idle_file == NULL) return;
+
+	if (num_registered_clients() == 0) {
+		if (no_clients_since.tv_sec != 0) return;
+		true_or_exit(clock_gettime(CLOCK_REALTIME,
+			     &no_clients_since) == 0);
+	} else {
+		if (no_clients_since.tv_sec == 0) return;
+		no_clients_since.tv_sec = 0;
+		no_clients_since.tv_nsec = 0;
+	}
+	true_or_exit(pthread_cond_signal(&idle_cv) == 0);
+}
+
+
+/* Report the idle state of the GPU, without holding global_mutex */
+static void notify_idle_state(int idle)
+{
+	const char *state = idle ? "idle" : "active";
+	FILE *fp;
+	pid_t pid;
+	int status;
+	sigset_t empty;
+
+	if (idle_file != NULL) {
+		fp = fopen(idle_file, "w");
+		if (fp == NULL || fprintf(fp, "%s %lld\n", state,
+					  (long long)time(NULL)) < 0)
+			log_warn("Failed to write idle file %s", idle_file);
+		if (fp != NULL) fclose(fp);
+	}
+	if (idle_command == NULL) return;
+
+	pid = fork();
+	if (pid < 0) {
+		log_warn("Failed to run the idle command: %s", strerror(errno));
+		return;
+	}
+	if (pid == 0) {
+		/* Don't let the command inherit our blocked SIGTERM */
+		sigemptyset(&empty);
+		sigprocmask(SIG_SETMASK, &empty, NULL);
+		execl("/bin/sh", "sh", "-c", idle_command, "sh", state, NULL);
+		_exit(127);
+	}
+	while (waitpid(pid, &status, 0) < 0) {
+		if (errno != EINTR) {
+			log_warn("Failed to wait for the idle command: %s",
+				 strerror(errno));
+			return;
+		}
+	}
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0)
+		log_warn("The idle command failed for state %s (status %d)",
+			 state, status);
+}
+
+
+/*
+ * The idle thread reports the transitions between idle and active. It runs
+ * the idle command itself, so that a slow command doesn't stall scheduling,
+ * and reports the transitions in order.
+ */
+void *idle_thr_fn(void *arg __attribute__((unused)))
+{
+	struct timespec deadline, now;
+	int idle, ret;
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	while (1) {
+		idle = (num_registered_clients() == 0);
+		if (idle && idle_state != 1) {
+			deadline = no_clients_since;
+			deadline.tv_sec += idle_debounce_ms / 1000;
+			deadline.tv_nsec += (idle_debounce_ms % 1000) * 1000000;
+			if (deadline.tv_nsec >= 1000000000) {
+				deadline.tv_sec++;
+				deadline.tv_nsec -= 1000000000;
+			}
+			true_or_exit(clock_gettime(CLOCK_REALTIME, &now) == 0);
+			if (now.tv_sec < deadline.tv_sec ||
+			    (now.tv_sec == deadline.tv_sec &&
+			     now.tv_nsec < deadline.tv_nsec)) {
+				/* Clients may come and go in the meantime */
+				ret = pthread_cond_timedwait(&idle_cv,
+					&global_mutex, &deadline);
+				if (ret != 0 && ret != ETIMEDOUT) {
+					errno = ret;
+					log_fatal("pthread_cond_timedwait()");
+				}
+				continue;
+			}
+		} else if (idle == idle_state) {
+			true_or_exit(pthread_cond_wait(&idle_cv,
+				     &global_mutex) == 0);
+			continue;
+		}
+
+		idle_state = idle;
+		log_info("The GPU is %s", idle ? "idle, no registered clients"
+			 " remain" : "active again");
+		nvshare_event(NVSHARE_EVENT_INFO, idle ? "gpu_idle" :
+			      "gpu_active", NVSHARE_UNREGISTERED_ID, NULL, NULL,
+			      NULL);
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		notify_idle_state(idle);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	}
+}
+
+
+/*
+ * On SIGTERM (e.g., on node shutdown), quiesce the GPU before exiting, so
+ * that we don't leave CUDA work behind. Give up waiting after
+ * quiesce_timeout_ms, to stay within the grace period of the container.
+ */
+void *signal_thr_fn(void *arg)
+{
+	sigset_t *set = (sigset_t *)arg;
+	struct timespec deadline;
+	int sig, ret;
+
+	if ((ret = sigwait(set, &sig)) != 0) {
+		errno = ret;
+		log_fatal_errno("sigwait() failed");
+	}
+	log_info("Received %s, quiescing the GPU before exiting",
+		 strsignal(sig));
+
+	true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+	if (quiesce_timeout_ms > 0) start_quiesce();
+
+	true_or_exit(clock_gettime(CLOCK_REALTIME, &deadline) == 0);
+	deadline.tv_sec += quiesce_timeout_ms / 1000;
+	deadline.tv_nsec += (quiesce_timeout_ms % 1000) * 1000000;
+	if (deadline.tv_nsec >= 1000000000) {
+		deadline.tv_sec++;
+		deadline.tv_nsec -= 1000000000;
+	}
+	while (quiesce_timeout_ms > 0 && !quiesce_complete) {
+		ret = pthread_cond_timedwait(&quiesce_cv, &global_mutex,
+					     &deadline);
+		if (ret == ETIMEDOUT) {
+			log_warn("Timed out waiting for the GPU to quiesce"
+				 " after %lld ms", quiesce_timeout_ms);
+			break;
+		} else if (ret != 0) {
+			errno = ret;
+			log_fatal("pthread_cond_timedwait()");
+		}
+	}
+
+	/* Don't leave the clocks locked behind us */
+	if (power_mgmt && !power_failed && power_state != 0)
+		nvshare_gpu_set_boost(0);
+
+	log_info("nvshare-scheduler exiting");
+	nvshare_event(NVSHARE_EVENT_INFO, "exit", NVSHARE_UNREGISTERED_ID,
+		      NULL, NULL, NULL);
+	exit(EXIT_SUCCESS);
+}
+
+
+/*
+ * As PID 1 of a minimal container, we inherit the orphans of whatever the
+ * client hook and the idle command leave running, and they pile up as
+ * zombies unless we reap them. Orphans become children of the main thread,
+ * while the hook and idle threads wait for the commands they spawn, so only
+ * reap the children of the main thread (__WNOTHREAD) to leave those alone.
+ */
+static void reap_orphans(int sfd)
+{
+	struct signalfd_siginfo si;
+	pid_t pid;
+	int status;
+
+	/* SIGCHLDs coalesce, so reap whatever has exited */
+	while (read(sfd, &si, sizeof(si)) == sizeof(si));
+	while ((pid = waitpid(-1, &status, WNOHANG | __WNOTHREAD)) > 0)
+		log_debug("Reaped orphaned process %d (status %d)", (int)pid,
+			  status);
+}
+
+
+/*
+ * On SIGUSR2, dump the whole state of the scheduler to the log at once, i.e.,
+ * the status that nvsharectl --status shows along with the queue, so that we
+ * can debug a scheduler that misbehaves without attaching to it. We write
+ * the dump under the global mutex, so it is consistent, but log it after
+ * releasing the mutex, so that a slow log doesn't stall the scheduler.
+ */
+void *dump_thr_fn(void *arg)
+{
+	sigset_t *set = (sigset_t *)arg;
+	char *buf, *line, *saveptr;
+	size_t len;
+	FILE *fp;
+	int sig, ret;
+	unsigned long long dumps = 0;
+
+	while (1) {
+		if ((ret = sigwait(set, &sig)) != 0) {
+			errno = ret;
+			log_fatal_errno("sigwait() failed");
 		}
+
+		buf = NULL;
+		len = 0;
+		true_or_exit(fp = open_memstream(&buf, &len));
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		write_status(fp);
+		write_queue(fp);
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		true_or_exit(fclose(fp) == 0);
+
+		log_info("Received %s, dumping the scheduler state (dump #%llu)",
+			 strsignal(sig), ++dumps);
+		for (line = strtok_r(buf, "\n", &saveptr); line != NULL;
+		     line = strtok_r(NULL, "\n", &saveptr))
+			log_info("  %s", line);
+		log_info("End of scheduler state dump #%llu", dumps);
+		free(buf);
+	}
+	return NULL;
+}
+
+
+/* Parse a comma-separated list of user IDs, the value of env, into uids */
+static void parse_uids(const char *env, const char *list, uid_t **uids,
+	int *uids_cnt)
+{
+	char *s, *tok, *saveptr, *endptr;
+	long long uid;
+
+	true_or_exit(s = strdup(list));
+	for (tok = strtok_r(s, ",", &saveptr); tok != NULL;
+	     tok = strtok_r(NULL, ",", &saveptr)) {
+		errno = 0;
+		uid = strtoll(tok, &endptr, 10);
+		if (tok == endptr || *endptr != '\0' || errno != 0 || uid < 0 ||
+		    uid >= (uid_t)-1)
+			log_fatal("Invalid value for %s: %s", env, list);
+		true_or_exit(*uids = realloc(*uids,
+			(*uids_cnt + 1) * sizeof(**uids)));
+		(*uids)[(*uids_cnt)++] = (uid_t)uid;
+	}
+	free(s);
+	if (*uids_cnt == 0)
+		log_fatal("Invalid value for %s: %s", env, list);
+}
+
+
+/* Parse a comma-separated list of namespaces into allowed_namespaces */
+static void parse_allowed_namespaces(const char *list)
+{
+	char *s, *tok, *saveptr;
+
+	true_or_exit(s = strdup(list));
+	for (tok = strtok_r(s, ",", &saveptr); tok != NULL;
+	     tok = strtok_r(NULL, ",", &saveptr)) {
+		if (strlen(tok) >= sizeof(out_msg.pod_namespace))
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_ALLOWED_NAMESPACES, list);
+		true_or_exit(allowed_namespaces = realloc(allowed_namespaces,
+			(allowed_namespaces_cnt + 1) *
+			sizeof(*allowed_namespaces)));
+		true_or_exit(allowed_namespaces[allowed_namespaces_cnt++] =
+			strdup(tok));
 	}
+	free(s);
+	if (allowed_namespaces_cnt == 0)
+		log_fatal("Invalid value for %s: %s",
+			  ENV_NVSHARE_ALLOWED_NAMESPACES, list);
+	log_info("Only accepting clients from namespaces %s", list);
 }
 
 
 static void process_msg(struct nvshare_client *client, const struct message *in_msg)
 {
-	int newtq;
+	int newtq, kicked, boosted;
+	long long committed_mib, total_mib, reserved_mib, millishares, contexts;
+	long long requested_mib, duration_s;
+	uint64_t kick_id, boost_id;
 	char id_str[HEX_STR_LEN(client->id)];
+	char value[MSG_DATA_LEN + 1];
 	char *endptr;
 
 	client_id_as_string(id_str, sizeof(id_str), client->id);
 
+	/* Whatever an evicted client still had to say is moot */
+	if (client->evicted) return;
+
+	/* Only registered clients and trusted peers may talk to us */
+	if (!has_registered(client) && !peer_allowed(client) &&
+	    in_msg->type != REGISTER && in_msg->type != REATTACH &&
+	    in_msg->type != IDENTITY) {
+		log_warn("Ignoring message of type %d from PID %d, which runs"
+			 " as user %d and is not allowed", (int)in_msg->type,
+			 (int)client->peer_pid, (int)client->peer_uid);
+		delete_client(client);
+		return;
+	}
+
+	/* Only administrators may change how we schedule */
+	if (admin_command(in_msg->type) && !peer_admin(client)) {
+		log_warn("Ignoring %s from PID %d, which runs as user %d and"
+			 " is not an administrator",
+			 message_type_string[in_msg->type],
+			 (int)client->peer_pid, (int)client->peer_uid);
+		delete_client(client);
+		return;
+	}
+
 	switch (in_msg->type) {
 	case REGISTER:
+	case REATTACH:
 		log_info("Received %s",
 			   message_type_string[in_msg->type]);
 
-		if (register_client(client, in_msg) < 0) delete_client(client);
-		else log_info("Registered client %016" PRIx64 " with Pod"
-			      " name = %s, Pod namespace = %s", client->id,
-			      client->pod_name, client->pod_namespace);
+		if (client->init_seq > 0) {
+			log_warn("Ignoring %s from client that waits to"
+				 " initialize", message_type_string[in_msg->type]);
+			break;
+		}
+		/*
+		 * Hold back the client until the one that is initializing is
+		 * done. It waits for our reply.
+		 */
+		if (in_msg->type == REGISTER && initializing != NULL &&
+		    !has_registered(client)) {
+			client->init_msg = *in_msg;
+			client->init_seq = ++init_seq_next;
+			log_info("Pod %s/%s waits for client %016" PRIx64
+				 " to initialize", in_msg->pod_namespace,
+				 in_msg->pod_name, initializing->id);
+			break;
+		}
+		if (complete_registration(client, in_msg) < 0)
+			delete_client(client);
+		break;
+
+	case IDENTITY: /* client, ahead of REGISTER or REATTACH */
+		if (has_registered(client)) {
+			log_warn("Ignoring %s from registered client %s",
+				 message_type_string[in_msg->type], id_str);
+			break;
+		}
+		set_identity(client, in_msg);
+		break;
+
+	case CLIENT_NAME:
+		if (!has_registered(client)) {
+			log_warn("Ignoring %s from unregistered client",
+				 message_type_string[in_msg->type]);
+			break;
+		}
+		snprintf(client->name, sizeof(client->name), "%.*s",
+			 (int)sizeof(in_msg->pod_name) - 1, in_msg->pod_name);
+		log_info("Client %s is named \"%s\"", id_str, client->name);
+		client_event(NVSHARE_EVENT_INFO, "name", client, "%s",
+			     client->name);
 		break;
 
 	case SCHED_ON: /* nvsharectl */
 		log_info("Received %s from %s",
 		   	 message_type_string[in_msg->type], id_str);
 
-		/*
-		 * Ensure status actually changed before broadcasting,
-		 * otherwise it is a no-op.
-		 */
-		if (!scheduler_on) {
-			scheduler_on = 1;
-			log_info("Scheduler turned ON, broadcasting it...");
-			bcast_status();
-		}
+		set_scheduler_on(1);
 		break;
 
 	case SCHED_OFF: /* nvsharectl */
 		log_info("Received %s from %s",
 			 message_type_string[in_msg->type], id_str);
 
-		if (scheduler_on) {
-			log_info("Scheduler turned OFF, broadcasting it...");
-			scheduler_on = 0;
-			bcast_status();
-			/*
-			 * When the scheduler is OFF, every client thinks they
-			 * have the lock, so the requests list instantaneously
-			 * becomes invalid. Empty it.
-			 */
-			struct nvshare_request *tmp, *r;
-			LL_FOREACH_SAFE(requests, r, tmp) {
-				LL_DELETE(requests, r);
-				free(r);
-			}
-			lock_held = 0;
-		}
+		set_scheduler_on(0);
 		break;
 
 	case SET_TQ: /* nvsharectl */
@@ -452,20 +4978,303 @@ static void process_msg(struct nvshare_client *client, const struct message *in_
 
 		errno = 0;
 		newtq = (int)strtoll(in_msg->data, &endptr, 0);
-        	if (in_msg->data != endptr && *endptr == '\0' && errno == 0) {
-			tq = newtq;
-			must_reset_timer = 1;
-			pthread_cond_broadcast(&timer_cv); /* Reset timer on TQ change */
-			log_info("New TQ = %d", tq);
-		}
+        	if (in_msg->data != endptr && *endptr == '\0' && errno == 0)
+			set_tq(newtq);
 		else log_info("Failed to parse new TQ from message");
 		break;
 
+	case STATUS: /* nvsharectl */
+		log_info("Received %s from %s",
+			 message_type_string[in_msg->type], id_str);
+
+		/* One-shot query, close the connection when done */
+		send_status(client, in_msg->data);
+		delete_client(client);
+		break;
+
+	case DRAIN: /* nvsharectl */
+		log_info("Received %s from %s",
+			 message_type_string[in_msg->type], id_str);
+
+		if (strcmp(in_msg->data, "off") == 0) {
+			if (draining) {
+				log_info("Drain cancelled, accepting new"
+					 " clients");
+				nvshare_event(NVSHARE_EVENT_INFO,
+					      "drain_cancel",
+					      NVSHARE_UNREGISTERED_ID, NULL,
+					      NULL, NULL);
+			}
+			draining = 0;
+			drain_complete = 0;
+			if (drain_complete_file != NULL &&
+			    unlink(drain_complete_file) != 0 && errno != ENOENT)
+				log_warn("Failed to remove drain completion"
+					 " file %s", drain_complete_file);
+			break;
+		}
+
+		if (!draining) {
+			draining = 1;
+			log_info("Draining, rejecting new clients");
+			nvshare_event(NVSHARE_EVENT_INFO, "drain",
+				      NVSHARE_UNREGISTERED_ID, NULL, NULL,
+				      NULL);
+		}
+		if (strcmp(in_msg->data, "wait") == 0) {
+			if (drain_complete) {
+				out_msg.type = DRAIN;
+				(void)send_message(client, &out_msg);
+			} else client->drain_waiter = 1;
+		}
+		check_drain_complete();
+		break;
+
+	case QUIESCE: /* nvsharectl */
+		log_info("Received %s from %s",
+			 message_type_string[in_msg->type], id_str);
+
+		if (strcmp(in_msg->data, "off") == 0) {
+			if (quiescing) {
+				log_info("Quiesce cancelled, granting slices"
+					 " again");
+				nvshare_event(NVSHARE_EVENT_INFO,
+					      "quiesce_cancel",
+					      NVSHARE_UNREGISTERED_ID, NULL,
+					      NULL, NULL);
+			}
+			quiescing = 0;
+			quiesce_complete = 0;
+			if (!lock_held && scheduler_on) try_schedule();
+			break;
+		}
+
+		start_quiesce();
+		if (strcmp(in_msg->data, "wait") == 0) {
+			if (quiesce_complete) {
+				out_msg.type = QUIESCE;
+				(void)send_message(client, &out_msg);
+			} else client->quiesce_waiter = 1;
+		}
+		break;
+
+	case EVICT: /* nvsharectl */
+		log_info("Received %s from %s",
+			 message_type_string[in_msg->type], id_str);
+
+		kicked = 0;
+		errno = 0;
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_EVICT_ID_FIELD,
+					  value, sizeof(value)) == 0) {
+			kick_id = strtoull(value, &endptr, 16);
+			if (value != endptr && *endptr == '\0' && errno == 0)
+				kicked = kick_client(kick_id);
+			else log_info("Failed to parse client ID from message");
+		}
+		/* One-shot request, close the connection when done */
+		out_msg.type = EVICT;
+		snprintf(out_msg.data, sizeof(out_msg.data), "%s=%d",
+			 NVSHARE_EVICTED_FIELD, kicked);
+		(void)send_message(client, &out_msg);
+		memset(&out_msg.data, 0, sizeof(out_msg.data));
+		delete_client(client);
+		break;
+
+	case BOOST: /* nvsharectl */
+		log_info("Received %s from %s",
+			 message_type_string[in_msg->type], id_str);
+
+		boosted = 0;
+		boost_id = 0;
+		duration_s = -1;
+		errno = 0;
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_BOOST_ID_FIELD,
+					  value, sizeof(value)) == 0) {
+			boost_id = strtoull(value, &endptr, 16);
+			if (value == endptr || *endptr != '\0' || errno != 0)
+				boost_id = 0;
+		}
+		if (nvshare_msg_get_field(in_msg->pod_name,
+					  NVSHARE_BOOST_DURATION_FIELD, value,
+					  sizeof(value)) == 0) {
+			duration_s = strtoll(value, &endptr, 10);
+			if (value == endptr || *endptr != '\0' ||
+			    duration_s > NVSHARE_BOOST_MAX_S)
+				duration_s = -1;
+		}
+		if (boost_id == 0 || duration_s < 0)
+			log_info("Failed to parse client ID or boost duration"
+				 " from message");
+		else boosted = boost_client(boost_id, duration_s);
+		/* One-shot request, close the connection when done */
+		out_msg.type = BOOST;
+		snprintf(out_msg.data, sizeof(out_msg.data), "%s=%d",
+			 NVSHARE_BOOSTED_FIELD, boosted);
+		(void)send_message(client, &out_msg);
+		memset(&out_msg.data, 0, sizeof(out_msg.data));
+		delete_client(client);
+		break;
+
+	case MEM_USAGE: /* client */
+		if (!has_registered(client)) {
+			log_warn("Ignoring %s from unregistered client",
+				 message_type_string[in_msg->type]);
+			break;
+		}
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_COMMITTED_FIELD,
+					  value, sizeof(value)) != 0 ||
+		    (committed_mib = strtoll(value, &endptr, 10)) < 0 ||
+		    *endptr != '\0' ||
+		    nvshare_msg_get_field(in_msg->data, NVSHARE_TOTAL_FIELD,
+					  value, sizeof(value)) != 0 ||
+		    (total_mib = strtoll(value, &endptr, 10)) < 0 ||
+		    *endptr != '\0') {
+			log_warn("Ignoring malformed %s from %s",
+				 message_type_string[in_msg->type], id_str);
+			break;
+		}
+		log_debug("Client %s has committed %lld MiB of GPU memory",
+			  id_str, committed_mib);
+		client->mem_committed_mib = committed_mib;
+		client->mem_total_mib = total_mib;
+		snprintf(client->gpu_uuid, sizeof(client->gpu_uuid), "%.*s",
+			 (int)strnlen(in_msg->pod_name, sizeof(in_msg->pod_name)),
+			 in_msg->pod_name);
+		(void)get_gpu_account(client->gpu_uuid); /* Export the GPU */
+		client_event(NVSHARE_EVENT_INFO, "memory", client,
+			     "committed=%lldMiB total=%lldMiB", committed_mib,
+			     total_mib);
+		check_oversubscription();
+		break;
+
+	case RESERVE: /* client */
+		if (!has_registered(client)) {
+			log_warn("Ignoring %s from unregistered client",
+				 message_type_string[in_msg->type]);
+			break;
+		}
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_RESERVED_FIELD,
+					  value, sizeof(value)) != 0 ||
+		    (reserved_mib = strtoll(value, &endptr, 10)) < 0 ||
+		    *endptr != '\0') {
+			log_warn("Ignoring malformed %s from %s",
+				 message_type_string[in_msg->type], id_str);
+			break;
+		}
+		log_info("Client %s reserves %lld MiB of GPU memory", id_str,
+			 reserved_mib);
+		client->mem_reserved_mib = reserved_mib;
+		client_event(NVSHARE_EVENT_INFO, "reserve", client,
+			     "reserved=%lldMiB", reserved_mib);
+		check_oversubscription();
+		break;
+
+	case SHARE: /* client */
+		if (!has_registered(client)) {
+			log_warn("Ignoring %s from unregistered client",
+				 message_type_string[in_msg->type]);
+			break;
+		}
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_SHARE_FIELD,
+					  value, sizeof(value)) != 0 ||
+		    (millishares = strtoll(value, &endptr, 10)) < 1 ||
+		    millishares > NVSHARE_FULL_SHARE || *endptr != '\0') {
+			log_warn("Ignoring malformed %s from %s",
+				 message_type_string[in_msg->type], id_str);
+			break;
+		}
+		log_info("Client %s has a share of %lld/%d", id_str,
+			 millishares, NVSHARE_FULL_SHARE);
+		client->millishares = millishares;
+		client_event(NVSHARE_EVENT_INFO, "share", client,
+			     "millishares=%lld", millishares);
+		break;
+
+	case WORKLOAD: /* client */
+		if (!has_registered(client)) {
+			log_warn("Ignoring %s from unregistered client",
+				 message_type_string[in_msg->type]);
+			break;
+		}
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_WORKLOAD_FIELD,
+					  value, sizeof(value)) != 0) {
+			log_warn("Ignoring malformed %s from %s",
+				 message_type_string[in_msg->type], id_str);
+			break;
+		}
+		/* Unknown types get the defaults */
+		client->workload = nvshare_workload_lookup(value);
+		if (client->workload == NULL)
+			log_warn("Client %s declared unknown workload type"
+				 " \"%s\", using the defaults", id_str, value);
+		else log_info("Client %s declared workload type %s", id_str,
+			      value);
+		client_event(NVSHARE_EVENT_INFO, "workload", client,
+			     "type=%s%s", value, client->workload == NULL ?
+			     " (unknown)" : "");
+		break;
+
+	case OOM: /* client */
+		if (!has_registered(client)) {
+			log_warn("Ignoring %s from unregistered client",
+				 message_type_string[in_msg->type]);
+			break;
+		}
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_OOM_FIELD,
+					  value, sizeof(value)) != 0 ||
+		    (requested_mib = strtoll(value, &endptr, 10)) < 0 ||
+		    *endptr != '\0') {
+			log_warn("Ignoring malformed %s from %s",
+				 message_type_string[in_msg->type], id_str);
+			break;
+		}
+		client->ooms++;
+		ooms++;
+		true_or_exit(clock_gettime(CLOCK_MONOTONIC, &last_oom_ts) == 0);
+		log_warn("Client %s (Pod %s/%s) ran out of GPU memory allocating"
+			 " %lld MiB, with %lld MiB committed", id_str,
+			 client->pod_namespace, client->pod_name, requested_mib,
+			 client->mem_committed_mib);
+		client_event(NVSHARE_EVENT_INFO, "oom", client,
+			     "requested=%lldMiB committed=%lldMiB",
+			     requested_mib, client->mem_committed_mib);
+		if (reclaim_policy != RECLAIM_OFF) reclaim_memory(client);
+		break;
+
+	case CONTEXTS: /* client */
+		if (!has_registered(client)) {
+			log_warn("Ignoring %s from unregistered client",
+				 message_type_string[in_msg->type]);
+			break;
+		}
+		if (nvshare_msg_get_field(in_msg->data, NVSHARE_CONTEXTS_FIELD,
+					  value, sizeof(value)) != 0 ||
+		    (contexts = strtoll(value, &endptr, 10)) < 0 ||
+		    *endptr != '\0') {
+			log_warn("Ignoring malformed %s from %s",
+				 message_type_string[in_msg->type], id_str);
+			break;
+		}
+		log_debug("Client %s has %lld CUDA contexts", id_str,
+			  contexts);
+		client->contexts = contexts;
+		client_event(NVSHARE_EVENT_INFO, "contexts", client,
+			     "contexts=%lld", contexts);
+		break;
+
 	case REQ_LOCK: /* client */
 		log_info("Received %s from %s",
 			 message_type_string[in_msg->type], id_str);
 
 		if (has_registered(client)) {
+			client_event(NVSHARE_EVENT_DEBUG, "req_lock", client,
+				     NULL);
+			if (client->denied) {
+				log_warn("Not granting the GPU lock to client"
+					 " %s, which has overrun its slice",
+					 id_str);
+				break;
+			}
 			if (scheduler_on) {
 				insert_req(client);
 				if (!lock_held) try_schedule();
@@ -484,10 +5293,15 @@ static void process_msg(struct nvshare_client *client, const struct message *in_
 			 * When the scheduler is OFF, LOCK_RELEASED messages
 			 * are meaningless. Mostly a sanity check.
 			 */
+			client_event(NVSHARE_EVENT_DEBUG, "lock_released",
+				     client, NULL);
 			if (scheduler_on) {
 				remove_req(client);
 				if (!lock_held) try_schedule();
 			}
+			/* Its first slice is over, it has initialized */
+			if (client == initializing)
+				end_init("released the GPU lock");
 		} else { /* The client is not registered. Slam the door. */
 			delete_client(client);
 		}
@@ -500,20 +5314,88 @@ static void process_msg(struct nvshare_client *client, const struct message *in_
 	}
 }
 
-int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
+
+/*
+ * Log the diagnostics block of the scheduler, once it listens. In debug mode,
+ * it includes our status, which at this point is all of our settings.
+ */
+static void log_diagnostics(void)
+{
+	struct nvshare_gpu_info gpus[GPU_ACCOUNTS_MAX];
+	char driver[NVSHARE_GPU_VERSION_BUF_LEN];
+	char nvml[NVSHARE_GPU_VERSION_BUF_LEN];
+	char clients[16];
+	char *buf = NULL, *line, *saveptr;
+	size_t len = 0;
+	int cuda, num_gpus, i;
+	FILE *fp;
+
+	log_info(NVSHARE_DIAG_BEGIN, "nvshare-scheduler");
+	log_info("nvshare: nvshare-scheduler %s, protocol versions %d to %d",
+		 NVSHARE_VERSION, NVSHARE_PROTOCOL_VERSION_MIN,
+		 NVSHARE_PROTOCOL_VERSION);
+	nvshare_log_diag_host();
+	if (nvshare_gpu_versions(driver, nvml, sizeof(driver), &cuda) == 0)
+		log_info("driver: NVIDIA %s, NVML %s, CUDA %d.%d", driver,
+			 nvml, cuda / 1000, (cuda % 1000) / 10);
+	else log_info("driver: unknown, NVML is unavailable");
+	num_gpus = nvshare_gpu_infos(gpus, GPU_ACCOUNTS_MAX);
+	for (i = 0; i < num_gpus; i++)
+		log_info("GPU %d: %s, %llu MiB, %s", i, gpus[i].name,
+			 gpus[i].memory_mib, gpus[i].uuid);
+	log_info("socket: %s", nvscheduler_socket_path);
+	if (max_clients > 0)
+		snprintf(clients, sizeof(clients), "%d", max_clients);
+	else strlcpy(clients, "unlimited", sizeof(clients));
+	log_info("config: scheduler %s, TQ %d s, scheduling policy %s, max"
+		 " clients %s", scheduler_on ? "ON" : "OFF", tq,
+		 sched_policy->name, clients);
+
+	if (__debug) {
+		true_or_exit((fp = open_memstream(&buf, &len)) != NULL);
+		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		write_status(fp);
+		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
+		true_or_exit(fclose(fp) == 0);
+		for (line = strtok_r(buf, "\n", &saveptr); line != NULL;
+		     line = strtok_r(NULL, "\n", &saveptr))
+			log_debug("status: %s", line);
+		free(buf);
+	}
+	nvshare_log_diag_env();
+	log_info(NVSHARE_DIAG_END);
+}
+
+int main(int argc, char *argv[])
 {
-	pthread_t timer_tid;
+	pthread_t timer_tid, policy_tid, quiesce_tid, init_tid, idle_tid;
+	pthread_t mem_tid, power_tid, throttle_tid, backpressure_tid, boost_tid;
+	pthread_t process_tid;
+	pthread_t signal_tid, dump_tid;
+	sigset_t sigterm_set, sigdump_set, sigchld_set;
+	int sigchld_fd = -1;
 	struct nvshare_client *client;
 	int ret, err, lsock, rsock, num_fds;
-	char *debug_val;
+	char *debug_val, *env_val, *endptr;
 	struct message in_msg = {0};
 	struct epoll_event event, events[EPOLL_MAX_EVENTS];
 
+	if (argc > 1 && strcmp(argv[1], "--version") == 0) {
+		printf("nvshare-scheduler %s (protocol version %d)\n",
+		       NVSHARE_VERSION, NVSHARE_PROTOCOL_VERSION);
+		return 0;
+	}
+
+	nvshare_logfile_init();
+
 	debug_val = getenv(ENV_NVSHARE_DEBUG);
 	if (debug_val != NULL) {
 		__debug = 1;
 		log_info("nvshare-scheduler started in debug mode");
 	} else log_info("nvshare-scheduler started in normal mode");
+	log_info("nvshare-scheduler version %s, protocol versions %d to %d",
+		 NVSHARE_VERSION, NVSHARE_PROTOCOL_VERSION_MIN,
+		 NVSHARE_PROTOCOL_VERSION);
 
 	/*
 	 * Permissions are 711:
@@ -550,12 +5432,428 @@ int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
 	scheduler_on = 1;
 	/* TODO: Enable setting this dynamically through an envvar/conffile */
 	tq = NVSHARE_DEFAULT_TQ;
+	default_tq = tq;
 
 	/* Seed srand() for generating client IDs */
 	srand((unsigned int)(time(NULL)));
 
+	nvshare_trace_init();
+	nvshare_eventlog_init();
+	nvshare_tod_load();
+	nvshare_workload_load();
+
+	env_val = getenv(ENV_NVSHARE_ACCOUNTING_FILE);
+	if (env_val != NULL && *env_val != '\0') {
+		accounting_fp = fopen(env_val, "a");
+		if (accounting_fp == NULL)
+			log_fatal_errno("Could not open accounting file %s",
+					env_val);
+		log_info("Writing GPU time accounting records to %s", env_val);
+	}
+
+	drain_complete_file = getenv(ENV_NVSHARE_DRAIN_COMPLETE_FILE);
+	if (drain_complete_file != NULL && *drain_complete_file == '\0')
+		drain_complete_file = NULL;
+
+	idle_command = getenv(ENV_NVSHARE_IDLE_COMMAND);
+	if (idle_command != NULL && *idle_command == '\0') idle_command = NULL;
+	idle_file = getenv(ENV_NVSHARE_IDLE_FILE);
+	if (idle_file != NULL && *idle_file == '\0') idle_file = NULL;
+	env_val = getenv(ENV_NVSHARE_IDLE_DEBOUNCE_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		idle_debounce_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    idle_debounce_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_IDLE_DEBOUNCE_MS, env_val);
+	}
+	if (idle_command != NULL || idle_file != NULL)
+		log_info("Reporting when the GPU goes idle, after %lld ms"
+			 " without clients", idle_debounce_ms);
+
+	env_val = getenv(ENV_NVSHARE_TTFS_SLO_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		ttfs_slo_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    ttfs_slo_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_TTFS_SLO_MS, env_val);
+		if (ttfs_slo_ms > 0)
+			log_info("Time to first slice SLO = %lld ms",
+				 ttfs_slo_ms);
+	}
+
+	env_val = getenv(ENV_NVSHARE_MIN_FREE_MEMORY_MIB);
+	if (env_val != NULL) {
+		errno = 0;
+		min_free_mib = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    min_free_mib < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_MIN_FREE_MEMORY_MIB, env_val);
+	}
+	env_val = getenv(ENV_NVSHARE_MIN_FREE_MEMORY_WAIT_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		min_free_wait_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    min_free_wait_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_MIN_FREE_MEMORY_WAIT_MS, env_val);
+	}
+	if (min_free_mib > 0)
+		log_info("Granting the GPU lock only with %lld MiB of GPU"
+			 " memory free, or after %lld ms", min_free_mib,
+			 min_free_wait_ms);
+
+	env_val = getenv(ENV_NVSHARE_THROTTLE_POLL_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		throttle_poll_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    throttle_poll_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_THROTTLE_POLL_MS, env_val);
+	}
+
+	env_val = getenv(ENV_NVSHARE_BACKPRESSURE_CLIENTS);
+	if (env_val != NULL) {
+		errno = 0;
+		backpressure_clients = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    backpressure_clients < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_BACKPRESSURE_CLIENTS, env_val);
+	}
+	env_val = getenv(ENV_NVSHARE_BACKPRESSURE_SWITCH_RATE);
+	if (env_val != NULL) {
+		errno = 0;
+		backpressure_switch_rate = strtod(env_val, &endptr);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    backpressure_switch_rate < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_BACKPRESSURE_SWITCH_RATE,
+				  env_val);
+	}
+	env_val = getenv(ENV_NVSHARE_BACKPRESSURE_PAUSE_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		backpressure_pause_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    backpressure_pause_ms < 1)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_BACKPRESSURE_PAUSE_MS, env_val);
+	}
+	if (backpressure_clients > 0 || backpressure_switch_rate > 0)
+		log_info("Asking clients to pause for %lld ms before they"
+			 " request the GPU lock again at %lld clients or %.1f"
+			 " lock switches/s (0 = never)", backpressure_pause_ms,
+			 backpressure_clients, backpressure_switch_rate);
+
+	env_val = getenv(ENV_NVSHARE_GPU_PROCESS_LIMIT);
+	if (env_val != NULL && strcmp(env_val, "auto") == 0) {
+		gpu_process_limit = GPU_PROCESS_LIMIT_AUTO;
+	} else if (env_val != NULL && strcmp(env_val, "off") != 0) {
+		errno = 0;
+		gpu_process_limit = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    gpu_process_limit < 1 || gpu_process_limit > INT_MAX)
+			log_fatal("Invalid value for %s: %s, must be \"auto\","
+				  " \"off\" or a positive number",
+				  ENV_NVSHARE_GPU_PROCESS_LIMIT, env_val);
+	}
+	if (gpu_process_limit == GPU_PROCESS_LIMIT_AUTO)
+		log_info("Turning new clients away while the GPU runs all the"
+			 " processes its compute mode allows");
+	else if (gpu_process_limit > 0)
+		log_info("Turning new clients away while the GPU runs %lld"
+			 " processes", gpu_process_limit);
+
+	env_val = getenv(ENV_NVSHARE_BOOST_FACTOR);
+	if (env_val != NULL) {
+		errno = 0;
+		boost_factor = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    boost_factor < 2 || boost_factor > NVSHARE_MAX_BOOST_FACTOR)
+			log_fatal("Invalid value for %s: %s, must be between 2"
+				  " and %d", ENV_NVSHARE_BOOST_FACTOR, env_val,
+				  NVSHARE_MAX_BOOST_FACTOR);
+	}
+
+	if (getenv(ENV_NVSHARE_POWER_MANAGEMENT) != NULL) {
+		power_mgmt = 1;
+		log_info("Boosting the GPU clocks while clients of boosted"
+			 " workload types hold the GPU lock");
+	}
+
+	env_val = getenv(ENV_NVSHARE_MIN_DWELL_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		min_dwell_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    min_dwell_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_MIN_DWELL_MS, env_val);
+		if (min_dwell_ms > 0)
+			log_info("Minimum dwell = %lld ms", min_dwell_ms);
+	}
+
+	env_val = getenv(ENV_NVSHARE_WARMUP_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		warmup_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    warmup_ms < 0 || warmup_ms > NVSHARE_MAX_WARMUP_MS)
+			log_fatal("Invalid value for %s: %s, must be between 0"
+				  " and %d", ENV_NVSHARE_WARMUP_MS, env_val,
+				  NVSHARE_MAX_WARMUP_MS);
+	}
+	env_val = getenv(ENV_NVSHARE_WARMUP_COOLDOWN_S);
+	if (env_val != NULL) {
+		errno = 0;
+		warmup_cooldown_s = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    warmup_cooldown_s < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_WARMUP_COOLDOWN_S, env_val);
+	}
+	if (warmup_ms > 0)
+		log_info("New clients warm up for %lld ms, once every %lld s"
+			 " per Pod", warmup_ms, warmup_cooldown_s);
+
+	env_val = getenv(ENV_NVSHARE_OOM_ADMISSION_PAUSE_S);
+	if (env_val != NULL) {
+		errno = 0;
+		oom_admission_pause_s = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    oom_admission_pause_s < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_OOM_ADMISSION_PAUSE_S, env_val);
+		if (oom_admission_pause_s > 0)
+			log_info("Admitting no new clients for %lld s after a"
+				 " client runs out of GPU memory",
+				 oom_admission_pause_s);
+	}
+	env_val = getenv(ENV_NVSHARE_RECLAIM_POLICY);
+	if (env_val != NULL && *env_val != '\0')
+		parse_reclaim_policy(env_val);
+	if (reclaim_policy != RECLAIM_OFF)
+		log_info("Evicting a client to reclaim GPU memory when another"
+			 " one runs out of it, reclaim policy = %s",
+			 reclaim_policies[reclaim_policy]);
+
+	env_val = getenv(ENV_NVSHARE_CLIENT_SEND_TIMEOUT_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		client_send_timeout_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    client_send_timeout_ms <= 0 ||
+		    client_send_timeout_ms > NVSHARE_MAX_CLIENT_SEND_TIMEOUT_MS)
+			log_fatal("Invalid value for %s: %s, must be between 1"
+				  " and %d", ENV_NVSHARE_CLIENT_SEND_TIMEOUT_MS,
+				  env_val, NVSHARE_MAX_CLIENT_SEND_TIMEOUT_MS);
+	}
+	env_val = getenv(ENV_NVSHARE_CLIENT_RECV_TIMEOUT_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		client_recv_timeout_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    client_recv_timeout_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_CLIENT_RECV_TIMEOUT_MS, env_val);
+	}
+	log_debug("Client socket timeouts: send %lld ms, receive %lld ms",
+		  client_send_timeout_ms, client_recv_timeout_ms);
+
+	env_val = getenv(ENV_NVSHARE_EXCLUSIVE_TIMEOUT_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		exclusive_timeout_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    exclusive_timeout_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_EXCLUSIVE_TIMEOUT_MS, env_val);
+	}
+	log_debug("Exclusive clients keep others waiting for at most %lld ms",
+		  exclusive_timeout_ms);
+
+	env_val = getenv(ENV_NVSHARE_OVERRUN_THRESHOLD_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		overrun_threshold_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    overrun_threshold_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_OVERRUN_THRESHOLD_MS, env_val);
+		if (overrun_threshold_ms > 0)
+			log_info("Overrun threshold = %lld ms",
+				 overrun_threshold_ms);
+	}
+	env_val = getenv(ENV_NVSHARE_ALLOWED_UIDS);
+	if (env_val != NULL && *env_val != '\0') {
+		parse_uids(ENV_NVSHARE_ALLOWED_UIDS, env_val, &allowed_uids,
+			   &allowed_uids_cnt);
+		log_info("Only accepting clients that run as users %s or as"
+			 " user %d", env_val, (int)geteuid());
+	}
+	env_val = getenv(ENV_NVSHARE_ADMIN_UIDS);
+	if (env_val != NULL && *env_val != '\0') {
+		parse_uids(ENV_NVSHARE_ADMIN_UIDS, env_val, &admin_uids,
+			   &admin_uids_cnt);
+		log_info("Only accepting control commands from users %s or"
+			 " from user %d", env_val, (int)geteuid());
+	}
+	env_val = getenv(ENV_NVSHARE_ALLOWED_NAMESPACES);
+	if (env_val != NULL && *env_val != '\0')
+		parse_allowed_namespaces(env_val);
+
+	env_val = getenv(ENV_NVSHARE_SERIALIZE_INIT_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		serialize_init_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    serialize_init_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_SERIALIZE_INIT_MS, env_val);
+		if (serialize_init_ms > 0)
+			log_info("Serializing the initialization of new"
+				 " clients, for up to %lld ms each",
+				 serialize_init_ms);
+	}
+	if (getenv(ENV_NVSHARE_OVERRUN_DENY) != NULL) {
+		overrun_deny = 1;
+		log_info("Clients that overrun their slice will be denied the"
+			 " GPU lock");
+	}
+	env_val = getenv(ENV_NVSHARE_SCHEDULING_POLICY);
+	if (env_val != NULL && *env_val != '\0')
+		parse_sched_policy(env_val);
+	log_info("Scheduling policy = %s", sched_policy->name);
+	env_val = getenv(ENV_NVSHARE_FAIR_SHARE_IDLE_RESET_S);
+	if (env_val != NULL) {
+		errno = 0;
+		fair_share_idle_reset_s = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    fair_share_idle_reset_s < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_FAIR_SHARE_IDLE_RESET_S, env_val);
+		if (fair_share_idle_reset_s > 0)
+			log_info("Clients idle for %lld s start afresh under"
+				 " fair-share", fair_share_idle_reset_s);
+	}
+
+	env_val = getenv(ENV_NVSHARE_OVERRUN_ACTION);
+	if (env_val != NULL && *env_val != '\0')
+		parse_overrun_action(env_val);
+	env_val = getenv(ENV_NVSHARE_OVERRUN_REPEAT);
+	if (env_val != NULL) {
+		errno = 0;
+		overrun_repeat = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    overrun_repeat < 1 || overrun_repeat > OVERRUN_HISTORY)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_OVERRUN_REPEAT, env_val);
+	}
+	if (overrun_action != OVERRUN_ACTION_NONE) {
+		if (overrun_threshold_ms == 0)
+			log_warn("%s has no effect without %s",
+				 ENV_NVSHARE_OVERRUN_ACTION,
+				 ENV_NVSHARE_OVERRUN_THRESHOLD_MS);
+		else log_info("Clients that overrun %lld of their last %d"
+			      " slices will be %s", overrun_repeat,
+			      OVERRUN_HISTORY,
+			      overrun_actions[overrun_action].applied);
+	}
+
+	env_val = getenv(ENV_NVSHARE_BURST_ACCRUAL_PERCENT);
+	if (env_val != NULL) {
+		errno = 0;
+		burst_accrual_pct = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    burst_accrual_pct < 0 || burst_accrual_pct > 100)
+			log_fatal("Invalid value for %s: %s. Must be an integer"
+				  " in [0, 100].",
+				  ENV_NVSHARE_BURST_ACCRUAL_PERCENT, env_val);
+	}
+	env_val = getenv(ENV_NVSHARE_BURST_CAP_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		burst_cap_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    burst_cap_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_BURST_CAP_MS, env_val);
+	}
+	env_val = getenv(ENV_NVSHARE_QUIESCE_TIMEOUT_MS);
+	if (env_val != NULL) {
+		errno = 0;
+		quiesce_timeout_ms = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    quiesce_timeout_ms < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_QUIESCE_TIMEOUT_MS, env_val);
+	}
+	env_val = getenv(ENV_NVSHARE_OVERSUB_WARN_RATIO);
+	if (env_val != NULL) {
+		errno = 0;
+		oversub_warn_ratio = strtod(env_val, &endptr);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    oversub_warn_ratio < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_OVERSUB_WARN_RATIO, env_val);
+	}
+	env_val = getenv(ENV_NVSHARE_OVERSUB_WARN_INTERVAL_S);
+	if (env_val != NULL) {
+		errno = 0;
+		oversub_warn_interval_s = strtoll(env_val, &endptr, 0);
+		if (env_val == endptr || *endptr != '\0' || errno != 0 ||
+		    oversub_warn_interval_s < 0)
+			log_fatal("Invalid value for %s: %s",
+				  ENV_NVSHARE_OVERSUB_WARN_INTERVAL_S, env_val);
+	}
+	if (oversub_warn_ratio > 0)
+		log_info("Warning when the committed GPU memory exceeds %.2fx"
+			 " the physical memory", oversub_warn_ratio);
+	if (burst_accrual_pct > 0)
+		log_info("Burst credits enabled: accrual = %lld%%, cap = %lld"
+			 " ms", burst_accrual_pct, burst_cap_ms);
+
 	true_or_exit(pthread_mutex_init(&global_mutex, NULL) == 0);
 	true_or_exit(pthread_cond_init(&timer_cv, NULL) == 0);
+	true_or_exit(pthread_cond_init(&quiesce_cv, NULL) == 0);
+	true_or_exit(pthread_cond_init(&init_cv, NULL) == 0);
+	true_or_exit(pthread_cond_init(&boost_cv, NULL) == 0);
+	true_or_exit(pthread_cond_init(&idle_cv, NULL) == 0);
+	true_or_exit(pthread_cond_init(&mem_cv, NULL) == 0);
+	true_or_exit(pthread_cond_init(&power_cv, NULL) == 0);
+
+	/*
+	 * Block SIGTERM and SIGUSR2 before spawning any threads, so that they
+	 * all inherit the mask and only the signal and dump threads handle them.
+	 * As PID 1, also block SIGCHLD, which the main loop reads through a
+	 * signalfd, see reap_orphans().
+	 */
+	if (getpid() == 1) {
+		true_or_exit(sigemptyset(&sigchld_set) == 0);
+		true_or_exit(sigaddset(&sigchld_set, SIGCHLD) == 0);
+		true_or_exit(pthread_sigmask(SIG_BLOCK, &sigchld_set,
+			     NULL) == 0);
+		true_or_exit((sigchld_fd = signalfd(-1, &sigchld_set,
+			     SFD_NONBLOCK | SFD_CLOEXEC)) >= 0);
+		log_info("Running as PID 1, reaping orphaned processes");
+	}
+	true_or_exit(sigemptyset(&sigterm_set) == 0);
+	true_or_exit(sigaddset(&sigterm_set, SIGTERM) == 0);
+	true_or_exit(sigemptyset(&sigdump_set) == 0);
+	true_or_exit(sigaddset(&sigdump_set, SIGUSR2) == 0);
+	true_or_exit(pthread_sigmask(SIG_BLOCK, &sigterm_set, NULL) == 0);
+	true_or_exit(pthread_sigmask(SIG_BLOCK, &sigdump_set, NULL) == 0);
+	true_or_exit(pthread_create(&signal_tid, NULL, signal_thr_fn,
+		     &sigterm_set) == 0);
+	true_or_exit(pthread_create(&dump_tid, NULL, dump_thr_fn,
+		     &sigdump_set) == 0);
 
 	if (nvshare_get_scheduler_path(nvscheduler_socket_path) != 0)
 		log_fatal("nvshare_get_scheduler_path() failed!");
@@ -563,6 +5861,50 @@ int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
 	/* Spawn the timer thread */
 	true_or_exit(pthread_create(&timer_tid, NULL, timer_thr_fn, NULL) == 0);
 
+	nvshare_metrics_start(write_metrics);
+	nvshare_lifecycle_init();
+
+	if (tod_policies_cnt > 0)
+		true_or_exit(pthread_create(&policy_tid, NULL, policy_thr_fn,
+			     NULL) == 0);
+
+	true_or_exit(pthread_create(&quiesce_tid, NULL, quiesce_thr_fn,
+		     NULL) == 0);
+
+	if (serialize_init_ms > 0)
+		true_or_exit(pthread_create(&init_tid, NULL, init_thr_fn,
+			     NULL) == 0);
+
+	/* Workload types may ask for free memory even without a default */
+	true_or_exit(pthread_create(&mem_tid, NULL, mem_thr_fn, NULL) == 0);
+
+	if (power_mgmt)
+		true_or_exit(pthread_create(&power_tid, NULL, power_thr_fn,
+			     NULL) == 0);
+
+	if (throttle_poll_ms > 0)
+		true_or_exit(pthread_create(&throttle_tid, NULL,
+			     throttle_thr_fn, NULL) == 0);
+
+	if (backpressure_clients > 0 || backpressure_switch_rate > 0)
+		true_or_exit(pthread_create(&backpressure_tid, NULL,
+			     backpressure_thr_fn, NULL) == 0);
+
+	true_or_exit(pthread_create(&boost_tid, NULL, boost_thr_fn,
+		     NULL) == 0);
+
+	if (gpu_process_limit != GPU_PROCESS_LIMIT_OFF)
+		true_or_exit(pthread_create(&process_tid, NULL,
+			     process_thr_fn, NULL) == 0);
+
+	/* We start out without clients */
+	if (idle_command != NULL || idle_file != NULL) {
+		true_or_exit(clock_gettime(CLOCK_REALTIME,
+			     &no_clients_since) == 0);
+		true_or_exit(pthread_create(&idle_tid, NULL, idle_thr_fn,
+			     NULL) == 0);
+	}
+
 	/* Set up fd for epoll */
 	true_or_exit((epoll_fd = epoll_create(1)) >= 0);
 	
@@ -574,6 +5916,11 @@ int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
 	event.data.fd = lsock;
 	event.events = EPOLLIN;
 	true_or_exit(epoll_ctl(epoll_fd, EPOLL_CTL_ADD, lsock, &event) == 0);
+	if (sigchld_fd >= 0) {
+		event.data.fd = sigchld_fd;
+		true_or_exit(epoll_ctl(epoll_fd, EPOLL_CTL_ADD, sigchld_fd,
+			     &event) == 0);
+	}
 
 	/*
 	 * According to man unix(7):
@@ -588,25 +5935,35 @@ int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
 	if (chmod(nvscheduler_socket_path, S_IRWXU | S_IWGRP| S_IWOTH) != 0)
 		log_fatal("chmod() failed for %s", nvscheduler_socket_path);
 
+	nvshare_snapshot_start(write_snapshot);
+
 	out_msg.id = 7331; 
 
+	nvshare_event(NVSHARE_EVENT_INFO, "start", NVSHARE_UNREGISTERED_ID,
+		      NULL, NULL, "protocol=v%d-v%d", NVSHARE_PROTOCOL_VERSION_MIN,
+		      NVSHARE_PROTOCOL_VERSION);
 	log_info("nvshare-scheduler listening on %s",
 		 nvscheduler_socket_path);
+	log_diagnostics();
 
 	for (;;) {
-		num_fds = RETRY_INTR(epoll_wait(epoll_fd, events, EPOLL_MAX_EVENTS, -1));
+		/* Wake up now and then to check for stuck clients */
+		num_fds = RETRY_INTR(epoll_wait(epoll_fd, events,
+			EPOLL_MAX_EVENTS, client_recv_timeout_ms > 0 ?
+			RECV_TIMEOUT_POLL_MS : -1));
 
-		/* Since we use an infinite timeout, a non-zero return value
-		 * indicates an error
-		 */
 		if (num_fds < 0) log_fatal("epoll_wait() failed");
 
-		/* ret > 0, we got an event */
+		/* ret >= 0, we got events or timed out */
 
 		true_or_exit(pthread_mutex_lock(&global_mutex) == 0);
+		begin_sends();
 
 		for (int i = 0; i < num_fds; i++) {
-			if (events[i].data.fd == lsock) {
+			if (sigchld_fd >= 0 &&
+			    events[i].data.fd == sigchld_fd) {
+				reap_orphans(sigchld_fd);
+			} else if (events[i].data.fd == lsock) {
 				/* New connection. */
 				ret = nvshare_accept(events[i].data.fd, &rsock);
 				if (ret == 0) { /* OK */
@@ -614,6 +5971,34 @@ int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
 					client = malloc(sizeof(*client));
 					client->fd = rsock;
 					client->id = NVSHARE_UNREGISTERED_ID;
+					client->drain_waiter = 0;
+					client->quiesce_waiter = 0;
+					client->lock_cycle = 0;
+					client->trace_sampled = 0;
+					client->in_len = 0;
+					client->slot[0] = '\0';
+					client->generation[0] = '\0';
+					client->pod_uid[0] = '\0';
+					client->container[0] = '\0';
+					client->evicted = 0;
+					client->proto_version = 0;
+					client->mem_committed_mib = 0;
+					client->mem_total_mib = 0;
+					client->mem_reserved_mib = 0;
+					client->gpu_uuid[0] = '\0';
+					client->init_seq = 0;
+					if (nvshare_peer_credentials(rsock,
+					    &client->peer_pid,
+					    &client->peer_uid) < 0) {
+						log_warn("Couldn't get the"
+							 " credentials of the"
+							 " peer of FD %d", rsock);
+						client->peer_pid = -1;
+						client->peer_uid = (uid_t)-1;
+					} else log_debug("Accepted connection"
+						" from PID %d, user %d",
+						(int)client->peer_pid,
+						(int)client->peer_uid);
 					client->next = NULL;
 
 					/*
@@ -648,7 +6033,8 @@ int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
 						delete_client(client);
 						if (!lock_held && scheduler_on) try_schedule();
 					}
-					else process_msg(client, &in_msg); /* OK */
+					else if (ret == 0) process_msg(client, &in_msg);
+					/* else: Incomplete message, wait for the rest */
 
 				}
 				/*
@@ -664,6 +6050,8 @@ int main(int argc __attribute__((unused)), char *argv[] __attribute__((unused)))
 
 			}
 		}
+		if (client_recv_timeout_ms > 0) check_recv_timeouts();
+		end_sends();
 		true_or_exit(pthread_mutex_unlock(&global_mutex) == 0);
 	}
 
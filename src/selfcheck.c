@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * An end-to-end self-check of nvshare: A tiny CUDA program that runs under
+ * libnvshare (LD_PRELOAD) and checks that libnvshare intercepts its calls,
+ * registers with nvshare-scheduler, gets the GPU lock, allocates GPU memory
+ * and runs a kernel to completion, with the right result. It exits with 0 if
+ * all of that works, or logs the step that failed and exits with 1.
+ */
+
+#define _GNU_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+#include <time.h>
+#include <dlfcn.h>
+
+#include "cuda_defs.h"
+#include "comm.h"
+#include "common.h"
+
+#define SELFCHECK_STATUS_MAX (1 << 20) /* Bytes */
+
+typedef CUresult (*cuModuleGetFunction_func)(CUfunction *hfunc, CUmodule hmod,
+	const char *name);
+
+/* Adds 1 to the integer that p points to */
+static const char inc_ptx[] =
+	".version 6.0\n"
+	".target sm_50\n"
+	".address_size 64\n"
+	"\n"
+	".visible .entry nvshare_selfcheck_inc(.param .u64 p)\n"
+	"{\n"
+	"	.reg .b32 %r<3>;\n"
+	"	.reg .b64 %rd<3>;\n"
+	"\n"
+	"	ld.param.u64 %rd1, [p];\n"
+	"	cvta.to.global.u64 %rd2, %rd1;\n"
+	"	ld.global.u32 %r1, [%rd2];\n"
+	"	add.s32 %r2, %r1, 1;\n"
+	"	st.global.u32 [%rd2], %r2;\n"
+	"	ret;\n"
+	"}\n";
+
+static cuGetErrorString_func cu_get_error_string;
+
+static void *resolve(void *handle, const char *symbol)
+{
+	void *f = dlsym(handle, symbol);
+
+	if (f == NULL)
+		log_fatal("Self-check failed: libcuda has no %s", symbol);
+	return f;
+}
+
+
+/* Whether libnvshare, rather than the CUDA driver, gave us the function */
+static void check_intercepted(void *f, const char *symbol)
+{
+	Dl_info info;
+
+	if (dladdr(f, &info) == 0 || info.dli_fname == NULL)
+		log_fatal("Self-check failed: Cannot tell where %s comes from",
+			  symbol);
+	if (strstr(info.dli_fname, "libnvshare") == NULL)
+		log_fatal("Self-check failed: %s is not intercepted, it comes"
+			  " from %s. Is libnvshare.so in LD_PRELOAD?", symbol,
+			  info.dli_fname);
+	log_info("%s is intercepted by %s", symbol, info.dli_fname);
+}
+
+
+static void check_cuda(CUresult err, const char *call)
+{
+	const char *str = NULL;
+
+	if (err == CUDA_SUCCESS) return;
+	if (cu_get_error_string == NULL || cu_get_error_string(err, &str) != 0 ||
+	    str == NULL)
+		str = "unknown error";
+	log_fatal("Self-check failed: %s returned %d (%s)", call, (int)err,
+		  str);
+}
+
+
+/*
+ * Ask the scheduler for its clients and check that we are among them, i.e.,
+ * that libnvshare has registered under our name, and that we have gotten a
+ * slice.
+ */
+static void check_registered(const char *name)
+{
+	int rsock;
+	ssize_t n;
+	size_t len = 0;
+	char *buf, *line, *end;
+	char needle[POD_NAME_LEN_MAX + 3];
+	char path[NVSHARE_SOCK_PATH_MAX];
+	struct message msg = {0};
+	const char *value;
+
+	true_or_exit(nvshare_get_scheduler_path(path) == 0);
+	value = getenv(ENV_NVSHARE_SCHEDULER_ADDRESS);
+	if (value != NULL && *value != '\0')
+		strlcpy(path, value, sizeof(path));
+
+	msg.type = STATUS;
+	snprintf(msg.data, MSG_DATA_LEN, "%s=1", NVSHARE_STATUS_CLIENTS_FIELD);
+	if (nvshare_connect(&rsock, path) != 0)
+		log_fatal("Self-check failed: Cannot connect to nvshare-scheduler"
+			  " at %s to check our registration", path);
+	if (write_whole(rsock, &msg, sizeof(msg)) != sizeof(msg))
+		log_fatal("Self-check failed: Cannot ask nvshare-scheduler for"
+			  " its status");
+	true_or_exit((buf = malloc(SELFCHECK_STATUS_MAX)) != NULL);
+	/* The scheduler closes the connection after sending the status */
+	while (len < SELFCHECK_STATUS_MAX - 1 &&
+	       (n = RETRY_INTR(read(rsock, buf + len,
+				    SELFCHECK_STATUS_MAX - 1 - len))) > 0)
+		len += n;
+	buf[len] = '\0';
+	true_or_exit(close(rsock) == 0);
+
+	snprintf(needle, sizeof(needle), "(%s)", name);
+	line = strstr(buf, needle);
+	if (line == NULL)
+		log_fatal("Self-check failed: nvshare-scheduler doesn't know us"
+			  " as %s. Did libnvshare fall back to standalone mode?",
+			  name);
+	end = strchr(line, '\n');
+	if (end != NULL) *end = '\0';
+	if (strstr(line, "time to first slice = pending") != NULL)
+		log_fatal("Self-check failed: nvshare-scheduler has never given"
+			  " us the GPU lock");
+	log_info("nvshare-scheduler knows us as %s and has given us the GPU"
+		 " lock", name);
+	free(buf);
+}
+
+
+int main(int argc, char *argv[])
+{
+	void *handle;
+	char name[64];
+	int value = 41, result = 0;
+	CUdevice dev;
+	CUcontext ctx;
+	CUmodule mod;
+	CUfunction fn;
+	CUdeviceptr dptr;
+	void *args[] = { &dptr };
+	cuInit_func cu_init;
+	cuDeviceGet_func cu_device_get;
+	cuCtxCreate_func cu_ctx_create;
+	cuCtxDestroy_func cu_ctx_destroy;
+	cuMemAlloc_func cu_mem_alloc;
+	cuMemFree_func cu_mem_free;
+	cuMemcpyHtoD_func cu_memcpy_htod;
+	cuMemcpyDtoH_func cu_memcpy_dtoh;
+	cuModuleLoadData_func cu_module_load_data;
+	cuModuleGetFunction_func cu_module_get_function;
+	cuModuleUnload_func cu_module_unload;
+	cuLaunchKernel_func cu_launch_kernel;
+	cuCtxSynchronize_func cu_ctx_synchronize;
+
+	if (argc > 1 && strcmp(argv[1], "--version") == 0) {
+		printf("nvshare-selfcheck %s (protocol version %d)\n",
+		       NVSHARE_VERSION, NVSHARE_PROTOCOL_VERSION);
+		exit(0);
+	}
+
+	/*
+	 * libnvshare reads its settings at cuInit(). We want to go through the
+	 * scheduler, not around it, and to find ourselves in its status.
+	 */
+	unsetenv("NVSHARE_STANDALONE");
+	unsetenv("NVSHARE_TIMESLICE");
+	unsetenv("NVSHARE_FALLBACK_TIMEOUT_MS");
+	snprintf(name, sizeof(name), "nvshare-selfcheck-%d-%lx", (int)getpid(),
+		 (long)time(NULL));
+	setenv("NVSHARE_CLIENT_NAME", name, 1);
+
+	handle = dlopen("libcuda.so.1", RTLD_NOW);
+	if (handle == NULL)
+		log_fatal("Self-check failed: Cannot load the CUDA driver: %s",
+			  dlerror());
+	cu_get_error_string = resolve(handle, "cuGetErrorString");
+	cu_init = resolve(handle, "cuInit");
+	cu_device_get = resolve(handle, "cuDeviceGet");
+	cu_ctx_create = resolve(handle, "cuCtxCreate_v2");
+	cu_ctx_destroy = resolve(handle, "cuCtxDestroy_v2");
+	cu_mem_alloc = resolve(handle, "cuMemAlloc_v2");
+	cu_mem_free = resolve(handle, "cuMemFree_v2");
+	cu_memcpy_htod = resolve(handle, "cuMemcpyHtoD_v2");
+	cu_memcpy_dtoh = resolve(handle, "cuMemcpyDtoH_v2");
+	cu_module_load_data = resolve(handle, "cuModuleLoadData");
+	cu_module_get_function = resolve(handle, "cuModuleGetFunction");
+	cu_module_unload = resolve(handle, "cuModuleUnload");
+	cu_launch_kernel = resolve(handle, "cuLaunchKernel");
+	cu_ctx_synchronize = resolve(handle, "cuCtxSynchronize");
+
+	check_intercepted(cu_init, "cuInit");
+	check_intercepted(cu_mem_alloc, "cuMemAlloc_v2");
+	check_intercepted(cu_launch_kernel, "cuLaunchKernel");
+
+	/* libnvshare registers with the scheduler here */
+	check_cuda(cu_init(0), "cuInit");
+	check_cuda(cu_device_get(&dev, 0), "cuDeviceGet");
+	check_cuda(cu_ctx_create(&ctx, 0, dev), "cuCtxCreate");
+	check_cuda(cu_mem_alloc(&dptr, sizeof(value)), "cuMemAlloc");
+	check_cuda(cu_memcpy_htod(dptr, &value, sizeof(value)), "cuMemcpyHtoD");
+	check_cuda(cu_module_load_data(&mod, inc_ptx), "cuModuleLoadData");
+	check_cuda(cu_module_get_function(&fn, mod, "nvshare_selfcheck_inc"),
+		   "cuModuleGetFunction");
+	/* libnvshare waits for the GPU lock here */
+	check_cuda(cu_launch_kernel(fn, 1, 1, 1, 1, 1, 1, 0, NULL, args, NULL),
+		   "cuLaunchKernel");
+	check_cuda(cu_ctx_synchronize(), "cuCtxSynchronize");
+	check_cuda(cu_memcpy_dtoh(&result, dptr, sizeof(result)),
+		   "cuMemcpyDtoH");
+	if (result != value + 1)
+		log_fatal("Self-check failed: The kernel turned %d into %d"
+			  " instead of %d", value, result, value + 1);
+	log_info("Ran a kernel on the GPU");
+
+	check_registered(name);
+
+	check_cuda(cu_module_unload(mod), "cuModuleUnload");
+	check_cuda(cu_mem_free(dptr), "cuMemFree");
+	check_cuda(cu_ctx_destroy(ctx), "cuCtxDestroy");
+	log_info("Self-check passed");
+	return 0;
+}
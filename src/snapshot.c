@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Text status snapshot socket for the nvshare scheduler.
+ *
+ * Every connection to the snapshot socket gets a human-readable snapshot of
+ * the scheduler state and is then closed, so that one can inspect a live
+ * scheduler with nothing more than socat or nc:
+ *
+ *     socat - UNIX-CONNECT:/var/run/nvshare/snapshot.sock
+ *
+ * We ignore whatever the peer sends us, e.g., "status". It runs in its own
+ * thread, so that a slow reader can never stall scheduling.
+ */
+
+#include <stdio.h>
+#include <fcntl.h>
+#include <stdlib.h>
+#include <signal.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <sys/stat.h>
+#include <sys/time.h>
+#include <sys/socket.h>
+
+#include "common.h"
+#include "snapshot.h"
+
+static int snapshot_lsock;
+static nvshare_snapshot_fn snapshot_fn;
+static pthread_t snapshot_tid;
+
+
+static void serve_one(int sock)
+{
+	char *buf = NULL, discard[256];
+	size_t len = 0;
+	FILE *fp;
+	struct timeval tv = {1, 0};
+
+	/* Don't let a misbehaving peer block us for long */
+	(void)setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+	(void)setsockopt(sock, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
+
+	true_or_exit(fp = open_memstream(&buf, &len));
+	snapshot_fn(fp);
+	true_or_exit(fclose(fp) == 0);
+
+	(void)write_whole(sock, buf, len);
+	free(buf);
+
+	/*
+	 * Signal the end of the snapshot, but wait for the peer to hang up
+	 * before closing, so that it doesn't get EPIPE if it sends its request
+	 * after we've answered.
+	 */
+	(void)shutdown(sock, SHUT_WR);
+	while (RETRY_INTR(read(sock, discard, sizeof(discard))) > 0);
+}
+
+
+static void *snapshot_thr_fn(void *arg __attribute__((unused)))
+{
+	int sock;
+	sigset_t signal_set;
+
+	true_or_exit(sigfillset(&signal_set) == 0);
+	true_or_exit(pthread_sigmask(SIG_SETMASK, &signal_set, NULL) == 0);
+
+	for (;;) {
+		sock = RETRY_INTR(accept(snapshot_lsock, NULL, NULL));
+		if (sock < 0) {
+			log_warn("Snapshot socket failed to accept() a"
+				 " connection");
+			continue;
+		}
+		serve_one(sock);
+		close(sock);
+	}
+	return NULL;
+}
+
+
+/*
+ * Start serving snapshots on the socket that NVSHARE_SNAPSHOT_SOCKET names,
+ * or on NVSHARE_DEFAULT_SNAPSHOT_SOCKET if it is unset.
+ *
+ * Does nothing if the variable is set but empty.
+ */
+void nvshare_snapshot_start(nvshare_snapshot_fn fn)
+{
+	char *path;
+	int flags;
+
+	path = getenv(ENV_NVSHARE_SNAPSHOT_SOCKET);
+	if (path == NULL) path = NVSHARE_DEFAULT_SNAPSHOT_SOCKET;
+	if (*path == '\0') return;
+
+	if (nvshare_bind_and_listen(&snapshot_lsock, path) != 0)
+		log_fatal_errno("Could not listen on snapshot socket %s", path);
+	/* The thread blocks in accept() */
+	true_or_exit((flags = fcntl(snapshot_lsock, F_GETFL)) >= 0);
+	true_or_exit(fcntl(snapshot_lsock, F_SETFL, flags & ~O_NONBLOCK) == 0);
+	/* Same permissions as the scheduler socket, see main() */
+	if (chmod(path, S_IRWXU | S_IWGRP | S_IWOTH) != 0)
+		log_fatal_errno("chmod() failed for %s", path);
+
+	snapshot_fn = fn;
+	true_or_exit(pthread_create(&snapshot_tid, NULL, snapshot_thr_fn,
+				    NULL) == 0);
+	log_info("Serving status snapshots on %s", path);
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Text status snapshot socket for the nvshare scheduler.
+ */
+
+#ifndef _NVSHARE_SNAPSHOT_H_
+#define _NVSHARE_SNAPSHOT_H_
+
+#include <stdio.h>
+
+#include "comm.h"
+
+#define ENV_NVSHARE_SNAPSHOT_SOCKET "NVSHARE_SNAPSHOT_SOCKET"
+#define NVSHARE_DEFAULT_SNAPSHOT_SOCKET NVSHARE_SOCK_DIR "snapshot.sock"
+
+/* Writes a human-readable snapshot of the scheduler state to fp */
+typedef void (*nvshare_snapshot_fn)(FILE *fp);
+
+extern void nvshare_snapshot_start(nvshare_snapshot_fn fn);
+
+#endif /* _NVSHARE_SNAPSHOT_H_ */
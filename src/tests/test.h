@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * A minimal unit test harness.
+ */
+
+#ifndef _NVSHARE_TEST_H_
+#define _NVSHARE_TEST_H_
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+struct nvshare_test {
+	const char *name;
+	void (*fn)(void);
+};
+
+static int test_failed;
+static const char *test_running;
+
+static void nvshare_test_atexit(void)
+{
+	if (test_running != NULL)
+		printf("FAIL %s: exited, run with -v to see why\n", test_running);
+}
+
+/* Fail the current test, and return from it, unless cond holds */
+#define CHECK(cond)                                                   \
+	do {                                                          \
+		if (!(cond)) {                                        \
+			printf("    %s:%d: CHECK(%s) failed\n",      \
+			       __FILE__, __LINE__, #cond);            \
+			test_failed = 1;                              \
+			return;                                       \
+		}                                                     \
+	} while (0)
+
+#define CHECK_EQ(a, b)                                                \
+	do {                                                          \
+		long long __a = (long long)(a), __b = (long long)(b); \
+		if (__a != __b) {                                     \
+			printf("    %s:%d: CHECK_EQ(%s, %s) failed:"     \
+			       " %lld != %lld\n", __FILE__, __LINE__, \
+			       #a, #b, __a, __b);                     \
+			test_failed = 1;                              \
+			return;                                       \
+		}                                                     \
+	} while (0)
+
+#define CHECK_STR(a, b)                                               \
+	do {                                                          \
+		const char *__a = (a), *__b = (b);                    \
+		if (strcmp(__a, __b) != 0) {                          \
+			printf("    %s:%d: CHECK_STR(%s, %s) failed:"    \
+			       " \"%s\" != \"%s\"\n", __FILE__,       \
+			       __LINE__, #a, #b, __a, __b);           \
+			test_failed = 1;                              \
+			return;                                       \
+		}                                                     \
+	} while (0)
+
+/*
+ * Run the tests whose names contain filter, all of them if it's NULL, calling
+ * setup() before each one.
+ *
+ * Return the exit status for main().
+ */
+static inline int nvshare_run_tests(const struct nvshare_test *tests,
+	void (*setup)(void), const char *filter)
+{
+	int run = 0, failed = 0;
+
+	atexit(nvshare_test_atexit);
+	for (; tests->name != NULL; tests++) {
+		if (filter != NULL && strstr(tests->name, filter) == NULL)
+			continue;
+		test_failed = 0;
+		test_running = tests->name;
+		if (setup != NULL) setup();
+		tests->fn();
+		test_running = NULL;
+		run++;
+		printf("%s %s\n", test_failed ? "FAIL" : "ok  ", tests->name);
+		if (test_failed) failed++;
+	}
+	printf("%d tests, %d failed\n", run, failed);
+	return failed > 0 ? EXIT_FAILURE : EXIT_SUCCESS;
+}
+
+#endif /* _NVSHARE_TEST_H_ */
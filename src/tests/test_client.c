@@ -0,0 +1,283 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Unit tests of the scheduler client of libnvshare.
+ *
+ * We build client.c into this file, so that the tests can call its static
+ * functions, and stand in for the CUDA and NVML hooks of hook.c. A fake
+ * scheduler answers the client with canned messages. The tests check what
+ * the client logs, so we keep its logs in a file.
+ */
+
+#include "../client.c"
+
+#include "test.h"
+
+/* What hook.c provides, we never call into CUDA or NVML */
+cuCtxGetCurrent_func real_cuCtxGetCurrent = NULL;
+cuCtxSetCurrent_func real_cuCtxSetCurrent = NULL;
+cuCtxSynchronize_func real_cuCtxSynchronize = NULL;
+cuStreamSynchronize_func real_cuStreamSynchronize = NULL;
+cuInit_func real_cuInit = NULL;
+nvmlInit_func real_nvmlInit = NULL;
+nvmlDeviceGetHandleByIndex_func real_nvmlDeviceGetHandleByIndex = NULL;
+nvmlDeviceGetUtilizationRates_func real_nvmlDeviceGetUtilizationRates = NULL;
+int nvml_ok = 0;
+int pending_kernel_window = 1;
+
+void cuda_driver_check_error(CUresult err __attribute__((unused)),
+	const char *func_name __attribute__((unused)))
+{
+}
+
+
+/* The logs of the client since the start of the current test */
+static FILE *log_fp;
+
+static int logged(const char *s)
+{
+	static char buf[16384];
+	size_t len;
+
+	fflush(stderr);
+	rewind(log_fp);
+	len = fread(buf, 1, sizeof(buf) - 1, log_fp);
+	buf[len] = '\0';
+	return strstr(buf, s) != NULL;
+}
+
+
+/*
+ * The fake scheduler, which listens at nvscheduler_socket_path, answers the
+ * first message of the next client that connects with fake_answer.
+ */
+static int fake_lsock = -1;
+static struct message fake_answer;
+static struct message fake_received;
+
+static void *fake_scheduler_fn(void *arg __attribute__((unused)))
+{
+	struct pollfd pfd = { .fd = fake_lsock, .events = POLLIN };
+	int sock;
+
+	if (RETRY_INTR(poll(&pfd, 1, 5000)) <= 0) return NULL;
+	if (nvshare_accept(fake_lsock, &sock) != 0) return NULL;
+	pfd.fd = sock;
+	if (RETRY_INTR(poll(&pfd, 1, 5000)) > 0 &&
+	    read_whole(sock, &fake_received, sizeof(fake_received)) ==
+	    sizeof(fake_received))
+		(void)write_whole(sock, &fake_answer, sizeof(fake_answer));
+	close(sock);
+	return NULL;
+}
+
+
+/* Register with the fake scheduler, which answers with answer */
+static int fake_register(const struct message *answer, struct message *in_msg)
+{
+	struct message out_msg = {0};
+	pthread_t tid;
+	int sock, ret;
+
+	fake_answer = *answer;
+	out_msg.type = REGISTER;
+	snprintf(out_msg.data, sizeof(out_msg.data), "%s=%d",
+		 NVSHARE_VERSION_FIELD, NVSHARE_PROTOCOL_VERSION);
+	true_or_exit(pthread_create(&tid, NULL, fake_scheduler_fn, NULL) == 0);
+	ret = try_register(&sock, &out_msg, in_msg, 5000);
+	true_or_exit(pthread_join(tid, NULL) == 0);
+	if (ret == 0) close(sock);
+	return ret;
+}
+
+
+static struct message make_answer(enum message_type type, const char *pod_name,
+	const char *data)
+{
+	struct message msg = {0};
+
+	msg.type = type;
+	strlcpy(msg.pod_name, pod_name, sizeof(msg.pod_name));
+	strlcpy(msg.data, data, sizeof(msg.data));
+	return msg;
+}
+
+
+static void reset_client(void)
+{
+	fflush(stderr);
+	true_or_exit(ftruncate(fileno(log_fp), 0) == 0);
+	rewind(log_fp);
+	mismatch_standalone = 1;
+	nvshare_client_id = NVSHARE_UNREGISTERED_ID;
+	memset(&fake_received, 0, sizeof(fake_received));
+	memset(&identity_msg, 0, sizeof(identity_msg));
+}
+
+
+/*
+ * The scheduler tells a client it turns away why, and the client logs it,
+ * instead of just seeing the connection close.
+ */
+
+static void test_scheduler_error_logged(void)
+{
+	struct message msg;
+
+	msg = make_answer(SCHED_ERROR, "nvshare-scheduler doesn't accept"
+			  " clients from namespace dev", "e=7");
+	CHECK_EQ(log_scheduler_error(&msg), NVSHARE_ERR_NAMESPACE);
+	CHECK(logged("turned us away: nvshare-scheduler doesn't accept"
+		     " clients from namespace dev (error 7)"));
+}
+
+
+static void test_scheduler_error_without_code(void)
+{
+	struct message msg;
+
+	msg = make_answer(SCHED_ERROR, "Something went wrong", "");
+	CHECK_EQ(log_scheduler_error(&msg), -1);
+	CHECK(logged("turned us away: Something went wrong (error -1)"));
+}
+
+
+/* The message fills the whole pod_name field, without a NULL */
+static void test_scheduler_error_unterminated(void)
+{
+	struct message msg = {0};
+
+	msg.type = SCHED_ERROR;
+	memset(msg.pod_name, 'x', sizeof(msg.pod_name));
+	strlcpy(msg.data, "e=2", sizeof(msg.data));
+	CHECK_EQ(log_scheduler_error(&msg), NVSHARE_ERR_MAX_CLIENTS);
+	CHECK(logged("xxxx (error 2)"));
+}
+
+
+static void test_register_rejected(void)
+{
+	struct message answer, in_msg;
+
+	answer = make_answer(SCHED_ERROR, "nvshare-scheduler is draining and"
+			     " accepts no new clients", "e=1");
+	CHECK_EQ(fake_register(&answer, &in_msg), -1);
+	CHECK_EQ(fake_received.type, REGISTER);
+	CHECK(logged("draining and accepts no new clients (error 1)"));
+}
+
+
+static void test_register_accepted(void)
+{
+	struct message answer, in_msg;
+
+	answer = make_answer(SCHED_ON, "v=18", "00000000000000ab");
+	CHECK_EQ(fake_register(&answer, &in_msg), 0);
+	CHECK_EQ(handle_initial_sched_status(&in_msg), 0);
+	CHECK_EQ(nvshare_client_id, 0xab);
+	CHECK(!logged("turned us away"));
+}
+
+
+static void test_register_unsupported_version(void)
+{
+	struct message answer, in_msg;
+
+	answer = make_answer(UNSUPPORTED_VERSION, "", "v=1-17");
+	CHECK_EQ(fake_register(&answer, &in_msg), 0);
+	CHECK_EQ(handle_initial_sched_status(&in_msg), -1);
+	CHECK(logged("does not support protocol version 18 of this libnvshare"
+		     " (it supports versions 1-17)"));
+}
+
+
+/* A scheduler that predates versioning doesn't tell its version */
+static void test_register_old_scheduler(void)
+{
+	struct message answer, in_msg;
+
+	answer = make_answer(SCHED_ON, "", "00000000000000ab");
+	CHECK_EQ(fake_register(&answer, &in_msg), 0);
+	CHECK_EQ(handle_initial_sched_status(&in_msg), -1);
+	CHECK(logged("speaks protocol version 1 (or doesn't tell"));
+}
+
+
+/*
+ * The fields that identify our container go in IDENTITY, where even the
+ * longest ones fit.
+ */
+static void test_identity_long_slot(void)
+{
+	char want[MSG_DATA_LEN + 1];
+	unsigned long long generation;
+
+	true_or_exit(setenv(ENV_NVSHARE_DEVICE_SLOT, "1000", 1) == 0);
+	read_identity();
+	true_or_exit(unsetenv(ENV_NVSHARE_DEVICE_SLOT) == 0);
+	CHECK_EQ(identity_msg.type, IDENTITY);
+	CHECK_STR(identity_msg.pod_name, "");
+	CHECK_EQ(read_container_generation(&generation), 0);
+	snprintf(want, sizeof(want), "d=1000 g=%llx",
+		 generation & 0xffffffffULL);
+	CHECK_STR(identity_msg.data, want);
+	CHECK(nvshare_msg_check(&identity_msg) == NULL);
+}
+
+
+static void test_identity_none(void)
+{
+	read_identity();
+	CHECK_EQ(identity_msg.type, 0);
+}
+
+
+static const struct nvshare_test tests[] = {
+	{ "scheduler_error_logged", test_scheduler_error_logged },
+	{ "scheduler_error_without_code", test_scheduler_error_without_code },
+	{ "scheduler_error_unterminated", test_scheduler_error_unterminated },
+	{ "register_rejected", test_register_rejected },
+	{ "register_accepted", test_register_accepted },
+	{ "register_unsupported_version", test_register_unsupported_version },
+	{ "register_old_scheduler", test_register_old_scheduler },
+	{ "identity_long_slot", test_identity_long_slot },
+	{ "identity_none", test_identity_none },
+	{ NULL, NULL },
+};
+
+
+static void remove_socket(void)
+{
+	(void)unlink(nvscheduler_socket_path);
+}
+
+
+/* Usage: test_client [filter] */
+int main(int argc, char *argv[])
+{
+	snprintf(nvscheduler_socket_path, sizeof(nvscheduler_socket_path),
+		 "/tmp/nvshare-test-client-%d.sock", (int)getpid());
+	true_or_exit(nvshare_bind_and_listen(&fake_lsock,
+		     nvscheduler_socket_path) == 0);
+	atexit(remove_socket);
+	true_or_exit((log_fp = tmpfile()) != NULL);
+	true_or_exit(dup2(fileno(log_fp), STDERR_FILENO) == STDERR_FILENO);
+	setvbuf(stderr, NULL, _IONBF, 0);
+	true_or_exit(pthread_mutex_init(&global_mutex, NULL) == 0);
+	signal(SIGPIPE, SIG_IGN);
+
+	return nvshare_run_tests(tests, reset_client, argc > 1 ? argv[1] : NULL);
+}
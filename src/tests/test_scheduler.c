@@ -0,0 +1,1903 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * Unit tests of nvshare-scheduler.
+ *
+ * We build scheduler.c into this file, so that the tests can call its static
+ * functions. Clients talk to it over socketpairs instead of connections to
+ * its socket, and the tests play the part of the main loop. We link with
+ * --wrap=read, so that the tests can break up and interrupt what the
+ * scheduler reads.
+ */
+
+#define main nvshare_scheduler_main
+#include "../scheduler.c"
+#undef main
+
+#include <poll.h>
+
+#include "test.h"
+
+ssize_t __real_read(int fd, void *buf, size_t count);
+
+/*
+ * Reads of wrap_fd fail with EINTR wrap_eintr times, then return at most
+ * wrap_max bytes each, if it's set.
+ */
+static int wrap_fd = -1;
+static int wrap_eintr;
+static size_t wrap_max;
+static unsigned int wrap_reads;
+
+ssize_t __wrap_read(int fd, void *buf, size_t count)
+{
+	if (fd == wrap_fd) {
+		wrap_reads++;
+		if (wrap_eintr > 0) {
+			wrap_eintr--;
+			errno = EINTR;
+			return -1;
+		}
+		if (wrap_max > 0 && count > wrap_max) count = wrap_max;
+	}
+	return __real_read(fd, buf, count);
+}
+
+
+/*
+ * A client the tests drive through *peer, the other end of its connection,
+ * which is non-blocking, like the connections the main loop accepts.
+ */
+static struct nvshare_client *new_client(int *peer)
+{
+	struct nvshare_client *client;
+	struct epoll_event event;
+	int sv[2];
+
+	true_or_exit(socketpair(AF_UNIX, SOCK_STREAM | SOCK_NONBLOCK, 0,
+		     sv) == 0);
+	client = calloc(1, sizeof(*client));
+	true_or_exit(client != NULL);
+	client->fd = sv[0];
+	client->id = NVSHARE_UNREGISTERED_ID;
+	client->peer_pid = getpid();
+	client->peer_uid = geteuid();
+	event.data.ptr = client;
+	event.events = EPOLLIN;
+	true_or_exit(epoll_ctl(epoll_fd, EPOLL_CTL_ADD, client->fd,
+		     &event) == 0);
+	LL_APPEND(clients, client);
+	*peer = sv[1];
+	return client;
+}
+
+
+static struct message make_msg(enum message_type type, const char *pod_namespace,
+	const char *pod_name, uint64_t id, const char *data)
+{
+	struct message msg = {0};
+
+	msg.type = type;
+	msg.id = id;
+	strlcpy(msg.pod_namespace, pod_namespace, sizeof(msg.pod_namespace));
+	strlcpy(msg.pod_name, pod_name, sizeof(msg.pod_name));
+	strlcpy(msg.data, data, sizeof(msg.data));
+	return msg;
+}
+
+
+/* Receive the next message the scheduler has sent to the client at peer */
+static int peer_recv(int peer, struct message *msg)
+{
+	struct pollfd pfd = { .fd = peer, .events = POLLIN };
+	ssize_t ret;
+	size_t len = 0;
+
+	while (len < sizeof(*msg)) {
+		if (RETRY_INTR(poll(&pfd, 1, len > 0 ? 1000 : 0)) <= 0)
+			return -1;
+		ret = __real_read(peer, (char *)msg + len, sizeof(*msg) - len);
+		if (ret <= 0) return -1;
+		len += ret;
+	}
+	return 0;
+}
+
+
+/* Skip messages until one of the given type, return -1 if there is none */
+static int peer_recv_type(int peer, enum message_type type,
+	struct message *msg)
+{
+	while (peer_recv(peer, msg) == 0)
+		if (msg->type == type) return 0;
+	return -1;
+}
+
+
+/* The error code of a SCHED_ERROR, -1 if it isn't one */
+static int error_code(const struct message *msg)
+{
+	char value[MSG_DATA_LEN + 1];
+
+	if (msg->type != SCHED_ERROR ||
+	    nvshare_msg_get_field(msg->data, NVSHARE_ERROR_FIELD, value,
+				  sizeof(value)) != 0)
+		return -1;
+	return atoi(value);
+}
+
+
+/* The error code of the next SCHED_ERROR the client at peer got, -1 if none */
+static int peer_error(int peer)
+{
+	struct message msg;
+
+	if (peer_recv_type(peer, SCHED_ERROR, &msg) != 0) return -1;
+	return error_code(&msg);
+}
+
+
+static int client_alive(struct nvshare_client *client)
+{
+	struct nvshare_client *c;
+
+	LL_FOREACH(clients, c) if (c == client) return 1;
+	return 0;
+}
+
+
+/* The answer of the scheduler to the last join() */
+static struct message reply;
+
+/*
+ * Have the client send IDENTITY, if identity isn't NULL, then REGISTER or
+ * REATTACH with the given data segment. Return the type of the answer of the
+ * scheduler, 0 if there is none.
+ */
+static int join_data(struct nvshare_client *client, int peer,
+	enum message_type type, const char *pod_name, uint64_t id,
+	const char *identity, const char *data)
+{
+	struct message msg;
+
+	memset(&reply, 0, sizeof(reply));
+	if (identity != NULL) {
+		msg = make_msg(IDENTITY, "", identity, 0, "");
+		process_msg(client, &msg);
+	}
+	msg = make_msg(type, "ns", pod_name, id, data);
+	process_msg(client, &msg);
+	if (peer_recv(peer, &reply) != 0) return 0;
+	return reply.type;
+}
+
+
+static int join(struct nvshare_client *client, int peer,
+	enum message_type type, const char *pod_name, uint64_t id,
+	const char *identity)
+{
+	return join_data(client, peer, type, pod_name, id, identity, "v=18");
+}
+
+
+/* Have a registered client send a message without a data segment */
+static void send_simple(struct nvshare_client *client, enum message_type type)
+{
+	struct message msg = make_msg(type, client->pod_namespace,
+				      client->pod_name, client->id, "");
+
+	process_msg(client, &msg);
+}
+
+
+/* A client that has registered as pod_name */
+static struct nvshare_client *registered_client(const char *pod_name,
+	int *peer)
+{
+	struct nvshare_client *client;
+
+	client = new_client(peer);
+	true_or_exit(join(client, *peer, REGISTER, pod_name, 0, NULL) ==
+		     SCHED_ON);
+	return client;
+}
+
+
+/* Read what receive_message() gets from the client at peer, piece by piece */
+static int receive_all(struct nvshare_client *client, struct message *msg,
+	unsigned int *partial)
+{
+	int ret;
+
+	*partial = 0;
+	while ((ret = receive_message(client, msg)) == 1) (*partial)++;
+	return ret;
+}
+
+
+/* Forget all clients and undo what the tests configure */
+static void reset_scheduler(void)
+{
+	struct nvshare_client *c, *tmp;
+
+	LL_FOREACH_SAFE(clients, c, tmp) delete_client(c);
+	lock_held = 0;
+	scheduler_on = 1;
+	sched_policy = &sched_policies[0];
+	fair_share_idle_reset_s = 0;
+	client_send_timeout_ms = send_budget_ms = NVSHARE_SEND_TIMEOUT_MS;
+	send_batches = 0;
+	tq = default_tq = NVSHARE_DEFAULT_TQ;
+	min_dwell_ms = 0;
+	overrun_action = OVERRUN_ACTION_NONE;
+	boost_factor = NVSHARE_DEFAULT_BOOST_FACTOR;
+	draining = 0;
+	max_clients = 0;
+	allowed_uids_cnt = 0;
+	admin_uids_cnt = 0;
+	allowed_namespaces_cnt = 0;
+	ooms = 0;
+	invalid_messages = 0;
+	reclaim_policy = RECLAIM_OFF;
+	reclaims = 0;
+	socket_timeouts = 0;
+	oom_admission_pause_s = 0;
+	gpu_process_limit = GPU_PROCESS_LIMIT_OFF;
+	gpu_processes = -1;
+	wrap_fd = -1;
+	wrap_eintr = 0;
+	wrap_max = 0;
+	wrap_reads = 0;
+}
+
+
+/*
+ * Messages may arrive in pieces, and reads may be interrupted by signals.
+ * Either way, the scheduler must put together the message the client sent.
+ */
+
+static void test_receive_partial_reads(void)
+{
+	struct nvshare_client *client;
+	struct message in, out;
+	unsigned int partial;
+	int peer;
+
+	client = new_client(&peer);
+	out = make_msg(REGISTER, "default", "pod", 0, "v=18");
+	true_or_exit(write(peer, &out, sizeof(out)) == sizeof(out));
+
+	wrap_fd = client->fd;
+	wrap_max = 100;
+	CHECK_EQ(receive_all(client, &in, &partial), 0);
+	CHECK_EQ(partial, (sizeof(out) - 1) / 100);
+	CHECK(memcmp(&in, &out, sizeof(in)) == 0);
+	CHECK_EQ(client->in_len, 0);
+	close(peer);
+}
+
+
+static void test_receive_interrupted_reads(void)
+{
+	struct nvshare_client *client;
+	struct message in, out;
+	unsigned int partial;
+	int peer;
+
+	client = new_client(&peer);
+	out = make_msg(REQ_LOCK, "ns", "pod", 0x1234, "");
+	true_or_exit(write(peer, &out, sizeof(out)) == sizeof(out));
+
+	wrap_fd = client->fd;
+	wrap_eintr = 5;
+	wrap_max = 300;
+	CHECK_EQ(receive_all(client, &in, &partial), 0);
+	CHECK_EQ(partial, 1);
+	CHECK_EQ(wrap_reads, 5 + 2);
+	CHECK(memcmp(&in, &out, sizeof(in)) == 0);
+	close(peer);
+}
+
+
+/* A client that sends its message in pieces, with pauses in between */
+static void test_receive_split_writes(void)
+{
+	static const size_t pieces[] = { 1, 200, 35, 300, 1 };
+	struct nvshare_client *client;
+	struct message in, out;
+	const char *p;
+	unsigned int i;
+	int peer;
+
+	client = new_client(&peer);
+	out = make_msg(MEM_USAGE, "ns", "GPU-0", 0xabcdef, "c=100 t=16000");
+	/* Nothing to read yet */
+	CHECK_EQ(receive_message(client, &in), 1);
+
+	p = (const char *)&out;
+	for (i = 0; i < sizeof(pieces) / sizeof(pieces[0]); i++) {
+		true_or_exit(write(peer, p, pieces[i]) == (ssize_t)pieces[i]);
+		p += pieces[i];
+		if (i < sizeof(pieces) / sizeof(pieces[0]) - 1) {
+			CHECK_EQ(receive_message(client, &in), 1);
+			CHECK_EQ(client->in_len, p - (const char *)&out);
+			/* The rest hasn't arrived yet */
+			CHECK_EQ(receive_message(client, &in), 1);
+		}
+	}
+	CHECK_EQ(p - (const char *)&out, sizeof(out));
+	CHECK_EQ(receive_message(client, &in), 0);
+	CHECK(memcmp(&in, &out, sizeof(in)) == 0);
+	close(peer);
+}
+
+
+/* Two messages back to back, we never read past the first one */
+static void test_receive_back_to_back(void)
+{
+	struct nvshare_client *client;
+	struct message in, out[2];
+	unsigned int partial;
+	int peer;
+
+	client = new_client(&peer);
+	out[0] = make_msg(REQ_LOCK, "ns", "pod", 1, "");
+	out[1] = make_msg(LOCK_RELEASED, "ns", "pod", 1, "");
+	true_or_exit(write(peer, out, sizeof(out)) == sizeof(out));
+
+	wrap_fd = client->fd;
+	wrap_max = 400;
+	CHECK_EQ(receive_all(client, &in, &partial), 0);
+	CHECK(memcmp(&in, &out[0], sizeof(in)) == 0);
+	CHECK_EQ(receive_all(client, &in, &partial), 0);
+	CHECK(memcmp(&in, &out[1], sizeof(in)) == 0);
+	close(peer);
+}
+
+
+static void test_receive_close_midway(void)
+{
+	struct nvshare_client *client;
+	struct message in, out;
+	int peer;
+
+	client = new_client(&peer);
+	out = make_msg(REQ_LOCK, "ns", "pod", 1, "");
+	true_or_exit(write(peer, &out, 100) == 100);
+	close(peer);
+
+	wrap_fd = client->fd;
+	wrap_eintr = 2;
+	CHECK_EQ(receive_message(client, &in), 1);
+	CHECK_EQ(client->in_len, 100);
+	errno = 0;
+	CHECK_EQ(receive_message(client, &in), -1);
+	CHECK_EQ(errno, ENOTCONN);
+}
+
+
+/* libnvshare reads the answers of the scheduler with a blocking read */
+static void test_receive_block(void)
+{
+	struct message in, out;
+	int sv[2];
+
+	true_or_exit(socketpair(AF_UNIX, SOCK_STREAM, 0, sv) == 0);
+	out = make_msg(SCHED_ON, "", "v=18", 0x42, "0000000000000042");
+	true_or_exit(write(sv[1], &out, sizeof(out)) == sizeof(out));
+
+	wrap_fd = sv[0];
+	wrap_eintr = 3;
+	wrap_max = 50;
+	CHECK_EQ(nvshare_receive_block(sv[0], &in, sizeof(in)), sizeof(in));
+	CHECK(memcmp(&in, &out, sizeof(in)) == 0);
+	CHECK_EQ(wrap_reads, 3 + (sizeof(out) + 49) / 50);
+
+	/* A short message is one the scheduler didn't finish */
+	true_or_exit(write(sv[1], &out, 10) == 10);
+	close(sv[1]);
+	CHECK_EQ(nvshare_receive_block(sv[0], &in, sizeof(in)), 10);
+	close(sv[0]);
+}
+
+
+/*
+ * Whatever a client sends, we must never parse past the end of a message.
+ * We drop clients that send malformed messages, and wait for the rest of
+ * truncated ones.
+ */
+
+/* Overwrite len bytes at off of a valid message with byte */
+static const struct frame_case {
+	const char *what;
+	size_t off;
+	size_t len;
+	int byte;
+	const char *want; /* What nvshare_msg_check() says, NULL if valid */
+} frame_cases[] = {
+	{ "valid", 0, 0, 0, NULL },
+	{ "any type and ID", offsetof(struct message, type), 1, 0xff, NULL },
+	{ "unterminated pod_name", offsetof(struct message, pod_name),
+	  POD_NAME_LEN_MAX, 'x', "pod_name is not NULL-terminated" },
+	{ "longest pod_name", offsetof(struct message, pod_name),
+	  POD_NAME_LEN_MAX - 1, 'x', NULL },
+	{ "unterminated pod_namespace",
+	  offsetof(struct message, pod_namespace), POD_NAMESPACE_LEN_MAX, 'x',
+	  "pod_namespace is not NULL-terminated" },
+	{ "unterminated data", offsetof(struct message, data), MSG_DATA_LEN,
+	  'x', "data segment is not NULL-terminated" },
+	{ "longest data", offsetof(struct message, data), MSG_DATA_LEN - 1, 'x',
+	  NULL },
+	{ "newline in data", offsetof(struct message, data) + 1, 1, '\n',
+	  "data segment holds non-printable characters" },
+	{ "high byte in data", offsetof(struct message, data), 1, 0x80,
+	  "data segment holds non-printable characters" },
+	/* Nothing reads past the NULL */
+	{ "garbage after data", offsetof(struct message, data) + 10, 5, 0x01,
+	  NULL },
+};
+#define FRAME_CASES (sizeof(frame_cases) / sizeof(frame_cases[0]))
+
+
+static struct message frame(const struct frame_case *fc)
+{
+	struct message msg = make_msg(REGISTER, "ns", "pod", 0, "v=18");
+
+	memset((char *)&msg + fc->off, fc->byte, fc->len);
+	return msg;
+}
+
+
+static void test_frame_check(void)
+{
+	struct message msg;
+	const char *reason;
+
+	for (size_t i = 0; i < FRAME_CASES; i++) {
+		msg = frame(&frame_cases[i]);
+		reason = nvshare_msg_check(&msg);
+		if (frame_cases[i].want == NULL) {
+			if (reason != NULL) printf("    %s\n", frame_cases[i].what);
+			CHECK(reason == NULL);
+		} else {
+			if (reason == NULL) printf("    %s\n", frame_cases[i].what);
+			CHECK(reason != NULL);
+			CHECK_STR(reason, frame_cases[i].want);
+		}
+	}
+}
+
+
+static void test_frame_receive(void)
+{
+	struct nvshare_client *client;
+	struct message in, out;
+	unsigned long long dropped = 0;
+	int peer;
+
+	for (size_t i = 0; i < FRAME_CASES; i++) {
+		client = new_client(&peer);
+		out = frame(&frame_cases[i]);
+		true_or_exit(write(peer, &out, sizeof(out)) == sizeof(out));
+		errno = 0;
+		if (frame_cases[i].want == NULL) {
+			CHECK_EQ(receive_message(client, &in), 0);
+			CHECK(memcmp(&in, &out, sizeof(in)) == 0);
+		} else {
+			CHECK_EQ(receive_message(client, &in), -1);
+			CHECK_EQ(errno, EPROTO);
+			dropped++;
+		}
+		CHECK_EQ(invalid_messages, dropped);
+		close(peer);
+		delete_client(client);
+	}
+}
+
+
+/* A message cut short anywhere is never one we take */
+static void test_frame_truncated(void)
+{
+	struct nvshare_client *client;
+	struct message in, out;
+	int peer;
+
+	out = make_msg(REGISTER, "ns", "pod", 0, "v=18");
+	for (size_t len = 1; len < sizeof(out); len++) {
+		client = new_client(&peer);
+		true_or_exit(write(peer, &out, len) == (ssize_t)len);
+		close(peer);
+		CHECK_EQ(receive_message(client, &in), 1);
+		CHECK_EQ(client->in_len, len);
+		errno = 0;
+		CHECK_EQ(receive_message(client, &in), -1);
+		CHECK_EQ(errno, ENOTCONN);
+		delete_client(client);
+	}
+}
+
+
+/* What a client sends past a message is the start of the next one */
+static void test_frame_oversized(void)
+{
+	struct nvshare_client *client;
+	struct message in, out;
+	char extra[50];
+	int peer;
+
+	client = new_client(&peer);
+	out = make_msg(REQ_LOCK, "ns", "pod", 1, "");
+	memset(extra, 'x', sizeof(extra));
+	true_or_exit(write(peer, &out, sizeof(out)) == sizeof(out));
+	true_or_exit(write(peer, extra, sizeof(extra)) == sizeof(extra));
+	CHECK_EQ(receive_message(client, &in), 0);
+	CHECK(memcmp(&in, &out, sizeof(in)) == 0);
+	CHECK_EQ(receive_message(client, &in), 1);
+	CHECK_EQ(client->in_len, sizeof(extra));
+	close(peer);
+	CHECK_EQ(receive_message(client, &in), -1);
+}
+
+
+/* Fill len bytes of buf with bytes that are mostly printable */
+static void fuzz_bytes(char *buf, size_t len)
+{
+	for (size_t i = 0; i < len; i++)
+		buf[i] = rand() % 8 ? ' ' + rand() % 95 : rand() % 256;
+}
+
+
+/* Fill a field with a random string, which may fill it up or end early */
+static void fuzz_field(char *field, size_t size)
+{
+	size_t len = rand() % (size + 1);
+
+	fuzz_bytes(field, len);
+	if (len < size) field[len] = '\0';
+}
+
+
+static void test_frame_fuzz(void)
+{
+	struct nvshare_client *client;
+	struct message in, out;
+	int peer;
+
+	srand(1);
+	for (int i = 0; i < 2000; i++) {
+		memset(&out, 0, sizeof(out));
+		fuzz_bytes((char *)&out, sizeof(out));
+		fuzz_field(out.pod_name, sizeof(out.pod_name));
+		fuzz_field(out.pod_namespace, sizeof(out.pod_namespace));
+		fuzz_field(out.data, sizeof(out.data));
+
+		client = new_client(&peer);
+		true_or_exit(write(peer, &out, sizeof(out)) == sizeof(out));
+		if (nvshare_msg_check(&out) == NULL) {
+			CHECK_EQ(receive_message(client, &in), 0);
+			CHECK(memcmp(&in, &out, sizeof(in)) == 0);
+		} else CHECK_EQ(receive_message(client, &in), -1);
+		close(peer);
+		delete_client(client);
+	}
+}
+
+
+/*
+ * A client that reattaches without an old connection to replace joins like a
+ * new one, so it must pass the same checks.
+ */
+
+static void test_reattach_unused_id(void)
+{
+	struct nvshare_client *client;
+	int peer;
+
+	client = new_client(&peer);
+	CHECK_EQ(join(client, peer, REATTACH, "pod", 0x1111, NULL), SCHED_ON);
+	CHECK_EQ(client->id, 0x1111);
+}
+
+
+static void test_reattach_while_draining(void)
+{
+	struct nvshare_client *client;
+	int peer;
+
+	draining = 1;
+	client = new_client(&peer);
+	CHECK_EQ(join(client, peer, REATTACH, "pod", 0x1111, NULL), SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_DRAINING);
+	CHECK(!client_alive(client));
+}
+
+
+static void test_reattach_at_max_clients(void)
+{
+	struct nvshare_client *client;
+	int peer, peer2;
+
+	max_clients = 1;
+	(void)registered_client("first", &peer);
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, NULL),
+		 SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_MAX_CLIENTS);
+	CHECK(!client_alive(client));
+	CHECK_EQ(num_registered_clients(), 1);
+}
+
+
+static void test_reattach_after_oom(void)
+{
+	struct nvshare_client *client;
+	int peer;
+
+	oom_admission_pause_s = 60;
+	ooms = 1;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &last_oom_ts) == 0);
+	client = new_client(&peer);
+	CHECK_EQ(join(client, peer, REATTACH, "pod", 0x1111, NULL), SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_MEMORY_PRESSURE);
+	CHECK(!client_alive(client));
+}
+
+
+/* The process of a reattaching client already runs on the GPU */
+static void test_reattach_at_process_limit(void)
+{
+	struct nvshare_client *client;
+	int peer, peer2;
+
+	(void)registered_client("first", &peer);
+	gpu_process_limit = 2;
+	gpu_processes = 2;
+
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REGISTER, "pod", 0, NULL), SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_PROCESS_LIMIT);
+	CHECK(!client_alive(client));
+
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, NULL), SCHED_ON);
+	CHECK_EQ(num_registered_clients(), 2);
+
+	gpu_processes = 3;
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x2222, NULL),
+		 SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_PROCESS_LIMIT);
+	CHECK(!client_alive(client));
+}
+
+
+/* A client that takes the place of its old connection isn't a new one */
+static void test_reattach_replacing_while_draining(void)
+{
+	struct nvshare_client *old, *client;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	draining = 1;
+	max_clients = 1;
+
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	CHECK_EQ(client->id, 0x1111);
+	CHECK(old->evicted);
+	CHECK_EQ(peer_error(peer), NVSHARE_ERR_EVICTED);
+}
+
+
+/* Another container has taken the ID, so the client gets a new one */
+static void test_reattach_clash_while_draining(void)
+{
+	struct nvshare_client *client;
+	int peer, peer2;
+
+	client = new_client(&peer);
+	CHECK_EQ(join(client, peer, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	draining = 1;
+
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, "uid-2/main"),
+		 SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_DRAINING);
+	CHECK(!client_alive(client));
+
+	draining = 0;
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, "uid-2/main"),
+		 SCHED_ON);
+	CHECK(client->id != 0x1111);
+}
+
+
+/*
+ * A reattaching client may find its ID taken. If we know the containers of
+ * both clients, we drop the old connection of the same container, or give
+ * the client of another container a new ID. Otherwise, we reject it.
+ */
+
+/* The client ID the scheduler told a client that joined */
+static uint64_t reply_id(void)
+{
+	return strtoull(reply.data, NULL, 16);
+}
+
+
+static void test_collision_same_container(void)
+{
+	struct nvshare_client *old, *client;
+	struct message msg;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	send_simple(old, REQ_LOCK);
+	CHECK_EQ(peer_recv_type(peer, LOCK_OK, &msg), 0);
+
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	CHECK_EQ(client->id, 0x1111);
+	CHECK_EQ(reply_id(), 0x1111);
+	CHECK(old->evicted);
+	CHECK_EQ(peer_error(peer), NVSHARE_ERR_EVICTED);
+	/* The old connection doesn't keep the lock to itself */
+	CHECK(!lock_held);
+	CHECK(requests == NULL);
+}
+
+
+static void test_collision_other_container(void)
+{
+	struct nvshare_client *old, *client;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+
+	/* Another container of the same Pod */
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, "uid-1/sidecar"),
+		 SCHED_ON);
+	CHECK(client->id != 0x1111);
+	CHECK_EQ(reply_id(), client->id);
+	CHECK(!old->evicted);
+	CHECK_EQ(old->id, 0x1111);
+
+	/* A container of another Pod */
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, "uid-2/main"),
+		 SCHED_ON);
+	CHECK(client->id != 0x1111);
+	CHECK(!old->evicted);
+	CHECK_EQ(num_registered_clients(), 3);
+}
+
+
+/* Without the container of both clients, we can't tell them apart */
+static void test_collision_unknown_container(void)
+{
+	struct nvshare_client *old, *client;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, NULL),
+		 SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_DUPLICATE_ID);
+	CHECK(!client_alive(client));
+	CHECK(!old->evicted);
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x2222, NULL), SCHED_ON);
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x2222, "uid-1/main"),
+		 SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_DUPLICATE_ID);
+	CHECK(!old->evicted);
+}
+
+
+/* A client we have evicted no longer holds its ID */
+static void test_collision_evicted_client(void)
+{
+	struct nvshare_client *old, *client;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x1111, NULL), SCHED_ON);
+	CHECK_EQ(kick_client(0x1111), 1);
+	CHECK(client_alive(old));
+
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, NULL), SCHED_ON);
+	CHECK_EQ(client->id, 0x1111);
+}
+
+
+/* We ignore an IDENTITY we can't parse, so the client is unknown */
+static void test_collision_malformed_identity(void)
+{
+	const char *malformed[] = {
+		"uid-1", "/main",
+		"0123456789012345678901234567890123456/main",
+	};
+	struct nvshare_client *old, *client;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	for (size_t i = 0; i < sizeof(malformed) / sizeof(*malformed); i++) {
+		client = new_client(&peer2);
+		CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111,
+			      malformed[i]), SCHED_ERROR);
+		CHECK_EQ(error_code(&reply), NVSHARE_ERR_DUPLICATE_ID);
+	}
+	CHECK(!old->evicted);
+}
+
+
+/* A registered client can't change its identity */
+static void test_collision_identity_after_register(void)
+{
+	struct nvshare_client *old, *client;
+	struct message msg;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join(old, peer, REATTACH, "pod", 0x1111, "uid-1/main"),
+		 SCHED_ON);
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x2222, "uid-2/main"),
+		 SCHED_ON);
+	msg = make_msg(IDENTITY, "", "uid-1/main", 0, "");
+	process_msg(client, &msg);
+	CHECK_STR(client->pod_uid, "uid-2");
+	CHECK(!same_container(client, old));
+}
+
+
+/*
+ * When a container restarts, the client of its previous instance may linger
+ * until we notice that its connection is gone. The client of the new
+ * instance takes its place.
+ */
+
+static void test_restart_evicts_lingering_client(void)
+{
+	struct nvshare_client *old, *client;
+	struct message msg;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join_data(old, peer, REGISTER, "web-0", 0, NULL,
+			   "v=18 d=1 g=aa"), SCHED_ON);
+	send_simple(old, REQ_LOCK);
+	CHECK_EQ(peer_recv_type(peer, LOCK_OK, &msg), 0);
+	CHECK(lock_held);
+
+	/* The new instance registers before the old one has gone away */
+	client = new_client(&peer2);
+	CHECK_EQ(join_data(client, peer2, REGISTER, "web-0", 0, NULL,
+			   "v=18 d=1 g=bb"), SCHED_ON);
+	CHECK(old->evicted);
+	CHECK_EQ(peer_error(peer), NVSHARE_ERR_EVICTED);
+	/* The lingering client doesn't keep the lock to itself */
+	CHECK(!lock_held);
+	CHECK(requests == NULL);
+
+	send_simple(client, REQ_LOCK);
+	CHECK_EQ(peer_recv_type(peer2, LOCK_OK, &msg), 0);
+
+	/* Whatever the lingering client still sends is moot */
+	send_simple(old, REQ_LOCK);
+	CHECK_EQ(requests->client, client);
+	CHECK(requests->next == NULL);
+}
+
+
+/* Only the clients of other instances of the same container are stale */
+static void test_restart_spares_other_clients(void)
+{
+	struct nvshare_client *same_gen, *other_slot, *other_pod, *client;
+	int peer[3], peer2;
+
+	same_gen = new_client(&peer[0]);
+	CHECK_EQ(join_data(same_gen, peer[0], REGISTER, "web-0", 0, NULL,
+			   "v=18 d=1 g=bb"), SCHED_ON);
+	other_slot = new_client(&peer[1]);
+	CHECK_EQ(join_data(other_slot, peer[1], REGISTER, "web-0", 0, NULL,
+			   "v=18 d=2 g=aa"), SCHED_ON);
+	other_pod = new_client(&peer[2]);
+	CHECK_EQ(join_data(other_pod, peer[2], REGISTER, "web-1", 0, NULL,
+			   "v=18 d=1 g=aa"), SCHED_ON);
+
+	client = new_client(&peer2);
+	CHECK_EQ(join_data(client, peer2, REGISTER, "web-0", 0, NULL,
+			   "v=18 d=1 g=bb"), SCHED_ON);
+	CHECK(!same_gen->evicted);
+	CHECK(!other_slot->evicted);
+	CHECK(!other_pod->evicted);
+	CHECK_EQ(num_registered_clients(), 4);
+}
+
+
+/*
+ * Have the client send IDENTITY with the Pod UID and container in identity
+ * and the device slot fields in fields, then REGISTER
+ */
+static int join_container(struct nvshare_client *client, int peer,
+	const char *pod_name, const char *identity, const char *fields)
+{
+	struct message msg = make_msg(IDENTITY, "", identity, 0, fields);
+
+	process_msg(client, &msg);
+	return join(client, peer, REGISTER, pod_name, 0, NULL);
+}
+
+
+/* The longest slot and generation, which don't fit in REGISTER */
+static void test_restart_long_slot(void)
+{
+	struct nvshare_client *old, *client;
+	int peer, peer2;
+
+	old = new_client(&peer);
+	CHECK_EQ(join_container(old, peer, "web-0", "", "d=1000 g=fffffffe"),
+		 SCHED_ON);
+	CHECK_STR(old->slot, "1000");
+	CHECK_STR(old->generation, "fffffffe");
+	CHECK_STR(old->pod_uid, "");
+
+	client = new_client(&peer2);
+	CHECK_EQ(join_container(client, peer2, "web-0", "uid-1/main",
+				"d=1000 g=ffffffff"), SCHED_ON);
+	CHECK_STR(client->slot, "1000");
+	CHECK_STR(client->generation, "ffffffff");
+	CHECK_STR(client->pod_uid, "uid-1");
+	CHECK(old->evicted);
+	CHECK_EQ(peer_error(peer), NVSHARE_ERR_EVICTED);
+}
+
+
+/* The client of the i-th request in the queue, NULL if there is none */
+static struct nvshare_client *queued(int i)
+{
+	struct nvshare_request *r;
+
+	LL_FOREACH(requests, r) if (i-- == 0) return r->client;
+	return NULL;
+}
+
+
+/* Have each of the n clients request the lock, in order */
+static void request_all(struct nvshare_client **c, int n)
+{
+	int i;
+
+	for (i = 0; i < n; i++) insert_req(c[i]);
+}
+
+
+/*
+ * The scheduling policy orders the waiting clients of the same rank, without
+ * ever passing the lock holder.
+ */
+
+static void test_policy_round_robin(void)
+{
+	struct nvshare_client *c[3];
+	int peer;
+
+	c[0] = registered_client("a", &peer);
+	c[1] = registered_client("b", &peer);
+	c[2] = registered_client("c", &peer);
+	c[0]->fair_ms = 300;
+	c[1]->fair_ms = 100;
+	c[2]->fair_ms = 200;
+	request_all(c, 3);
+	CHECK(queued(0) == c[0]);
+	CHECK(queued(1) == c[1]);
+	CHECK(queued(2) == c[2]);
+}
+
+
+static void test_policy_fair_share(void)
+{
+	struct nvshare_client *c[4];
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	c[0] = registered_client("a", &peer);
+	c[1] = registered_client("b", &peer);
+	c[2] = registered_client("c", &peer);
+	c[3] = registered_client("d", &peer);
+	c[0]->fair_ms = 300;
+	c[1]->fair_ms = 100;
+	c[2]->fair_ms = 200;
+	c[3]->fair_ms = 200;
+	insert_req(c[1]);
+	insert_req(c[0]);
+	insert_req(c[2]);
+	insert_req(c[3]);
+	CHECK(queued(0) == c[1]);
+	/* Clients that have had as much go FCFS */
+	CHECK(queued(1) == c[2]);
+	CHECK(queued(2) == c[3]);
+	CHECK(queued(3) == c[0]);
+}
+
+
+static void test_policy_fair_share_lock_holder(void)
+{
+	struct nvshare_client *c[2];
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	c[0] = registered_client("a", &peer);
+	c[1] = registered_client("b", &peer);
+	c[0]->fair_ms = 300;
+	c[1]->fair_ms = 100;
+	insert_req(c[0]);
+	lock_held = 1;
+	insert_req(c[1]);
+	CHECK(queued(0) == c[0]);
+	CHECK(queued(1) == c[1]);
+}
+
+
+static void test_policy_fair_share_register(void)
+{
+	struct nvshare_client *c[3];
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	c[0] = registered_client("a", &peer);
+	CHECK_EQ(c[0]->fair_ms, 0);
+	c[0]->fair_ms = 300;
+	c[1] = registered_client("b", &peer);
+	CHECK_EQ(c[1]->fair_ms, 300);
+	c[1]->fair_ms = 200;
+	c[2] = registered_client("c", &peer);
+	CHECK_EQ(c[2]->fair_ms, 200);
+}
+
+
+static void test_policy_fair_share_yield(void)
+{
+	struct nvshare_client *client;
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	client = registered_client("a", &peer);
+	client->millishares = NVSHARE_FULL_SHARE / 2;
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &client->slice_ts) == 0);
+	client->slice_ts.tv_sec -= 1;
+	sched_policy->on_yield(client);
+	/* Half a share takes twice as long to have had a second */
+	CHECK(client->fair_ms >= 2000 && client->fair_ms < 2100);
+}
+
+
+/*
+ * A client that comes back after a while without GPU work catches up with
+ * the clients that kept using the GPU, instead of having it to itself until
+ * they have had as much as it has.
+ */
+static void test_policy_fair_share_idle_return(void)
+{
+	struct nvshare_client *c[4];
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	c[0] = registered_client("a", &peer);
+	c[1] = registered_client("b", &peer);
+	c[2] = registered_client("c", &peer);
+	c[3] = registered_client("d", &peer);
+	c[0]->fair_ms = 5000;
+	c[1]->fair_ms = 6000;
+	c[2]->fair_ms = 100;
+	c[3]->fair_ms = 9000;
+	request_all(c, 2);
+	lock_held = 1;
+
+	insert_req(c[2]);
+	CHECK_EQ(c[2]->fair_ms, 5000);
+	CHECK(queued(1) == c[2]);
+	CHECK(queued(2) == c[1]);
+
+	/* A client ahead of the others stays there */
+	insert_req(c[3]);
+	CHECK_EQ(c[3]->fair_ms, 9000);
+	CHECK(queued(3) == c[3]);
+}
+
+
+/* Nobody else uses the GPU, so there is nobody to catch up with */
+static void test_policy_fair_share_idle_return_alone(void)
+{
+	struct nvshare_client *c[2];
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	c[0] = registered_client("a", &peer);
+	c[1] = registered_client("b", &peer);
+	c[0]->fair_ms = 5000;
+	c[1]->fair_ms = 100;
+	insert_req(c[1]);
+	CHECK_EQ(c[1]->fair_ms, 100);
+}
+
+
+/* A client that has been idle since secs ago */
+static void set_idle(struct nvshare_client *client, time_t secs)
+{
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &client->idle_ts) == 0);
+	client->idle_ts.tv_sec -= secs;
+	client->has_idled = 1;
+}
+
+
+/*
+ * With NVSHARE_FAIR_SHARE_IDLE_RESET_S, a client that comes back after a
+ * long while without GPU work doesn't pay for the GPU time it had before.
+ */
+static void test_policy_fair_share_idle_reset(void)
+{
+	struct nvshare_client *c[4];
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	fair_share_idle_reset_s = 60;
+	c[0] = registered_client("a", &peer);
+	c[1] = registered_client("b", &peer);
+	c[2] = registered_client("heavy", &peer);
+	c[3] = registered_client("recent", &peer);
+	c[0]->fair_ms = 5000;
+	c[1]->fair_ms = 7000;
+	c[2]->fair_ms = 20000;
+	c[3]->fair_ms = 20000;
+	request_all(c, 2);
+	lock_held = 1;
+
+	set_idle(c[2], 61);
+	insert_req(c[2]);
+	CHECK_EQ(c[2]->fair_ms, 5000);
+	CHECK(queued(1) == c[2]);
+	CHECK(queued(2) == c[1]);
+
+	/* It hasn't been idle for long enough */
+	set_idle(c[3], 59);
+	insert_req(c[3]);
+	CHECK_EQ(c[3]->fair_ms, 20000);
+	CHECK(queued(3) == c[3]);
+}
+
+
+/* Without NVSHARE_FAIR_SHARE_IDLE_RESET_S, it keeps its lead */
+static void test_policy_fair_share_idle_reset_off(void)
+{
+	struct nvshare_client *c[2];
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	c[0] = registered_client("a", &peer);
+	c[1] = registered_client("heavy", &peer);
+	c[0]->fair_ms = 5000;
+	c[1]->fair_ms = 20000;
+	insert_req(c[0]);
+	lock_held = 1;
+	set_idle(c[1], 3600);
+	insert_req(c[1]);
+	CHECK_EQ(c[1]->fair_ms, 20000);
+}
+
+
+/* Nobody else is around, so there is nobody to start off even with */
+static void test_policy_fair_share_idle_reset_alone(void)
+{
+	struct nvshare_client *client;
+	int peer;
+
+	sched_policy = &sched_policies[1];
+	fair_share_idle_reset_s = 60;
+	client = registered_client("heavy", &peer);
+	client->fair_ms = 20000;
+	set_idle(client, 61);
+	insert_req(client);
+	CHECK_EQ(client->fair_ms, 0);
+}
+
+
+/*
+ * A client we turn away learns why, so that it can fail with a clear error
+ * instead of retrying in the dark.
+ */
+
+static void test_error_already_registered(void)
+{
+	struct nvshare_client *client;
+	struct message msg;
+	int peer;
+
+	client = registered_client("pod", &peer);
+	while (peer_recv(peer, &msg) == 0) ; /* What came after SCHED_ON */
+	CHECK_EQ(join(client, peer, REGISTER, "pod", 0, NULL), SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_ALREADY_REGISTERED);
+	CHECK(!client_alive(client));
+}
+
+
+/* Without the containers of both clients, we can't tell which is which */
+static void test_error_duplicate_id(void)
+{
+	struct nvshare_client *client;
+	int peer, peer2;
+
+	client = new_client(&peer);
+	CHECK_EQ(join(client, peer, REATTACH, "pod", 0x1111, NULL), SCHED_ON);
+
+	client = new_client(&peer2);
+	CHECK_EQ(join(client, peer2, REATTACH, "pod", 0x1111, NULL),
+		 SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_DUPLICATE_ID);
+	CHECK(!client_alive(client));
+}
+
+
+static void test_error_unauthorized(void)
+{
+	struct nvshare_client *client;
+	uid_t uid = geteuid() + 2;
+	int peer;
+
+	allowed_uids = &uid;
+	allowed_uids_cnt = 1;
+	client = new_client(&peer);
+	client->peer_uid = geteuid() + 1;
+	CHECK_EQ(join(client, peer, REGISTER, "pod", 0, NULL), SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_UNAUTHORIZED);
+	CHECK(!client_alive(client));
+
+	client = new_client(&peer);
+	client->peer_uid = uid;
+	CHECK_EQ(join(client, peer, REGISTER, "pod", 0, NULL), SCHED_ON);
+}
+
+
+static void test_error_namespace(void)
+{
+	struct nvshare_client *client;
+	char *namespaces[] = { "prod" };
+	int peer;
+
+	allowed_namespaces = namespaces;
+	allowed_namespaces_cnt = 1;
+	client = new_client(&peer);
+	CHECK_EQ(join(client, peer, REGISTER, "pod", 0, NULL), SCHED_ERROR);
+	CHECK_EQ(error_code(&reply), NVSHARE_ERR_NAMESPACE);
+	CHECK(strstr(reply.pod_name, "namespace ns") != NULL);
+	CHECK(!client_alive(client));
+}
+
+
+static void test_error_kicked(void)
+{
+	struct nvshare_client *victim, *ctl;
+	struct message msg;
+	char data[MSG_DATA_LEN];
+	int peer, ctl_peer;
+
+	victim = registered_client("pod", &peer);
+	ctl = new_client(&ctl_peer);
+	snprintf(data, sizeof(data), "%s=%016" PRIx64, NVSHARE_EVICT_ID_FIELD,
+		 victim->id);
+	msg = make_msg(EVICT, "", "", 0, data);
+	process_msg(ctl, &msg);
+	CHECK_EQ(peer_recv_type(ctl_peer, EVICT, &msg), 0);
+	CHECK_STR(msg.data, NVSHARE_EVICTED_FIELD "=1");
+	CHECK(victim->evicted);
+	CHECK_EQ(peer_error(peer), NVSHARE_ERR_KICKED);
+}
+
+
+static void test_error_unsupported_version(void)
+{
+	struct nvshare_client *client;
+	char want[MSG_DATA_LEN];
+	int peer;
+
+	client = new_client(&peer);
+	CHECK_EQ(join_data(client, peer, REGISTER, "pod", 0, NULL, "v=99"),
+		 UNSUPPORTED_VERSION);
+	snprintf(want, sizeof(want), "%s=%d-%d", NVSHARE_VERSION_FIELD,
+		 NVSHARE_PROTOCOL_VERSION_MIN, NVSHARE_PROTOCOL_VERSION);
+	CHECK_STR(reply.data, want);
+	CHECK(!client_alive(client));
+}
+
+
+/* Clients older than SCHED_ERROR only see the connection close */
+static void test_error_old_client(void)
+{
+	struct nvshare_client *client;
+	char data[MSG_DATA_LEN];
+	int peer;
+
+	draining = 1;
+	client = new_client(&peer);
+	snprintf(data, sizeof(data), "%s=%d", NVSHARE_VERSION_FIELD,
+		 NVSHARE_ERROR_MIN_VERSION - 1);
+	CHECK_EQ(join_data(client, peer, REGISTER, "pod", 0, NULL, data), 0);
+	CHECK(!client_alive(client));
+}
+
+
+/*
+ * The effective share of a client is its turn out of the turns of all the
+ * clients that may get the lock.
+ */
+
+static int share_is(struct nvshare_client *client, double share)
+{
+	double d = client_effective_share(client) - share;
+
+	return d > -1e-9 && d < 1e-9;
+}
+
+
+static void test_share_equal(void)
+{
+	struct nvshare_client *c[4];
+	int peer;
+
+	for (int i = 0; i < 4; i++) c[i] = registered_client("pod", &peer);
+	/* Clients that haven't registered yet don't count */
+	(void)new_client(&peer);
+	for (int i = 0; i < 4; i++) CHECK(share_is(c[i], 0.25));
+}
+
+
+static void test_share_weighted(void)
+{
+	struct nvshare_client *a, *b;
+	int peer;
+
+	a = registered_client("a", &peer);
+	b = registered_client("b", &peer);
+	a->millishares = 3 * NVSHARE_FULL_SHARE;
+	CHECK(share_is(a, 0.75));
+	CHECK(share_is(b, 0.25));
+
+	boost_factor = 3;
+	b->boost_until.tv_sec = 1;
+	CHECK(share_is(a, 0.5));
+	CHECK(share_is(b, 0.5));
+}
+
+
+static void test_share_denied(void)
+{
+	struct nvshare_client *a, *b, *c;
+	int peer;
+
+	a = registered_client("a", &peer);
+	b = registered_client("b", &peer);
+	c = registered_client("c", &peer);
+	c->denied = 1;
+	CHECK(share_is(a, 0.5));
+	CHECK(share_is(b, 0.5));
+	CHECK(share_is(c, 0));
+}
+
+
+/* Short slices last at least min_dwell_ms */
+static void test_share_min_dwell(void)
+{
+	struct nvshare_client *a, *b;
+	int peer;
+
+	tq = 30;
+	a = registered_client("a", &peer);
+	b = registered_client("b", &peer);
+	a->millishares = NVSHARE_FULL_SHARE / 10;
+	CHECK(share_is(a, 1.0 / 11));
+
+	min_dwell_ms = 10000;
+	CHECK(share_is(a, 0.25));
+	CHECK(share_is(b, 0.75));
+}
+
+
+static void test_share_shortened(void)
+{
+	struct nvshare_client *a, *b;
+	int peer;
+
+	a = registered_client("a", &peer);
+	b = registered_client("b", &peer);
+	a->repeat_overrunner = 1;
+	CHECK(share_is(a, 0.5));
+
+	overrun_action = OVERRUN_ACTION_SHORTEN;
+	CHECK(share_is(a, 1.0 / 3));
+	CHECK(share_is(b, 2.0 / 3));
+}
+
+
+/*
+ * Only administrators may change how the scheduler schedules, any client may
+ * ask for its status.
+ */
+
+static void test_admin_ignores_clients(void)
+{
+	struct nvshare_client *victim, *client;
+	struct message msg;
+	char data[MSG_DATA_LEN];
+	int peer, client_peer;
+
+	victim = registered_client("victim", &peer);
+	client = registered_client("pod", &client_peer);
+	client->peer_uid = geteuid() + 1;
+	snprintf(data, sizeof(data), "%s=%016" PRIx64, NVSHARE_EVICT_ID_FIELD,
+		 victim->id);
+	msg = make_msg(EVICT, "", "", 0, data);
+	process_msg(client, &msg);
+	CHECK(!victim->evicted);
+	CHECK(!client_alive(client));
+
+	client = new_client(&client_peer);
+	client->peer_uid = geteuid() + 1;
+	send_simple(client, DRAIN);
+	CHECK(!draining);
+	CHECK(!client_alive(client));
+
+	client = new_client(&client_peer);
+	client->peer_uid = geteuid() + 1;
+	send_simple(client, SCHED_OFF);
+	CHECK(scheduler_on);
+	CHECK(client_alive(victim));
+}
+
+
+static void test_admin_uids(void)
+{
+	struct nvshare_client *client;
+	uid_t uid = geteuid() + 1;
+	int peer;
+
+	admin_uids = &uid;
+	admin_uids_cnt = 1;
+	client = new_client(&peer);
+	client->peer_uid = uid;
+	send_simple(client, DRAIN);
+	CHECK(draining);
+
+	client = new_client(&peer);
+	client->peer_uid = geteuid() + 2;
+	send_simple(client, SCHED_OFF);
+	CHECK(scheduler_on);
+	CHECK(!client_alive(client));
+}
+
+
+/* Processes that run as our own user are administrators */
+static void test_admin_own_user(void)
+{
+	struct nvshare_client *client;
+	int peer;
+
+	client = new_client(&peer);
+	send_simple(client, DRAIN);
+	CHECK(draining);
+}
+
+
+static void test_admin_status_open(void)
+{
+	struct nvshare_client *client;
+	char buf[64];
+	int peer;
+
+	client = new_client(&peer);
+	client->peer_uid = geteuid() + 1;
+	send_simple(client, STATUS);
+	CHECK(read(peer, buf, sizeof(buf)) > 0);
+}
+
+
+/*
+ * When a client runs out of GPU memory, we may evict another client that
+ * holds memory on the same GPU, which the reclaim policy picks.
+ */
+
+/* A registered client that has committed mib of GPU memory */
+static struct nvshare_client *holding(const char *pod_name, long long mib,
+	int *peer)
+{
+	struct nvshare_client *client;
+
+	client = registered_client(pod_name, peer);
+	client->mem_committed_mib = mib;
+	return client;
+}
+
+
+/* Have the client report that it ran out of memory */
+static void send_oom(struct nvshare_client *client)
+{
+	struct message msg = make_msg(OOM, client->pod_namespace,
+				      client->pod_name, client->id,
+				      NVSHARE_OOM_FIELD "=100");
+
+	process_msg(client, &msg);
+}
+
+
+static void test_reclaim_lru(void)
+{
+	struct nvshare_client *oom, *c[3];
+	int peer, peers[3];
+
+	reclaim_policy = RECLAIM_LRU;
+	oom = holding("oom", 100, &peer);
+	for (int i = 0; i < 3; i++) c[i] = holding("pod", 100, &peers[i]);
+	set_idle(c[0], 10);
+	set_idle(c[1], 30);
+	set_idle(c[2], 20);
+	CHECK(reclaim_before(c[1], c[2]));
+	CHECK(!reclaim_before(c[0], c[2]));
+
+	/* A client that asks for the GPU is active now */
+	send_simple(c[1], REQ_LOCK);
+	CHECK(reclaim_before(c[2], c[1]));
+	send_oom(oom);
+	CHECK(c[2]->evicted);
+	CHECK_EQ(peer_error(peers[2]), NVSHARE_ERR_KICKED);
+	CHECK(!c[0]->evicted);
+	CHECK(!c[1]->evicted);
+	CHECK(!oom->evicted);
+	CHECK_EQ(reclaims, 1);
+	CHECK_EQ(reclaim_history[0].id, c[2]->id);
+	CHECK_EQ(reclaim_history[0].oom_id, oom->id);
+	CHECK_EQ(reclaim_history[0].mem_committed_mib, 100);
+}
+
+
+static void test_reclaim_lfu(void)
+{
+	struct nvshare_client *oom, *c[3];
+	int peer;
+
+	reclaim_policy = RECLAIM_LFU;
+	oom = holding("oom", 100, &peer);
+	for (int i = 0; i < 3; i++) {
+		c[i] = holding("pod", 100, &peer);
+		c[i]->register_ts.tv_sec -= 60;
+	}
+	c[0]->slices = 10;
+	c[1]->slices = 2;
+	c[2]->slices = 5;
+	/* However long it has idled */
+	set_idle(c[0], 60);
+	CHECK(reclaim_before(c[1], c[2]));
+	CHECK(!reclaim_before(c[0], c[2]));
+
+	send_oom(oom);
+	CHECK(c[1]->evicted);
+	CHECK(!c[0]->evicted);
+	CHECK(!c[2]->evicted);
+}
+
+
+/* The smallest share goes first, and the least recently active among those */
+static void test_reclaim_priority(void)
+{
+	struct nvshare_client *oom, *c[3];
+	int peer;
+
+	reclaim_policy = RECLAIM_PRIORITY;
+	oom = holding("oom", 100, &peer);
+	for (int i = 0; i < 3; i++) c[i] = holding("pod", 100, &peer);
+	c[0]->millishares = NVSHARE_FULL_SHARE / 2;
+	c[1]->millishares = NVSHARE_FULL_SHARE / 2;
+	set_idle(c[0], 10);
+	set_idle(c[1], 20);
+	set_idle(c[2], 30);
+	CHECK(reclaim_before(c[1], c[2]));
+	CHECK(reclaim_before(c[1], c[0]));
+
+	send_oom(oom);
+	CHECK(c[1]->evicted);
+	CHECK(!c[0]->evicted);
+	CHECK(!c[2]->evicted);
+}
+
+
+/* Only other clients of the same GPU that hold memory and allow it */
+static void test_reclaim_candidates(void)
+{
+	static struct workload_policy keep = { .name = "keep", .reclaim = 0 };
+	struct nvshare_client *oom, *c[4];
+	int peer;
+
+	reclaim_policy = RECLAIM_LRU;
+	oom = holding("oom", 100, &peer);
+	strlcpy(oom->gpu_uuid, "GPU-a", sizeof(oom->gpu_uuid));
+	set_idle(oom, 60);
+	c[0] = holding("empty", 0, &peer);
+	c[1] = holding("keep", 100, &peer);
+	c[1]->workload = &keep;
+	c[2] = holding("other-gpu", 100, &peer);
+	strlcpy(c[2]->gpu_uuid, "GPU-b", sizeof(c[2]->gpu_uuid));
+	c[3] = holding("evicted", 100, &peer);
+	CHECK_EQ(kick_client(c[3]->id), 1);
+	for (int i = 0; i < 4; i++) set_idle(c[i], 30);
+
+	send_oom(oom);
+	CHECK_EQ(reclaims, 0);
+	CHECK(!oom->evicted);
+	for (int i = 0; i < 3; i++) CHECK(!c[i]->evicted);
+}
+
+
+/* We give the application of a victim time to exit */
+static void test_reclaim_cooldown(void)
+{
+	struct nvshare_client *oom, *a, *b;
+	int peer;
+
+	reclaim_policy = RECLAIM_LRU;
+	oom = holding("oom", 100, &peer);
+	a = holding("a", 100, &peer);
+	b = holding("b", 100, &peer);
+	set_idle(a, 20);
+	set_idle(b, 10);
+
+	send_oom(oom);
+	CHECK(a->evicted);
+	send_oom(oom);
+	CHECK(!b->evicted);
+	CHECK_EQ(reclaims, 1);
+}
+
+
+static void test_reclaim_off(void)
+{
+	struct nvshare_client *oom, *c;
+	int peer;
+
+	oom = holding("oom", 100, &peer);
+	c = holding("pod", 100, &peer);
+	set_idle(c, 30);
+	send_oom(oom);
+	CHECK(!c->evicted);
+	CHECK_EQ(reclaims, 0);
+	CHECK_EQ(ooms, 1);
+}
+
+
+/*
+ * A client that stops reading must not stall the scheduler for long, and
+ * neither must many of them.
+ */
+
+/* Fill the socket of a client, as if it had stopped reading */
+static void fill_socket(struct nvshare_client *client)
+{
+	char buf[4096] = {0};
+
+	while (write(client->fd, buf, sizeof(buf)) > 0);
+	true_or_exit(errno == EAGAIN || errno == EWOULDBLOCK);
+}
+
+
+static void test_send_stuck_client(void)
+{
+	struct nvshare_client *client;
+	struct message msg = make_msg(SCHED_OFF, "", "", 0, "");
+	struct timespec start;
+	long long waited_ms;
+	int peer;
+
+	client_send_timeout_ms = send_budget_ms = 200;
+	client = registered_client("pod", &peer);
+	fill_socket(client);
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &start) == 0);
+	CHECK_EQ(send_message(client, &msg), -1);
+	waited_ms = elapsed_ms_since(&start);
+	CHECK(waited_ms >= 200);
+	CHECK(waited_ms < 1000);
+	CHECK_EQ(socket_timeouts, 1);
+}
+
+
+static void test_send_stuck_clients_share_timeout(void)
+{
+	struct nvshare_client *stuck[4], *healthy;
+	struct message msg;
+	struct timespec start;
+	int peer, healthy_peer;
+
+	client_send_timeout_ms = send_budget_ms = 200;
+	for (int i = 0; i < 4; i++) stuck[i] = registered_client("stuck", &peer);
+	healthy = registered_client("healthy", &healthy_peer);
+	for (int i = 0; i < 4; i++) fill_socket(stuck[i]);
+	true_or_exit(clock_gettime(CLOCK_MONOTONIC, &start) == 0);
+	set_scheduler_on(0);
+	CHECK(elapsed_ms_since(&start) < 400);
+	for (int i = 0; i < 4; i++) CHECK(!client_alive(stuck[i]));
+	CHECK(client_alive(healthy));
+	CHECK_EQ(peer_recv_type(healthy_peer, SCHED_OFF, &msg), 0);
+}
+
+
+/* Read everything at the peer of a client, after it has stalled for a while */
+static void *slow_reader_fn(void *arg)
+{
+	int peer = *(int *)arg;
+	struct pollfd pfd = { .fd = peer, .events = POLLIN };
+	char buf[4096];
+
+	usleep(50 * 1000);
+	while (poll(&pfd, 1, 200) > 0 && read(peer, buf, sizeof(buf)) > 0);
+	return NULL;
+}
+
+
+/*
+ * A message we send on its own, e.g., a DROP_LOCK from the timer thread,
+ * doesn't pay for the stuck clients of the last batch
+ */
+static void test_send_after_batch(void)
+{
+	struct nvshare_client *stuck, *slow;
+	struct message msg = make_msg(DROP_LOCK, "", "", 0, "");
+	pthread_t tid;
+	int peer, slow_peer, ret;
+
+	client_send_timeout_ms = 200;
+	stuck = registered_client("stuck", &peer);
+	slow = registered_client("slow", &slow_peer);
+	fill_socket(stuck);
+	fill_socket(slow);
+
+	begin_sends();
+	CHECK_EQ(send_message(stuck, &msg), -1);
+	CHECK_EQ(send_budget_ms, 0);
+	/* Within the batch, a full socket fails right away */
+	CHECK_EQ(send_message(slow, &msg), -1);
+	end_sends();
+
+	true_or_exit(pthread_create(&tid, NULL, slow_reader_fn,
+				    &slow_peer) == 0);
+	ret = send_message(slow, &msg);
+	true_or_exit(pthread_join(tid, NULL) == 0);
+	CHECK_EQ(ret, 0);
+	CHECK_EQ(send_batches, 0);
+}
+
+
+static const struct nvshare_test tests[] = {
+	{ "receive_partial_reads", test_receive_partial_reads },
+	{ "receive_interrupted_reads", test_receive_interrupted_reads },
+	{ "receive_split_writes", test_receive_split_writes },
+	{ "receive_back_to_back", test_receive_back_to_back },
+	{ "receive_close_midway", test_receive_close_midway },
+	{ "receive_block", test_receive_block },
+	{ "frame_check", test_frame_check },
+	{ "frame_receive", test_frame_receive },
+	{ "frame_truncated", test_frame_truncated },
+	{ "frame_oversized", test_frame_oversized },
+	{ "frame_fuzz", test_frame_fuzz },
+	{ "reattach_unused_id", test_reattach_unused_id },
+	{ "reattach_while_draining", test_reattach_while_draining },
+	{ "reattach_at_max_clients", test_reattach_at_max_clients },
+	{ "reattach_after_oom", test_reattach_after_oom },
+	{ "reattach_at_process_limit", test_reattach_at_process_limit },
+	{ "reattach_replacing_while_draining",
+	  test_reattach_replacing_while_draining },
+	{ "reattach_clash_while_draining", test_reattach_clash_while_draining },
+	{ "collision_same_container", test_collision_same_container },
+	{ "collision_other_container", test_collision_other_container },
+	{ "collision_unknown_container", test_collision_unknown_container },
+	{ "collision_evicted_client", test_collision_evicted_client },
+	{ "collision_malformed_identity", test_collision_malformed_identity },
+	{ "collision_identity_after_register",
+	  test_collision_identity_after_register },
+	{ "restart_evicts_lingering_client",
+	  test_restart_evicts_lingering_client },
+	{ "restart_spares_other_clients", test_restart_spares_other_clients },
+	{ "restart_long_slot", test_restart_long_slot },
+	{ "policy_round_robin", test_policy_round_robin },
+	{ "policy_fair_share", test_policy_fair_share },
+	{ "policy_fair_share_lock_holder", test_policy_fair_share_lock_holder },
+	{ "policy_fair_share_register", test_policy_fair_share_register },
+	{ "policy_fair_share_yield", test_policy_fair_share_yield },
+	{ "policy_fair_share_idle_return", test_policy_fair_share_idle_return },
+	{ "policy_fair_share_idle_return_alone",
+	  test_policy_fair_share_idle_return_alone },
+	{ "policy_fair_share_idle_reset", test_policy_fair_share_idle_reset },
+	{ "policy_fair_share_idle_reset_off",
+	  test_policy_fair_share_idle_reset_off },
+	{ "policy_fair_share_idle_reset_alone",
+	  test_policy_fair_share_idle_reset_alone },
+	{ "error_already_registered", test_error_already_registered },
+	{ "error_duplicate_id", test_error_duplicate_id },
+	{ "error_unauthorized", test_error_unauthorized },
+	{ "error_namespace", test_error_namespace },
+	{ "error_kicked", test_error_kicked },
+	{ "error_unsupported_version", test_error_unsupported_version },
+	{ "error_old_client", test_error_old_client },
+	{ "share_equal", test_share_equal },
+	{ "share_weighted", test_share_weighted },
+	{ "share_denied", test_share_denied },
+	{ "share_min_dwell", test_share_min_dwell },
+	{ "share_shortened", test_share_shortened },
+	{ "reclaim_lru", test_reclaim_lru },
+	{ "reclaim_lfu", test_reclaim_lfu },
+	{ "reclaim_priority", test_reclaim_priority },
+	{ "reclaim_candidates", test_reclaim_candidates },
+	{ "reclaim_cooldown", test_reclaim_cooldown },
+	{ "reclaim_off", test_reclaim_off },
+	{ "send_stuck_client", test_send_stuck_client },
+	{ "send_stuck_clients_share_timeout",
+	  test_send_stuck_clients_share_timeout },
+	{ "send_after_batch", test_send_after_batch },
+	{ "admin_ignores_clients", test_admin_ignores_clients },
+	{ "admin_uids", test_admin_uids },
+	{ "admin_own_user", test_admin_own_user },
+	{ "admin_status_open", test_admin_status_open },
+	{ NULL, NULL },
+};
+
+
+/*
+ * Usage: test_scheduler [-v] [filter]
+ *
+ * Without -v, we silence the logs of the scheduler.
+ */
+int main(int argc, char *argv[])
+{
+	const char *filter = NULL;
+	int i;
+
+	for (i = 1; i < argc; i++) {
+		if (strcmp(argv[i], "-v") == 0) __debug = 1;
+		else filter = argv[i];
+	}
+	if (!__debug) true_or_exit(freopen("/dev/null", "w", stderr) != NULL);
+
+	true_or_exit((epoll_fd = epoll_create(1)) >= 0);
+	true_or_exit(pthread_mutex_init(&global_mutex, NULL) == 0);
+	signal(SIGPIPE, SIG_IGN);
+	srand((unsigned int)time(NULL));
+
+	return nvshare_run_tests(tests, reset_scheduler, filter);
+}
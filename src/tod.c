@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Time-of-day policies for the nvshare scheduler.
+ *
+ * The policy file contains one policy window per line:
+ *
+ *     <name> <HH:MM>-<HH:MM> [tq=<seconds>] [max_clients=<n>] [scheduler=on|off]
+ *
+ * Empty lines and lines starting with '#' are ignored. If windows overlap,
+ * the first one in the file wins.
+ */
+
+#include <stdio.h>
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "common.h"
+#include "tod.h"
+
+struct tod_policy *tod_policies = NULL;
+int tod_policies_cnt = 0;
+
+
+/* Parse "HH:MM" into minutes since midnight. Return -1 on error. */
+static int parse_hhmm(const char *s)
+{
+	int hh, mm, n;
+
+	if (sscanf(s, "%2d:%2d%n", &hh, &mm, &n) != 2 || s[n] != '\0')
+		return -1;
+	if (hh < 0 || hh > 23 || mm < 0 || mm > 59) return -1;
+	return hh * 60 + mm;
+}
+
+
+static int parse_int(const char *s, int *val)
+{
+	char *endptr;
+	long long v;
+
+	errno = 0;
+	v = strtoll(s, &endptr, 10);
+	if (s == endptr || *endptr != '\0' || errno != 0 || v < 0 ||
+	    v > 1000000000)
+		return -1;
+	*val = (int)v;
+	return 0;
+}
+
+
+static int parse_line(char *line, struct tod_policy *p)
+{
+	char *tok, *saveptr, *dash, *val;
+
+	tok = strtok_r(line, " \t", &saveptr);
+	if (tok == NULL || strlen(tok) >= sizeof(p->name)) return -1;
+	strlcpy(p->name, tok, sizeof(p->name));
+
+	tok = strtok_r(NULL, " \t", &saveptr);
+	if (tok == NULL || (dash = strchr(tok, '-')) == NULL) return -1;
+	*dash = '\0';
+	if ((p->start_min = parse_hhmm(tok)) < 0) return -1;
+	if ((p->end_min = parse_hhmm(dash + 1)) < 0) return -1;
+
+	p->tq = -1;
+	p->max_clients = -1;
+	p->scheduler_on = -1;
+	while ((tok = strtok_r(NULL, " \t", &saveptr)) != NULL) {
+		if ((val = strchr(tok, '=')) == NULL) return -1;
+		*val++ = '\0';
+		if (strcmp(tok, "tq") == 0) {
+			if (parse_int(val, &p->tq) < 0 || p->tq == 0) return -1;
+		} else if (strcmp(tok, "max_clients") == 0) {
+			if (parse_int(val, &p->max_clients) < 0) return -1;
+		} else if (strcmp(tok, "scheduler") == 0) {
+			if (strcmp(val, "on") == 0) p->scheduler_on = 1;
+			else if (strcmp(val, "off") == 0) p->scheduler_on = 0;
+			else return -1;
+		} else return -1;
+	}
+	return 0;
+}
+
+
+/* Load the policy windows from the file that ENV_NVSHARE_POLICY_FILE names */
+void nvshare_tod_load(void)
+{
+	FILE *fp;
+	char *path, *line = NULL, *s;
+	size_t cap = 0;
+	int lineno = 0;
+	struct tod_policy p;
+
+	path = getenv(ENV_NVSHARE_POLICY_FILE);
+	if (path == NULL || *path == '\0') return;
+
+	fp = fopen(path, "r");
+	if (fp == NULL)
+		log_fatal_errno("Could not open policy file %s", path);
+
+	while (getline(&line, &cap, fp) != -1) {
+		lineno++;
+		line[strcspn(line, "\r\n")] = '\0';
+		for (s = line; *s == ' ' || *s == '\t'; s++);
+		if (*s == '\0' || *s == '#') continue;
+		if (parse_line(s, &p) < 0)
+			log_fatal("Invalid policy at %s:%d", path, lineno);
+		true_or_exit(tod_policies = realloc(tod_policies,
+			(tod_policies_cnt + 1) * sizeof(*tod_policies)));
+		tod_policies[tod_policies_cnt++] = p;
+		log_info("Loaded policy %s: %02d:%02d-%02d:%02d", p.name,
+			 p.start_min / 60, p.start_min % 60, p.end_min / 60,
+			 p.end_min % 60);
+	}
+	free(line);
+	fclose(fp);
+}
+
+
+/* Return the index of the policy window active at tm, or -1 if none is */
+int nvshare_tod_active(const struct tm *tm)
+{
+	int i, now = tm->tm_hour * 60 + tm->tm_min;
+	struct tod_policy *p;
+
+	for (i = 0; i < tod_policies_cnt; i++) {
+		p = &tod_policies[i];
+		if (p->start_min < p->end_min) {
+			if (now >= p->start_min && now < p->end_min) return i;
+		} else if (now >= p->start_min || now < p->end_min) return i;
+	}
+	return -1;
+}
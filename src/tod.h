@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Time-of-day policies for the nvshare scheduler.
+ */
+
+#ifndef _NVSHARE_TOD_H_
+#define _NVSHARE_TOD_H_
+
+#include <time.h>
+
+#define ENV_NVSHARE_POLICY_FILE "NVSHARE_POLICY_FILE"
+
+#define TOD_POLICY_NAME_MAX 64
+
+/*
+ * A policy window applies from start_min (inclusive) until end_min
+ * (exclusive), in minutes since local midnight. If end_min <= start_min, the
+ * window wraps around midnight.
+ *
+ * A value of -1 leaves the respective setting at its default.
+ */
+struct tod_policy {
+	char name[TOD_POLICY_NAME_MAX];
+	int start_min;
+	int end_min;
+	int tq;
+	int max_clients;
+	int scheduler_on;
+};
+
+extern struct tod_policy *tod_policies;
+extern int tod_policies_cnt;
+
+extern void nvshare_tod_load(void);
+extern int nvshare_tod_active(const struct tm *tm);
+
+#endif /* _NVSHARE_TOD_H_ */
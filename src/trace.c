@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * OpenTelemetry span export for the nvshare scheduler.
+ *
+ * We don't link against an OpenTelemetry SDK. Instead, we write every span
+ * as a single line of OTLP/JSON (an ExportTraceServiceRequest) to a file.
+ * The OpenTelemetry Collector can ingest this file using its `otlpjsonfile`
+ * receiver and forward the spans to any OTLP backend.
+ *
+ * This keeps the hot path of the scheduler free of network I/O. Nothing
+ * truncates the file once the Collector has read it, so we rotate it like
+ * the event log, once it grows past max_bytes, keeping up to max_files files
+ * in total.
+ */
+
+#include <stdio.h>
+#include <errno.h>
+#include <stdlib.h>
+#include <pthread.h>
+
+#include "common.h"
+#include "comm.h"
+#include "trace.h"
+
+#define DEFAULT_TRACES_MAX_BYTES (10 * 1024 * 1024)
+#define DEFAULT_TRACES_FILES 3
+
+int nvshare_trace_enabled = 0;
+
+static FILE *trace_fp = NULL;
+static char *trace_path;
+static double sample_ratio = 1.0;
+static long long max_bytes = DEFAULT_TRACES_MAX_BYTES;
+static long long max_files = DEFAULT_TRACES_FILES;
+static pthread_mutex_t trace_mutex = PTHREAD_MUTEX_INITIALIZER;
+
+
+static long long getenv_positive(const char *name, long long def)
+{
+	char *value, *endptr;
+	long long n;
+
+	value = getenv(name);
+	if (value == NULL) return def;
+
+	errno = 0;
+	n = strtoll(value, &endptr, 0);
+	if (value == endptr || *endptr != '\0' || errno != 0 || n <= 0)
+		log_fatal("Invalid value for %s: %s", name, value);
+	return n;
+}
+
+
+void nvshare_trace_init(void)
+{
+	char *ratio_str, *endptr;
+	double ratio;
+
+	trace_path = getenv(ENV_NVSHARE_OTEL_TRACES_FILE);
+	if (trace_path == NULL || *trace_path == '\0') return;
+
+	ratio_str = getenv(ENV_NVSHARE_OTEL_SAMPLE_RATIO);
+	if (ratio_str != NULL) {
+		errno = 0;
+		ratio = strtod(ratio_str, &endptr);
+		if (ratio_str == endptr || *endptr != '\0' || errno != 0 ||
+		    ratio < 0.0 || ratio > 1.0)
+			log_fatal("Invalid value for %s: %s. Must be a number in"
+				  " [0, 1].", ENV_NVSHARE_OTEL_SAMPLE_RATIO,
+				  ratio_str);
+		sample_ratio = ratio;
+	}
+	max_bytes = getenv_positive(ENV_NVSHARE_OTEL_TRACES_MAX_BYTES,
+				    DEFAULT_TRACES_MAX_BYTES);
+	max_files = getenv_positive(ENV_NVSHARE_OTEL_TRACES_FILES,
+				    DEFAULT_TRACES_FILES);
+
+	trace_fp = fopen(trace_path, "a");
+	if (trace_fp == NULL)
+		log_fatal_errno("Could not open traces file %s", trace_path);
+
+	nvshare_trace_enabled = 1;
+	log_info("Exporting OpenTelemetry spans to %s (sample ratio = %.3f, up"
+		 " to %lld bytes per file, %lld files)", trace_path,
+		 sample_ratio, max_bytes, max_files);
+}
+
+
+/*
+ * Shift every rotated file one place down, dropping the oldest one, and
+ * start a fresh file. If we can't, keep writing to whatever file we have.
+ */
+static void rotate_traces(void)
+{
+	FILE *fp;
+
+	rotate_files(trace_path, max_files);
+	fp = fopen(trace_path, "a");
+	if (fp == NULL) {
+		log_warn("Failed to reopen traces file %s", trace_path);
+		return;
+	}
+	fclose(trace_fp);
+	trace_fp = fp;
+}
+
+
+/* Decide whether a lock cycle of a client will be traced. */
+int nvshare_trace_sample(void)
+{
+	if (!nvshare_trace_enabled) return 0;
+	if (sample_ratio >= 1.0) return 1;
+	return ((double)rand() / ((double)RAND_MAX + 1.0)) < sample_ratio;
+}
+
+
+/* Write a string as a JSON string literal, escaping whatever needs it. */
+void nvshare_json_write_string(FILE *fp, const char *s)
+{
+	fputc('"', fp);
+	for (; *s != '\0'; s++) {
+		if (*s == '"' || *s == '\\') fprintf(fp, "\\%c", *s);
+		else if ((unsigned char)*s < 0x20) fprintf(fp, "\\u%04x", *s);
+		else fputc(*s, fp);
+	}
+	fputc('"', fp);
+}
+
+
+static unsigned long long ts_to_ns(const struct timespec *ts)
+{
+	return (unsigned long long)ts->tv_sec * 1000000000ULL +
+	       (unsigned long long)ts->tv_nsec;
+}
+
+
+/*
+ * Export a single span.
+ *
+ * All spans of the same lock cycle of a client share a trace ID, which
+ * consists of the client ID followed by the cycle number. This way, the
+ * tracing UI groups together the wait and hold phases of each cycle and we
+ * can easily find every cycle of a given client.
+ */
+void nvshare_trace_span(const char *name, uint64_t client_id, uint64_t cycle,
+	const char *pod_name, const char *pod_namespace,
+	const struct timespec *start, const struct timespec *end)
+{
+	uint64_t span_id;
+
+	if (!nvshare_trace_enabled) return;
+
+	do span_id = nvshare_generate_id(); while (span_id == 0);
+
+	true_or_exit(pthread_mutex_lock(&trace_mutex) == 0);
+	fprintf(trace_fp, "{\"resourceSpans\":[{\"resource\":{\"attributes\":["
+		"{\"key\":\"service.name\",\"value\":{\"stringValue\":"
+		"\"nvshare-scheduler\"}}]},\"scopeSpans\":[{\"scope\":"
+		"{\"name\":\"nvshare-scheduler\"},\"spans\":[{");
+	fprintf(trace_fp, "\"traceId\":\"%016" PRIx64 "%016" PRIx64 "\","
+		"\"spanId\":\"%016" PRIx64 "\",\"name\":", client_id, cycle,
+		span_id);
+	nvshare_json_write_string(trace_fp, name);
+	fprintf(trace_fp, ",\"kind\":1,\"startTimeUnixNano\":\"%llu\","
+		"\"endTimeUnixNano\":\"%llu\",\"attributes\":[",
+		ts_to_ns(start), ts_to_ns(end));
+	fprintf(trace_fp, "{\"key\":\"nvshare.client.id\",\"value\":"
+		"{\"stringValue\":\"%016" PRIx64 "\"}},", client_id);
+	fprintf(trace_fp, "{\"key\":\"k8s.pod.name\",\"value\":"
+		"{\"stringValue\":");
+	nvshare_json_write_string(trace_fp, pod_name);
+	fprintf(trace_fp, "}},{\"key\":\"k8s.namespace.name\",\"value\":"
+		"{\"stringValue\":");
+	nvshare_json_write_string(trace_fp, pod_namespace);
+	fprintf(trace_fp, "}}]}]}]}]}\n");
+
+	if (fflush(trace_fp) != 0)
+		log_warn("Failed to write span to traces file");
+	if (ftell(trace_fp) >= max_bytes) rotate_traces();
+	true_or_exit(pthread_mutex_unlock(&trace_mutex) == 0);
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ * OpenTelemetry span export for the nvshare scheduler.
+ */
+
+#ifndef _NVSHARE_TRACE_H_
+#define _NVSHARE_TRACE_H_
+
+#include <stdio.h>
+#include <time.h>
+#include <inttypes.h>
+
+#define ENV_NVSHARE_OTEL_TRACES_FILE   "NVSHARE_OTEL_TRACES_FILE"
+#define ENV_NVSHARE_OTEL_SAMPLE_RATIO  "NVSHARE_OTEL_SAMPLE_RATIO"
+#define ENV_NVSHARE_OTEL_TRACES_MAX_BYTES "NVSHARE_OTEL_TRACES_MAX_BYTES"
+#define ENV_NVSHARE_OTEL_TRACES_FILES  "NVSHARE_OTEL_TRACES_FILES"
+
+extern int nvshare_trace_enabled;
+
+extern void nvshare_trace_init(void);
+extern int nvshare_trace_sample(void);
+extern void nvshare_json_write_string(FILE *fp, const char *s);
+extern void nvshare_trace_span(const char *name, uint64_t client_id,
+	uint64_t cycle, const char *pod_name, const char *pod_namespace,
+	const struct timespec *start, const struct timespec *end);
+
+#endif /* _NVSHARE_TRACE_H_ */
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Workload type policies for the nvshare scheduler.
+ *
+ * Clients may declare the type of workload they run. The scheduler applies
+ * the defaults of the type to them, so that users can state their intent
+ * instead of tuning every knob. We ship defaults for the common types, which
+ * the policy file can override or extend, one type per line:
+ *
+ *     <type> [tq=<seconds>] [preempt=on|off] [burst=<percent>]
+ *            [min_free=<MiB>] [boost=on|off] [reclaim=on|off]
+ *
+ * Empty lines and lines starting with '#' are ignored. A line for a type we
+ * ship defaults for replaces them.
+ */
+
+#include <stdio.h>
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "common.h"
+#include "workload.h"
+
+static const struct workload_policy builtin_policies[] = {
+	/* Latency-sensitive, short bursts of work */
+	{ .name = "interactive", .tq = 5, .preempt = -1, .burst_pct = 50,
+	  .min_free_mib = -1, .boost = 1, .reclaim = 1 },
+	{ .name = "inference", .tq = 10, .preempt = -1, .burst_pct = 25,
+	  .min_free_mib = -1, .boost = 1, .reclaim = 1 },
+	/* Throughput-oriented, long stretches of work */
+	{ .name = "training", .tq = 60, .preempt = -1, .burst_pct = 0,
+	  .min_free_mib = -1, .boost = 0, .reclaim = 1 },
+	/* The guaranteed devices of the device plugin, never preempted */
+	{ .name = "guaranteed", .tq = -1, .preempt = 0, .burst_pct = -1,
+	  .min_free_mib = -1, .boost = 0, .reclaim = 0 },
+};
+
+struct workload_policy *workload_policies = NULL;
+int workload_policies_cnt = 0;
+
+
+static int parse_int(const char *s, int *val, int max)
+{
+	char *endptr;
+	long long v;
+
+	errno = 0;
+	v = strtoll(s, &endptr, 10);
+	if (s == endptr || *endptr != '\0' || errno != 0 || v < 0 || v > max)
+		return -1;
+	*val = (int)v;
+	return 0;
+}
+
+
+static int parse_line(char *line, struct workload_policy *p)
+{
+	char *tok, *saveptr, *val;
+
+	tok = strtok_r(line, " \t", &saveptr);
+	if (tok == NULL || strlen(tok) >= sizeof(p->name) ||
+	    strchr(tok, '=') != NULL)
+		return -1;
+	strlcpy(p->name, tok, sizeof(p->name));
+
+	p->tq = -1;
+	p->preempt = -1;
+	p->burst_pct = -1;
+	p->min_free_mib = -1;
+	p->boost = 0;
+	p->reclaim = 1;
+	while ((tok = strtok_r(NULL, " \t", &saveptr)) != NULL) {
+		if ((val = strchr(tok, '=')) == NULL) return -1;
+		*val++ = '\0';
+		if (strcmp(tok, "tq") == 0) {
+			if (parse_int(val, &p->tq, 1000000000) < 0 ||
+			    p->tq == 0)
+				return -1;
+		} else if (strcmp(tok, "preempt") == 0) {
+			if (strcmp(val, "on") == 0) p->preempt = 1;
+			else if (strcmp(val, "off") == 0) p->preempt = 0;
+			else return -1;
+		} else if (strcmp(tok, "burst") == 0) {
+			if (parse_int(val, &p->burst_pct, 100) < 0) return -1;
+		} else if (strcmp(tok, "min_free") == 0) {
+			if (parse_int(val, &p->min_free_mib, 1000000000) < 0)
+				return -1;
+		} else if (strcmp(tok, "boost") == 0) {
+			if (strcmp(val, "on") == 0) p->boost = 1;
+			else if (strcmp(val, "off") == 0) p->boost = 0;
+			else return -1;
+		} else if (strcmp(tok, "reclaim") == 0) {
+			if (strcmp(val, "on") == 0) p->reclaim = 1;
+			else if (strcmp(val, "off") == 0) p->reclaim = 0;
+			else return -1;
+		} else return -1;
+	}
+	return 0;
+}
+
+
+static void add_policy(const struct workload_policy *p)
+{
+	int i;
+
+	for (i = 0; i < workload_policies_cnt; i++) {
+		if (strcmp(workload_policies[i].name, p->name) == 0) {
+			workload_policies[i] = *p;
+			return;
+		}
+	}
+	true_or_exit(workload_policies = realloc(workload_policies,
+		(workload_policies_cnt + 1) * sizeof(*workload_policies)));
+	workload_policies[workload_policies_cnt++] = *p;
+}
+
+
+/*
+ * Load the built-in policies, then the ones from the file that
+ * ENV_NVSHARE_WORKLOAD_POLICY_FILE names, if any.
+ */
+void nvshare_workload_load(void)
+{
+	FILE *fp;
+	char *path, *line = NULL, *s;
+	size_t cap = 0, i;
+	int lineno = 0;
+	struct workload_policy p;
+
+	for (i = 0; i < sizeof(builtin_policies) / sizeof(*builtin_policies);
+	     i++)
+		add_policy(&builtin_policies[i]);
+
+	path = getenv(ENV_NVSHARE_WORKLOAD_POLICY_FILE);
+	if (path == NULL || *path == '\0') return;
+
+	fp = fopen(path, "r");
+	if (fp == NULL)
+		log_fatal_errno("Could not open workload policy file %s", path);
+
+	while (getline(&line, &cap, fp) != -1) {
+		lineno++;
+		line[strcspn(line, "\r\n")] = '\0';
+		for (s = line; *s == ' ' || *s == '\t'; s++);
+		if (*s == '\0' || *s == '#') continue;
+		if (parse_line(s, &p) < 0)
+			log_fatal("Invalid workload policy at %s:%d", path,
+				  lineno);
+		add_policy(&p);
+		log_info("Loaded workload policy %s", p.name);
+	}
+	free(line);
+	fclose(fp);
+}
+
+
+/* Return the policy of a workload type, or NULL if we don't know the type */
+const struct workload_policy *nvshare_workload_lookup(const char *name)
+{
+	int i;
+
+	for (i = 0; i < workload_policies_cnt; i++)
+		if (strcmp(workload_policies[i].name, name) == 0)
+			return &workload_policies[i];
+	return NULL;
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2023 Georgios Alexopoulos
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ *
+ *
+ * Workload type policies for the nvshare scheduler.
+ */
+
+#ifndef _NVSHARE_WORKLOAD_H_
+#define _NVSHARE_WORKLOAD_H_
+
+#include "comm.h"
+
+#define ENV_NVSHARE_WORKLOAD_POLICY_FILE "NVSHARE_WORKLOAD_POLICY_FILE"
+
+/*
+ * Scheduling defaults for the clients of a workload type. A value of -1
+ * leaves the respective setting at the scheduler-wide default.
+ *
+ * tq:        TQ of the clients, in seconds
+ * preempt:   0 if the scheduler never asks the clients to drop the lock
+ * burst_pct: Burst credit accrual percentage of the clients
+ * min_free_mib: GPU memory that must be free before the clients get the lock
+ */
+struct workload_policy {
+	char name[NVSHARE_WORKLOAD_TYPE_MAX + 1];
+	int tq;
+	int preempt;
+	int burst_pct;
+	int min_free_mib;
+	int boost;
+	int reclaim; /* We may evict its clients to reclaim memory */
+};
+
+extern struct workload_policy *workload_policies;
+extern int workload_policies_cnt;
+
+extern void nvshare_workload_load(void);
+extern const struct workload_policy *nvshare_workload_lookup(const char *name);
+
+#endif /* _NVSHARE_WORKLOAD_H_ */